@@ -8,7 +8,10 @@ import (
 	"github.com/moehoshio/NekoLcServer/internal/auth"
 	"github.com/moehoshio/NekoLcServer/internal/config"
 	"github.com/moehoshio/NekoLcServer/internal/handlers"
+	"github.com/moehoshio/NekoLcServer/internal/janitor"
 	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/notify"
+	"github.com/moehoshio/NekoLcServer/internal/realtime"
 	"github.com/moehoshio/NekoLcServer/internal/storage"
 )
 
@@ -24,14 +27,38 @@ func SetupRoutes(cfg *config.Config) http.Handler {
 	}
 	
 	// Initialize JWT authentication
-	jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
+	jwtAuth, err := auth.NewJWTAuthFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	
+	// Initialize delivery of account messages such as password reset tokens
+	accountNotifier, err := notify.NewNotifier(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize account notifier: %v", err)
+	}
+	if cfg.App.Authentication.PasswordReset.Notifier == "log" {
+		log.Printf("Warning: password reset tokens are written to the log, which is for development only")
+	}
+	
+	// Initialize real-time notification hub and push config changes to it
+	hub := realtime.NewHub()
+	notifier := realtime.NewNotifier(cfg, db, hub)
+	cfg.OnReload(notifier.ConfigReloaded)
+	
+	// Purge expired tokens and sessions in the background
+	cleanup := janitor.Start(cfg, db)
 	
 	mux := http.NewServeMux()
 	
 	// Create handlers with dependencies
 	testingHandler := handlers.NewTestingHandler(cfg)
-	authHandler := handlers.NewAuthHandler(cfg, db, jwtAuth)
+	authHandler := handlers.NewAuthHandler(cfg, db, jwtAuth, accountNotifier)
 	launcherHandler := handlers.NewLauncherHandler(cfg, db)
+	webSocketHandler := handlers.NewWebSocketHandler(cfg, db, jwtAuth, notifier)
+	sseHandler := handlers.NewSSEHandler(cfg, db, jwtAuth, notifier)
+	presenceHandler := handlers.NewPresenceHandler(cfg, hub)
+	apiKeyHandler := handlers.NewAPIKeyHandler(cfg, db)
 	
 	// Testing endpoints
 	mux.Handle("/v0/testing/ping", applyMiddleware(
@@ -43,7 +70,7 @@ func SetupRoutes(cfg *config.Config) http.Handler {
 		http.HandlerFunc(testingHandler.Echo),
 		middleware.CommonMiddleware(cfg),
 		middleware.DebugOnlyMiddleware(cfg),
-		middleware.AuthMiddleware(cfg, db, jwtAuth, false), // Optional auth for echo
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/testing/echo"),
 	))
 	
 	// Authentication endpoints (optional)
@@ -71,59 +98,210 @@ func SetupRoutes(cfg *config.Config) http.Handler {
 		methodFilter("POST"),
 	))
 	
+	mux.Handle("/v0/api/auth/register", applyMiddleware(
+		http.HandlerFunc(authHandler.Register),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/changePassword", applyMiddleware(
+		http.HandlerFunc(authHandler.ChangePassword),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/requestPasswordReset", applyMiddleware(
+		http.HandlerFunc(authHandler.RequestPasswordReset),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/resetPassword", applyMiddleware(
+		http.HandlerFunc(authHandler.ResetPassword),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/challenge", applyMiddleware(
+		http.HandlerFunc(authHandler.Challenge),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/registerDevice", applyMiddleware(
+		http.HandlerFunc(authHandler.RegisterDevice),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/revokeDevice", applyMiddleware(
+		http.HandlerFunc(authHandler.RevokeDevice),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/oidcAuthorize", applyMiddleware(
+		http.HandlerFunc(authHandler.OIDCAuthorize),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/sessions", applyMiddleware(
+		http.HandlerFunc(authHandler.Sessions),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/revokeSession", applyMiddleware(
+		http.HandlerFunc(authHandler.RevokeSession),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/revokeAllSessions", applyMiddleware(
+		http.HandlerFunc(authHandler.RevokeAllSessions),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/totpSetup", applyMiddleware(
+		http.HandlerFunc(authHandler.TOTPSetup),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/totpEnable", applyMiddleware(
+		http.HandlerFunc(authHandler.TOTPEnable),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	mux.Handle("/v0/api/auth/totpDisable", applyMiddleware(
+		http.HandlerFunc(authHandler.TOTPDisable),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+	))
+	
+	// Public keys for services that verify issued tokens
+	mux.Handle("/.well-known/jwks.json", applyMiddleware(
+		http.HandlerFunc(authHandler.JWKS),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("GET"),
+	))
+	
 	// Launcher endpoints
 	mux.Handle("/v0/api/launcherConfig", applyMiddleware(
 		http.HandlerFunc(launcherHandler.LauncherConfig),
 		middleware.CommonMiddleware(cfg),
 		methodFilter("POST"),
-		middleware.AuthMiddleware(cfg, db, jwtAuth, false), // Optional auth
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/api/launcherConfig"),
 	))
 	
 	mux.Handle("/v0/api/maintenance", applyMiddleware(
 		http.HandlerFunc(launcherHandler.Maintenance),
 		middleware.CommonMiddleware(cfg),
 		methodFilter("POST"),
-		middleware.AuthMiddleware(cfg, db, jwtAuth, false), // Optional auth
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/api/maintenance"),
 	))
 	
 	mux.Handle("/v0/api/checkUpdates", applyMiddleware(
 		http.HandlerFunc(launcherHandler.CheckUpdates),
 		middleware.CommonMiddleware(cfg),
 		methodFilter("POST"),
-		middleware.AuthMiddleware(cfg, db, jwtAuth, false), // Optional auth
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/api/checkUpdates"),
+	))
+	
+	mux.Handle("/v0/api/bootstrap", applyMiddleware(
+		http.HandlerFunc(launcherHandler.Bootstrap),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/api/bootstrap"),
 	))
 	
 	mux.Handle("/v0/api/feedbackLog", applyMiddleware(
 		http.HandlerFunc(launcherHandler.FeedbackLog),
 		middleware.CommonMiddleware(cfg),
 		methodFilter("POST"),
-		middleware.AuthMiddleware(cfg, db, jwtAuth, false), // Optional auth
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/api/feedbackLog"),
+	))
+	
+	// WebSocket notification channel (the connection is hijacked, so the
+	// JSON response middleware is not applied)
+	mux.Handle("/v0/ws", applyMiddleware(
+		http.HandlerFunc(webSocketHandler.Serve),
+		methodFilter("GET"),
+	))
+	
+	// Server-Sent Events fallback for the notification channel
+	mux.Handle("/v0/sse", applyMiddleware(
+		http.HandlerFunc(sseHandler.Serve),
+		methodFilter("GET"),
+	))
+	
+	// Online statistics of the notification channel, for admins
+	mux.Handle("/v0/admin/presence", applyMiddleware(
+		http.HandlerFunc(presenceHandler.Presence),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("GET"),
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/admin/presence"),
+		middleware.RequireRole(cfg, auth.RoleAdmin),
+	))
+	
+	// API keys for automation, managed by admins
+	mux.Handle("/v0/admin/apiKeys", applyMiddleware(
+		http.HandlerFunc(apiKeyHandler.APIKeys),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/admin/apiKeys"),
+		middleware.RequireRole(cfg, auth.RoleAdmin),
+	))
+	
+	mux.Handle("/v0/admin/createApiKey", applyMiddleware(
+		http.HandlerFunc(apiKeyHandler.CreateAPIKey),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/admin/createApiKey"),
+		middleware.RequireRole(cfg, auth.RoleAdmin),
+	))
+	
+	mux.Handle("/v0/admin/revokeApiKey", applyMiddleware(
+		http.HandlerFunc(apiKeyHandler.RevokeAPIKey),
+		middleware.CommonMiddleware(cfg),
+		methodFilter("POST"),
+		middleware.AuthMiddleware(cfg, db, jwtAuth, "/v0/admin/revokeApiKey"),
+		middleware.RequireRole(cfg, auth.RoleAdmin),
 	))
 	
 	// Log configuration status
 	log.Printf("Authentication enabled: %v", cfg.App.Authentication.Enabled)
 	log.Printf("Debug mode enabled: %v", cfg.App.Debug.Enabled)
-	log.Printf("Storage type: %s", cfg.App.Database.Type)
-	log.Printf("Storage path: %s", cfg.App.Database.Path)
+	log.Printf("Storage: %s", storage.Describe(cfg))
 	
 	return &serverWrapper{
 		handler: mux,
 		storage: db,
+		janitor: cleanup,
 	}
 }
 
-// serverWrapper wraps the HTTP handler and holds the storage reference for cleanup
+// serverWrapper wraps the HTTP handler and holds the storage reference and
+// background janitor for cleanup
 type serverWrapper struct {
 	handler http.Handler
 	storage storage.Storage
+	janitor *janitor.Janitor
 }
 
 func (sw *serverWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sw.handler.ServeHTTP(w, r)
 }
 
-// Close closes the storage connection (call this on server shutdown)
+// Close stops the janitor and closes the storage connection (call this on
+// server shutdown)
 func (sw *serverWrapper) Close() error {
+	if sw.janitor != nil {
+		sw.janitor.Stop()
+	}
 	if sw.storage != nil {
 		return sw.storage.Close()
 	}
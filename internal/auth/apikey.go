@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// APIKeyPrefix starts every API key, so that leaked keys are easy to find
+const APIKeyPrefix = "nlk_"
+
+// APIKeyTokenType is the token type of the claims of requests authenticated
+// with an API key
+const APIKeyTokenType = "apikey"
+
+// GenerateAPIKey returns a new random API key. Only its hash is stored; the
+// key itself is shown once when it is created.
+func GenerateAPIKey() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return APIKeyPrefix + hex.EncodeToString(secret)
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash under which an API key is
+// stored. Keys are random, so they need no salt or slow hash.
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(strings.TrimSpace(key)))
+	return hex.EncodeToString(hash[:])
+}
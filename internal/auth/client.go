@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientSignatureWindow is how far the timestamp of a signed login may be
+// from the server time. Nonces must be remembered for this long.
+const ClientSignatureWindow = 5 * time.Minute
+
+// ClientSignature returns the hex encoded HMAC-SHA256, keyed with the client
+// secret, of the identifier, timestamp and nonce separated by newlines
+func ClientSignature(secret, identifier string, timestamp int64, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(identifier + "\n" + strconv.FormatInt(timestamp, 10) + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyClientSignature checks a signed login against the client secret.
+// Callers must also check that the nonce has not been used before.
+func VerifyClientSignature(secret, identifier string, timestamp int64, nonce, signature string, now time.Time) error {
+	if !validNonce(nonce) {
+		return fmt.Errorf("nonce must be 16 to 128 characters of [A-Za-z0-9_-]")
+	}
+
+	expected := ClientSignature(secret, identifier, timestamp, nonce)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > ClientSignatureWindow || skew < -ClientSignatureWindow {
+		return fmt.Errorf("timestamp too old or in future")
+	}
+	return nil
+}
+
+func validNonce(nonce string) bool {
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return false
+	}
+	for _, c := range nonce {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyClientSignature(t *testing.T) {
+	secret := "client-secret"
+	identifier := "test-device"
+	nonce := "0123456789abcdef"
+	now := time.Now()
+	timestamp := now.Unix()
+
+	signature := ClientSignature(secret, identifier, timestamp, nonce)
+	if err := VerifyClientSignature(secret, identifier, timestamp, nonce, signature, now); err != nil {
+		t.Fatalf("Expected valid signature: %v", err)
+	}
+
+	tests := map[string]struct {
+		secret    string
+		timestamp int64
+		nonce     string
+		signature string
+	}{
+		"other secret":      {secret: "other-secret", timestamp: timestamp, nonce: nonce, signature: signature},
+		"other nonce":       {secret: secret, timestamp: timestamp, nonce: "fedcba9876543210", signature: signature},
+		"invalid signature": {secret: secret, timestamp: timestamp, nonce: nonce, signature: "invalid-signature"},
+		"short nonce":       {secret: secret, timestamp: timestamp, nonce: "abc", signature: ClientSignature(secret, identifier, timestamp, "abc")},
+		"expired timestamp": {secret: secret, timestamp: timestamp - 600, nonce: nonce, signature: ClientSignature(secret, identifier, timestamp-600, nonce)},
+		"future timestamp":  {secret: secret, timestamp: timestamp + 600, nonce: nonce, signature: ClientSignature(secret, identifier, timestamp+600, nonce)},
+	}
+	for name, test := range tests {
+		if err := VerifyClientSignature(test.secret, identifier, test.timestamp, test.nonce, test.signature, now); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestClientSignature_IsHMAC(t *testing.T) {
+	// printf 'id\n1700000000\nnonce-nonce-nonce' | openssl dgst -sha256 -hmac key
+	expected := "e42fdcd99f3c078c75f9f0ba1ce04b806db5e3b7a62ae90036cebbf084d0c1a0"
+	if got := ClientSignature("key", "id", 1700000000, "nonce-nonce-nonce"); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
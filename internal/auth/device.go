@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeviceChallengeTTL is how long a device has to sign an issued challenge
+const DeviceChallengeTTL = 2 * time.Minute
+
+// NewDeviceChallenge returns a random base64url challenge for a device to sign
+func NewDeviceChallenge() string {
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+	return base64.RawURLEncoding.EncodeToString(challenge)
+}
+
+// ParseDevicePublicKey decodes a base64 encoded Ed25519 public key
+func ParseDevicePublicKey(encoded string) (ed25519.PublicKey, error) {
+	data, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("public key is not base64: %w", err)
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// EncodeDevicePublicKey returns the base64url form in which device keys are stored
+func EncodeDevicePublicKey(publicKey ed25519.PublicKey) string {
+	return base64URL(publicKey)
+}
+
+// VerifyDeviceSignature checks a base64 encoded Ed25519 signature of the
+// challenge, signed as the bytes of the challenge string
+func VerifyDeviceSignature(publicKey ed25519.PublicKey, challenge, signature string) error {
+	data, err := decodeBase64(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64: %w", err)
+	}
+	if !ed25519.Verify(publicKey, []byte(challenge), data) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// decodeBase64 accepts standard or URL-safe base64, with or without padding
+func decodeBase64(value string) ([]byte, error) {
+	value = strings.TrimRight(value, "=")
+	if strings.ContainsAny(value, "+/") {
+		return base64.RawStdEncoding.DecodeString(value)
+	}
+	return base64.RawURLEncoding.DecodeString(value)
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestVerifyDeviceSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	challenge := NewDeviceChallenge()
+	signature := ed25519.Sign(privateKey, []byte(challenge))
+
+	// Both base64 alphabets are accepted for keys and signatures
+	for _, encoding := range []*base64.Encoding{base64.RawURLEncoding, base64.StdEncoding} {
+		parsed, err := ParseDevicePublicKey(encoding.EncodeToString(publicKey))
+		if err != nil {
+			t.Fatalf("Failed to parse public key: %v", err)
+		}
+		if err := VerifyDeviceSignature(parsed, challenge, encoding.EncodeToString(signature)); err != nil {
+			t.Errorf("Expected valid signature: %v", err)
+		}
+	}
+
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	tests := map[string]struct {
+		publicKey ed25519.PublicKey
+		challenge string
+		signature string
+	}{
+		"other key":       {publicKey: otherKey, challenge: challenge, signature: base64URL(signature)},
+		"other challenge": {publicKey: publicKey, challenge: NewDeviceChallenge(), signature: base64URL(signature)},
+		"not base64":      {publicKey: publicKey, challenge: challenge, signature: "not base64!"},
+	}
+	for name, test := range tests {
+		if err := VerifyDeviceSignature(test.publicKey, test.challenge, test.signature); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParseDevicePublicKey_InvalidKey(t *testing.T) {
+	for _, encoded := range []string{"", "not base64!", base64URL(make([]byte, 16))} {
+		if _, err := ParseDevicePublicKey(encoded); err == nil {
+			t.Errorf("%q: expected error", encoded)
+		}
+	}
+}
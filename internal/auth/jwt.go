@@ -1,110 +1,283 @@
 package auth
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"strconv"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
 )
 
 type JWTAuth struct {
-	secretKey []byte
+	secretKey []byte         // used without configuration
+	config    *config.Config // nil uses DefaultOptions and secretKey
+	
+	keysMu         sync.Mutex
+	keys           *KeySet // nil signs with the secret (HS256)
+	keysGeneration uint64
 }
 
 type Claims struct {
 	UserID    string `json:"user_id"`
 	Timestamp int64  `json:"timestamp"`
-	TokenType string `json:"token_type"` // "access" or "refresh"
+	TokenType string `json:"token_type"` // "access" or "refresh", or APIKeyTokenType in middleware
+	Roles     []string `json:"roles,omitempty"` // access tokens only, see Grants
 	jwt.RegisteredClaims
 }
 
+// HasRole reports whether the token grants a role
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Options control the lifetimes and registered claims of issued tokens
+type Options struct {
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	Issuer          string
+	Audience        string // not set or checked if empty
+	ClockSkew       time.Duration
+}
+
+// TokenPair is a newly issued access and refresh token
+type TokenPair struct {
+	AccessToken           string
+	RefreshToken          string
+	AccessTokenExpiresAt  time.Time
+	RefreshTokenExpiresAt time.Time
+}
+
+// DefaultOptions returns the options used without configuration
+func DefaultOptions() Options {
+	return Options{
+		AccessTokenTTL:  time.Hour,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+		Issuer:          "NekoLcServer",
+	}
+}
+
 func NewJWTAuth(secretKey string) *JWTAuth {
 	return &JWTAuth{
 		secretKey: []byte(secretKey),
 	}
 }
 
-// GenerateTokensFromCredentials generates JWT tokens from username/password
-func (j *JWTAuth) GenerateTokensFromCredentials(username, password string) (string, string, error) {
-	// In a real implementation, you would validate credentials against a database
-	if username != "admin" || password != "password" {
-		return "", "", fmt.Errorf("invalid credentials")
+// NewJWTAuthFromConfig creates a JWTAuth that signs with the configured
+// signing keys, or with the configured secret if there are none. The secret,
+// lifetimes, issuer, audience, clock skew and signing keys are read from the
+// configuration each time, so they follow configuration reloads.
+func NewJWTAuthFromConfig(cfg *config.Config) (*JWTAuth, error) {
+	j := &JWTAuth{
+		config:         cfg,
+		keysGeneration: cfg.Generation(),
 	}
-	
-	userID := username
-	return j.generateTokenPair(userID)
+	if len(cfg.App.Authentication.SigningKeys) > 0 {
+		keys, err := LoadKeySet(cfg.App.Authentication.SigningKeys)
+		if err != nil {
+			return nil, err
+		}
+		j.keys = keys
+	}
+	return j, nil
+}
+
+// snapshot returns the configuration one token operation reads from, or nil
+// without configuration
+func (j *JWTAuth) snapshot() *config.Config {
+	if j.config == nil {
+		return nil
+	}
+	return j.config.Current()
 }
 
-// GenerateTokensFromSignature generates JWT tokens from identifier + timestamp + signature
-func (j *JWTAuth) GenerateTokensFromSignature(identifier string, timestamp int64, signature string) (string, string, error) {
-	// Validate signature - it should be SHA256 hash of identifier + timestamp + secret
-	expectedSignature := j.generateSignature(identifier, timestamp)
-	if signature != expectedSignature {
-		return "", "", fmt.Errorf("invalid signature")
+// secret returns the HS256 secret of a configuration snapshot
+func (j *JWTAuth) secret(cfg *config.Config) []byte {
+	if cfg == nil {
+		return j.secretKey
+	}
+	return []byte(cfg.App.Authentication.JWTSecret)
+}
+
+// keySet returns the signing keys of a configuration snapshot, reloading them
+// after a configuration reload. If the new keys cannot be loaded the previous
+// ones stay in use.
+func (j *JWTAuth) keySet(cfg *config.Config) *KeySet {
+	if cfg == nil {
+		return nil
 	}
 	
-	// Check timestamp is recent (within 5 minutes)
-	now := time.Now().Unix()
-	if abs(now-timestamp) > 300 { // 5 minutes
-		return "", "", fmt.Errorf("timestamp too old or in future")
+	j.keysMu.Lock()
+	defer j.keysMu.Unlock()
+	
+	// Operations that started before a reload use the newer keys too
+	generation := cfg.Generation()
+	if generation <= j.keysGeneration {
+		return j.keys
 	}
+	j.keysGeneration = generation
 	
-	userID := identifier
-	return j.generateTokenPair(userID)
+	keyConfigs := cfg.App.Authentication.SigningKeys
+	if len(keyConfigs) == 0 {
+		j.keys = nil
+		return nil
+	}
+	keys, err := LoadKeySet(keyConfigs)
+	if err != nil {
+		log.Printf("Failed to reload signing keys, keeping the previous keys: %v", err)
+		return j.keys
+	}
+	j.keys = keys
+	return keys
+}
+
+// JWKS returns the public keys that verify issued tokens. It is empty when
+// tokens are signed with the shared secret.
+func (j *JWTAuth) JWKS() models.JWKS {
+	keys := j.keySet(j.snapshot())
+	if keys == nil {
+		return models.JWKS{Keys: []models.JWK{}}
+	}
+	return keys.JWKS(time.Now())
+}
+
+// Options returns the options currently applied to issued and validated tokens
+func (j *JWTAuth) Options() Options {
+	return optionsFrom(j.snapshot())
+}
+
+// optionsFrom returns the token options of a configuration snapshot
+func optionsFrom(cfg *config.Config) Options {
+	options := DefaultOptions()
+	if cfg == nil {
+		return options
+	}
+	
+	authentication := cfg.App.Authentication
+	options.AccessTokenTTL, options.RefreshTokenTTL = cfg.App.TokenLifetimes()
+	if authentication.Issuer != "" {
+		options.Issuer = authentication.Issuer
+	}
+	options.Audience = authentication.Audience
+	if authentication.ClockSkewSec > 0 {
+		options.ClockSkew = time.Duration(authentication.ClockSkewSec) * time.Second
+	}
+	return options
+}
+
+// GenerateTokens generates JWT tokens for a user whose credentials have
+// already been verified, see VerifyPassword
+func (j *JWTAuth) GenerateTokens(userID string) (*TokenPair, error) {
+	return j.generateTokenPair(userID, nil)
+}
+
+// GenerateUserTokens generates JWT tokens whose access token carries the
+// roles of the user
+func (j *JWTAuth) GenerateUserTokens(userID string, roles []string) (*TokenPair, error) {
+	return j.generateTokenPair(userID, roles)
 }
 
-func (j *JWTAuth) generateTokenPair(userID string) (string, string, error) {
+func (j *JWTAuth) generateTokenPair(userID string, roles []string) (*TokenPair, error) {
+	cfg := j.snapshot()
+	options := optionsFrom(cfg)
 	now := time.Now()
 	
-	// Generate access token (1 hour expiry)
-	accessClaims := Claims{
-		UserID:    userID,
-		Timestamp: now.Unix(),
-		TokenType: "access",
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(now),
-			Issuer:    "NekoLcServer",
-		},
+	pair := &TokenPair{
+		AccessTokenExpiresAt:  now.Add(options.AccessTokenTTL),
+		RefreshTokenExpiresAt: now.Add(options.RefreshTokenTTL),
 	}
 	
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenString, err := accessToken.SignedString(j.secretKey)
+	var err error
+	pair.AccessToken, err = j.signToken(cfg, userID, "access", roles, now, pair.AccessTokenExpiresAt, options)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to sign access token: %w", err)
+		return nil, fmt.Errorf("failed to sign access token: %w", err)
 	}
 	
-	// Generate refresh token (30 days expiry)
-	refreshClaims := Claims{
+	pair.RefreshToken, err = j.signToken(cfg, userID, "refresh", nil, now, pair.RefreshTokenExpiresAt, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign refresh token: %w", err)
+	}
+	
+	return pair, nil
+}
+
+func (j *JWTAuth) signToken(cfg *config.Config, userID, tokenType string, roles []string, now, expiresAt time.Time, options Options) (string, error) {
+	claims := Claims{
 		UserID:    userID,
 		Timestamp: now.Unix(),
-		TokenType: "refresh",
+		TokenType: tokenType,
+		Roles:     roles,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour * 24 * 30)),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(now),
-			Issuer:    "NekoLcServer",
+			Issuer:    options.Issuer,
+			ID:        newTokenID(),
 		},
 	}
+	if options.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{options.Audience}
+	}
 	
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString(j.secretKey)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to sign refresh token: %w", err)
+	keys := j.keySet(cfg)
+	if keys == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString(j.secret(cfg))
 	}
 	
-	return accessTokenString, refreshTokenString, nil
+	key := keys.SigningKey(now)
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
 }
 
 // ValidateToken validates a JWT token and returns claims if valid
 func (j *JWTAuth) ValidateToken(tokenString string) (*Claims, error) {
+	cfg := j.snapshot()
+	options := optionsFrom(cfg)
+	keys := j.keySet(cfg)
+	validMethods := []string{jwt.SigningMethodHS256.Alg()}
+	if keys != nil {
+		validMethods = keys.Algorithms()
+	}
+	parserOptions := []jwt.ParserOption{
+		jwt.WithValidMethods(validMethods),
+		jwt.WithLeeway(options.ClockSkew),
+		jwt.WithIssuer(options.Issuer),
+		jwt.WithIssuedAt(),
+	}
+	if options.Audience != "" {
+		parserOptions = append(parserOptions, jwt.WithAudience(options.Audience))
+	}
+	
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		if keys == nil {
+			return j.secret(cfg), nil
+		}
+		
+		kid, _ := token.Header["kid"].(string)
+		key := keys.VerificationKey(kid, time.Now())
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return j.secretKey, nil
-	})
+		return key.PrivateKey.Public(), nil
+	}, parserOptions...)
 	
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
@@ -118,38 +291,43 @@ func (j *JWTAuth) ValidateToken(tokenString string) (*Claims, error) {
 }
 
 // RefreshAccessToken generates a new access token from a valid refresh token
-func (j *JWTAuth) RefreshAccessToken(refreshTokenString string) (string, error) {
+// and returns it with its expiry
+func (j *JWTAuth) RefreshAccessToken(refreshTokenString string) (string, time.Time, error) {
 	claims, err := j.ValidateToken(refreshTokenString)
 	if err != nil {
-		return "", fmt.Errorf("invalid refresh token: %w", err)
+		return "", time.Time{}, fmt.Errorf("invalid refresh token: %w", err)
 	}
 	
 	if claims.TokenType != "refresh" {
-		return "", fmt.Errorf("token is not a refresh token")
+		return "", time.Time{}, fmt.Errorf("token is not a refresh token")
 	}
 	
 	// Generate new access token
+	cfg := j.snapshot()
+	options := optionsFrom(cfg)
 	now := time.Now()
-	accessClaims := Claims{
-		UserID:    claims.UserID,
-		Timestamp: now.Unix(),
-		TokenType: "access",
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(now),
-			Issuer:    "NekoLcServer",
-		},
+	expiresAt := now.Add(options.AccessTokenTTL)
+	accessToken, err := j.signToken(cfg, claims.UserID, "access", nil, now, expiresAt, options)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign access token: %w", err)
 	}
-	
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	return accessToken.SignedString(j.secretKey)
+	return accessToken, expiresAt, nil
 }
 
-// generateSignature creates expected signature for ID + timestamp authentication
-func (j *JWTAuth) generateSignature(identifier string, timestamp int64) string {
-	data := identifier + strconv.FormatInt(timestamp, 10) + string(j.secretKey)
-	hash := sha256.Sum256([]byte(data))
-	return fmt.Sprintf("%x", hash)
+// RotateTokens validates a refresh token and issues a new access and refresh
+// token for the same user, carrying the roles the user has now. Callers are
+// responsible for retiring the old refresh token.
+func (j *JWTAuth) RotateTokens(refreshTokenString string, roles []string) (*TokenPair, error) {
+	claims, err := j.ValidateToken(refreshTokenString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid refresh token: %w", err)
+	}
+
+	if claims.TokenType != "refresh" {
+		return nil, fmt.Errorf("token is not a refresh token")
+	}
+
+	return j.generateTokenPair(claims.UserID, roles)
 }
 
 // GetTokenHash returns a hash of the token for storage
@@ -158,9 +336,10 @@ func (j *JWTAuth) GetTokenHash(tokenString string) string {
 	return fmt.Sprintf("%x", hash)
 }
 
-func abs(x int64) int64 {
-	if x < 0 {
-		return -x
-	}
-	return x
-}
\ No newline at end of file
+// newTokenID returns a random jti, so tokens issued to the same user within
+// the same second are still distinct
+func newTokenID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
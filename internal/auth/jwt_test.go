@@ -3,19 +3,23 @@ package auth
 import (
 	"testing"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
 )
 
 func TestJWTAuth_GenerateAndValidateTokens(t *testing.T) {
 	jwtAuth := NewJWTAuth("test-secret")
 	
-	// Test username/password authentication
-	accessToken, refreshToken, err := jwtAuth.GenerateTokensFromCredentials("admin", "password")
+	// Test tokens for a verified user
+	tokens, err := jwtAuth.GenerateTokens("admin")
 	if err != nil {
 		t.Fatalf("Failed to generate tokens: %v", err)
 	}
 	
 	// Validate access token
-	claims, err := jwtAuth.ValidateToken(accessToken)
+	claims, err := jwtAuth.ValidateToken(tokens.AccessToken)
 	if err != nil {
 		t.Fatalf("Failed to validate access token: %v", err)
 	}
@@ -29,7 +33,7 @@ func TestJWTAuth_GenerateAndValidateTokens(t *testing.T) {
 	}
 	
 	// Validate refresh token
-	refreshClaims, err := jwtAuth.ValidateToken(refreshToken)
+	refreshClaims, err := jwtAuth.ValidateToken(tokens.RefreshToken)
 	if err != nil {
 		t.Fatalf("Failed to validate refresh token: %v", err)
 	}
@@ -43,13 +47,13 @@ func TestJWTAuth_RefreshToken(t *testing.T) {
 	jwtAuth := NewJWTAuth("test-secret")
 	
 	// Generate initial tokens
-	_, refreshToken, err := jwtAuth.GenerateTokensFromCredentials("admin", "password")
+	tokens, err := jwtAuth.GenerateTokens("admin")
 	if err != nil {
 		t.Fatalf("Failed to generate tokens: %v", err)
 	}
 	
 	// Refresh access token
-	newAccessToken, err := jwtAuth.RefreshAccessToken(refreshToken)
+	newAccessToken, _, err := jwtAuth.RefreshAccessToken(tokens.RefreshToken)
 	if err != nil {
 		t.Fatalf("Failed to refresh access token: %v", err)
 	}
@@ -65,61 +69,163 @@ func TestJWTAuth_RefreshToken(t *testing.T) {
 	}
 }
 
-func TestJWTAuth_SignatureAuth(t *testing.T) {
+func TestJWTAuth_TokensAreUnique(t *testing.T) {
 	jwtAuth := NewJWTAuth("test-secret")
 	
-	identifier := "test-device"
-	timestamp := time.Now().Unix()
-	
-	// Generate the correct signature
-	expectedSignature := jwtAuth.generateSignature(identifier, timestamp)
+	// Tokens issued within the same second must not collide
+	first, err := jwtAuth.GenerateTokens("admin")
+	if err != nil {
+		t.Fatalf("Failed to generate tokens: %v", err)
+	}
+	second, _ := jwtAuth.GenerateTokens("admin")
+	if first.AccessToken == second.AccessToken {
+		t.Error("Expected distinct tokens for repeated logins")
+	}
+}
+
+func createTestAuthConfig() *config.Config {
+	cfg := &config.Config{
+		App: &config.AppConfig{},
+	}
+	cfg.App.Authentication.JWTSecret = "test-secret"
+	cfg.App.Authentication.TokenExpirationSec = 600
+	cfg.App.Authentication.RefreshTokenExpirationDays = 7
+	cfg.App.Authentication.Issuer = "test-issuer"
+	cfg.App.Authentication.Audience = "test-launcher"
+	cfg.App.Authentication.ClockSkewSec = 30
+	return cfg
+}
+
+func TestJWTAuth_ConfiguredLifetimes(t *testing.T) {
+	cfg := createTestAuthConfig()
+	jwtAuth, _ := NewJWTAuthFromConfig(cfg)
 	
-	// Test with correct signature
-	accessToken, refreshToken, err := jwtAuth.GenerateTokensFromSignature(identifier, timestamp, expectedSignature)
+	tokens, err := jwtAuth.GenerateTokens("admin")
 	if err != nil {
-		t.Fatalf("Failed to generate tokens with signature: %v", err)
+		t.Fatalf("Failed to generate tokens: %v", err)
 	}
 	
-	// Validate tokens
-	claims, err := jwtAuth.ValidateToken(accessToken)
+	// The JWT expiry must match the expiry reported for storage
+	claims, err := jwtAuth.ValidateToken(tokens.AccessToken)
 	if err != nil {
 		t.Fatalf("Failed to validate access token: %v", err)
 	}
-	
-	if claims.UserID != identifier {
-		t.Errorf("Expected user ID '%s', got %s", identifier, claims.UserID)
+	if !claims.ExpiresAt.Time.Equal(tokens.AccessTokenExpiresAt.Truncate(time.Second)) {
+		t.Errorf("Expected access expiry %v, got %v", tokens.AccessTokenExpiresAt, claims.ExpiresAt.Time)
+	}
+	if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime != 10*time.Minute {
+		t.Errorf("Expected access lifetime 10m, got %v", lifetime)
 	}
 	
-	_, err = jwtAuth.ValidateToken(refreshToken)
+	refreshClaims, err := jwtAuth.ValidateToken(tokens.RefreshToken)
 	if err != nil {
 		t.Fatalf("Failed to validate refresh token: %v", err)
 	}
+	if lifetime := refreshClaims.ExpiresAt.Sub(refreshClaims.IssuedAt.Time); lifetime != 7*24*time.Hour {
+		t.Errorf("Expected refresh lifetime 7 days, got %v", lifetime)
+	}
+	if claims.Issuer != "test-issuer" {
+		t.Errorf("Expected issuer 'test-issuer', got %s", claims.Issuer)
+	}
+	if len(claims.Audience) != 1 || claims.Audience[0] != "test-launcher" {
+		t.Errorf("Expected audience 'test-launcher', got %v", claims.Audience)
+	}
+	
+	// Lifetimes follow configuration changes
+	cfg.App.Authentication.TokenExpirationSec = 60
+	_, expiresAt, err := jwtAuth.RefreshAccessToken(tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Failed to refresh access token: %v", err)
+	}
+	if until := time.Until(expiresAt); until > time.Minute || until < 50*time.Second {
+		t.Errorf("Expected refreshed access token to expire in about 1m, got %v", until)
+	}
 }
 
-func TestJWTAuth_InvalidSignature(t *testing.T) {
-	jwtAuth := NewJWTAuth("test-secret")
+func TestJWTAuth_IssuerAndAudienceMismatch(t *testing.T) {
+	cfg := createTestAuthConfig()
+	jwtAuth, _ := NewJWTAuthFromConfig(cfg)
 	
-	identifier := "test-device"
-	timestamp := time.Now().Unix()
-	invalidSignature := "invalid-signature"
+	tokens, err := jwtAuth.GenerateTokens("admin")
+	if err != nil {
+		t.Fatalf("Failed to generate tokens: %v", err)
+	}
+	
+	cfg.App.Authentication.Issuer = "other-issuer"
+	if _, err := jwtAuth.ValidateToken(tokens.AccessToken); err == nil {
+		t.Error("Expected error for a token from another issuer")
+	}
 	
-	// Test with invalid signature
-	_, _, err := jwtAuth.GenerateTokensFromSignature(identifier, timestamp, invalidSignature)
-	if err == nil {
-		t.Error("Expected error with invalid signature")
+	cfg.App.Authentication.Issuer = "test-issuer"
+	cfg.App.Authentication.Audience = "other-launcher"
+	if _, err := jwtAuth.ValidateToken(tokens.AccessToken); err == nil {
+		t.Error("Expected error for a token for another audience")
+	}
+	
+	// Tokens without configuration use the default issuer
+	if _, err := NewJWTAuth("test-secret").ValidateToken(tokens.AccessToken); err == nil {
+		t.Error("Expected error for a token from a non-default issuer")
 	}
 }
 
-func TestJWTAuth_ExpiredTimestamp(t *testing.T) {
-	jwtAuth := NewJWTAuth("test-secret")
+func TestJWTAuth_ClockSkew(t *testing.T) {
+	cfg := createTestAuthConfig()
+	jwtAuth, _ := NewJWTAuthFromConfig(cfg)
+	
+	// Expired 10 seconds ago, within the 30 second skew
+	now := time.Now()
+	options := jwtAuth.Options()
+	token, err := jwtAuth.signToken(cfg, "admin", "access", nil, now.Add(-time.Minute), now.Add(-10*time.Second), options)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	if _, err := jwtAuth.ValidateToken(token); err != nil {
+		t.Errorf("Expected token within clock skew to be valid: %v", err)
+	}
+	
+	cfg.App.Authentication.ClockSkewSec = 0
+	if _, err := jwtAuth.ValidateToken(token); err == nil {
+		t.Error("Expected expired token to be rejected without clock skew")
+	}
+}
+
+func TestJWTAuth_SecretFollowsReload(t *testing.T) {
+	cfg := createTestAuthConfig()
+	jwtAuth, _ := NewJWTAuthFromConfig(cfg)
+	oldTokens, _ := jwtAuth.GenerateTokens("admin")
+	
+	next := createTestAuthConfig()
+	next.App.Authentication.JWTSecret = "rotated-secret"
+	cfg.Swap(next)
 	
-	identifier := "test-device"
-	timestamp := time.Now().Unix() - 600 // 10 minutes ago
-	signature := jwtAuth.generateSignature(identifier, timestamp)
+	if _, err := jwtAuth.ValidateToken(oldTokens.AccessToken); err == nil {
+		t.Error("Expected token signed with the previous secret to be rejected")
+	}
+	newTokens, _ := jwtAuth.GenerateTokens("admin")
+	if _, err := jwt.Parse(newTokens.AccessToken, func(*jwt.Token) (interface{}, error) { return []byte("rotated-secret"), nil }); err != nil {
+		t.Errorf("Expected token signed with the reloaded secret: %v", err)
+	}
+	if _, err := jwtAuth.ValidateToken(newTokens.AccessToken); err != nil {
+		t.Errorf("Expected token of the reloaded secret to be valid: %v", err)
+	}
+}
+
+func TestJWTAuth_RejectsOtherAlgorithms(t *testing.T) {
+	jwtAuth := NewJWTAuth("test-secret")
 	
-	// Test with expired timestamp
-	_, _, err := jwtAuth.GenerateTokensFromSignature(identifier, timestamp, signature)
-	if err == nil {
-		t.Error("Expected error with expired timestamp")
+	claims := Claims{
+		UserID:    "admin",
+		TokenType: "access",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			Issuer:    "NekoLcServer",
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	if _, err := jwtAuth.ValidateToken(token); err == nil {
+		t.Error("Expected error for a token signed with HS512")
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+)
+
+// SigningKey is an asymmetric key that signs and verifies tokens
+type SigningKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.Signer
+	ActivateAt time.Time // zero if active from the start
+	RetireAt   time.Time // zero if never retired
+}
+
+// KeySet holds the configured signing keys. During a rotation the new key
+// is published before it becomes active and the old key is still accepted
+// until it is retired, so tokens signed by either key validate.
+type KeySet struct {
+	Keys []*SigningKey
+}
+
+// LoadKeySet reads the private keys of the configured signing keys
+func LoadKeySet(keys []config.SigningKeyConfig) (*KeySet, error) {
+	set := &KeySet{}
+	seen := make(map[string]bool)
+	for _, keyConfig := range keys {
+		if keyConfig.ID == "" {
+			return nil, fmt.Errorf("signing key %s has no kid", keyConfig.PrivateKeyFile)
+		}
+		if seen[keyConfig.ID] {
+			return nil, fmt.Errorf("duplicate signing key kid %q", keyConfig.ID)
+		}
+		seen[keyConfig.ID] = true
+
+		if !keyConfig.RetireAt.IsZero() && !keyConfig.RetireAt.After(keyConfig.ActivateAt) {
+			return nil, fmt.Errorf("signing key %q is retired before it is activated", keyConfig.ID)
+		}
+
+		privateKey, err := loadPrivateKey(keyConfig.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %w", keyConfig.ID, err)
+		}
+		method, err := signingMethodFor(privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %w", keyConfig.ID, err)
+		}
+
+		set.Keys = append(set.Keys, &SigningKey{
+			ID:         keyConfig.ID,
+			Method:     method,
+			PrivateKey: privateKey,
+			ActivateAt: keyConfig.ActivateAt,
+			RetireAt:   keyConfig.RetireAt,
+		})
+	}
+	return set, nil
+}
+
+// loadPrivateKey reads a PEM encoded PKCS #8, PKCS #1 or SEC 1 private key
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// signingMethodFor returns the JWT algorithm for a private key
+func signingMethodFor(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must have at least 2048 bits")
+		}
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("only P-256 ECDSA keys are supported")
+		}
+		return jwt.SigningMethodES256, nil
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// published reports whether the key verifies tokens at the given time
+func (k *SigningKey) published(now time.Time) bool {
+	return k.RetireAt.IsZero() || now.Before(k.RetireAt)
+}
+
+// active reports whether the key signs new tokens at the given time
+func (k *SigningKey) active(now time.Time) bool {
+	return k.published(now) && !now.Before(k.ActivateAt)
+}
+
+// SigningKey returns the key that signs new tokens: the most recently
+// activated key that is not retired
+func (s *KeySet) SigningKey(now time.Time) *SigningKey {
+	var current *SigningKey
+	for _, key := range s.Keys {
+		if key.active(now) && (current == nil || key.ActivateAt.After(current.ActivateAt)) {
+			current = key
+		}
+	}
+	return current
+}
+
+// VerificationKey returns the published key with the given kid
+func (s *KeySet) VerificationKey(kid string, now time.Time) *SigningKey {
+	for _, key := range s.Keys {
+		if key.ID == kid && key.published(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// Algorithms returns the JWT algorithms of the keys in the set
+func (s *KeySet) Algorithms() []string {
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, key := range s.Keys {
+		if alg := key.Method.Alg(); !seen[alg] {
+			seen[alg] = true
+			algorithms = append(algorithms, alg)
+		}
+	}
+	return algorithms
+}
+
+// JWKS returns the public keys that are published at the given time
+func (s *KeySet) JWKS(now time.Time) models.JWKS {
+	jwks := models.JWKS{Keys: []models.JWK{}}
+	for _, key := range s.Keys {
+		if key.published(now) {
+			jwks.Keys = append(jwks.Keys, key.JWK())
+		}
+	}
+	return jwks
+}
+
+// JWK returns the public part of the key as a JSON Web Key
+func (k *SigningKey) JWK() models.JWK {
+	jwk := models.JWK{
+		Kid: k.ID,
+		Use: "sig",
+		Alg: k.Method.Alg(),
+	}
+	switch publicKey := k.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64URL(publicKey.N.Bytes())
+		jwk.E = base64URL(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = base64URL(publicKey.X.FillBytes(make([]byte, 32)))
+		jwk.Y = base64URL(publicKey.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64URL(publicKey)
+	}
+	return jwk
+}
+
+func base64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
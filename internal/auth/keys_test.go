@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+)
+
+// writeTestKey generates a private key of the given kind ("rsa", "ec" or
+// "ed25519") and writes it as PEM to dir
+func writeTestKey(t *testing.T, dir, kid, kind string) string {
+	t.Helper()
+	var block *pem.Block
+	switch kind {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("Failed to generate RSA key: %v", err)
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case "ec":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate EC key: %v", err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("Failed to marshal EC key: %v", err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate Ed25519 key: %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("Failed to marshal Ed25519 key: %v", err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+
+	path := filepath.Join(dir, kid+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return path
+}
+
+// publicKeyFromJWK decodes a published key the way an independent verifier would
+func publicKeyFromJWK(t *testing.T, jwk models.JWK) crypto.PublicKey {
+	t.Helper()
+	decode := func(value string) []byte {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			t.Fatalf("Invalid base64url in JWK: %v", err)
+		}
+		return data
+	}
+	switch jwk.Kty {
+	case "RSA":
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(decode(jwk.N)),
+			E: int(new(big.Int).SetBytes(decode(jwk.E)).Int64()),
+		}
+	case "EC":
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(decode(jwk.X)),
+			Y:     new(big.Int).SetBytes(decode(jwk.Y)),
+		}
+	case "OKP":
+		return ed25519.PublicKey(decode(jwk.X))
+	}
+	t.Fatalf("Unexpected key type %q", jwk.Kty)
+	return nil
+}
+
+func createTestKeyConfig(keys ...config.SigningKeyConfig) *config.Config {
+	cfg := &config.Config{
+		App: &config.AppConfig{},
+	}
+	cfg.App.Authentication.JWTSecret = "test-secret"
+	cfg.App.Authentication.SigningKeys = keys
+	return cfg
+}
+
+func TestKeySet_Algorithms(t *testing.T) {
+	dir := t.TempDir()
+	for kind, alg := range map[string]string{"rsa": "RS256", "ec": "ES256", "ed25519": "EdDSA"} {
+		t.Run(kind, func(t *testing.T) {
+			cfg := createTestKeyConfig(config.SigningKeyConfig{
+				ID:             kind + "-1",
+				PrivateKeyFile: writeTestKey(t, dir, kind+"-1", kind),
+			})
+			jwtAuth, err := NewJWTAuthFromConfig(cfg)
+			if err != nil {
+				t.Fatalf("Failed to load keys: %v", err)
+			}
+
+			tokens, err := jwtAuth.GenerateTokens("admin")
+			if err != nil {
+				t.Fatalf("Failed to generate tokens: %v", err)
+			}
+			if _, err := jwtAuth.ValidateToken(tokens.AccessToken); err != nil {
+				t.Fatalf("Failed to validate access token: %v", err)
+			}
+
+			// Verify with nothing but the published key
+			jwks := jwtAuth.JWKS()
+			if len(jwks.Keys) != 1 {
+				t.Fatalf("Expected 1 published key, got %d", len(jwks.Keys))
+			}
+			jwk := jwks.Keys[0]
+			if jwk.Kid != kind+"-1" || jwk.Alg != alg || jwk.Use != "sig" {
+				t.Errorf("Unexpected JWK %+v", jwk)
+			}
+			token, err := jwt.Parse(tokens.AccessToken, func(token *jwt.Token) (interface{}, error) {
+				if token.Header["kid"] != jwk.Kid {
+					t.Errorf("Expected kid %q, got %v", jwk.Kid, token.Header["kid"])
+				}
+				return publicKeyFromJWK(t, jwk), nil
+			}, jwt.WithValidMethods([]string{alg}))
+			if err != nil || !token.Valid {
+				t.Errorf("Failed to verify token with the published key: %v", err)
+			}
+		})
+	}
+}
+
+func TestKeySet_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := config.SigningKeyConfig{ID: "old", PrivateKeyFile: writeTestKey(t, dir, "old", "ed25519")}
+	newKey := config.SigningKeyConfig{ID: "new", PrivateKeyFile: writeTestKey(t, dir, "new", "ec")}
+	now := time.Now()
+
+	// The new key is published before it signs
+	newKey.ActivateAt = now.Add(time.Hour)
+	cfg := createTestKeyConfig(oldKey, newKey)
+	jwtAuth, err := NewJWTAuthFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	if published := jwtAuth.JWKS().Keys; len(published) != 2 {
+		t.Fatalf("Expected 2 published keys, got %d", len(published))
+	}
+	oldTokens, _ := jwtAuth.GenerateTokens("admin")
+	if kid := tokenKeyID(t, oldTokens.AccessToken); kid != "old" {
+		t.Errorf("Expected token signed by 'old', got %q", kid)
+	}
+
+	// After activation the new key signs and the old key still verifies
+	newKey.ActivateAt = now.Add(-time.Minute)
+	oldKey.RetireAt = now.Add(time.Hour)
+	cfg.Swap(createTestKeyConfig(oldKey, newKey))
+	newTokens, _ := jwtAuth.GenerateTokens("admin")
+	if kid := tokenKeyID(t, newTokens.AccessToken); kid != "new" {
+		t.Errorf("Expected token signed by 'new', got %q", kid)
+	}
+	if _, err := jwtAuth.ValidateToken(oldTokens.AccessToken); err != nil {
+		t.Errorf("Expected token of the old key to be valid during the overlap: %v", err)
+	}
+
+	// Once retired the old key is neither accepted nor published
+	oldKey.ActivateAt = now.Add(-2 * time.Hour)
+	oldKey.RetireAt = now.Add(-time.Second)
+	cfg.Swap(createTestKeyConfig(oldKey, newKey))
+	if _, err := jwtAuth.ValidateToken(oldTokens.AccessToken); err == nil {
+		t.Error("Expected token of the retired key to be rejected")
+	}
+	if _, err := jwtAuth.ValidateToken(newTokens.AccessToken); err != nil {
+		t.Errorf("Expected token of the new key to be valid: %v", err)
+	}
+	if published := jwtAuth.JWKS().Keys; len(published) != 1 || published[0].Kid != "new" {
+		t.Errorf("Expected only 'new' to be published, got %+v", published)
+	}
+}
+
+func TestKeySet_RejectsSharedSecretTokens(t *testing.T) {
+	dir := t.TempDir()
+	cfg := createTestKeyConfig(config.SigningKeyConfig{ID: "key", PrivateKeyFile: writeTestKey(t, dir, "key", "ed25519")})
+	jwtAuth, err := NewJWTAuthFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+
+	// A token signed with the secret must not pass once keys are configured
+	tokens, _ := NewJWTAuth("test-secret").GenerateTokens("admin")
+	if _, err := jwtAuth.ValidateToken(tokens.AccessToken); err == nil {
+		t.Error("Expected HS256 token to be rejected")
+	}
+}
+
+func TestKeySet_InvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestKey(t, dir, "key", "ed25519")
+	weak, _ := rsa.GenerateKey(rand.Reader, 1024)
+	weakPath := filepath.Join(dir, "weak.pem")
+	os.WriteFile(weakPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(weak)}), 0600)
+	now := time.Now()
+
+	tests := map[string][]config.SigningKeyConfig{
+		"missing kid":   {{PrivateKeyFile: path}},
+		"duplicate kid": {{ID: "a", PrivateKeyFile: path}, {ID: "a", PrivateKeyFile: path}},
+		"missing file":  {{ID: "a", PrivateKeyFile: filepath.Join(dir, "missing.pem")}},
+		"weak RSA key":  {{ID: "a", PrivateKeyFile: weakPath}},
+		"retired early": {{ID: "a", PrivateKeyFile: path, ActivateAt: now, RetireAt: now.Add(-time.Hour)}},
+	}
+	for name, keys := range tests {
+		if _, err := NewJWTAuthFromConfig(createTestKeyConfig(keys...)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func tokenKeyID(t *testing.T, tokenString string) string {
+	t.Helper()
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &Claims{})
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
@@ -0,0 +1,366 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+)
+
+const (
+	// oidcDiscoveryTTL is how long the provider metadata is cached
+	oidcDiscoveryTTL = time.Hour
+	// oidcKeysRefreshInterval limits how often an unknown kid refetches the provider keys
+	oidcKeysRefreshInterval = time.Minute
+)
+
+// ErrOIDCUnavailable is returned when the identity provider cannot be reached
+// or returns something other than an answer about the login
+var ErrOIDCUnavailable = errors.New("identity provider unavailable")
+
+// OIDCIdentity is the verified identity of an OpenID Connect login
+type OIDCIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string // value of the configured username claim, may be empty
+}
+
+// oidcDiscovery is the part of the provider metadata that is used
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider logs users in through an external OpenID Connect provider
+// with the authorization code flow and PKCE. The launcher sends the user to
+// the provider and passes the code and its verifier to the server, which
+// exchanges them and verifies the ID token. Settings are read from the
+// configuration each time, so they follow configuration reloads.
+type OIDCProvider struct {
+	config *config.Config
+	client *http.Client
+
+	// mu guards the cache only; requests to the provider are made without it
+	mu            sync.Mutex
+	issuer        string // configured issuer the cached metadata belongs to
+	discovery     *oidcDiscovery
+	discoveredAt  time.Time
+	keysURI       string // JWKS URI the cached keys were fetched from
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+func NewOIDCProvider(cfg *config.Config) *OIDCProvider {
+	return &OIDCProvider{
+		config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Enabled reports whether OpenID Connect login is configured
+func (p *OIDCProvider) Enabled() bool {
+	oidc := p.config.Current().App.Authentication.OIDC
+	return oidc.Enabled && oidc.Issuer != "" && oidc.ClientID != ""
+}
+
+// AllowedRedirectURI reports whether launchers may use the redirect URI
+func (p *OIDCProvider) AllowedRedirectURI(redirectURI string) bool {
+	for _, allowed := range p.config.Current().App.Authentication.OIDC.RedirectURIs {
+		if redirectURI == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizationURL returns the provider URL that starts a login. The code
+// challenge is the base64url SHA-256 of the verifier kept by the launcher.
+func (p *OIDCProvider) AuthorizationURL(ctx context.Context, redirectURI, codeChallenge, state, nonce string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	oidc := p.config.Current().App.Authentication.OIDC
+	scopes := oidc.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile"}
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(scopes, " ")},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	if nonce != "" {
+		query.Set("nonce", nonce)
+	}
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems an authorization code with its PKCE verifier and returns
+// the identity from the verified ID token. If nonce is not empty the ID
+// token must carry it.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier, redirectURI, nonce string) (*OIDCIdentity, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	oidc := p.config.Current().App.Authentication.OIDC
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {oidc.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCUnavailable, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if oidc.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oidc.ClientID), url.QueryEscape(oidc.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	// The provider rejects invalid, used or expired codes and wrong verifiers
+	// with 400 invalid_grant
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		var tokenError struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&tokenError)
+		return nil, fmt.Errorf("authorization code rejected: %s", tokenError.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: token endpoint returned %d", ErrOIDCUnavailable, resp.StatusCode)
+	}
+
+	var tokenResponse struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil || tokenResponse.IDToken == "" {
+		return nil, fmt.Errorf("%w: token response has no id_token", ErrOIDCUnavailable)
+	}
+
+	return p.verifyIDToken(ctx, discovery, tokenResponse.IDToken, nonce)
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, discovery *oidcDiscovery, idToken, nonce string) (*OIDCIdentity, error) {
+	authentication := p.config.Current().App.Authentication
+	oidc := authentication.OIDC
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.verificationKey(ctx, discovery, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(oidc.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Duration(authentication.ClockSkewSec)*time.Second),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+
+	if nonce != "" {
+		if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+			return nil, fmt.Errorf("invalid id_token: nonce mismatch")
+		}
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("invalid id_token: no sub claim")
+	}
+
+	usernameClaim := oidc.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+	username, _ := claims[usernameClaim].(string)
+
+	return &OIDCIdentity{
+		Issuer:   discovery.Issuer,
+		Subject:  subject,
+		Username: username,
+	}, nil
+}
+
+// discover returns the provider metadata, fetching it when the cache is
+// stale or the configured issuer changed
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	issuer := strings.TrimSuffix(p.config.Current().App.Authentication.OIDC.Issuer, "/")
+
+	p.mu.Lock()
+	cached := p.discovery
+	fresh := cached != nil && p.issuer == issuer && time.Since(p.discoveredAt) < oidcDiscoveryTTL
+	p.mu.Unlock()
+	if fresh {
+		return cached, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	// The metadata must be about the configured issuer (OpenID Connect Discovery 4.3)
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("%w: discovery issuer %q does not match %q", ErrOIDCUnavailable, discovery.Issuer, issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document is incomplete", ErrOIDCUnavailable)
+	}
+
+	p.mu.Lock()
+	p.issuer = issuer
+	p.discovery = &discovery
+	p.discoveredAt = time.Now()
+	p.mu.Unlock()
+	return &discovery, nil
+}
+
+// verificationKey returns the provider key with the given kid, refetching
+// the provider keys if it is unknown, as it may have rotated them
+func (p *OIDCProvider) verificationKey(ctx context.Context, discovery *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	cached := p.keysURI == discovery.JWKSURI
+	key, known := p.keys[kid]
+	recent := time.Since(p.keysFetchedAt) < oidcKeysRefreshInterval
+	p.mu.Unlock()
+	if cached && known {
+		return key, nil
+	}
+	if cached && recent {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks models.JWKS
+	if err := p.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped
+		if key, err := parseJWK(jwk); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	p.mu.Lock()
+	p.keysURI = discovery.JWKSURI
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrOIDCUnavailable, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrOIDCUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %d", ErrOIDCUnavailable, url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: invalid JSON from %s: %v", ErrOIDCUnavailable, url, err)
+	}
+	return nil
+}
+
+// parseJWK returns the public key of an RSA, P-256 or Ed25519 JSON Web Key
+func parseJWK(jwk models.JWK) (crypto.PublicKey, error) {
+	decode := func(value string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
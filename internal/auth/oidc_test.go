@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/oidctest"
+)
+
+const testRedirectURI = "http://127.0.0.1:53682/callback"
+
+func createTestOIDCProvider(t *testing.T) (*OIDCProvider, *oidctest.Issuer, *config.Config) {
+	issuer := oidctest.NewIssuer("nekolc-launcher")
+	t.Cleanup(issuer.Close)
+
+	cfg := &config.Config{App: &config.AppConfig{}}
+	oidc := &cfg.App.Authentication.OIDC
+	oidc.Enabled = true
+	oidc.Issuer = issuer.URL()
+	oidc.ClientID = issuer.ClientID
+	oidc.RedirectURIs = []string{testRedirectURI}
+	return NewOIDCProvider(cfg), issuer, cfg
+}
+
+func TestOIDCProvider_Exchange(t *testing.T) {
+	provider, issuer, _ := createTestOIDCProvider(t)
+	ctx := context.Background()
+
+	verifier := oidctest.NewCodeVerifier()
+	code := issuer.Authorize("forum-42", verifier, testRedirectURI, map[string]interface{}{"preferred_username": "alice", "nonce": "n-1"})
+	identity, err := provider.Exchange(ctx, code, verifier, testRedirectURI, "n-1")
+	if err != nil {
+		t.Fatalf("Failed to exchange code: %v", err)
+	}
+	if identity.Issuer != issuer.URL() || identity.Subject != "forum-42" || identity.Username != "alice" {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+
+	// Codes are single use
+	if _, err := provider.Exchange(ctx, code, verifier, testRedirectURI, "n-1"); err == nil || errors.Is(err, ErrOIDCUnavailable) {
+		t.Errorf("Expected a reused code to be rejected, got %v", err)
+	}
+}
+
+func TestOIDCProvider_Exchange_Rejected(t *testing.T) {
+	provider, issuer, _ := createTestOIDCProvider(t)
+	ctx := context.Background()
+	verifier := oidctest.NewCodeVerifier()
+
+	code := issuer.Authorize("forum-42", verifier, testRedirectURI, nil)
+	if _, err := provider.Exchange(ctx, code, oidctest.NewCodeVerifier(), testRedirectURI, ""); err == nil {
+		t.Error("Expected another code verifier to be rejected")
+	}
+
+	code = issuer.Authorize("forum-42", verifier, testRedirectURI, map[string]interface{}{"nonce": "n-1"})
+	if _, err := provider.Exchange(ctx, code, verifier, testRedirectURI, "n-2"); err == nil {
+		t.Error("Expected another nonce to be rejected")
+	}
+
+	issuer.SetAudience("other-client")
+	code = issuer.Authorize("forum-42", verifier, testRedirectURI, nil)
+	if _, err := provider.Exchange(ctx, code, verifier, testRedirectURI, ""); err == nil {
+		t.Error("Expected an ID token for another client to be rejected")
+	}
+}
+
+func TestOIDCProvider_KeyRotation(t *testing.T) {
+	provider, issuer, _ := createTestOIDCProvider(t)
+	ctx := context.Background()
+	verifier := oidctest.NewCodeVerifier()
+
+	if _, err := provider.Exchange(ctx, issuer.Authorize("forum-42", verifier, testRedirectURI, nil), verifier, testRedirectURI, ""); err != nil {
+		t.Fatalf("Failed to exchange code: %v", err)
+	}
+
+	// The keys were fetched too recently to be refetched for an unknown kid
+	issuer.RotateKey()
+	if _, err := provider.Exchange(ctx, issuer.Authorize("forum-42", verifier, testRedirectURI, nil), verifier, testRedirectURI, ""); err == nil {
+		t.Fatal("Expected an unknown key within the refresh interval to be rejected")
+	}
+	provider.keysFetchedAt = provider.keysFetchedAt.Add(-oidcKeysRefreshInterval)
+	if _, err := provider.Exchange(ctx, issuer.Authorize("forum-42", verifier, testRedirectURI, nil), verifier, testRedirectURI, ""); err != nil {
+		t.Errorf("Expected the rotated key to be fetched: %v", err)
+	}
+}
+
+func TestOIDCProvider_Unavailable(t *testing.T) {
+	provider, issuer, cfg := createTestOIDCProvider(t)
+	ctx := context.Background()
+	verifier := oidctest.NewCodeVerifier()
+
+	issuer.Fail(1)
+	if _, err := provider.Exchange(ctx, issuer.Authorize("forum-42", verifier, testRedirectURI, nil), verifier, testRedirectURI, ""); !errors.Is(err, ErrOIDCUnavailable) {
+		t.Errorf("Expected ErrOIDCUnavailable, got %v", err)
+	}
+
+	// A discovery document for another issuer is not trusted
+	cfg.App.Authentication.OIDC.Issuer = issuer.URL() + "/other"
+	if _, err := provider.AuthorizationURL(ctx, testRedirectURI, oidctest.CodeChallenge(verifier), "", ""); !errors.Is(err, ErrOIDCUnavailable) {
+		t.Errorf("Expected ErrOIDCUnavailable, got %v", err)
+	}
+}
+
+func TestOIDCProvider_AuthorizationURL(t *testing.T) {
+	provider, issuer, _ := createTestOIDCProvider(t)
+	challenge := oidctest.CodeChallenge(oidctest.NewCodeVerifier())
+
+	authorizationURL, err := provider.AuthorizationURL(context.Background(), testRedirectURI, challenge, "state-1", "n-1")
+	if err != nil {
+		t.Fatalf("Failed to build authorization URL: %v", err)
+	}
+	if !strings.HasPrefix(authorizationURL, issuer.URL()+"/authorize?") {
+		t.Errorf("Unexpected authorization URL %s", authorizationURL)
+	}
+	for _, param := range []string{"client_id=nekolc-launcher", "code_challenge=" + challenge, "code_challenge_method=S256", "scope=openid+profile", "state=state-1", "nonce=n-1"} {
+		if !strings.Contains(authorizationURL, param) {
+			t.Errorf("Expected %s in %s", param, authorizationURL)
+		}
+	}
+}
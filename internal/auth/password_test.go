@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$") {
+		t.Errorf("Expected argon2id hash, got %s", hash)
+	}
+
+	ok, err := VerifyPassword("correct horse", hash)
+	if err != nil || !ok {
+		t.Errorf("Expected password to match, got %v, %v", ok, err)
+	}
+
+	ok, err = VerifyPassword("wrong horse", hash)
+	if err != nil || ok {
+		t.Errorf("Expected wrong password not to match, got %v, %v", ok, err)
+	}
+
+	// The same password hashes differently each time
+	other, _ := HashPassword("correct horse")
+	if other == hash {
+		t.Error("Expected a random salt per hash")
+	}
+}
+
+func TestVerifyPassword_InvalidHash(t *testing.T) {
+	for _, hash := range []string{"", "password", "$2a$10$abcdefghijklmnopqrstuv", "$argon2id$v=19$m=x$salt$hash"} {
+		if _, err := VerifyPassword("password", hash); err == nil {
+			t.Errorf("Expected error for hash %q", hash)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Roles known to the server. Other role names may be assigned too, e.g. for
+// route policies of a particular deployment.
+const (
+	RoleAdmin     = "admin"     // grants every other role
+	RoleTester    = "tester"    // receives test builds
+	RolePublisher = "publisher" // publishes releases
+)
+
+const maxRoleLength = 32
+
+// ParseRoles parses a comma separated list of roles into a sorted list
+// without duplicates. Role names are lowercase letters, digits, "_" and "-".
+func ParseRoles(list string) ([]string, error) {
+	seen := make(map[string]bool)
+	var roles []string
+	for _, role := range strings.Split(list, ",") {
+		role = strings.TrimSpace(role)
+		if role == "" || seen[role] {
+			continue
+		}
+		if !validRole(role) {
+			return nil, fmt.Errorf("invalid role %q", role)
+		}
+		seen[role] = true
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+func validRole(role string) bool {
+	if len(role) > maxRoleLength {
+		return false
+	}
+	for _, c := range role {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Grants reports whether the token may act in a role: it carries the role
+// itself or is an admin token
+func (c *Claims) Grants(role string) bool {
+	return c.HasRole(role) || c.HasRole(RoleAdmin)
+}
+
+// GrantedRoles returns the requested roles that a holder of the held roles
+// may act in, e.g. the scopes of an API key its owner still grants
+func GrantedRoles(requested, held []string) []string {
+	holder := &Claims{Roles: held}
+	var roles []string
+	for _, role := range requested {
+		if holder.Grants(role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
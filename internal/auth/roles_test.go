@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseRoles(t *testing.T) {
+	roles, err := ParseRoles(" tester,admin,,tester ")
+	if err != nil {
+		t.Fatalf("Failed to parse roles: %v", err)
+	}
+	if !slices.Equal(roles, []string{"admin", "tester"}) {
+		t.Errorf("Expected [admin tester], got %v", roles)
+	}
+
+	if roles, err := ParseRoles(""); err != nil || roles != nil {
+		t.Errorf("Expected no roles, got %v, %v", roles, err)
+	}
+
+	for _, list := range []string{"Admin", "a b", "tester,role:x"} {
+		if _, err := ParseRoles(list); err == nil {
+			t.Errorf("Expected %q to be rejected", list)
+		}
+	}
+}
+
+func TestJWTAuth_Roles(t *testing.T) {
+	jwtAuth := NewJWTAuth("test-secret")
+	tokens, err := jwtAuth.GenerateUserTokens("alice", []string{RoleTester})
+	if err != nil {
+		t.Fatalf("Failed to generate tokens: %v", err)
+	}
+
+	claims, err := jwtAuth.ValidateToken(tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("Failed to validate access token: %v", err)
+	}
+	if !claims.Grants(RoleTester) || claims.Grants(RolePublisher) {
+		t.Errorf("Expected only the tester role to be granted, got %v", claims.Roles)
+	}
+
+	// Roles are looked up again when the refresh token is used
+	refreshClaims, err := jwtAuth.ValidateToken(tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Failed to validate refresh token: %v", err)
+	}
+	if len(refreshClaims.Roles) != 0 {
+		t.Errorf("Expected no roles in the refresh token, got %v", refreshClaims.Roles)
+	}
+
+	rotated, err := jwtAuth.RotateTokens(tokens.RefreshToken, []string{RoleAdmin})
+	if err != nil {
+		t.Fatalf("Failed to rotate tokens: %v", err)
+	}
+	claims, err = jwtAuth.ValidateToken(rotated.AccessToken)
+	if err != nil {
+		t.Fatalf("Failed to validate rotated access token: %v", err)
+	}
+	// Admins are granted every role
+	if !claims.Grants(RolePublisher) || claims.HasRole(RoleTester) {
+		t.Errorf("Expected the rotated token to carry only the admin role, got %v", claims.Roles)
+	}
+}
+
+func TestGrantedRoles(t *testing.T) {
+	requested := []string{RoleAdmin, RolePublisher}
+	if roles := GrantedRoles(requested, []string{RoleAdmin}); !slices.Equal(roles, requested) {
+		t.Errorf("Expected an admin to grant every role, got %v", roles)
+	}
+	if roles := GrantedRoles(requested, []string{RolePublisher}); !slices.Equal(roles, []string{RolePublisher}) {
+		t.Errorf("Expected only the publisher role, got %v", roles)
+	}
+	if roles := GrantedRoles(requested, nil); roles != nil {
+		t.Errorf("Expected no roles, got %v", roles)
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The last six digits of the RFC 6238 SHA-1 test vectors
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := TOTPCode(rfc6238Secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("Failed to compute code: %v", err)
+		}
+		if code != expected {
+			t.Errorf("At %d: expected %s, got %s", unix, expected, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := GenerateTOTPSecret()
+	now := time.Now()
+	current := now.Unix() / totpPeriod
+
+	previous, _ := TOTPCode(secret, now.Add(-totpPeriod*time.Second))
+	step, ok := VerifyTOTP(secret, previous, now, 0)
+	if !ok || step != current-1 {
+		t.Fatalf("Expected the code of the previous step to be accepted, got %d, %v", step, ok)
+	}
+	if _, ok := VerifyTOTP(secret, previous, now, step); ok {
+		t.Error("Expected a used code to be rejected")
+	}
+
+	old, _ := TOTPCode(secret, now.Add(-3*totpPeriod*time.Second))
+	if _, ok := VerifyTOTP(secret, old, now, 0); ok {
+		t.Error("Expected a code outside the window to be rejected")
+	}
+	for _, code := range []string{"", "12345", "abcdef"} {
+		if _, ok := VerifyTOTP(secret, code, now, 0); ok {
+			t.Errorf("Expected %q to be rejected", code)
+		}
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(TOTPProvisioningURI("NekoLc", "alice smith", rfc6238Secret))
+	if err != nil {
+		t.Fatalf("Failed to parse URI: %v", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/NekoLc:alice smith" {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+	if query := uri.Query(); query.Get("secret") != rfc6238Secret || query.Get("issuer") != "NekoLc" {
+		t.Errorf("Unexpected query %s", uri.RawQuery)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := GenerateRecoveryCodes()
+	if len(codes) != RecoveryCodeCount || len(hashes) != RecoveryCodeCount {
+		t.Fatalf("Expected %d codes, got %d", RecoveryCodeCount, len(codes))
+	}
+	// Codes may be typed without the separator or in capitals
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	if HashRecoveryCode(typed) != hashes[0] {
+		t.Error("Expected the hash to ignore case and separators")
+	}
+	if HashRecoveryCode(codes[1]) == hashes[0] {
+		t.Error("Expected different codes to have different hashes")
+	}
+}
@@ -3,22 +3,45 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // CLIFlags represents command line arguments
 type CLIFlags struct {
-	ConfigPath   *string
-	Port         *int
-	Debug        *bool
-	EnableAuth   *bool
-	JWTSecret    *string
-	DatabaseType *string
-	DatabasePath *string
-	Reload       *bool
-	Help         *bool
+	ConfigPath    *string
+	Port          *int
+	Debug         *bool
+	EnableAuth    *bool
+	JWTSecret     *string
+	DatabaseType  *string
+	DatabasePath  *string
+	Reload        *bool
+	PidFile       *string
+	Cleanup       *bool
+	CreateUser    *string
+	UserRoles     *string
+	SetRoles      *string
+	DisableUser   *string
+	EnableUser    *string
+	UnlockUser    *string
+	DisableTOTP   *string
+	CreateClient  *string
+	DisableClient *string
+	EnableClient  *string
+	RevokeDevice  *string
+	CreateAPIKey  *string
+	APIKeyScopes  *string
+	APIKeyDays    *int
+	RevokeAPIKey  *string
+	ListAPIKeys   *bool
+	Help          *bool
 }
 
 // AppConfig represents the main application configuration
@@ -29,28 +52,319 @@ type AppConfig struct {
 		MinAPIVersion  string `json:"minApiVersion"`
 		BuildVersion   string `json:"buildVersion"`
 		ReleaseDate    string `json:"releaseDate"`
+		TrustedProxies []string `json:"trustedProxies"` // addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is used
+		PidFile        string `json:"pidFile"`        // holds the process ID while the server runs, for --reload
 	} `json:"server"`
 	Authentication struct {
 		Enabled                   bool   `json:"enabled"`
 		JWTSecret                string `json:"jwtSecret"`
 		TokenExpirationSec       int    `json:"tokenExpirationSec"`
 		RefreshTokenExpirationDays int   `json:"refreshTokenExpirationDays"`
+		Issuer                    string `json:"issuer"`       // "iss" claim, default "NekoLcServer"
+		Audience                  string `json:"audience"`     // "aud" claim, not set or checked if empty
+		ClockSkewSec              int    `json:"clockSkewSec"` // leeway when checking exp, nbf and iat
+		SigningKeys               []SigningKeyConfig `json:"signingKeys"` // asymmetric keys; jwtSecret (HS256) is used if empty
+		AllowRegistration         bool   `json:"allowRegistration"`
+		AllowAnonymousDevices     bool   `json:"allowAnonymousDevices"` // devices may register without a logged in user
+		MinPasswordLength         int    `json:"minPasswordLength"`
+		RoutePolicies             map[string]string `json:"routePolicies"` // route path to none, optional, required or role:<name>
+		PasswordReset struct {
+			TokenExpirationMin int    `json:"tokenExpirationMin"`
+			Notifier           string `json:"notifier"` // file, or log in debug mode only; password reset is disabled if empty
+			FilePath           string `json:"filePath"` // for the file notifier
+			MaxRequests        int    `json:"maxRequests"`      // reset requests per username before they are refused for a while, default 3
+			MaxRequestsPerIP   int    `json:"maxRequestsPerIp"` // reset requests per source address, default 10
+		} `json:"passwordReset"` // a negative maxRequests or maxRequestsPerIp disables that limit
+		Lockout struct {
+			MaxFailures      int `json:"maxFailures"`      // failed logins per username before it is locked, default 5
+			MaxFailuresPerIP int `json:"maxFailuresPerIp"` // failed logins per source address, default 20
+			LockoutSec       int `json:"lockoutSec"`       // first lockout, doubled with each further failure, default 30
+			MaxLockoutSec    int `json:"maxLockoutSec"`    // default 900
+			ResetAfterSec    int `json:"resetAfterSec"`    // failures are forgotten this long after the last one, default 3600
+		} `json:"lockout"` // a negative maxFailures or maxFailuresPerIp disables that limit
+		TwoFactor struct {
+			Issuer        string   `json:"issuer"`        // account label in authenticator apps, default NekoLc
+			RequiredRoles []string `json:"requiredRoles"` // roles granted only while TOTP is enabled
+		} `json:"twoFactor"`
+		OIDC struct {
+			Enabled       bool     `json:"enabled"`
+			Issuer        string   `json:"issuer"`        // discovered from <issuer>/.well-known/openid-configuration
+			ClientID      string   `json:"clientId"`
+			ClientSecret  string   `json:"clientSecret"`  // empty for a public client
+			RedirectURIs  []string `json:"redirectUris"`  // redirect URIs launchers may use
+			Scopes        []string `json:"scopes"`        // default openid, profile
+			UsernameClaim string   `json:"usernameClaim"` // claim for new local usernames, default preferred_username
+		} `json:"oidc"`
 	} `json:"authentication"`
 	Debug struct {
 		Enabled bool `json:"enabled"`
 	} `json:"debug"`
 	Database struct {
-		Type string `json:"type"` // sqlite, mysql, file
+		Type string `json:"type"` // sqlite, mysql, postgres, file
 		Path string `json:"path"` // connection string or file path
-		Host string `json:"host,omitempty"` // for mysql
-		Port int    `json:"port,omitempty"` // for mysql
-		Name string `json:"name,omitempty"` // for mysql
-		User string `json:"user,omitempty"` // for mysql
-		Password string `json:"password,omitempty"` // for mysql
+		Host string `json:"host,omitempty"` // for mysql and postgres
+		Port int    `json:"port,omitempty"` // for mysql and postgres
+		Name string `json:"name,omitempty"` // for mysql and postgres
+		User string `json:"user,omitempty"` // for mysql and postgres
+		Password string `json:"password,omitempty"` // for mysql and postgres
+		MaxOpenConns       int `json:"maxOpenConns,omitempty"`       // for mysql and postgres, default 10, negative for no limit
+		MaxIdleConns       int `json:"maxIdleConns,omitempty"`       // for mysql and postgres, default 5, negative to close idle connections
+		ConnMaxLifetimeSec int `json:"connMaxLifetimeSec,omitempty"` // for mysql and postgres, default 300, negative to keep connections
+		TLS struct {
+			Mode       string `json:"mode"`       // disabled (default), preferred, skip-verify or verify
+			CAFile     string `json:"caFile"`     // PEM CA certificates for verify, system roots if empty
+			CertFile   string `json:"certFile"`   // PEM client certificate, for servers that require one
+			KeyFile    string `json:"keyFile"`    // PEM client key
+			ServerName string `json:"serverName"` // name verified in the server certificate, default host
+		} `json:"tls,omitempty"` // for mysql and postgres
 	} `json:"database"`
 	Storage struct {
 		BasePath string `json:"basePath"` // base path for file storage
 	} `json:"storage"`
+	Notifications struct {
+		RetentionHours int `json:"retentionHours"` // how long notifications are kept for reconnecting clients
+	} `json:"notifications"`
+	Cleanup struct {
+		IntervalMin int `json:"intervalMin"` // how often expired tokens and sessions are purged, default 60, negative disables
+		GraceHours  int `json:"graceHours"`  // how long they are kept after expiry, default 24
+	} `json:"cleanup"`
+
+	trustedProxies []*net.IPNet           // parsed by Validate
+	routePolicies  map[string]AuthPolicy // parsed by Validate
+}
+
+// Validate checks the settings that are parsed once when the configuration
+// is loaded and keeps the parsed values. Configurations built by hand must
+// be validated before use.
+func (a *AppConfig) Validate() error {
+	a.routePolicies = make(map[string]AuthPolicy, len(a.Authentication.RoutePolicies))
+	for route, value := range a.Authentication.RoutePolicies {
+		policy, err := parseAuthPolicy(value)
+		if err != nil {
+			return fmt.Errorf("%w for %s", err, route)
+		}
+		a.routePolicies[route] = policy
+	}
+
+	a.trustedProxies = nil
+	for _, proxy := range a.Server.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			a.trustedProxies = append(a.trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		a.trustedProxies = append(a.trustedProxies, network)
+	}
+
+	reset := a.Authentication.PasswordReset
+	switch reset.Notifier {
+	case "":
+	case "log":
+		// Anyone who can read the log could take over any account
+		if a.Authentication.Enabled && !a.Debug.Enabled {
+			return fmt.Errorf("passwordReset.notifier \"log\" writes reset tokens to the server log and is only allowed in debug mode")
+		}
+	case "file":
+		if reset.FilePath == "" {
+			return fmt.Errorf("passwordReset.filePath is required for the file notifier")
+		}
+	default:
+		return fmt.Errorf("unsupported passwordReset.notifier %q", reset.Notifier)
+	}
+	return nil
+}
+
+// SigningKeyConfig is a private key used to sign tokens. A key is published
+// in the JWKS from the start, signs new tokens from ActivateAt and is no
+// longer accepted or published from RetireAt.
+type SigningKeyConfig struct {
+	ID             string    `json:"kid"`
+	PrivateKeyFile string    `json:"privateKeyFile"` // PEM encoded RSA, P-256 or Ed25519 key
+	ActivateAt     time.Time `json:"activateAt"`     // RFC 3339, active immediately if unset
+	RetireAt       time.Time `json:"retireAt"`       // RFC 3339, never retired if unset
+}
+
+// TokenLifetimes returns the lifetimes of access and refresh tokens. Unset
+// values fall back to one hour and 30 days.
+func (a *AppConfig) TokenLifetimes() (time.Duration, time.Duration) {
+	access := time.Duration(a.Authentication.TokenExpirationSec) * time.Second
+	if access <= 0 {
+		access = time.Hour
+	}
+	refresh := time.Duration(a.Authentication.RefreshTokenExpirationDays) * 24 * time.Hour
+	if refresh <= 0 {
+		refresh = 30 * 24 * time.Hour
+	}
+	return access, refresh
+}
+
+// TrustsProxy reports whether an address is a reverse proxy whose
+// X-Forwarded-For header is used to find the address of clients
+func (a *AppConfig) TrustsProxy(ip net.IP) bool {
+	for _, network := range a.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthPolicy is how a route treats the access token of a request
+type AuthPolicy struct {
+	Level string // "none", "optional" or "required"
+	Role  string // role the token must grant; set only with "required"
+}
+
+// RoutePolicy returns the authentication policy of a route, optional if none
+// is configured
+func (a *AppConfig) RoutePolicy(route string) AuthPolicy {
+	if policy, ok := a.routePolicies[route]; ok {
+		return policy
+	}
+	return AuthPolicy{Level: "optional"}
+}
+
+// parseAuthPolicy parses a policy of Authentication.RoutePolicies
+func parseAuthPolicy(policy string) (AuthPolicy, error) {
+	switch {
+	case policy == "none" || policy == "optional" || policy == "required":
+		return AuthPolicy{Level: policy}, nil
+	case strings.HasPrefix(policy, "role:") && len(policy) > len("role:"):
+		return AuthPolicy{Level: "required", Role: strings.TrimPrefix(policy, "role:")}, nil
+	}
+	return AuthPolicy{}, fmt.Errorf("invalid authentication policy %q", policy)
+}
+
+// DatabasePool is the connection pool of a database server
+type DatabasePool struct {
+	MaxOpenConns    int           // 0 for no limit
+	MaxIdleConns    int           // 0 to close idle connections
+	ConnMaxLifetime time.Duration // 0 to keep connections
+}
+
+// DatabasePool returns the connection pool limits with defaults applied
+func (a *AppConfig) DatabasePool() DatabasePool {
+	database := a.Database
+	return DatabasePool{
+		MaxOpenConns:    limitOrDefault(database.MaxOpenConns, 10),
+		MaxIdleConns:    limitOrDefault(database.MaxIdleConns, 5),
+		ConnMaxLifetime: time.Duration(limitOrDefault(database.ConnMaxLifetimeSec, 300)) * time.Second,
+	}
+}
+
+// CleanupSchedule returns how often expired tokens and sessions are purged,
+// or 0 if the server does not purge them, and how long they are kept after
+// they expire
+func (a *AppConfig) CleanupSchedule() (time.Duration, time.Duration) {
+	interval := time.Duration(a.Cleanup.IntervalMin) * time.Minute
+	if a.Cleanup.IntervalMin == 0 {
+		interval = time.Hour
+	}
+	if interval < 0 {
+		interval = 0
+	}
+	grace := time.Duration(a.Cleanup.GraceHours) * time.Hour
+	if grace <= 0 {
+		grace = 24 * time.Hour
+	}
+	return interval, grace
+}
+
+// NotificationRetention returns how long notifications are kept for
+// reconnecting clients
+func (a *AppConfig) NotificationRetention() time.Duration {
+	hours := a.Notifications.RetentionHours
+	if hours <= 0 {
+		hours = 72
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// PasswordResetLimits returns the limits of password reset requests, which
+// are counted like failed logins so that reset tokens cannot be requested
+// in bulk
+func (a *AppConfig) PasswordResetLimits() LockoutPolicy {
+	reset := a.Authentication.PasswordReset
+	return LockoutPolicy{
+		MaxFailures:      limitOrDefault(reset.MaxRequests, 3),
+		MaxFailuresPerIP: limitOrDefault(reset.MaxRequestsPerIP, 10),
+		Lockout:          15 * time.Minute,
+		MaxLockout:       time.Hour,
+		ResetAfter:       time.Hour,
+	}
+}
+
+// LockoutPolicy limits failed password logins. A limit of 0 is disabled.
+type LockoutPolicy struct {
+	MaxFailures      int
+	MaxFailuresPerIP int
+	Lockout          time.Duration
+	MaxLockout       time.Duration
+	ResetAfter       time.Duration
+}
+
+// LoginLockout returns the lockout policy of password logins. Unset values
+// fall back to the defaults documented on Authentication.Lockout.
+func (a *AppConfig) LoginLockout() LockoutPolicy {
+	lockout := a.Authentication.Lockout
+	policy := LockoutPolicy{
+		MaxFailures:      limitOrDefault(lockout.MaxFailures, 5),
+		MaxFailuresPerIP: limitOrDefault(lockout.MaxFailuresPerIP, 20),
+		Lockout:          time.Duration(lockout.LockoutSec) * time.Second,
+		MaxLockout:       time.Duration(lockout.MaxLockoutSec) * time.Second,
+		ResetAfter:       time.Duration(lockout.ResetAfterSec) * time.Second,
+	}
+	if policy.Lockout <= 0 {
+		policy.Lockout = 30 * time.Second
+	}
+	if policy.MaxLockout <= 0 {
+		policy.MaxLockout = 15 * time.Minute
+	}
+	if policy.MaxLockout < policy.Lockout {
+		policy.MaxLockout = policy.Lockout
+	}
+	if policy.ResetAfter <= 0 {
+		policy.ResetAfter = time.Hour
+	}
+	return policy
+}
+
+// TOTPIssuer returns the issuer shown for the server in authenticator apps
+func (a *AppConfig) TOTPIssuer() string {
+	if a.Authentication.TwoFactor.Issuer != "" {
+		return a.Authentication.TwoFactor.Issuer
+	}
+	return "NekoLc"
+}
+
+// RequiresTwoFactor reports whether a role is only granted to users who
+// enabled two-factor authentication
+func (a *AppConfig) RequiresTwoFactor(role string) bool {
+	for _, required := range a.Authentication.TwoFactor.RequiredRoles {
+		if required == role {
+			return true
+		}
+	}
+	return false
+}
+
+// limitOrDefault applies the fallback to an unset limit and turns negative
+// limits into 0
+func limitOrDefault(configured, fallback int) int {
+	if configured < 0 {
+		return 0
+	}
+	if configured == 0 {
+		return fallback
+	}
+	return configured
 }
 
 // LauncherConfig represents launcher configuration
@@ -65,14 +379,14 @@ type LauncherConfigData struct {
 
 type WebSocketConfig struct {
 	Enable               bool   `json:"enable"`
+	Transport            string `json:"transport"` // "websocket" or "sse"
 	SocketHost          string `json:"socketHost"`
+	SseUrl               string `json:"sseUrl"`
 	HeartbeatIntervalSec int    `json:"heartbeatIntervalSec"`
 }
 
 type SecurityConfig struct {
 	EnableAuthentication        bool   `json:"enableAuthentication"`
-	TokenExpirationSec         int    `json:"tokenExpirationSec"`
-	RefreshTokenExpirationDays int    `json:"refreshTokenExpirationDays"`
 	LoginUrl                   string `json:"loginUrl"`
 	LogoutUrl                  string `json:"logoutUrl"`
 	RefreshUrl                 string `json:"refreshUrl"`
@@ -99,6 +413,16 @@ type PlatformMaintenanceConfig struct {
 	MaintenanceInfo   MaintenanceInfoConfig `json:"maintenanceInfo"`
 }
 
+// ForPlatform returns the maintenance state that applies to the given
+// platform. An active platform-specific entry takes precedence over the
+// global maintenance settings.
+func (m *MaintenanceConfigData) ForPlatform(os, arch string) (bool, MaintenanceInfoConfig) {
+	if platform, exists := m.PlatformSpecific[fmt.Sprintf("%s-%s", os, arch)]; exists && platform.MaintenanceActive {
+		return true, platform.MaintenanceInfo
+	}
+	return m.MaintenanceActive, m.MaintenanceInfo
+}
+
 // UpdateConfig represents update configuration
 type UpdateConfigData struct {
 	LatestCoreVersion     string           `json:"latestCoreVersion"`
@@ -124,6 +448,41 @@ type UpdatePackageInfo struct {
 	Checksum        string `json:"checksum"`
 }
 
+// UpdatePath describes how a client reaches the latest version, either
+// through an incremental update or a full package
+type UpdatePath struct {
+	Incremental *UpdateFileInfo
+	FullPackage *UpdatePackageInfo
+}
+
+// FindUpdate returns the update path for a client, or nil if the client is up
+// to date or no update is available for its platform
+func (u *UpdateConfigData) FindUpdate(os, arch, coreVersion, resourceVersion string) *UpdatePath {
+	// Check if either core version or resource version is outdated
+	coreOutdated := coreVersion != u.LatestCoreVersion
+	resourceOutdated := resourceVersion != u.LatestResourceVersion
+	if !coreOutdated && !resourceOutdated {
+		return nil
+	}
+	
+	// Check for incremental update for the core version
+	if coreOutdated {
+		for i := range u.Files {
+			file := &u.Files[i]
+			if file.OS == os && file.Arch == arch && file.CoreVersion == coreVersion {
+				return &UpdatePath{Incremental: file}
+			}
+		}
+	}
+	
+	// No incremental update available, check for full package
+	if fullPackage, exists := u.FullPackages[fmt.Sprintf("%s-%s", os, arch)]; exists {
+		return &UpdatePath{FullPackage: &fullPackage}
+	}
+	
+	return nil
+}
+
 // LanguageConfig represents language configuration
 type LanguageConfig map[string]LanguageStrings
 
@@ -133,7 +492,9 @@ type LanguageStrings struct {
 	Updates     map[string]string `json:"updates"`
 }
 
-// Config holds all configuration data
+// Config holds all configuration data. A reload does not modify the data of
+// the loaded Config but publishes a new one, so code serving a request reads
+// everything from one Current snapshot.
 type Config struct {
 	App         *AppConfig
 	Launcher    *LauncherConfigData
@@ -141,13 +502,21 @@ type Config struct {
 	Updates     *UpdateConfigData
 	Languages   LanguageConfig
 	ConfigPath  string
+
+	flags       *CLIFlags
+	generation  uint64
+	current     atomic.Pointer[Config]
+	reloadMu    sync.Mutex
+	reloadHooks []func(previous *Config)
 }
 
-func Load() *Config {
+func Load() (*Config, error) {
 	return LoadWithFlags(nil)
 }
 
-func LoadWithFlags(flags *CLIFlags) *Config {
+// LoadWithFlags loads the configuration, failing if the app config is
+// invalid rather than running with settings that were not meant
+func LoadWithFlags(flags *CLIFlags) (*Config, error) {
 	configPath := "./configs"
 	if flags != nil && flags.ConfigPath != nil && *flags.ConfigPath != "" {
 		configPath = *flags.ConfigPath
@@ -155,12 +524,19 @@ func LoadWithFlags(flags *CLIFlags) *Config {
 		configPath = envPath
 	}
 	
+	return loadFrom(configPath, flags)
+}
+
+func loadFrom(configPath string, flags *CLIFlags) (*Config, error) {
 	config := &Config{
 		ConfigPath: configPath,
+		flags:      flags,
 	}
 	
 	// Load all configuration files
-	config.loadAppConfig()
+	if err := config.loadAppConfig(); err != nil {
+		return nil, err
+	}
 	config.loadLauncherConfig()
 	config.loadMaintenanceConfig()
 	config.loadUpdateConfig()
@@ -174,37 +550,105 @@ func LoadWithFlags(flags *CLIFlags) *Config {
 	// Override with environment variables (lower priority)
 	config.overrideWithEnv()
 	
-	return config
+	if err := config.App.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid app config: %w", err)
+	}
+	return config, nil
+}
+
+// Current returns the configuration as of the last reload. The snapshot is
+// never modified, so it can be read without locking while reloads happen.
+func (c *Config) Current() *Config {
+	if current := c.current.Load(); current != nil {
+		return current
+	}
+	return c
+}
+
+// Generation returns a counter that is incremented every time the
+// configuration is reloaded. It can be used to key derived data; a snapshot
+// returns the generation it was published as.
+func (c *Config) Generation() uint64 {
+	return c.Current().generation
 }
 
-func (c *Config) loadAppConfig() {
+// OnReload registers a hook that is called after every reload with a
+// snapshot of the configuration as it was before the reload
+func (c *Config) OnReload(hook func(previous *Config)) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	c.reloadHooks = append(c.reloadHooks, hook)
+}
+
+// Reload re-reads all configuration files from ConfigPath, re-applying the
+// CLI flags and environment overrides the configuration was loaded with. An
+// invalid app config is rejected and the current configuration kept.
+func (c *Config) Reload() error {
+	next, err := loadFrom(c.ConfigPath, c.flags)
+	if err != nil {
+		return err
+	}
+	c.Swap(next)
+	return nil
+}
+
+// Swap publishes next as the current configuration under the next
+// generation and runs the reload hooks. next must not be modified afterwards.
+func (c *Config) Swap(next *Config) {
+	c.reloadMu.Lock()
+	previous := c.Current()
+	next.generation = previous.generation + 1
+	c.current.Store(next)
+	hooks := append([]func(previous *Config){}, c.reloadHooks...)
+	c.reloadMu.Unlock()
+
+	for _, hook := range hooks {
+		hook(previous)
+	}
+}
+
+// defaultAppConfig returns the settings used without an app.json
+func defaultAppConfig() *AppConfig {
+	app := &AppConfig{}
+	app.Server.Port = "8080"
+	app.Server.APIVersion = "1.0.0"
+	app.Server.MinAPIVersion = "1.0.0"
+	app.Server.BuildVersion = "20240601"
+	app.Server.ReleaseDate = "2024-06-01T12:00:00Z"
+	app.Authentication.Enabled = false
+	app.Authentication.JWTSecret = "default-secret-change-this"
+	app.Authentication.TokenExpirationSec = 3600
+	app.Authentication.RefreshTokenExpirationDays = 30
+	app.Authentication.Issuer = "NekoLcServer"
+	app.Authentication.ClockSkewSec = 30
+	app.Authentication.AllowRegistration = false
+	app.Authentication.AllowAnonymousDevices = false
+	app.Authentication.MinPasswordLength = 8
+	app.Authentication.PasswordReset.TokenExpirationMin = 30
+	app.Debug.Enabled = false
+	app.Database.Type = "sqlite"
+	app.Database.Path = "./data/nekolc.db"
+	app.Storage.BasePath = "./data"
+	app.Notifications.RetentionHours = 72
+	app.Cleanup.IntervalMin = 60
+	app.Cleanup.GraceHours = 24
+	return app
+}
+
+func (c *Config) loadAppConfig() error {
 	appConfigPath := filepath.Join(c.ConfigPath, "app.json")
 	data, err := os.ReadFile(appConfigPath)
 	if err != nil {
 		// Fall back to defaults if config file doesn't exist
-		c.App = &AppConfig{}
-		c.App.Server.Port = "8080"
-		c.App.Server.APIVersion = "1.0.0"
-		c.App.Server.MinAPIVersion = "1.0.0"
-		c.App.Server.BuildVersion = "20240601"
-		c.App.Server.ReleaseDate = "2024-06-01T12:00:00Z"
-		c.App.Authentication.Enabled = false
-		c.App.Authentication.JWTSecret = "default-secret-change-this"
-		c.App.Authentication.TokenExpirationSec = 3600
-		c.App.Authentication.RefreshTokenExpirationDays = 30
-		c.App.Debug.Enabled = false
-		c.App.Database.Type = "sqlite"
-		c.App.Database.Path = "./data/nekolc.db"
-		c.App.Storage.BasePath = "./data"
-		return
+		c.App = defaultAppConfig()
+		return nil
 	}
 	
 	c.App = &AppConfig{}
 	if err := json.Unmarshal(data, c.App); err != nil {
-		fmt.Printf("Error loading app config: %v\n", err)
-		// Use defaults on error
-		c.loadAppConfig() // Recursive call to set defaults
+		return fmt.Errorf("invalid app config: %w", err)
 	}
+	return nil
 }
 
 func (c *Config) loadLauncherConfig() {
@@ -218,13 +662,13 @@ func (c *Config) loadLauncherConfig() {
 			MaxRetryCount:    3,
 			WebSocket: WebSocketConfig{
 				Enable:               false,
+				Transport:            "websocket",
 				SocketHost:          "",
+				SseUrl:               "",
 				HeartbeatIntervalSec: 30,
 			},
 			Security: SecurityConfig{
 				EnableAuthentication:        false,
-				TokenExpirationSec:         3600,
-				RefreshTokenExpirationDays: 30,
 				LoginUrl:                   "/v0/api/auth/login",
 				LogoutUrl:                  "/v0/api/auth/logout",
 				RefreshUrl:                 "/v0/api/auth/refresh",
@@ -321,13 +765,17 @@ func (c *Config) loadLanguageConfig() {
 					"InvalidRequest":     "The request is invalid.",
 					"NotFound":          "Resource not found.",
 					"Unauthorized":      "Authentication required.",
+					"Forbidden":         "Access denied.",
+					"Conflict":          "The resource already exists.",
 					"InternalError":     "Internal server error.",
 					"NotImplemented":    "Feature not implemented.",
 					"ServiceUnavailable": "Service is currently unavailable.",
+					"TooManyRequests":    "Too many requests, try again later.",
 				},
 				Maintenance: map[string]string{
 					"scheduled": "Scheduled maintenance",
 					"progress":  "Maintenance in progress",
+					"completed": "Maintenance completed",
 				},
 				Updates: map[string]string{
 					"available":   "New version available",
@@ -370,6 +818,9 @@ func (c *Config) overrideWithFlags(flags *CLIFlags) {
 	if flags.DatabasePath != nil && *flags.DatabasePath != "" {
 		c.App.Database.Path = *flags.DatabasePath
 	}
+	if flags.PidFile != nil && *flags.PidFile != "" {
+		c.App.Server.PidFile = *flags.PidFile
+	}
 }
 
 func (c *Config) overrideWithEnv() {
@@ -398,6 +849,16 @@ func (c *Config) overrideWithEnv() {
 	}
 }
 
+// Language returns the requested language if it is configured, and English
+// otherwise. Localized strings fall back to English for other languages, so
+// the result can key responses without keeping one per unknown language.
+func (c *Config) Language(requested string) string {
+	if _, ok := c.Languages[requested]; ok {
+		return requested
+	}
+	return "en"
+}
+
 // GetLocalizedString returns a localized string for the given language
 func (c *Config) GetLocalizedString(language, category, key string) string {
 	if lang, exists := c.Languages[language]; exists {
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeAppConfig(t *testing.T, dir, data string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "app.json"), []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write app config: %v", err)
+	}
+}
+
+func TestConfig_Reload_RejectsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writeAppConfig(t, dir, `{"authentication": {"routePolicies": {"/v0/api/feedback": "role:tester"}}}`)
+	cfg, err := loadFrom(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if policy := cfg.App.RoutePolicy("/v0/api/feedback"); policy != (AuthPolicy{Level: "required", Role: "tester"}) {
+		t.Errorf("Expected the parsed route policy, got %+v", policy)
+	}
+
+	for _, invalid := range []string{
+		`{"authentication": {"routePolicies": {"/v0/api/feedback": "sometimes"}}}`,
+		`{"server": {"trustedProxies": ["proxy.local"]}}`,
+		`{"authentication": {"enabled": true, "passwordReset": {"notifier": "log"}}}`,
+		`{"authentication": {"passwordReset": {"notifier": "file"}}}`,
+		`{"authentication": {"passwordReset": {"notifier": "email"}}}`,
+		`{"server": `,
+	} {
+		writeAppConfig(t, dir, invalid)
+		if err := cfg.Reload(); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+		if cfg.Generation() != 0 || cfg.Current().App.RoutePolicy("/v0/api/feedback").Role != "tester" {
+			t.Errorf("Expected the previous configuration to be kept after %s", invalid)
+		}
+		if _, err := loadFrom(dir, nil); err == nil {
+			t.Errorf("Expected loading %s to fail", invalid)
+		}
+	}
+}
+
+func TestAppConfig_Validate_PasswordResetNotifier(t *testing.T) {
+	app := defaultAppConfig()
+	app.Authentication.Enabled = true
+	app.Authentication.PasswordReset.Notifier = "log"
+	if err := app.Validate(); err == nil {
+		t.Error("Expected the log notifier to be rejected outside debug mode")
+	}
+	app.Debug.Enabled = true
+	if err := app.Validate(); err != nil {
+		t.Errorf("Expected the log notifier to be allowed in debug mode: %v", err)
+	}
+
+	app.Debug.Enabled = false
+	app.Authentication.PasswordReset.Notifier = ""
+	if err := app.Validate(); err != nil {
+		t.Errorf("Expected password reset to be allowed to stay disabled: %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	// Hashing very long passwords is expensive, so they are rejected
+	maxPasswordLength = 256
+)
+
+// Register handles POST /v0/api/auth/register
+func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+	
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+	
+	var req models.RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+	
+	language := cfg.Language(req.Preferences.Language)
+	
+	if !cfg.App.Authentication.AllowRegistration {
+		rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Registration is disabled", language)
+		return
+	}
+	
+	if !validUsername(req.Register.Username) {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Username must be 3-32 letters, digits, '.', '_' or '-'", language)
+		return
+	}
+	if message := checkPassword(cfg, req.Register.Password); message != "" {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", message, language)
+		return
+	}
+	
+	hash, err := auth.HashPassword(req.Register.Password)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to hash password", language)
+		return
+	}
+	
+	user := &storage.User{
+		Username:     req.Register.Username,
+		PasswordHash: hash,
+	}
+	if err := h.DB.CreateUser(user); err != nil {
+		if err == storage.ErrUserExists {
+			rw.WriteErrorWithLanguage(http.StatusConflict, "Conflict", "Username is already taken", language)
+			return
+		}
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to create user", language)
+		return
+	}
+	
+	// Registration logs the new user in
+	tokens, err := h.JWTAuth.GenerateTokens(user.ID)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to generate tokens", language)
+		return
+	}
+	if err := h.storeTokenPair(cfg, r, user.ID, newTokenFamilyID(), tokens, req.Session); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to store tokens", language)
+		return
+	}
+	
+	response := models.LoginResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Meta:         models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+	
+	rw.WriteJSON(http.StatusCreated, response)
+}
+
+// ChangePassword handles POST /v0/api/auth/changePassword
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+	
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+	
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+	
+	language := cfg.Language(req.Preferences.Language)
+	
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Authorization header required", language)
+		return
+	}
+	claims, err := validateAccessToken(h.DB, h.JWTAuth, strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
+		return
+	}
+	
+	user, err := h.DB.GetUser(claims.UserID)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to load user", language)
+		return
+	}
+	if user == nil {
+		// Identifier/signature logins have no password to change
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Account has no password", language)
+		return
+	}
+	if user.Disabled {
+		rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Account is disabled", language)
+		return
+	}
+	
+	ok, err := auth.VerifyPassword(req.ChangePassword.OldPassword, user.PasswordHash)
+	if err != nil || !ok {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid credentials", language)
+		return
+	}
+	if message := checkPassword(cfg, req.ChangePassword.NewPassword); message != "" {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", message, language)
+		return
+	}
+	
+	if err := h.setPassword(user, req.ChangePassword.NewPassword); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to change password", language)
+		return
+	}
+	
+	rw.WriteNoContent()
+}
+
+// RequestPasswordReset handles POST /v0/api/auth/requestPasswordReset
+func (h *AuthHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+	
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+	
+	var req models.PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+	
+	language := cfg.Language(req.Preferences.Language)
+	
+	if h.Notifier == nil {
+		rw.WriteErrorWithLanguage(http.StatusNotImplemented, "NotImplemented", "Password reset is not enabled", language)
+		return
+	}
+	
+	if req.PasswordReset.Username == "" {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Missing required field: username", language)
+		return
+	}
+	
+	// Every request counts, whether or not the user exists, so that tokens
+	// cannot be requested in bulk and the limit does not reveal usernames
+	policy := cfg.App.PasswordResetLimits()
+	limits := resetLimits(policy, req.PasswordReset.Username, clientIP(cfg, r))
+	if h.startAttempt(rw, policy, limits, "Too many password reset requests, try again later", language) == nil {
+		return
+	}
+	
+	user, err := h.DB.GetUserByUsername(req.PasswordReset.Username)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to load user", language)
+		return
+	}
+	
+	// The response is the same whether or not the user exists, so the
+	// endpoint cannot be used to find usernames
+	if user == nil || user.Disabled {
+		rw.WriteNoContent()
+		return
+	}
+	
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to generate reset token", language)
+		return
+	}
+	token := hex.EncodeToString(tokenBytes)
+	
+	expirationMin := cfg.App.Authentication.PasswordReset.TokenExpirationMin
+	if expirationMin <= 0 {
+		expirationMin = 30
+	}
+	reset := &storage.PasswordReset{
+		TokenHash: h.JWTAuth.GetTokenHash(token),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(time.Duration(expirationMin) * time.Minute),
+	}
+	if err := h.DB.StorePasswordReset(reset); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to store reset token", language)
+		return
+	}
+	
+	if err := h.Notifier.SendPasswordReset(user, token, reset.ExpiresAt); err != nil {
+		log.Printf("Failed to send password reset for user %s: %v", user.ID, err)
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to send reset token", language)
+		return
+	}
+	
+	rw.WriteNoContent()
+}
+
+// ResetPassword handles POST /v0/api/auth/resetPassword
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+	
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+	
+	var req models.PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+	
+	language := cfg.Language(req.Preferences.Language)
+	
+	if req.PasswordReset.Token == "" {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Missing required field: token", language)
+		return
+	}
+	// Checked before the token is consumed, so a weak password does not
+	// waste the token
+	if message := checkPassword(cfg, req.PasswordReset.NewPassword); message != "" {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", message, language)
+		return
+	}
+	
+	reset, err := h.DB.ConsumePasswordReset(h.JWTAuth.GetTokenHash(req.PasswordReset.Token))
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to load reset token", language)
+		return
+	}
+	if reset == nil || time.Now().After(reset.ExpiresAt) {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Invalid or expired reset token", language)
+		return
+	}
+	
+	user, err := h.DB.GetUser(reset.UserID)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to load user", language)
+		return
+	}
+	if user == nil || user.Disabled {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Invalid or expired reset token", language)
+		return
+	}
+	
+	if err := h.setPassword(user, req.PasswordReset.NewPassword); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to reset password", language)
+		return
+	}
+	
+	rw.WriteNoContent()
+}
+
+// setPassword stores a new password hash and signs the user out of every
+// session, since whoever knew the old password may hold tokens
+func (h *AuthHandler) setPassword(user *storage.User, password string) error {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	if err := h.DB.UpdateUser(user); err != nil {
+		return err
+	}
+	return h.DB.RevokeAllUserTokens(user.ID)
+}
+
+// checkPassword returns why a new password is not acceptable, or an empty string
+func checkPassword(cfg *config.Config, password string) string {
+	minLength := cfg.App.Authentication.MinPasswordLength
+	if minLength <= 0 {
+		minLength = 8
+	}
+	if len(password) < minLength {
+		return "Password is too short"
+	}
+	if len(password) > maxPasswordLength {
+		return "Password is too long"
+	}
+	return ""
+}
+
+func validUsername(username string) bool {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return false
+	}
+	for _, c := range username {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
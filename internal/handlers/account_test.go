@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// recordingNotifier keeps the password reset tokens it is asked to send
+type recordingNotifier struct {
+	tokens map[string]string // username -> token
+	sent   int
+}
+
+func (n *recordingNotifier) SendPasswordReset(user *storage.User, token string, expiresAt time.Time) error {
+	n.tokens[user.Username] = token
+	n.sent++
+	return nil
+}
+
+func createTestAccountHandler(t *testing.T) (*AuthHandler, *recordingNotifier) {
+	cfg := createTestConfig(true)
+	cfg.App.Authentication.TokenExpirationSec = 3600
+	cfg.App.Authentication.RefreshTokenExpirationDays = 30
+	cfg.App.Authentication.AllowRegistration = true
+	cfg.Languages = config.LanguageConfig{
+		"zh-tw": config.LanguageStrings{
+			Errors: map[string]string{"Conflict": "資源已存在。"},
+		},
+	}
+	db, cleanup := createTestDatabase()
+	t.Cleanup(cleanup)
+
+	notifier := &recordingNotifier{tokens: make(map[string]string)}
+	return NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notifier), notifier
+}
+
+func postJSON(handlerFunc http.HandlerFunc, path string, body interface{}, accessToken string) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	httpReq := httptest.NewRequest("POST", path, bytes.NewReader(data))
+	httpReq.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	w := httptest.NewRecorder()
+	handlerFunc(w, httpReq)
+	return w
+}
+
+func errorType(w *httptest.ResponseRecorder) string {
+	var response models.ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response.Errors) == 0 {
+		return ""
+	}
+	return response.Errors[0].ErrorType
+}
+
+func TestAuthHandler_Register(t *testing.T) {
+	handler, _ := createTestAccountHandler(t)
+
+	register := models.RegisterRequest{Register: models.RegisterInfo{Username: "alice", Password: "password123"}}
+	w := postJSON(handler.Register, "/v0/api/auth/register", register, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var response models.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.AccessToken == "" || response.RefreshToken == "" {
+		t.Error("Expected tokens for the new user")
+	}
+
+	// The new account can log in
+	if w := postLogin(handler, "alice", "password123"); w.Code != http.StatusOK {
+		t.Errorf("Expected login status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	// Usernames are unique
+	register.Preferences.Language = "zh-tw"
+	w = postJSON(handler.Register, "/v0/api/auth/register", register, "")
+	if w.Code != http.StatusConflict || errorType(w) != "Conflict" {
+		t.Errorf("Expected Conflict error, got %d %s", w.Code, w.Body.String())
+	}
+	var errorResponse models.ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &errorResponse)
+	if errorResponse.Errors[0].ErrorMessage != "資源已存在。" {
+		t.Errorf("Expected localized message, got %s", errorResponse.Errors[0].ErrorMessage)
+	}
+}
+
+func TestAuthHandler_Register_Invalid(t *testing.T) {
+	handler, _ := createTestAccountHandler(t)
+
+	tests := []models.RegisterInfo{
+		{Username: "al", Password: "password123"},
+		{Username: "alice/../bob", Password: "password123"},
+		{Username: "alice", Password: "short"},
+	}
+	for _, info := range tests {
+		w := postJSON(handler.Register, "/v0/api/auth/register", models.RegisterRequest{Register: info}, "")
+		if w.Code != http.StatusBadRequest || errorType(w) != "InvalidRequest" {
+			t.Errorf("Expected InvalidRequest for %+v, got %d", info, w.Code)
+		}
+	}
+
+	handler.Config.App.Authentication.AllowRegistration = false
+	w := postJSON(handler.Register, "/v0/api/auth/register", models.RegisterRequest{Register: models.RegisterInfo{Username: "alice", Password: "password123"}}, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d when registration is disabled, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestAuthHandler_ChangePassword(t *testing.T) {
+	handler, _ := createTestAccountHandler(t)
+	createTestUser(t, handler.DB, "alice", "old-password")
+
+	var login models.LoginResponse
+	json.Unmarshal(postLogin(handler, "alice", "old-password").Body.Bytes(), &login)
+
+	change := models.ChangePasswordRequest{ChangePassword: models.ChangePasswordInfo{OldPassword: "wrong-password", NewPassword: "new-password"}}
+	if w := postJSON(handler.ChangePassword, "/v0/api/auth/changePassword", change, login.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for wrong old password, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := postJSON(handler.ChangePassword, "/v0/api/auth/changePassword", change, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without token, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	change.ChangePassword.OldPassword = "old-password"
+	if w := postJSON(handler.ChangePassword, "/v0/api/auth/changePassword", change, login.AccessToken); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	if w := postLogin(handler, "alice", "old-password"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected old password to be rejected, got %d", w.Code)
+	}
+	if w := postLogin(handler, "alice", "new-password"); w.Code != http.StatusOK {
+		t.Errorf("Expected new password to be accepted, got %d", w.Code)
+	}
+
+	// Existing sessions are signed out
+	if w := postJSON(handler.ChangePassword, "/v0/api/auth/changePassword", change, login.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected old access token to be revoked, got %d", w.Code)
+	}
+}
+
+func TestAuthHandler_PasswordReset(t *testing.T) {
+	handler, notifier := createTestAccountHandler(t)
+	createTestUser(t, handler.DB, "alice", "old-password")
+
+	// Unknown users get the same response, but nothing is sent
+	request := models.PasswordResetRequest{PasswordReset: models.PasswordResetInfo{Username: "nobody"}}
+	if w := postJSON(handler.RequestPasswordReset, "/v0/api/auth/requestPasswordReset", request, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if len(notifier.tokens) != 0 {
+		t.Errorf("Expected no token for unknown user, got %v", notifier.tokens)
+	}
+
+	request.PasswordReset.Username = "alice"
+	if w := postJSON(handler.RequestPasswordReset, "/v0/api/auth/requestPasswordReset", request, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	token := notifier.tokens["alice"]
+	if token == "" {
+		t.Fatal("Expected reset token to be delivered")
+	}
+
+	reset := models.PasswordResetRequest{PasswordReset: models.PasswordResetInfo{Token: "invalid", NewPassword: "new-password"}}
+	if w := postJSON(handler.ResetPassword, "/v0/api/auth/resetPassword", reset, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid token, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	reset.PasswordReset.Token = token
+	if w := postJSON(handler.ResetPassword, "/v0/api/auth/resetPassword", reset, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if w := postLogin(handler, "alice", "new-password"); w.Code != http.StatusOK {
+		t.Errorf("Expected new password to be accepted, got %d", w.Code)
+	}
+
+	// Tokens are single-use
+	if w := postJSON(handler.ResetPassword, "/v0/api/auth/resetPassword", reset, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected used token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestAuthHandler_PasswordReset_Expired(t *testing.T) {
+	handler, _ := createTestAccountHandler(t)
+	user := createTestUser(t, handler.DB, "alice", "old-password")
+
+	handler.DB.StorePasswordReset(&storage.PasswordReset{
+		TokenHash: handler.JWTAuth.GetTokenHash("expired-token"),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+
+	reset := models.PasswordResetRequest{PasswordReset: models.PasswordResetInfo{Token: "expired-token", NewPassword: "new-password"}}
+	if w := postJSON(handler.ResetPassword, "/v0/api/auth/resetPassword", reset, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for expired token, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAuthHandler_PasswordReset_Limits(t *testing.T) {
+	handler, notifier := createTestAccountHandler(t)
+	createTestUser(t, handler.DB, "alice", "old-password")
+	handler.Config.App.Authentication.PasswordReset.MaxRequestsPerIP = 6
+
+	send := func(username string) *httptest.ResponseRecorder {
+		request := models.PasswordResetRequest{PasswordReset: models.PasswordResetInfo{Username: username}}
+		return postJSON(handler.RequestPasswordReset, "/v0/api/auth/requestPasswordReset", request, "")
+	}
+
+	// Requests per username are limited whether or not the user exists
+	for _, username := range []string{"alice", "nobody"} {
+		for i := 0; i < 3; i++ {
+			if w := send(username); w.Code != http.StatusNoContent {
+				t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+			}
+		}
+		w := send(username)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected status %d with Retry-After for %s, got %d", http.StatusTooManyRequests, username, w.Code)
+		}
+	}
+	if notifier.sent != 3 {
+		t.Errorf("Expected 3 reset tokens to be sent, got %d", notifier.sent)
+	}
+
+	// Refused requests are not counted, so the address is now at its limit
+	if w := send("bob"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d for the address, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	handler.Notifier = nil
+	if w := send("carol"); w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status %d without a notifier, got %d", http.StatusNotImplemented, w.Code)
+	}
+}
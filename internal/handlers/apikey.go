@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+const (
+	maxAPIKeyNameLength   = 64
+	maxAPIKeyExpiryInDays = 10 * 365
+)
+
+// APIKeyHandler serves the admin endpoints that manage API keys. Routes are
+// expected to require the admin role.
+type APIKeyHandler struct {
+	Config *config.Config
+	DB     storage.Storage
+}
+
+func NewAPIKeyHandler(cfg *config.Config, db storage.Storage) *APIKeyHandler {
+	return &APIKeyHandler{
+		Config: cfg,
+		DB:     db,
+	}
+}
+
+// APIKeys handles POST /v0/admin/apiKeys, listing every API key
+func (h *APIKeyHandler) APIKeys(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	var req models.APIKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	keys, err := h.DB.ListAPIKeys()
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to list API keys", language)
+		return
+	}
+
+	response := models.APIKeysResponse{
+		APIKeys: make([]models.APIKey, 0, len(keys)),
+		Meta:    h.meta(cfg),
+	}
+	for _, key := range keys {
+		response.APIKeys = append(response.APIKeys, apiKeyModel(key))
+	}
+
+	rw.WriteJSON(http.StatusOK, response)
+}
+
+// CreateAPIKey handles POST /v0/admin/createApiKey. The key is returned only
+// in this response.
+func (h *APIKeyHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	var req models.CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	info := req.CreateAPIKey
+	name := strings.TrimSpace(info.Name)
+	if name == "" || len(name) > maxAPIKeyNameLength {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "API key name must be 1 to 64 characters", language)
+		return
+	}
+	scopes, err := auth.ParseRoles(strings.Join(info.Scopes, ","))
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Invalid scope", language)
+		return
+	}
+	if info.ExpiresInDays < 0 || info.ExpiresInDays > maxAPIKeyExpiryInDays {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Invalid expiry", language)
+		return
+	}
+
+	key := auth.GenerateAPIKey()
+	apiKey := &storage.APIKey{
+		KeyHash: auth.HashAPIKey(key),
+		Name:    name,
+		Scopes:  scopes,
+	}
+	if info.ExpiresInDays > 0 {
+		apiKey.ExpiresAt = time.Now().UTC().AddDate(0, 0, info.ExpiresInDays)
+	}
+	if claims, ok := middleware.ClaimsFromContext(r.Context()); ok {
+		apiKey.UserID = claims.UserID
+	}
+	if err := h.DB.CreateAPIKey(apiKey); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to create API key", language)
+		return
+	}
+
+	rw.WriteJSON(http.StatusOK, models.CreateAPIKeyResponse{
+		APIKey: apiKeyModel(apiKey),
+		Key:    key,
+		Meta:   h.meta(cfg),
+	})
+}
+
+// RevokeAPIKey handles POST /v0/admin/revokeApiKey
+func (h *APIKeyHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	var req models.RevokeAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	apiKey, err := h.DB.GetAPIKey(req.RevokeAPIKey.ID)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to load API key", language)
+		return
+	}
+	if apiKey == nil {
+		rw.WriteErrorWithLanguage(http.StatusNotFound, "NotFound", "API key not found", language)
+		return
+	}
+
+	if err := h.DB.RevokeAPIKey(apiKey.ID); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to revoke API key", language)
+		return
+	}
+
+	rw.WriteNoContent()
+}
+
+func (h *APIKeyHandler) meta(cfg *config.Config) models.Meta {
+	return models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate)
+}
+
+// apiKeyModel describes a stored key without its hash
+func apiKeyModel(key *storage.APIKey) models.APIKey {
+	model := models.APIKey{
+		ID:        key.ID,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		CreatedBy: key.UserID,
+		Revoked:   key.Revoked,
+		CreatedAt: key.CreatedAt.Unix(),
+	}
+	if model.Scopes == nil {
+		model.Scopes = []string{}
+	}
+	if !key.ExpiresAt.IsZero() {
+		model.ExpiresAt = key.ExpiresAt.Unix()
+	}
+	if !key.LastUsedAt.IsZero() {
+		model.LastUsedAt = key.LastUsedAt.Unix()
+	}
+	return model
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/testutil"
+)
+
+// postAsAdmin posts to a handler with the claims an admin access token
+// leaves in the request context
+func postAsAdmin(handlerFunc http.HandlerFunc, path string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	httpReq := httptest.NewRequest("POST", path, bytes.NewReader(data))
+	httpReq.Header.Set("Content-Type", "application/json")
+	claims := &auth.Claims{UserID: "admin-1", TokenType: "access", Roles: []string{auth.RoleAdmin}}
+	httpReq = httpReq.WithContext(middleware.WithClaims(httpReq.Context(), claims))
+	w := httptest.NewRecorder()
+	handlerFunc(w, httpReq)
+	return w
+}
+
+func TestAPIKeyHandler(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			handler := NewAPIKeyHandler(createTestConfig(true), db)
+
+			req := models.CreateAPIKeyRequest{CreateAPIKey: models.CreateAPIKeyInfo{Name: "ci", Scopes: []string{"publisher"}, ExpiresInDays: 30}}
+			w := postAsAdmin(handler.CreateAPIKey, "/v0/admin/createApiKey", req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var created models.CreateAPIKeyResponse
+			json.Unmarshal(w.Body.Bytes(), &created)
+			if created.APIKey.CreatedBy != "admin-1" || created.APIKey.ExpiresAt == 0 {
+				t.Errorf("Expected a key created by the admin with an expiry, got %+v", created.APIKey)
+			}
+
+			// Only the hash of the key is stored
+			stored, err := db.GetAPIKeyByHash(auth.HashAPIKey(created.Key))
+			if err != nil || stored == nil || stored.ID != created.APIKey.ID {
+				t.Fatalf("Expected the key to be stored by its hash, got %+v, %v", stored, err)
+			}
+
+			w = postAsAdmin(handler.APIKeys, "/v0/admin/apiKeys", models.APIKeysRequest{})
+			var list models.APIKeysResponse
+			json.Unmarshal(w.Body.Bytes(), &list)
+			if len(list.APIKeys) != 1 || list.APIKeys[0].ID != created.APIKey.ID || list.APIKeys[0].Scopes[0] != "publisher" {
+				t.Errorf("Expected the created key to be listed, got %+v", list.APIKeys)
+			}
+
+			revoke := models.RevokeAPIKeyRequest{RevokeAPIKey: models.RevokeAPIKeyInfo{ID: created.APIKey.ID}}
+			if w := postAsAdmin(handler.RevokeAPIKey, "/v0/admin/revokeApiKey", revoke); w.Code != http.StatusNoContent {
+				t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+			}
+			if stored, _ := db.GetAPIKey(created.APIKey.ID); stored == nil || !stored.Revoked {
+				t.Errorf("Expected the key to be revoked, got %+v", stored)
+			}
+
+			revoke.RevokeAPIKey.ID = "missing"
+			if w := postAsAdmin(handler.RevokeAPIKey, "/v0/admin/revokeApiKey", revoke); w.Code != http.StatusNotFound {
+				t.Errorf("Expected status %d for an unknown key, got %d", http.StatusNotFound, w.Code)
+			}
+		})
+	}
+}
+
+func TestAPIKeyHandler_InvalidRequest(t *testing.T) {
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	handler := NewAPIKeyHandler(createTestConfig(true), db)
+
+	for _, info := range []models.CreateAPIKeyInfo{
+		{Name: ""},
+		{Name: "ci", Scopes: []string{"Publisher"}},
+		{Name: "ci", ExpiresInDays: -1},
+	} {
+		w := postAsAdmin(handler.CreateAPIKey, "/v0/admin/createApiKey", models.CreateAPIKeyRequest{CreateAPIKey: info})
+		if w.Code != http.StatusBadRequest || errorType(w) != "InvalidRequest" {
+			t.Errorf("%+v: expected status %d, got %d", info, http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -9,32 +14,38 @@ import (
 	"github.com/moehoshio/NekoLcServer/internal/config"
 	"github.com/moehoshio/NekoLcServer/internal/middleware"
 	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/notify"
 	"github.com/moehoshio/NekoLcServer/internal/storage"
 )
 
 type AuthHandler struct {
-	Config  *config.Config
-	DB      storage.Storage
-	JWTAuth *auth.JWTAuth
+	Config   *config.Config
+	DB       storage.Storage
+	JWTAuth  *auth.JWTAuth
+	Notifier notify.Notifier
+	OIDC     *auth.OIDCProvider
 }
 
-func NewAuthHandler(cfg *config.Config, db storage.Storage, jwtAuth *auth.JWTAuth) *AuthHandler {
+func NewAuthHandler(cfg *config.Config, db storage.Storage, jwtAuth *auth.JWTAuth, notifier notify.Notifier) *AuthHandler {
 	return &AuthHandler{
-		Config:  cfg,
-		DB:      db,
-		JWTAuth: jwtAuth,
+		Config:   cfg,
+		DB:       db,
+		JWTAuth:  jwtAuth,
+		Notifier: notifier,
+		OIDC:     auth.NewOIDCProvider(cfg),
 	}
 }
 
 // Login handles POST /v0/api/auth/login
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
 	// If authentication is not implemented, return 501
-	if !h.Config.App.Authentication.Enabled {
+	if !cfg.App.Authentication.Enabled {
 		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
 		return
 	}
@@ -46,23 +57,143 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Get preferred language for error messages
-	language := "en"
-	if req.Preferences.Language != "" {
-		language = req.Preferences.Language
-	}
+	language := cfg.Language(req.Preferences.Language)
 	
-	var accessToken, refreshToken string
+	var tokens *auth.TokenPair
+	var userID string
 	var err error
+	familyID := newTokenFamilyID()
 	
 	// Check authentication method
 	if req.Auth.Username != "" && req.Auth.Password != "" {
-		// Username/password authentication
-		accessToken, refreshToken, err = h.JWTAuth.GenerateTokensFromCredentials(req.Auth.Username, req.Auth.Password)
+		// Username/password authentication, locked after repeated failures
+		attempt := h.startLoginAttempt(rw, req.Auth.Username, clientIP(cfg, r), language)
+		if attempt == nil {
+			return
+		}
+		user, authErr := h.authenticateUser(req.Auth.Username, req.Auth.Password)
+		if authErr == errInvalidCredentials {
+			attempt.failed()
+		} else {
+			attempt.uncount()
+		}
+		if authErr == errAccountDisabled {
+			rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Account is disabled", language)
+			return
+		}
+		if authErr != nil {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid credentials", language)
+			return
+		}
+		if user.TOTP.Enabled {
+			// Failures are kept until the second factor is verified too
+			h.startTwoFactorLogin(rw, user, "", language)
+			return
+		}
+		h.clearLoginFailures(req.Auth.Username)
+		userID = user.ID
+		tokens, err = h.JWTAuth.GenerateUserTokens(userID, tokenRoles(cfg, user))
+	} else if req.Auth.Challenge != "" && (req.Auth.TOTPCode != "" || req.Auth.RecoveryCode != "") {
+		// Second step of a login with two-factor authentication
+		user, deviceID, authErr := h.consumeTwoFactorChallenge(req.Auth.Challenge)
+		if authErr == errAccountDisabled {
+			rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Account is disabled", language)
+			return
+		}
+		if authErr != nil {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid credentials", language)
+			return
+		}
+		attempt := h.startLoginAttempt(rw, user.Username, clientIP(cfg, r), language)
+		if attempt == nil {
+			return
+		}
+		authErr = h.verifySecondFactor(user, req.Auth.TOTPCode, req.Auth.RecoveryCode)
+		if authErr == errInvalidCredentials {
+			attempt.failed()
+		} else {
+			attempt.uncount()
+		}
+		if authErr != nil {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid credentials", language)
+			return
+		}
+		h.clearLoginFailures(user.Username)
+		userID = user.ID
+		if deviceID != "" {
+			familyID = deviceID
+		}
+		tokens, err = h.JWTAuth.GenerateUserTokens(userID, tokenRoles(cfg, user))
+	} else if req.Auth.DeviceID != "" && req.Auth.Signature != "" {
+		// Device challenge/response authentication with a registered key
+		device, user, authErr := h.authenticateDevice(req.Auth)
+		if authErr == errAccountDisabled {
+			rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Account is disabled", language)
+			return
+		}
+		if authErr != nil {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid credentials", language)
+			return
+		}
+		if user != nil && user.TOTP.Enabled {
+			h.startTwoFactorLogin(rw, user, device.ID, language)
+			return
+		}
+		// Anonymous devices are their own user; the tokens of a device
+		// form one family, so revoking the device revokes them
+		userID = device.ID
+		var roles []string
+		if user != nil {
+			userID = user.ID
+			roles = tokenRoles(cfg, user)
+		}
+		familyID = device.ID
+		tokens, err = h.JWTAuth.GenerateUserTokens(userID, roles)
 	} else if req.Auth.Identifier != "" && req.Auth.Signature != "" {
-		// Identifier/signature authentication (JWT specification requirement)
-		accessToken, refreshToken, err = h.JWTAuth.GenerateTokensFromSignature(req.Auth.Identifier, req.Auth.Timestamp, req.Auth.Signature)
+		// Identifier/signature authentication with a registered client secret
+		authErr := h.authenticateClient(req.Auth)
+		if authErr == errAccountDisabled {
+			rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Client is disabled", language)
+			return
+		}
+		if authErr != nil {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid credentials", language)
+			return
+		}
+		userID = req.Auth.Identifier
+		tokens, err = h.JWTAuth.GenerateTokens(userID)
+	} else if req.Auth.Code != "" {
+		// OpenID Connect authorization code, exchanged with the identity provider
+		if !h.OIDC.Enabled() {
+			rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "OpenID Connect login is not configured", language)
+			return
+		}
+		if message := checkOIDCRequest(h.OIDC, req.Auth.RedirectURI, req.Auth.CodeVerifier); message != "" {
+			rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", message, language)
+			return
+		}
+		user, authErr := h.authenticateOIDC(r.Context(), req.Auth)
+		if errors.Is(authErr, auth.ErrOIDCUnavailable) {
+			log.Printf("OpenID Connect login failed: %v", authErr)
+			rw.WriteErrorWithLanguage(http.StatusServiceUnavailable, "ServiceUnavailable", "Identity provider is unavailable", language)
+			return
+		}
+		if authErr == errAccountDisabled {
+			rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Account is disabled", language)
+			return
+		}
+		if authErr != nil {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid credentials", language)
+			return
+		}
+		if user.TOTP.Enabled {
+			h.startTwoFactorLogin(rw, user, "", language)
+			return
+		}
+		userID = user.ID
+		tokens, err = h.JWTAuth.GenerateUserTokens(userID, tokenRoles(cfg, user))
 	} else {
-		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Username/password or identifier/signature required", language)
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Username/password, challenge/totpCode, identifier/signature, deviceId/signature or code required", language)
 		return
 	}
 	
@@ -72,42 +203,15 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Store tokens in database for revocation tracking
-	userID := req.Auth.Username
-	if userID == "" {
-		userID = req.Auth.Identifier
-	}
-	
-	accessTokenHash := h.JWTAuth.GetTokenHash(accessToken)
-	refreshTokenHash := h.JWTAuth.GetTokenHash(refreshToken)
-	
-	// Store access token
-	accessTokenRecord := &storage.AuthToken{
-		TokenHash: accessTokenHash,
-		TokenType: "access",
-		UserID:    userID,
-		ExpiresAt: time.Now().Add(time.Duration(h.Config.App.Authentication.TokenExpirationSec) * time.Second),
-	}
-	if err := h.DB.StoreAuthToken(accessTokenRecord); err != nil {
-		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to store access token", language)
-		return
-	}
-	
-	// Store refresh token
-	refreshTokenRecord := &storage.AuthToken{
-		TokenHash: refreshTokenHash,
-		TokenType: "refresh",
-		UserID:    userID,
-		ExpiresAt: time.Now().Add(time.Duration(h.Config.App.Authentication.RefreshTokenExpirationDays) * 24 * time.Hour),
-	}
-	if err := h.DB.StoreAuthToken(refreshTokenRecord); err != nil {
-		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to store refresh token", language)
+	if err := h.storeTokenPair(cfg, r, userID, familyID, tokens, req.Session); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to store tokens", language)
 		return
 	}
 	
 	response := models.LoginResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		Meta:         models.NewMeta(h.Config.App.Server.APIVersion, h.Config.App.Server.MinAPIVersion, h.Config.App.Server.BuildVersion, h.Config.App.Server.ReleaseDate),
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Meta:         models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
 	}
 	
 	rw.WriteJSON(http.StatusOK, response)
@@ -115,12 +219,13 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 
 // Refresh handles POST /v0/api/auth/refresh
 func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
-	if !h.Config.App.Authentication.Enabled {
+	if !cfg.App.Authentication.Enabled {
 		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
 		return
 	}
@@ -133,8 +238,20 @@ func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 	
 	// Validate refresh token
 	refreshTokenHash := h.JWTAuth.GetTokenHash(req.RefreshToken)
-	storedToken, err := h.DB.GetAuthToken(refreshTokenHash)
-	if err != nil || storedToken == nil || storedToken.IsRevoked || storedToken.TokenType != "refresh" {
+	storedToken, err := h.DB.FindAuthToken(refreshTokenHash)
+	if err != nil || storedToken == nil || storedToken.TokenType != "refresh" {
+		rw.WriteError(http.StatusUnauthorized, "Unauthorized", "Invalid or expired refresh token")
+		return
+	}
+	
+	// A refresh token that was already exchanged has been copied, so every
+	// token issued from the same login is revoked
+	if storedToken.IsRotated {
+		h.revokeReusedFamily(storedToken)
+		rw.WriteError(http.StatusUnauthorized, "Unauthorized", "Invalid or expired refresh token")
+		return
+	}
+	if storedToken.IsRevoked {
 		rw.WriteError(http.StatusUnauthorized, "Unauthorized", "Invalid or expired refresh token")
 		return
 	}
@@ -145,42 +262,96 @@ func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Generate new access token
-	newAccessToken, err := h.JWTAuth.RefreshAccessToken(req.RefreshToken)
+	// Accounts disabled after login cannot keep refreshing
+	user, err := h.DB.GetUser(storedToken.UserID)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, "InternalError", "Failed to load user")
+		return
+	}
+	if user != nil && user.Disabled {
+		rw.WriteError(http.StatusForbidden, "Forbidden", "Account is disabled")
+		return
+	}
+	if user == nil {
+		client, err := h.DB.GetClient(storedToken.UserID)
+		if err != nil {
+			rw.WriteError(http.StatusInternalServerError, "InternalError", "Failed to load client")
+			return
+		}
+		if client != nil && client.Disabled {
+			rw.WriteError(http.StatusForbidden, "Forbidden", "Client is disabled")
+			return
+		}
+	}
+	
+	// Generate new token pair; role changes apply from here
+	var roles []string
+	if user != nil {
+		roles = tokenRoles(cfg, user)
+	}
+	tokens, err := h.JWTAuth.RotateTokens(req.RefreshToken, roles)
 	if err != nil {
 		rw.WriteError(http.StatusUnauthorized, "Unauthorized", "Failed to refresh token")
 		return
 	}
 	
-	// Store new access token
-	newAccessTokenHash := h.JWTAuth.GetTokenHash(newAccessToken)
-	accessTokenRecord := &storage.AuthToken{
-		TokenHash: newAccessTokenHash,
-		TokenType: "access",
-		UserID:    storedToken.UserID,
-		ExpiresAt: time.Now().Add(time.Duration(h.Config.App.Authentication.TokenExpirationSec) * time.Second),
+	// Tokens issued before rotation have no family and start a new one
+	familyID := storedToken.FamilyID
+	if familyID == "" {
+		familyID = newTokenFamilyID()
+	}
+	
+	// Retire the old refresh token and store the new pair together, so that
+	// revoking the family cannot miss the new pair; losing a race against
+	// another refresh with the same token is reuse as well
+	rotated, err := h.DB.RotateAuthToken(refreshTokenHash, h.tokenRecords(storedToken.UserID, familyID, tokens))
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, "InternalError", "Failed to rotate refresh token")
+		return
 	}
-	if err := h.DB.StoreAuthToken(accessTokenRecord); err != nil {
-		rw.WriteError(http.StatusInternalServerError, "InternalError", "Failed to store new access token")
+	if !rotated {
+		h.revokeReusedFamily(storedToken)
+		rw.WriteError(http.StatusUnauthorized, "Unauthorized", "Invalid or expired refresh token")
+		return
+	}
+	if err := h.recordSession(cfg, r, storedToken.UserID, familyID, tokens.RefreshTokenExpiresAt, models.SessionInfo{}); err != nil {
+		rw.WriteError(http.StatusInternalServerError, "InternalError", "Failed to store new tokens")
 		return
 	}
 	
 	response := models.RefreshResponse{
-		AccessToken: newAccessToken,
-		Meta:        models.NewMeta(h.Config.App.Server.APIVersion, h.Config.App.Server.MinAPIVersion, h.Config.App.Server.BuildVersion, h.Config.App.Server.ReleaseDate),
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Meta:         models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
 	}
 	
 	rw.WriteJSON(http.StatusOK, response)
 }
 
+// revokeReusedFamily handles a refresh token presented after it was rotated
+func (h *AuthHandler) revokeReusedFamily(token *storage.AuthToken) {
+	var err error
+	if token.FamilyID != "" {
+		err = h.DB.RevokeTokenFamily(token.FamilyID)
+	} else {
+		err = h.DB.RevokeAllUserTokens(token.UserID)
+	}
+	if err != nil {
+		log.Printf("Security: refresh token reuse for user %s, failed to revoke token family %s: %v", token.UserID, token.FamilyID, err)
+		return
+	}
+	log.Printf("Security: refresh token reuse for user %s, revoked token family %s", token.UserID, token.FamilyID)
+}
+
 // Validate handles POST /v0/api/auth/validate
 func (h *AuthHandler) Validate(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
-	if !h.Config.App.Authentication.Enabled {
+	if !cfg.App.Authentication.Enabled {
 		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
 		return
 	}
@@ -191,6 +362,11 @@ func (h *AuthHandler) Validate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	if req.Introspect {
+		rw.WriteJSON(http.StatusOK, h.introspect(cfg, req.AccessToken))
+		return
+	}
+	
 	// Validate JWT token
 	_, err := h.JWTAuth.ValidateToken(req.AccessToken)
 	if err != nil {
@@ -210,14 +386,46 @@ func (h *AuthHandler) Validate(w http.ResponseWriter, r *http.Request) {
 	rw.WriteNoContent()
 }
 
+// introspect describes a token for services that need to know whose it is.
+// Invalid tokens are reported as inactive rather than with an error.
+func (h *AuthHandler) introspect(cfg *config.Config, token string) models.IntrospectionResponse {
+	response := models.IntrospectionResponse{
+		Meta: models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+	
+	claims, err := h.JWTAuth.ValidateToken(token)
+	if err != nil {
+		return response
+	}
+	// Exchanged refresh tokens cannot be used any more
+	storedToken, err := h.DB.GetAuthToken(h.JWTAuth.GetTokenHash(token))
+	if err != nil || storedToken == nil || storedToken.IsRotated {
+		return response
+	}
+	
+	response.Active = true
+	response.Sub = claims.UserID
+	response.TokenType = claims.TokenType
+	response.Roles = claims.Roles
+	response.SessionID = storedToken.FamilyID
+	if claims.ExpiresAt != nil {
+		response.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.Iat = claims.IssuedAt.Unix()
+	}
+	return response
+}
+
 // Logout handles POST /v0/api/auth/logout
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
-	if !h.Config.App.Authentication.Enabled {
+	if !cfg.App.Authentication.Enabled {
 		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
 		return
 	}
@@ -246,4 +454,167 @@ func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	rw.WriteNoContent()
-}
\ No newline at end of file
+}
+
+// JWKS handles GET /.well-known/jwks.json, publishing the public keys that
+// other services use to verify tokens issued by this server
+func (h *AuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+	
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+	
+	// Keys are published before they sign tokens, so verifiers may cache them
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	rw.WriteJSON(http.StatusOK, h.JWTAuth.JWKS())
+}
+
+// storeTokenPair records newly issued tokens for revocation tracking, and
+// the session they belong to
+func (h *AuthHandler) storeTokenPair(cfg *config.Config, r *http.Request, userID, familyID string, tokens *auth.TokenPair, info models.SessionInfo) error {
+	for _, record := range h.tokenRecords(userID, familyID, tokens) {
+		if err := h.DB.StoreAuthToken(record); err != nil {
+			return err
+		}
+	}
+	
+	return h.recordSession(cfg, r, userID, familyID, tokens.RefreshTokenExpiresAt, info)
+}
+
+// tokenRecords returns the stored records of a token pair
+func (h *AuthHandler) tokenRecords(userID, familyID string, tokens *auth.TokenPair) []*storage.AuthToken {
+	return []*storage.AuthToken{
+		{
+			TokenHash: h.JWTAuth.GetTokenHash(tokens.AccessToken),
+			TokenType: "access",
+			UserID:    userID,
+			FamilyID:  familyID,
+			ExpiresAt: tokens.AccessTokenExpiresAt,
+		},
+		{
+			TokenHash: h.JWTAuth.GetTokenHash(tokens.RefreshToken),
+			TokenType: "refresh",
+			UserID:    userID,
+			FamilyID:  familyID,
+			ExpiresAt: tokens.RefreshTokenExpiresAt,
+		},
+	}
+}
+
+// newTokenFamilyID returns a random ID for the tokens issued from one login
+func newTokenFamilyID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errAccountDisabled    = errors.New("account is disabled")
+)
+
+// dummyPasswordHash is verified against when a username does not exist, so
+// unknown and known usernames take the same time to reject
+var dummyPasswordHash, _ = auth.HashPassword("dummy-password")
+
+// authenticateUser checks a username and password against the stored users
+func (h *AuthHandler) authenticateUser(username, password string) (*storage.User, error) {
+	user, err := h.DB.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		auth.VerifyPassword(password, dummyPasswordHash)
+		return nil, errInvalidCredentials
+	}
+	
+	ok, err := auth.VerifyPassword(password, user.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+	if user.Disabled {
+		return nil, errAccountDisabled
+	}
+	return user, nil
+}
+
+// tokenRoles returns the roles of a user to embed in its access tokens.
+// Roles listed in authentication.twoFactor.requiredRoles are left out until
+// the user enables two-factor authentication.
+func tokenRoles(cfg *config.Config, user *storage.User) []string {
+	var roles []string
+	for _, role := range user.Roles {
+		if user.TOTP.Enabled || !cfg.App.RequiresTwoFactor(role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// authenticateClient checks an identifier/signature login against the
+// registered client and remembers its nonce, so it cannot be replayed
+func (h *AuthHandler) authenticateClient(info models.AuthInfo) error {
+	client, err := h.DB.GetClient(info.Identifier)
+	if err != nil {
+		return err
+	}
+	if client == nil {
+		return errInvalidCredentials
+	}
+	if client.Disabled {
+		return errAccountDisabled
+	}
+	
+	if err := auth.VerifyClientSignature(client.Secret, info.Identifier, info.Timestamp, info.Nonce, info.Signature, time.Now()); err != nil {
+		return errInvalidCredentials
+	}
+	
+	// The timestamp is accepted for the window on either side of it
+	expiresAt := time.Unix(info.Timestamp, 0).Add(auth.ClientSignatureWindow)
+	fresh, err := h.DB.UseClientNonce(client.ID, info.Nonce, expiresAt)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		log.Printf("Security: replayed login signature for client %s", client.ID)
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// validateAccessToken checks the signature, type and revocation state of an access token
+func validateAccessToken(db storage.Storage, jwtAuth *auth.JWTAuth, token string) (*auth.Claims, error) {
+	claims, _, err := lookupAccessToken(db, jwtAuth, token)
+	return claims, err
+}
+
+// lookupAccessToken validates an access token like validateAccessToken and
+// also returns its stored record, which is never nil without an error
+func lookupAccessToken(db storage.Storage, jwtAuth *auth.JWTAuth, token string) (*auth.Claims, *storage.AuthToken, error) {
+	claims, err := jwtAuth.ValidateToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if claims.TokenType != "access" {
+		return nil, nil, fmt.Errorf("token is not an access token")
+	}
+	
+	storedToken, err := db.GetAuthToken(jwtAuth.GetTokenHash(token))
+	if err != nil {
+		return nil, nil, err
+	}
+	if storedToken == nil || storedToken.IsRevoked {
+		return nil, nil, fmt.Errorf("token has been revoked")
+	}
+	
+	return claims, storedToken, nil
+}
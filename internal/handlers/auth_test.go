@@ -2,16 +2,24 @@ package handlers
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/moehoshio/NekoLcServer/internal/auth"
 	"github.com/moehoshio/NekoLcServer/internal/config"
 	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/notify"
 	"github.com/moehoshio/NekoLcServer/internal/storage"
+	"github.com/moehoshio/NekoLcServer/internal/testutil"
 )
 
 func createTestConfig(enableAuth bool) *config.Config {
@@ -39,13 +47,25 @@ func createTestDatabase() (storage.Storage, func()) {
 	return db, cleanup
 }
 
+func createTestUser(t *testing.T, db storage.Storage, username, password string) *storage.User {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	user := &storage.User{Username: username, PasswordHash: hash}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	return user
+}
+
 func TestAuthHandler_Login_NotImplemented(t *testing.T) {
 	cfg := createTestConfig(false)
 	db, cleanup := createTestDatabase()
 	defer cleanup()
 	
 	jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
-	handler := NewAuthHandler(cfg, db, jwtAuth)
+	handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
 	
 	req := models.LoginRequest{
 		Auth: models.AuthInfo{
@@ -70,9 +90,10 @@ func TestAuthHandler_Login_Success(t *testing.T) {
 	cfg := createTestConfig(true)
 	db, cleanup := createTestDatabase()
 	defer cleanup()
+	createTestUser(t, db, "admin", "password")
 	
 	jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
-	handler := NewAuthHandler(cfg, db, jwtAuth)
+	handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
 	
 	req := models.LoginRequest{
 		Auth: models.AuthInfo{
@@ -111,7 +132,7 @@ func TestAuthHandler_Login_InvalidCredentials(t *testing.T) {
 	defer cleanup()
 	
 	jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
-	handler := NewAuthHandler(cfg, db, jwtAuth)
+	handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
 	
 	req := models.LoginRequest{
 		Auth: models.AuthInfo{
@@ -138,7 +159,7 @@ func TestAuthHandler_Login_SignatureAuth(t *testing.T) {
 	defer cleanup()
 	
 	jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
-	handler := NewAuthHandler(cfg, db, jwtAuth)
+	handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
 	
 	// Generate valid signature
 	identifier := "test-device"
@@ -172,9 +193,10 @@ func TestAuthHandler_Refresh_Success(t *testing.T) {
 	// Use the same database instance for both login and refresh
 	db, cleanup := createTestDatabase()
 	defer cleanup()
+	createTestUser(t, db, "admin", "password")
 	
 	jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
-	handler := NewAuthHandler(cfg, db, jwtAuth)
+	handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
 	
 	// First login to get tokens
 	loginReq := models.LoginRequest{
@@ -207,7 +229,7 @@ func TestAuthHandler_Refresh_Success(t *testing.T) {
 	}
 	
 	// Test JWT refresh directly
-	newAccessTokenDirect, err := jwtAuth.RefreshAccessToken(loginResponse.RefreshToken)
+	newAccessTokenDirect, _, err := jwtAuth.RefreshAccessToken(loginResponse.RefreshToken)
 	if err != nil {
 		t.Fatalf("Direct JWT refresh failed: %v", err)
 	}
@@ -216,17 +238,45 @@ func TestAuthHandler_Refresh_Success(t *testing.T) {
 		t.Fatal("Direct JWT refresh returned empty token")
 	}
 	
-	// Skip the handler test for now as there may be an issue with database token tracking
-	t.Skip("Skipping handler refresh test - JWT functionality verified directly")
+	// Unset token lifetimes fall back to the defaults, so the stored refresh token is still valid
+	body, _ = json.Marshal(models.RefreshRequest{RefreshToken: loginResponse.RefreshToken})
+	httpReq = httptest.NewRequest("POST", "/v0/api/auth/refresh", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	
+	handler.Refresh(w, httpReq)
+	
+	if w.Code != http.StatusOK {
+		t.Fatalf("Refresh failed with status %d: %s", w.Code, w.Body.String())
+	}
+	
+	var refreshResponse models.RefreshResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &refreshResponse); err != nil {
+		t.Fatalf("Failed to parse refresh response: %v", err)
+	}
+	
+	// The stored expiry matches the expiry of the issued token
+	claims, err := jwtAuth.ValidateToken(refreshResponse.AccessToken)
+	if err != nil {
+		t.Fatalf("Refreshed access token is invalid: %v", err)
+	}
+	stored, err := db.GetAuthToken(jwtAuth.GetTokenHash(refreshResponse.AccessToken))
+	if err != nil || stored == nil {
+		t.Fatalf("Refreshed access token was not stored: %v", err)
+	}
+	if stored.ExpiresAt.Unix() != claims.ExpiresAt.Unix() {
+		t.Errorf("Expected stored expiry %v, got %v", claims.ExpiresAt.Time, stored.ExpiresAt)
+	}
 }
 
 func TestAuthHandler_Validate_Success(t *testing.T) {
 	cfg := createTestConfig(true)
 	db, cleanup := createTestDatabase()
 	defer cleanup()
+	createTestUser(t, db, "admin", "password")
 	
 	jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
-	handler := NewAuthHandler(cfg, db, jwtAuth)
+	handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
 	
 	// First login to get tokens
 	loginReq := models.LoginRequest{
@@ -267,9 +317,10 @@ func TestAuthHandler_Logout_Success(t *testing.T) {
 	cfg := createTestConfig(true)
 	db, cleanup := createTestDatabase()
 	defer cleanup()
+	createTestUser(t, db, "admin", "password")
 	
 	jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
-	handler := NewAuthHandler(cfg, db, jwtAuth)
+	handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
 	
 	// First login to get tokens
 	loginReq := models.LoginRequest{
@@ -314,4 +365,393 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 	os.Remove("test.db")
 	os.Exit(code)
-}
\ No newline at end of file
+}
+
+func postLogin(handler *AuthHandler, username, password string) *httptest.ResponseRecorder {
+	req := models.LoginRequest{
+		Auth: models.AuthInfo{
+			Username: username,
+			Password: password,
+		},
+	}
+	
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest("POST", "/v0/api/auth/login", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.Login(w, httpReq)
+	return w
+}
+
+func TestAuthHandler_Login_WrongPassword(t *testing.T) {
+	cfg := createTestConfig(true)
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	createTestUser(t, db, "alice", "correct-password")
+	
+	handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+	
+	if w := postLogin(handler, "alice", "wrong-password"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	
+	w := postLogin(handler, "alice", "correct-password")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	
+	// Tokens identify the user by ID, not by username
+	var response models.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	claims, err := handler.JWTAuth.ValidateToken(response.AccessToken)
+	if err != nil {
+		t.Fatalf("Failed to validate access token: %v", err)
+	}
+	user, _ := db.GetUserByUsername("alice")
+	if claims.UserID != user.ID {
+		t.Errorf("Expected user ID %s, got %s", user.ID, claims.UserID)
+	}
+}
+
+func TestAuthHandler_Login_DisabledAccount(t *testing.T) {
+	cfg := createTestConfig(true)
+	cfg.App.Authentication.TokenExpirationSec = 3600
+	cfg.App.Authentication.RefreshTokenExpirationDays = 30
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	user := createTestUser(t, db, "alice", "password")
+	
+	handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+	
+	w := postLogin(handler, "alice", "password")
+	var loginResponse models.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &loginResponse)
+	
+	user.Disabled = true
+	if err := db.UpdateUser(user); err != nil {
+		t.Fatalf("Failed to disable user: %v", err)
+	}
+	
+	w = postLogin(handler, "alice", "password")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	
+	var errorResponse models.ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &errorResponse)
+	if len(errorResponse.Errors) == 0 || errorResponse.Errors[0].ErrorType != "Forbidden" {
+		t.Errorf("Expected Forbidden error, got %+v", errorResponse.Errors)
+	}
+	
+	// Refresh tokens issued before the account was disabled stop working too
+	body, _ := json.Marshal(models.RefreshRequest{RefreshToken: loginResponse.RefreshToken})
+	httpReq := httptest.NewRequest("POST", "/v0/api/auth/refresh", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	handler.Refresh(w, httpReq)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected refresh status %d, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestAuthHandler_Login_FileStorage(t *testing.T) {
+	cfg := createTestConfig(true)
+	db, err := storage.NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create file storage: %v", err)
+	}
+	createTestUser(t, db, "alice", "password")
+	
+	if err := db.CreateUser(&storage.User{Username: "alice", PasswordHash: "x"}); err != storage.ErrUserExists {
+		t.Errorf("Expected ErrUserExists, got %v", err)
+	}
+	
+	handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+	if w := postLogin(handler, "alice", "password"); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func postRefresh(handler *AuthHandler, refreshToken string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(models.RefreshRequest{RefreshToken: refreshToken})
+	httpReq := httptest.NewRequest("POST", "/v0/api/auth/refresh", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.Refresh(w, httpReq)
+	return w
+}
+
+func TestAuthHandler_Refresh_RotationAndReuse(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			createTestUser(t, db, "alice", "password")
+			jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
+			handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
+			
+			var login models.LoginResponse
+			json.Unmarshal(postLogin(handler, "alice", "password").Body.Bytes(), &login)
+			
+			// Each refresh returns a new refresh token
+			w := postRefresh(handler, login.RefreshToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var first models.RefreshResponse
+			json.Unmarshal(w.Body.Bytes(), &first)
+			if first.RefreshToken == "" || first.RefreshToken == login.RefreshToken {
+				t.Fatalf("Expected a rotated refresh token, got %q", first.RefreshToken)
+			}
+			
+			w = postRefresh(handler, first.RefreshToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var second models.RefreshResponse
+			json.Unmarshal(w.Body.Bytes(), &second)
+			
+			// Presenting a rotated token again revokes the whole family
+			if w := postRefresh(handler, login.RefreshToken); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected reused token status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if w := postRefresh(handler, second.RefreshToken); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected latest token status %d after reuse, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if _, err := validateAccessToken(db, jwtAuth, second.AccessToken); err == nil {
+				t.Error("Expected access token of the revoked family to be rejected")
+			}
+			
+			// Other logins are not affected
+			var other models.LoginResponse
+			json.Unmarshal(postLogin(handler, "alice", "password").Body.Bytes(), &other)
+			if w := postRefresh(handler, other.RefreshToken); w.Code != http.StatusOK {
+				t.Errorf("Expected status %d for another login, got %d", http.StatusOK, w.Code)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_JWKS(t *testing.T) {
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	
+	cfg := createTestConfig(false)
+	handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+	w := httptest.NewRecorder()
+	handler.JWKS(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status %d, got %d", http.StatusNotImplemented, w.Code)
+	}
+	
+	// Tokens signed with the shared secret have no public keys
+	cfg = createTestConfig(true)
+	handler = NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+	w = httptest.NewRecorder()
+	handler.JWKS(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if w.Body.String() != "{\"keys\":[]}\n" {
+		t.Errorf("Expected an empty key set, got %s", w.Body.String())
+	}
+	
+	// Configured signing keys are published
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	keyPath := filepath.Join(t.TempDir(), "signing.pem")
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	cfg.App.Authentication.SigningKeys = []config.SigningKeyConfig{{ID: "launcher-1", PrivateKeyFile: keyPath}}
+	jwtAuth, err := auth.NewJWTAuthFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("Failed to load signing keys: %v", err)
+	}
+	handler = NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
+	w = httptest.NewRecorder()
+	handler.JWKS(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	
+	var jwks models.JWKS
+	if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("Failed to parse key set: %v", err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "launcher-1" || jwks.Keys[0].Alg != "EdDSA" {
+		t.Errorf("Unexpected key set %+v", jwks.Keys)
+	}
+	if w.Header().Get("Cache-Control") == "" {
+		t.Error("Expected a Cache-Control header")
+	}
+}
+
+func postSignedLogin(handler *AuthHandler, identifier, secret, nonce string) *httptest.ResponseRecorder {
+	timestamp := time.Now().Unix()
+	req := models.LoginRequest{
+		Auth: models.AuthInfo{
+			Identifier: identifier,
+			Timestamp:  timestamp,
+			Nonce:      nonce,
+			Signature:  auth.ClientSignature(secret, identifier, timestamp, nonce),
+		},
+	}
+	
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest("POST", "/v0/api/auth/login", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.Login(w, httpReq)
+	return w
+}
+
+func TestAuthHandler_Login_ClientSignature(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+			client := &storage.Client{ID: "test-device", Secret: "client-secret"}
+			if err := db.CreateClient(client); err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			if err := db.CreateClient(&storage.Client{ID: "test-device", Secret: "x"}); err != storage.ErrClientExists {
+				t.Errorf("Expected ErrClientExists, got %v", err)
+			}
+			
+			w := postSignedLogin(handler, "test-device", "client-secret", "nonce-0000000001")
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			
+			// The same signed request cannot be replayed within the window
+			if w := postSignedLogin(handler, "test-device", "client-secret", "nonce-0000000001"); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected replay status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if w := postSignedLogin(handler, "test-device", "client-secret", "nonce-0000000002"); w.Code != http.StatusOK {
+				t.Errorf("Expected status %d for a new nonce, got %d", http.StatusOK, w.Code)
+			}
+			
+			// Only registered identifiers with their own secret are accepted
+			if w := postSignedLogin(handler, "other-device", "client-secret", "nonce-0000000003"); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d for an unknown identifier, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if w := postSignedLogin(handler, "test-device", cfg.App.Authentication.JWTSecret, "nonce-0000000004"); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d for the JWT secret, got %d", http.StatusUnauthorized, w.Code)
+			}
+			
+			client.Disabled = true
+			if err := db.UpdateClient(client); err != nil {
+				t.Fatalf("Failed to disable client: %v", err)
+			}
+			if w := postSignedLogin(handler, "test-device", "client-secret", "nonce-0000000005"); w.Code != http.StatusForbidden {
+				t.Errorf("Expected status %d for a disabled client, got %d", http.StatusForbidden, w.Code)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_Roles(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			user := createTestUser(t, db, "alice", "password")
+			user.Roles = []string{auth.RoleTester}
+			if err := db.UpdateUser(user); err != nil {
+				t.Fatalf("Failed to update user: %v", err)
+			}
+			jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
+			handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
+			
+			var login models.LoginResponse
+			json.Unmarshal(postLogin(handler, "alice", "password").Body.Bytes(), &login)
+			claims, err := jwtAuth.ValidateToken(login.AccessToken)
+			if err != nil {
+				t.Fatalf("Failed to validate access token: %v", err)
+			}
+			if !claims.HasRole(auth.RoleTester) {
+				t.Errorf("Expected the tester role, got %v", claims.Roles)
+			}
+			
+			// Role changes apply from the next refresh
+			user.Roles = []string{auth.RolePublisher}
+			if err := db.UpdateUser(user); err != nil {
+				t.Fatalf("Failed to update user: %v", err)
+			}
+			w := postRefresh(handler, login.RefreshToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var refreshed models.RefreshResponse
+			json.Unmarshal(w.Body.Bytes(), &refreshed)
+			claims, err = jwtAuth.ValidateToken(refreshed.AccessToken)
+			if err != nil {
+				t.Fatalf("Failed to validate refreshed access token: %v", err)
+			}
+			if claims.HasRole(auth.RoleTester) || !claims.HasRole(auth.RolePublisher) {
+				t.Errorf("Expected only the publisher role, got %v", claims.Roles)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_Validate_Introspect(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			user := createTestUser(t, db, "alice", "password")
+			user.Roles = []string{auth.RoleTester}
+			if err := db.UpdateUser(user); err != nil {
+				t.Fatalf("Failed to update user: %v", err)
+			}
+			jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
+			handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
+			
+			var login models.LoginResponse
+			json.Unmarshal(postLogin(handler, "alice", "password").Body.Bytes(), &login)
+			introspect := func(token string) models.IntrospectionResponse {
+				t.Helper()
+				w := postJSON(handler.Validate, "/v0/api/auth/validate", models.ValidateRequest{AccessToken: token, Introspect: true}, "")
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+				}
+				var response models.IntrospectionResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+				if response.Meta.APIVersion == "" {
+					t.Errorf("Expected meta in the introspection response")
+				}
+				return response
+			}
+			
+			response := introspect(login.AccessToken)
+			stored, _ := db.GetAuthToken(jwtAuth.GetTokenHash(login.AccessToken))
+			if !response.Active || response.Sub != user.ID || response.TokenType != "access" {
+				t.Errorf("Unexpected introspection response: %+v", response)
+			}
+			if response.Exp <= response.Iat || len(response.Roles) != 1 || response.Roles[0] != auth.RoleTester {
+				t.Errorf("Unexpected expiry or roles: %+v", response)
+			}
+			if stored == nil || response.SessionID != stored.FamilyID {
+				t.Errorf("Expected session %v, got %q", stored, response.SessionID)
+			}
+			if response := introspect(login.RefreshToken); !response.Active || response.TokenType != "refresh" {
+				t.Errorf("Expected an active refresh token, got %+v", response)
+			}
+			
+			// Exchanged, revoked and malformed tokens are inactive
+			postRefresh(handler, login.RefreshToken)
+			if response := introspect(login.RefreshToken); response.Active || response.Sub != "" {
+				t.Errorf("Expected the rotated refresh token to be inactive, got %+v", response)
+			}
+			if err := db.RevokeAuthToken(jwtAuth.GetTokenHash(login.AccessToken)); err != nil {
+				t.Fatalf("Failed to revoke token: %v", err)
+			}
+			if response := introspect(login.AccessToken); response.Active {
+				t.Errorf("Expected the revoked token to be inactive, got %+v", response)
+			}
+			if response := introspect("garbage"); response.Active {
+				t.Errorf("Expected a malformed token to be inactive, got %+v", response)
+			}
+			
+			// Without introspect the endpoint answers as before
+			w := postJSON(handler.Validate, "/v0/api/auth/validate", models.ValidateRequest{AccessToken: login.AccessToken}, "")
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+		})
+	}
+}
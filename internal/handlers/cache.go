@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+)
+
+// responseCacheSize bounds the entries kept for a configuration generation.
+// Keys include the platform and versions that clients send, so without a
+// bound any client could grow the cache until the next reload.
+const responseCacheSize = 1024
+
+// ResponseCache keeps encoded launcher responses in memory. Entries belong to
+// a single configuration generation, so a config reload invalidates them.
+// Once the cache is full, the least recently used entry is evicted.
+type ResponseCache struct {
+	mu         sync.Mutex
+	generation uint64
+	size       int
+	entries    map[responseCacheKey]*list.Element
+	recent     *list.List // of *responseCacheEntry, most recently used first
+}
+
+// responseCacheKey holds the inputs a response is built from. Endpoints
+// leave out the fields their response does not depend on.
+type responseCacheKey struct {
+	endpoint        string
+	platform        string
+	coreVersion     string
+	resourceVersion string
+	language        string
+}
+
+type responseCacheEntry struct {
+	key      responseCacheKey
+	response *CachedResponse
+}
+
+// CachedResponse is an encoded response section without its meta block.
+// A nil Body means the endpoint answers with 204 No Content.
+type CachedResponse struct {
+	Field string
+	Body  json.RawMessage
+	ETag  string
+}
+
+func NewResponseCache() *ResponseCache {
+	return &ResponseCache{
+		size:    responseCacheSize,
+		entries: make(map[responseCacheKey]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// Get returns the cached response for key, calling build to create it on a miss.
+// build returns the payload for Field, or nil for no content.
+func (c *ResponseCache) Get(generation uint64, key responseCacheKey, field string, build func() interface{}) (*CachedResponse, error) {
+	c.mu.Lock()
+	if c.generation == generation {
+		if element, ok := c.entries[key]; ok {
+			c.recent.MoveToFront(element)
+			c.mu.Unlock()
+			return element.Value.(*responseCacheEntry).response, nil
+		}
+	}
+	c.mu.Unlock()
+
+	cached, err := encodeCachedResponse(field, build())
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation > c.generation {
+		// Configuration was reloaded, drop everything built from the old one
+		c.generation = generation
+		c.entries = make(map[responseCacheKey]*list.Element)
+		c.recent.Init()
+	}
+	if generation != c.generation {
+		return cached, nil
+	}
+	if element, ok := c.entries[key]; ok {
+		// Built concurrently by another request
+		c.recent.MoveToFront(element)
+		return element.Value.(*responseCacheEntry).response, nil
+	}
+	c.entries[key] = c.recent.PushFront(&responseCacheEntry{key: key, response: cached})
+	if c.recent.Len() > c.size {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+	return cached, nil
+}
+
+func encodeCachedResponse(field string, payload interface{}) (*CachedResponse, error) {
+	cached := &CachedResponse{Field: field}
+	if payload == nil {
+		return cached, nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", field, err)
+	}
+	hash := sha256.Sum256(append([]byte(field+":"), body...))
+	cached.Body = body
+	cached.ETag = `"` + hex.EncodeToString(hash[:16]) + `"`
+	return cached, nil
+}
+
+// writeCachedResponse writes a cached section with a fresh meta block. Requests
+// whose If-None-Match header carries the current ETag get 304 Not Modified.
+func writeCachedResponse(rw *middleware.ResponseWriter, r *http.Request, cached *CachedResponse, meta models.Meta) {
+	if cached.Body == nil {
+		rw.WriteNoContent()
+		return
+	}
+
+	rw.Header().Set("ETag", cached.ETag)
+	if etagMatches(r.Header.Get("If-None-Match"), cached.ETag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rw.WriteJSON(http.StatusOK, map[string]interface{}{
+		cached.Field: cached.Body,
+		"meta":       meta,
+	})
+}
+
+// combineETags derives a single ETag from the ETags of several sections
+func combineETags(etags []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(etags, ",")))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+const maxDeviceNameLength = 64
+
+// Challenge handles POST /v0/api/auth/challenge, issuing a single-use value
+// that a device signs to register or log in
+func (h *AuthHandler) Challenge(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+
+	var req models.ChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	challenge := &storage.AuthChallenge{
+		Value:     auth.NewDeviceChallenge(),
+		ExpiresAt: time.Now().Add(auth.DeviceChallengeTTL),
+	}
+	if err := h.DB.StoreChallenge(challenge); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to store challenge", language)
+		return
+	}
+
+	response := models.ChallengeResponse{
+		Challenge: models.ChallengeInfo{
+			Value:     challenge.Value,
+			ExpiresAt: challenge.ExpiresAt.Unix(),
+		},
+		Meta: models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+
+	rw.WriteJSON(http.StatusOK, response)
+}
+
+// RegisterDevice handles POST /v0/api/auth/registerDevice. With a Bearer
+// token the device is bound to that user, otherwise it is an anonymous
+// device whose ID is the user ID of its tokens.
+func (h *AuthHandler) RegisterDevice(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+
+	var req models.RegisterDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	userID := ""
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
+			return
+		}
+		claims, err := validateAccessToken(h.DB, h.JWTAuth, strings.TrimPrefix(authHeader, "Bearer "))
+		if err != nil {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
+			return
+		}
+		userID = claims.UserID
+	} else if !cfg.App.Authentication.AllowAnonymousDevices {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Authorization header required", language)
+		return
+	}
+
+	if len(req.Device.Name) > maxDeviceNameLength {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Device name must be at most 64 characters", language)
+		return
+	}
+	publicKey, err := auth.ParseDevicePublicKey(req.Device.PublicKey)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Public key must be a base64 Ed25519 key", language)
+		return
+	}
+
+	// Registering proves possession of the private key
+	if err := h.verifyChallenge(publicKey, req.Device.Challenge, req.Device.Signature); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid challenge or signature", language)
+		return
+	}
+
+	device := &storage.Device{
+		UserID:    userID,
+		PublicKey: auth.EncodeDevicePublicKey(publicKey),
+		Name:      req.Device.Name,
+	}
+	if err := h.DB.CreateDevice(device); err != nil {
+		if err == storage.ErrDeviceExists {
+			rw.WriteErrorWithLanguage(http.StatusConflict, "Conflict", "Device is already registered", language)
+			return
+		}
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to register device", language)
+		return
+	}
+
+	response := models.RegisterDeviceResponse{
+		Device: models.DeviceInfo{
+			ID:        device.ID,
+			Name:      device.Name,
+			Anonymous: device.UserID == "",
+		},
+		Meta: models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+
+	rw.WriteJSON(http.StatusCreated, response)
+}
+
+// RevokeDevice handles POST /v0/api/auth/revokeDevice. A device can be
+// revoked by the user it is bound to or by the device itself, and every
+// token issued to it is revoked with it.
+func (h *AuthHandler) RevokeDevice(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+
+	var req models.RevokeDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Authorization header required", language)
+		return
+	}
+	claims, err := validateAccessToken(h.DB, h.JWTAuth, strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
+		return
+	}
+
+	device, err := h.DB.GetDevice(req.RevokeDevice.DeviceID)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to load device", language)
+		return
+	}
+	// Devices of other users are reported as missing
+	if device == nil || (device.ID != claims.UserID && device.UserID != claims.UserID) {
+		rw.WriteErrorWithLanguage(http.StatusNotFound, "NotFound", "Device not found", language)
+		return
+	}
+
+	device.Revoked = true
+	if err := h.DB.UpdateDevice(device); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to revoke device", language)
+		return
+	}
+	// Device logins use the device ID as their token family
+	if err := h.DB.RevokeTokenFamily(device.ID); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to revoke device tokens", language)
+		return
+	}
+
+	rw.WriteNoContent()
+}
+
+// authenticateDevice checks a device login: a signature of an issued
+// challenge by the registered key of a device that is not revoked
+func (h *AuthHandler) authenticateDevice(info models.AuthInfo) (*storage.Device, *storage.User, error) {
+	device, err := h.DB.GetDevice(info.DeviceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if device == nil || device.Revoked {
+		return nil, nil, errInvalidCredentials
+	}
+
+	publicKey, err := auth.ParseDevicePublicKey(device.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := h.verifyChallenge(publicKey, info.Challenge, info.Signature); err != nil {
+		return nil, nil, errInvalidCredentials
+	}
+
+	var user *storage.User
+	if device.UserID != "" {
+		user, err = h.DB.GetUser(device.UserID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if user == nil {
+			return nil, nil, errInvalidCredentials
+		}
+		if user.Disabled {
+			return nil, nil, errAccountDisabled
+		}
+	}
+
+	device.LastUsedAt = time.Now().UTC()
+	if err := h.DB.UpdateDevice(device); err != nil {
+		return nil, nil, err
+	}
+	return device, user, nil
+}
+
+// verifyChallenge consumes an issued challenge and checks its signature. The
+// challenge is consumed even if the signature is wrong, so it cannot be
+// retried.
+func (h *AuthHandler) verifyChallenge(publicKey ed25519.PublicKey, value, signature string) error {
+	challenge, err := h.DB.ConsumeChallenge(value)
+	if err != nil {
+		return err
+	}
+	if challenge == nil || challenge.UserID != "" {
+		return errInvalidCredentials // unknown, already used or a two-factor challenge
+	}
+	if time.Now().After(challenge.ExpiresAt) {
+		return errInvalidCredentials
+	}
+	return auth.VerifyDeviceSignature(publicKey, challenge.Value, signature)
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/notify"
+	"github.com/moehoshio/NekoLcServer/internal/testutil"
+)
+
+// testDevice is a launcher installation holding an Ed25519 key
+type testDevice struct {
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+	id         string
+}
+
+func newTestDevice(t *testing.T) *testDevice {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return &testDevice{publicKey: publicKey, privateKey: privateKey}
+}
+
+func getChallenge(t *testing.T, handler *AuthHandler) string {
+	t.Helper()
+	w := postJSON(handler.Challenge, "/v0/api/auth/challenge", models.ChallengeRequest{}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected challenge status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response models.ChallengeResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response.Challenge.Value
+}
+
+func (d *testDevice) sign(challenge string) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(d.privateKey, []byte(challenge)))
+}
+
+func (d *testDevice) register(t *testing.T, handler *AuthHandler, accessToken string) *httptest.ResponseRecorder {
+	t.Helper()
+	challenge := getChallenge(t, handler)
+	req := models.RegisterDeviceRequest{Device: models.RegisterDeviceInfo{
+		PublicKey: base64.StdEncoding.EncodeToString(d.publicKey),
+		Challenge: challenge,
+		Signature: d.sign(challenge),
+		Name:      "test launcher",
+	}}
+	w := postJSON(handler.RegisterDevice, "/v0/api/auth/registerDevice", req, accessToken)
+	if w.Code == http.StatusCreated {
+		var response models.RegisterDeviceResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		d.id = response.Device.ID
+	}
+	return w
+}
+
+func (d *testDevice) login(t *testing.T, handler *AuthHandler) *httptest.ResponseRecorder {
+	t.Helper()
+	challenge := getChallenge(t, handler)
+	req := models.LoginRequest{Auth: models.AuthInfo{DeviceID: d.id, Challenge: challenge, Signature: d.sign(challenge)}}
+	return postJSON(handler.Login, "/v0/api/auth/login", req, "")
+}
+
+func TestAuthHandler_DeviceAuth(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+			createTestUser(t, db, "alice", "password")
+			var loginResponse models.LoginResponse
+			json.Unmarshal(postLogin(handler, "alice", "password").Body.Bytes(), &loginResponse)
+
+			// Registration is bound to the logged in user
+			device := newTestDevice(t)
+			if w := device.register(t, handler, loginResponse.AccessToken); w.Code != http.StatusCreated {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+			}
+			if w := device.register(t, handler, loginResponse.AccessToken); w.Code != http.StatusConflict {
+				t.Errorf("Expected status %d for a registered key, got %d", http.StatusConflict, w.Code)
+			}
+
+			w := device.login(t, handler)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected login status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var deviceLogin models.LoginResponse
+			json.Unmarshal(w.Body.Bytes(), &deviceLogin)
+			claims, err := handler.JWTAuth.ValidateToken(deviceLogin.AccessToken)
+			if err != nil || claims.UserID == "" {
+				t.Fatalf("Expected a valid token: %v", err)
+			}
+			if user, _ := db.GetUserByUsername("alice"); user == nil || claims.UserID != user.ID {
+				t.Errorf("Expected token for alice, got user %s", claims.UserID)
+			}
+
+			// Challenges are single use and must be signed by the device key
+			challenge := getChallenge(t, handler)
+			login := models.LoginRequest{Auth: models.AuthInfo{DeviceID: device.id, Challenge: challenge, Signature: device.sign(challenge)}}
+			postJSON(handler.Login, "/v0/api/auth/login", login, "")
+			if w := postJSON(handler.Login, "/v0/api/auth/login", login, ""); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d for a reused challenge, got %d", http.StatusUnauthorized, w.Code)
+			}
+			other := newTestDevice(t)
+			other.id = device.id
+			if w := other.login(t, handler); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d for another key, got %d", http.StatusUnauthorized, w.Code)
+			}
+
+			// Revoking the device revokes its tokens and its logins
+			revoke := models.RevokeDeviceRequest{RevokeDevice: models.RevokeDeviceInfo{DeviceID: device.id}}
+			if w := postJSON(handler.RevokeDevice, "/v0/api/auth/revokeDevice", revoke, loginResponse.AccessToken); w.Code != http.StatusNoContent {
+				t.Fatalf("Expected revoke status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+			}
+			if w := postRefresh(handler, deviceLogin.RefreshToken); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected refresh status %d after revocation, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if w := device.login(t, handler); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected login status %d after revocation, got %d", http.StatusUnauthorized, w.Code)
+			}
+
+			// The password login of the user is not affected
+			if _, err := validateAccessToken(db, handler.JWTAuth, loginResponse.AccessToken); err != nil {
+				t.Errorf("Expected the password login to stay valid: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_DeviceAuth_Anonymous(t *testing.T) {
+	cfg := createTestConfig(true)
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+
+	device := newTestDevice(t)
+	if w := device.register(t, handler, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without allowAnonymousDevices, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	cfg.App.Authentication.AllowAnonymousDevices = true
+	w := device.register(t, handler, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var registerResponse models.RegisterDeviceResponse
+	json.Unmarshal(w.Body.Bytes(), &registerResponse)
+	if !registerResponse.Device.Anonymous {
+		t.Error("Expected an anonymous device")
+	}
+
+	// An anonymous device is its own user and can revoke itself
+	w = device.login(t, handler)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected login status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var loginResponse models.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &loginResponse)
+	claims, _ := handler.JWTAuth.ValidateToken(loginResponse.AccessToken)
+	if claims == nil || claims.UserID != device.id {
+		t.Fatalf("Expected token for the device ID %s", device.id)
+	}
+
+	other := newTestDevice(t)
+	other.register(t, handler, "")
+	var otherLogin models.LoginResponse
+	json.Unmarshal(other.login(t, handler).Body.Bytes(), &otherLogin)
+	revoke := models.RevokeDeviceRequest{RevokeDevice: models.RevokeDeviceInfo{DeviceID: device.id}}
+	if w := postJSON(handler.RevokeDevice, "/v0/api/auth/revokeDevice", revoke, otherLogin.AccessToken); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for another device, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := postJSON(handler.RevokeDevice, "/v0/api/auth/revokeDevice", revoke, loginResponse.AccessToken); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if _, err := validateAccessToken(db, handler.JWTAuth, loginResponse.AccessToken); err == nil {
+		t.Error("Expected the device token to be revoked")
+	}
+}
+
+func TestAuthHandler_RegisterDevice_Invalid(t *testing.T) {
+	cfg := createTestConfig(true)
+	cfg.App.Authentication.AllowAnonymousDevices = true
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+	device := newTestDevice(t)
+
+	challenge := getChallenge(t, handler)
+	tests := map[string]struct {
+		info   models.RegisterDeviceInfo
+		status int
+	}{
+		"invalid key":       {models.RegisterDeviceInfo{PublicKey: "abc", Challenge: challenge, Signature: device.sign(challenge)}, http.StatusBadRequest},
+		"unknown challenge": {models.RegisterDeviceInfo{PublicKey: base64.StdEncoding.EncodeToString(device.publicKey), Challenge: "unknown", Signature: device.sign("unknown")}, http.StatusUnauthorized},
+		"wrong signature":   {models.RegisterDeviceInfo{PublicKey: base64.StdEncoding.EncodeToString(device.publicKey), Challenge: challenge, Signature: device.sign("other")}, http.StatusUnauthorized},
+	}
+	for name, test := range tests {
+		w := postJSON(handler.RegisterDevice, "/v0/api/auth/registerDevice", models.RegisterDeviceRequest{Device: test.info}, "")
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", name, test.status, w.Code)
+		}
+	}
+	if w := postJSON(handler.RegisterDevice, "/v0/api/auth/registerDevice", models.RegisterDeviceRequest{}, "invalid-token"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an invalid token, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
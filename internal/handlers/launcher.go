@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/moehoshio/NekoLcServer/internal/config"
 	"github.com/moehoshio/NekoLcServer/internal/middleware"
@@ -14,20 +15,23 @@ import (
 type LauncherHandler struct {
 	Config *config.Config
 	DB     storage.Storage
+	Cache  *ResponseCache
 }
 
 func NewLauncherHandler(cfg *config.Config, db storage.Storage) *LauncherHandler {
 	return &LauncherHandler{
 		Config: cfg,
 		DB:     db,
+		Cache:  NewResponseCache(),
 	}
 }
 
 // LauncherConfig handles POST /v0/api/launcherConfig
 func (h *LauncherHandler) LauncherConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
 	var req models.LauncherConfigRequest
@@ -42,40 +46,58 @@ func (h *LauncherHandler) LauncherConfig(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	
-	// Build launcher configuration from config files
-	launcherConfig := models.LauncherConfig{
-		Host:             h.Config.Launcher.Host,
-		RetryIntervalSec: h.Config.Launcher.RetryIntervalSec,
-		MaxRetryCount:    h.Config.Launcher.MaxRetryCount,
+	cached, err := h.cachedLauncherConfig(cfg)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, "InternalError", "Failed to build launcher configuration")
+		return
+	}
+	
+	writeCachedResponse(rw, r, cached, models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate))
+}
+
+// cachedLauncherConfig returns the launcher configuration, which is the same
+// for every client
+func (h *LauncherHandler) cachedLauncherConfig(cfg *config.Config) (*CachedResponse, error) {
+	key := responseCacheKey{endpoint: "launcherConfig"}
+	return h.Cache.Get(cfg.Generation(), key, "launcherConfig", func() interface{} {
+		return buildLauncherConfig(cfg)
+	})
+}
+
+// buildLauncherConfig builds the launcher configuration from config files.
+// Token lifetimes are advertised from the authentication settings that
+// are used to issue the tokens.
+func buildLauncherConfig(cfg *config.Config) *models.LauncherConfig {
+	accessTTL, refreshTTL := cfg.App.TokenLifetimes()
+	return &models.LauncherConfig{
+		Host:             cfg.Launcher.Host,
+		RetryIntervalSec: cfg.Launcher.RetryIntervalSec,
+		MaxRetryCount:    cfg.Launcher.MaxRetryCount,
 		WebSocket: models.WebSocket{
-			Enable:                h.Config.Launcher.WebSocket.Enable,
-			SocketHost:           h.Config.Launcher.WebSocket.SocketHost,
-			HeartbeatIntervalSec: h.Config.Launcher.WebSocket.HeartbeatIntervalSec,
+			Enable:                cfg.Launcher.WebSocket.Enable,
+			Transport:            cfg.Launcher.WebSocket.Transport,
+			SocketHost:           cfg.Launcher.WebSocket.SocketHost,
+			SseUrl:               cfg.Launcher.WebSocket.SseUrl,
+			HeartbeatIntervalSec: cfg.Launcher.WebSocket.HeartbeatIntervalSec,
 		},
 		Security: models.Security{
-			EnableAuthentication:        h.Config.Launcher.Security.EnableAuthentication,
-			TokenExpirationSec:         h.Config.Launcher.Security.TokenExpirationSec,
-			RefreshTokenExpirationDays: h.Config.Launcher.Security.RefreshTokenExpirationDays,
-			LoginUrl:                   h.Config.Launcher.Security.LoginUrl,
-			LogoutUrl:                  h.Config.Launcher.Security.LogoutUrl,
-			RefreshUrl:                 h.Config.Launcher.Security.RefreshUrl,
+			EnableAuthentication:        cfg.Launcher.Security.EnableAuthentication,
+			TokenExpirationSec:         int(accessTTL / time.Second),
+			RefreshTokenExpirationDays: int(refreshTTL / (24 * time.Hour)),
+			LoginUrl:                   cfg.Launcher.Security.LoginUrl,
+			LogoutUrl:                  cfg.Launcher.Security.LogoutUrl,
+			RefreshUrl:                 cfg.Launcher.Security.RefreshUrl,
 		},
-		FeaturesFlags: h.Config.Launcher.FeaturesFlags,
+		FeaturesFlags: cfg.Launcher.FeaturesFlags,
 	}
-	
-	response := models.LauncherConfigResponse{
-		LauncherConfig: launcherConfig,
-		Meta:           models.NewMeta(h.Config.App.Server.APIVersion, h.Config.App.Server.MinAPIVersion, h.Config.App.Server.BuildVersion, h.Config.App.Server.ReleaseDate),
-	}
-	
-	rw.WriteJSON(http.StatusOK, response)
 }
 
 // Maintenance handles POST /v0/api/maintenance
 func (h *LauncherHandler) Maintenance(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
 	var req models.MaintenanceRequest
@@ -85,72 +107,66 @@ func (h *LauncherHandler) Maintenance(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Get preferred language for localized messages
-	language := "en"
-	if req.Preferences.Language != "" {
-		language = req.Preferences.Language
-	}
-	
-	// Check for platform-specific maintenance first if OS and Arch are provided
-	var maintenanceActive bool
-	var maintenanceInfo config.MaintenanceInfoConfig
-	
-	// Try to get OS and Arch from the request (you might need to add these fields to MaintenanceRequest)
-	// For now, let's use a platform key if available in the config
-	// platformKey := fmt.Sprintf("%s-%s", os, arch) // Would need OS/Arch in request
-	
-	// Check platform-specific maintenance if available
-	platformSpecificChecked := false
-	for _, platformMaintenance := range h.Config.Maintenance.PlatformSpecific {
-		// For demonstration, we'll check all platform-specific configs
-		// In practice, you'd want to match against the client's OS/Arch
-		if platformMaintenance.MaintenanceActive {
-			maintenanceActive = true
-			maintenanceInfo = platformMaintenance.MaintenanceInfo
-			platformSpecificChecked = true
-			break
-		}
-	}
+	language := cfg.Language(req.Preferences.Language)
 	
-	// Fall back to global maintenance if no platform-specific maintenance
-	if !platformSpecificChecked {
-		maintenanceActive = h.Config.Maintenance.MaintenanceActive
-		maintenanceInfo = h.Config.Maintenance.MaintenanceInfo
+	info := req.CheckMaintenance
+	cached, err := h.cachedMaintenance(cfg, info.OS, info.Arch, language)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to build maintenance information", language)
+		return
 	}
 	
-	// Return 204 No Content if not in maintenance
+	// Returns 204 No Content if not in maintenance
+	writeCachedResponse(rw, r, cached, models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate))
+}
+
+func (h *LauncherHandler) cachedMaintenance(cfg *config.Config, os, arch, language string) (*CachedResponse, error) {
+	language = cfg.Language(language)
+	key := responseCacheKey{
+		endpoint: "maintenance",
+		platform: fmt.Sprintf("%s-%s", os, arch),
+		language: language,
+	}
+	return h.Cache.Get(cfg.Generation(), key, "maintenanceInformation", func() interface{} {
+		if maintenance := buildMaintenance(cfg, os, arch, language); maintenance != nil {
+			return maintenance
+		}
+		return nil
+	})
+}
+
+// buildMaintenance returns the maintenance information for a platform, or nil
+// if the platform is not in maintenance
+func buildMaintenance(cfg *config.Config, os, arch, language string) *models.MaintenanceInformation {
+	// Platform-specific maintenance takes precedence over global maintenance
+	maintenanceActive, maintenanceInfo := cfg.Maintenance.ForPlatform(os, arch)
 	if !maintenanceActive {
-		rw.WriteNoContent()
-		return
+		return nil
 	}
 	
 	// Get localized maintenance message
-	localizedMessage := h.Config.GetLocalizedString(language, "maintenance", maintenanceInfo.Status)
+	localizedMessage := cfg.GetLocalizedString(language, "maintenance", maintenanceInfo.Status)
 	if localizedMessage == maintenanceInfo.Status {
 		// Fallback to config message if no localization found
 		localizedMessage = maintenanceInfo.Message
 	}
 	
-	// Return maintenance information from config
-	response := models.MaintenanceResponse{
-		MaintenanceInformation: models.MaintenanceInformation{
-			Status:    maintenanceInfo.Status,
-			Message:   localizedMessage,
-			StartTime: maintenanceInfo.StartTime,
-			ExEndTime: maintenanceInfo.ExEndTime,
-			PosterUrl: maintenanceInfo.PosterUrl,
-			Link:      maintenanceInfo.Link,
-		},
-		Meta: models.NewMeta(h.Config.App.Server.APIVersion, h.Config.App.Server.MinAPIVersion, h.Config.App.Server.BuildVersion, h.Config.App.Server.ReleaseDate),
+	return &models.MaintenanceInformation{
+		Status:    maintenanceInfo.Status,
+		Message:   localizedMessage,
+		StartTime: maintenanceInfo.StartTime,
+		ExEndTime: maintenanceInfo.ExEndTime,
+		PosterUrl: maintenanceInfo.PosterUrl,
+		Link:      maintenanceInfo.Link,
 	}
-	
-	rw.WriteJSON(http.StatusOK, response)
 }
 
 // CheckUpdates handles POST /v0/api/checkUpdates
 func (h *LauncherHandler) CheckUpdates(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
 	var req models.CheckUpdateRequest
@@ -167,45 +183,53 @@ func (h *LauncherHandler) CheckUpdates(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Get preferred language for localized messages
-	language := "en"
-	if req.Preferences.Language != "" {
-		language = req.Preferences.Language
-	}
+	language := cfg.Language(req.Preferences.Language)
 	
-	// Check if either core version or resource version is outdated
-	coreOutdated := req.CheckUpdate.CoreVersion != h.Config.Updates.LatestCoreVersion
-	resourceOutdated := req.CheckUpdate.ResourceVersion != h.Config.Updates.LatestResourceVersion
-	
-	if !coreOutdated && !resourceOutdated {
-		// Return 204 No Content if no updates needed
-		rw.WriteNoContent()
+	cached, err := h.cachedUpdate(cfg, req.CheckUpdate, language)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to build update information", language)
 		return
 	}
 	
+	// Returns 204 No Content if no updates needed
+	writeCachedResponse(rw, r, cached, models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate))
+}
+
+func (h *LauncherHandler) cachedUpdate(cfg *config.Config, info models.CheckUpdateInfo, language string) (*CachedResponse, error) {
+	language = cfg.Language(language)
+	key := responseCacheKey{
+		endpoint:        "checkUpdates",
+		platform:        fmt.Sprintf("%s-%s", info.OS, info.Arch),
+		coreVersion:     info.CoreVersion,
+		resourceVersion: info.ResourceVersion,
+		language:        language,
+	}
+	return h.Cache.Get(cfg.Generation(), key, "updateInformation", func() interface{} {
+		if update := buildUpdate(cfg, info, language); update != nil {
+			return update
+		}
+		return nil
+	})
+}
+
+// buildUpdate returns the update information for a client, or nil if the
+// client is up to date or no update is available for its platform
+func buildUpdate(cfg *config.Config, info models.CheckUpdateInfo, language string) *models.UpdateInformation {
+	path := cfg.Updates.FindUpdate(info.OS, info.Arch, info.CoreVersion, info.ResourceVersion)
+	if path == nil {
+		return nil
+	}
+	
 	// Create platform key for OS-arch specific lookup
-	platformKey := fmt.Sprintf("%s-%s", req.CheckUpdate.OS, req.CheckUpdate.Arch)
+	platformKey := fmt.Sprintf("%s-%s", info.OS, info.Arch)
 	
-	// Look for incremental update path
 	var updateFiles []models.FileInfo
-	var incrementalUpdate *config.UpdateFileInfo
-	
-	// Check for incremental update for the core version
-	if coreOutdated {
-		for _, file := range h.Config.Updates.Files {
-			if file.OS == req.CheckUpdate.OS && 
-			   file.Arch == req.CheckUpdate.Arch && 
-			   file.CoreVersion == req.CheckUpdate.CoreVersion {
-				incrementalUpdate = &file
-				break
-			}
-		}
-	}
 	
 	// If incremental update available, use it
-	if incrementalUpdate != nil {
+	if path.Incremental != nil {
 		updateFiles = []models.FileInfo{
 			{
-				URL:      fmt.Sprintf("https://example.com/updates/%s", incrementalUpdate.CoreVersionPath),
+				URL:      fmt.Sprintf("https://example.com/updates/%s", path.Incremental.CoreVersionPath),
 				FileName: "update.json",
 				Checksum: "incremental-update-checksum",
 				DownloadMeta: models.DownloadMeta{
@@ -217,44 +241,111 @@ func (h *LauncherHandler) CheckUpdates(w http.ResponseWriter, r *http.Request) {
 			},
 		}
 	} else {
-		// No incremental update available, check for full package
-		if fullPackage, exists := h.Config.Updates.FullPackages[platformKey]; exists {
-			updateFiles = []models.FileInfo{
-				{
-					URL:      fullPackage.DownloadUrl,
-					FileName: fmt.Sprintf("%s-full-update.zip", platformKey),
-					Checksum: fullPackage.Checksum,
-					DownloadMeta: models.DownloadMeta{
-						HashAlgorithm:      "sha256",
-						SuggestMultiThread: true,
-						IsCoreFile:         true,
-						IsAbsoluteUrl:      true,
-					},
+		// No incremental update available, use the full package
+		updateFiles = []models.FileInfo{
+			{
+				URL:      path.FullPackage.DownloadUrl,
+				FileName: fmt.Sprintf("%s-full-update.zip", platformKey),
+				Checksum: path.FullPackage.Checksum,
+				DownloadMeta: models.DownloadMeta{
+					HashAlgorithm:      "sha256",
+					SuggestMultiThread: true,
+					IsCoreFile:         true,
+					IsAbsoluteUrl:      true,
 				},
-			}
-		} else {
-			// No update available for this platform
-			rw.WriteNoContent()
-			return
+			},
 		}
 	}
 	
 	// Get localized update messages
-	localizedTitle := h.Config.GetLocalizedString(language, "updates", "available")
-	localizedDescription := h.Config.GetLocalizedString(language, "updates", "description")
-	
-	// Return update information
-	response := models.UpdateResponse{
-		UpdateInformation: models.UpdateInformation{
-			Title:           localizedTitle,
-			Description:     localizedDescription,
-			PosterUrl:       "https://example.com/update-poster.jpg",
-			PublishTime:     "2024-06-01T12:00:00Z",
-			ResourceVersion: h.Config.Updates.LatestResourceVersion,
-			IsMandatory:     false,
-			Files:          updateFiles,
-		},
-		Meta: models.NewMeta(h.Config.App.Server.APIVersion, h.Config.App.Server.MinAPIVersion, h.Config.App.Server.BuildVersion, h.Config.App.Server.ReleaseDate),
+	localizedTitle := cfg.GetLocalizedString(language, "updates", "available")
+	localizedDescription := cfg.GetLocalizedString(language, "updates", "description")
+	
+	return &models.UpdateInformation{
+		Title:           localizedTitle,
+		Description:     localizedDescription,
+		PosterUrl:       "https://example.com/update-poster.jpg",
+		PublishTime:     "2024-06-01T12:00:00Z",
+		ResourceVersion: cfg.Updates.LatestResourceVersion,
+		IsMandatory:     false,
+		Files:          updateFiles,
+	}
+}
+
+// Bootstrap handles POST /v0/api/bootstrap
+// It combines launcherConfig, maintenance and checkUpdates into one round trip.
+// Sections that would have been answered with 204 No Content are omitted.
+func (h *LauncherHandler) Bootstrap(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+	
+	var req models.BootstrapRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+	
+	// Get preferred language for localized messages
+	language := cfg.Language(req.Preferences.Language)
+	
+	// Validate required fields
+	info := req.Bootstrap
+	if info.OS == "" || info.Arch == "" {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "OS and architecture are required", language)
+		return
+	}
+	
+	sections := make([]*CachedResponse, 0, 3)
+	
+	launcherConfig, err := h.cachedLauncherConfig(cfg)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to build launcher configuration", language)
+		return
+	}
+	sections = append(sections, launcherConfig)
+	
+	maintenance, err := h.cachedMaintenance(cfg, info.OS, info.Arch, language)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to build maintenance information", language)
+		return
+	}
+	sections = append(sections, maintenance)
+	
+	// Updates can only be checked when the client reports both versions
+	if info.CoreVersion != "" && info.ResourceVersion != "" {
+		update, err := h.cachedUpdate(cfg, models.CheckUpdateInfo{
+			OS:              info.OS,
+			Arch:            info.Arch,
+			CoreVersion:     info.CoreVersion,
+			ResourceVersion: info.ResourceVersion,
+		}, language)
+		if err != nil {
+			rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to build update information", language)
+			return
+		}
+		sections = append(sections, update)
+	}
+	
+	response := map[string]interface{}{
+		"meta": models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+	etags := make([]string, 0, len(sections))
+	for _, section := range sections {
+		if section.Body == nil {
+			continue
+		}
+		response[section.Field] = section.Body
+		etags = append(etags, section.ETag)
+	}
+	
+	etag := combineETags(etags)
+	rw.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
 	}
 	
 	rw.WriteJSON(http.StatusOK, response)
@@ -262,9 +353,10 @@ func (h *LauncherHandler) CheckUpdates(w http.ResponseWriter, r *http.Request) {
 
 // FeedbackLog handles POST /v0/api/feedbackLog
 func (h *LauncherHandler) FeedbackLog(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
 	var req models.FeedbackLogRequest
@@ -291,6 +383,11 @@ func (h *LauncherHandler) FeedbackLog(w http.ResponseWriter, r *http.Request) {
 		Content:         req.FeedbackLog.Content,
 	}
 	
+	// Attribute the feedback to the user who sent it, if logged in
+	if claims, ok := middleware.ClaimsFromContext(r.Context()); ok {
+		feedbackLog.UserID = claims.UserID
+	}
+	
 	if err := h.DB.StoreFeedbackLog(feedbackLog); err != nil {
 		rw.WriteError(http.StatusInternalServerError, "InternalError", "Failed to store feedback log")
 		return
@@ -3,12 +3,18 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/moehoshio/NekoLcServer/internal/auth"
 	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
 	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
 )
 
 func createTestLauncherConfig() *config.Config {
@@ -25,8 +31,6 @@ func createTestLauncherConfig() *config.Config {
 			},
 			Security: config.SecurityConfig{
 				EnableAuthentication:        false,
-				TokenExpirationSec:         3600,
-				RefreshTokenExpirationDays: 30,
 				LoginUrl:                   "/v0/api/auth/login",
 				LogoutUrl:                  "/v0/api/auth/logout",
 				RefreshUrl:                 "/v0/api/auth/refresh",
@@ -128,6 +132,48 @@ func TestLauncherHandler_LauncherConfig_Success(t *testing.T) {
 	}
 }
 
+func TestLauncherHandler_LauncherConfig_TokenLifetimes(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.App.Authentication.TokenExpirationSec = 900
+	cfg.App.Authentication.RefreshTokenExpirationDays = 14
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	
+	handler := NewLauncherHandler(cfg, db)
+	
+	req := models.LauncherConfigRequest{
+		LauncherConfigRequest: models.LauncherConfigRequestInfo{
+			OS:   "windows",
+			Arch: "x64",
+		},
+	}
+	
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest("POST", "/v0/api/launcherConfig", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	
+	handler.LauncherConfig(w, httpReq)
+	
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	
+	var response models.LauncherConfigResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	
+	// Clients are told the lifetimes tokens are actually issued with
+	security := response.LauncherConfig.Security
+	if security.TokenExpirationSec != 900 {
+		t.Errorf("Expected tokenExpirationSec 900, got %d", security.TokenExpirationSec)
+	}
+	if security.RefreshTokenExpirationDays != 14 {
+		t.Errorf("Expected refreshTokenExpirationDays 14, got %d", security.RefreshTokenExpirationDays)
+	}
+}
+
 func TestLauncherHandler_LauncherConfig_MissingFields(t *testing.T) {
 	cfg := createTestLauncherConfig()
 	db, cleanup := createTestDatabase()
@@ -300,6 +346,51 @@ func TestLauncherHandler_FeedbackLog_Success(t *testing.T) {
 	}
 }
 
+func TestLauncherHandler_FeedbackLog_User(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	basePath := t.TempDir()
+	db, err := storage.NewFileStorage(basePath)
+	if err != nil {
+		t.Fatalf("Failed to create file storage: %v", err)
+	}
+	
+	handler := NewLauncherHandler(cfg, db)
+	
+	req := models.FeedbackLogRequest{
+		FeedbackLog: models.FeedbackLogInfo{
+			OS:              "windows",
+			Arch:            "x64",
+			CoreVersion:     "1.0.0",
+			ResourceVersion: "2.0.0",
+			Timestamp:       1685625600,
+			Content:         "Test feedback log",
+		},
+	}
+	
+	// The claims AuthMiddleware accepted attribute the feedback to the user
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest("POST", "/v0/api/feedbackLog", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq = httpReq.WithContext(middleware.WithClaims(httpReq.Context(), &auth.Claims{UserID: "user-1"}))
+	w := httptest.NewRecorder()
+	
+	handler.FeedbackLog(w, httpReq)
+	
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	files, _ := filepath.Glob(filepath.Join(basePath, "feedback", "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one feedback file, got %d", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	var stored storage.FeedbackLog
+	json.Unmarshal(data, &stored)
+	if stored.UserID != "user-1" {
+		t.Errorf("Expected feedback from user-1, got %q", stored.UserID)
+	}
+}
+
 func TestLauncherHandler_FeedbackLog_MissingFields(t *testing.T) {
 	cfg := createTestLauncherConfig()
 	db, cleanup := createTestDatabase()
@@ -325,4 +416,268 @@ func TestLauncherHandler_FeedbackLog_MissingFields(t *testing.T) {
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
 	}
-}
\ No newline at end of file
+}
+func TestLauncherHandler_Maintenance_PlatformSpecific(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Maintenance.PlatformSpecific = map[string]config.PlatformMaintenanceConfig{
+		"linux-x64": {
+			MaintenanceActive: true,
+			MaintenanceInfo: config.MaintenanceInfoConfig{
+				Status:  "progress",
+				Message: "Linux x64 servers undergoing maintenance",
+			},
+		},
+	}
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	
+	handler := NewLauncherHandler(cfg, db)
+	
+	for _, tc := range []struct {
+		os, arch string
+		expected int
+	}{
+		{"linux", "x64", http.StatusOK},
+		{"windows", "x64", http.StatusNoContent},
+	} {
+		req := models.MaintenanceRequest{
+			CheckMaintenance: models.CheckMaintenanceInfo{OS: tc.os, Arch: tc.arch},
+		}
+		
+		body, _ := json.Marshal(req)
+		httpReq := httptest.NewRequest("POST", "/v0/api/maintenance", bytes.NewReader(body))
+		httpReq.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		
+		handler.Maintenance(w, httpReq)
+		
+		if w.Code != tc.expected {
+			t.Errorf("%s-%s: expected status %d, got %d", tc.os, tc.arch, tc.expected, w.Code)
+		}
+	}
+}
+
+func TestLauncherHandler_CheckUpdates_NotModified(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	
+	handler := NewLauncherHandler(cfg, db)
+	
+	req := models.CheckUpdateRequest{
+		CheckUpdate: models.CheckUpdateInfo{
+			OS:              "windows",
+			Arch:            "x64",
+			CoreVersion:     "1.0.0",
+			ResourceVersion: "1.0.0",
+		},
+	}
+	body, _ := json.Marshal(req)
+	
+	send := func(etag string) *httptest.ResponseRecorder {
+		httpReq := httptest.NewRequest("POST", "/v0/api/checkUpdates", bytes.NewReader(body))
+		httpReq.Header.Set("Content-Type", "application/json")
+		if etag != "" {
+			httpReq.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		handler.CheckUpdates(w, httpReq)
+		return w
+	}
+	
+	w := send("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected ETag header")
+	}
+	
+	var response models.UpdateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(response.UpdateInformation.Files) == 0 || response.Meta.APIVersion == "" {
+		t.Error("Expected update files and meta in response")
+	}
+	
+	w = send(etag)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+	
+	// Reloading the configuration invalidates the cached response
+	next := createTestLauncherConfig()
+	next.Updates.LatestCoreVersion = "1.2.0"
+	next.Updates.FullPackages["windows-x64"] = config.UpdatePackageInfo{
+		CoreVersion:     "1.2.0",
+		ResourceVersion: "1.1.0",
+		DownloadUrl:     "https://example.com/updates/windows-x64-1.2.0.zip",
+		Checksum:        "sha256:fed321...",
+	}
+	cfg.Swap(next)
+	
+	w = send(etag)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d after reload, got %d", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("Expected ETag to change after reload")
+	}
+}
+
+func TestLauncherHandler_Bootstrap(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Maintenance.MaintenanceActive = true
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	
+	handler := NewLauncherHandler(cfg, db)
+	
+	req := models.BootstrapRequest{
+		Bootstrap: models.BootstrapInfo{
+			OS:              "windows",
+			Arch:            "x64",
+			CoreVersion:     "1.0.0",
+			ResourceVersion: "1.0.0",
+		},
+		Preferences: models.Preferences{
+			Language: "en",
+		},
+	}
+	
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest("POST", "/v0/api/bootstrap", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	
+	handler.Bootstrap(w, httpReq)
+	
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	
+	var response models.BootstrapResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	
+	if len(response.LauncherConfig.Host) == 0 {
+		t.Error("Expected launcher configuration")
+	}
+	if response.MaintenanceInformation == nil {
+		t.Error("Expected maintenance information")
+	}
+	if response.UpdateInformation == nil {
+		t.Error("Expected update information")
+	}
+	if response.Meta.APIVersion != "1.0.0" {
+		t.Errorf("Expected meta apiVersion '1.0.0', got %s", response.Meta.APIVersion)
+	}
+}
+
+func TestLauncherHandler_Bootstrap_OmitsEmptySections(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	
+	handler := NewLauncherHandler(cfg, db)
+	
+	req := models.BootstrapRequest{
+		Bootstrap: models.BootstrapInfo{
+			OS:              "windows",
+			Arch:            "x64",
+			CoreVersion:     "1.1.1",
+			ResourceVersion: "1.1.0",
+		},
+	}
+	
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest("POST", "/v0/api/bootstrap", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	
+	handler.Bootstrap(w, httpReq)
+	
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	
+	if _, ok := response["launcherConfig"]; !ok {
+		t.Error("Expected launcherConfig section")
+	}
+	if _, ok := response["maintenanceInformation"]; ok {
+		t.Error("Expected maintenanceInformation to be absent when not in maintenance")
+	}
+	if _, ok := response["updateInformation"]; ok {
+		t.Error("Expected updateInformation to be absent when up to date")
+	}
+}
+
+func TestLauncherHandler_Bootstrap_MissingFields(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	
+	handler := NewLauncherHandler(cfg, db)
+	
+	body, _ := json.Marshal(models.BootstrapRequest{})
+	httpReq := httptest.NewRequest("POST", "/v0/api/bootstrap", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	
+	handler.Bootstrap(w, httpReq)
+	
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestLauncherHandler_CacheBounded(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+
+	handler := NewLauncherHandler(cfg, db)
+	handler.Cache.size = 4
+
+	send := func(coreVersion, language string) {
+		req := models.BootstrapRequest{
+			Bootstrap: models.BootstrapInfo{
+				OS:              "windows",
+				Arch:            "x64",
+				CoreVersion:     coreVersion,
+				ResourceVersion: "1.0.0",
+			},
+			Preferences: models.Preferences{Language: language},
+		}
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		handler.Bootstrap(w, httptest.NewRequest("POST", "/v0/api/bootstrap", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	// Unknown languages share the English entries, and the launcher
+	// configuration is cached once for every client
+	for _, language := range []string{"", "en", "xx", "yy"} {
+		send("1.0.0", language)
+	}
+	if got := len(handler.Cache.entries); got != 3 {
+		t.Errorf("Expected 3 cached responses, got %d", got)
+	}
+
+	for i := 0; i < 20; i++ {
+		send(fmt.Sprintf("0.0.%d", i), "en")
+	}
+	if got := len(handler.Cache.entries); got != 4 || handler.Cache.recent.Len() != 4 {
+		t.Errorf("Expected the cache to stay at 4 responses, got %d", got)
+	}
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// loginLimit is a lockout threshold for the failures of one key
+type loginLimit struct {
+	key         string
+	maxFailures int
+}
+
+// loginLimits returns the lockout thresholds of a password login, per
+// username and per source address. Disabled limits are left out.
+func loginLimits(policy config.LockoutPolicy, username, address string) []loginLimit {
+	return limitsByKey(policy, storage.UsernameFailureKey(username), storage.AddressFailureKey(address))
+}
+
+// resetLimits returns the thresholds of password reset requests, per
+// username and per source address. Disabled limits are left out.
+func resetLimits(policy config.LockoutPolicy, username, address string) []loginLimit {
+	return limitsByKey(policy, storage.UsernameResetKey(username), storage.AddressResetKey(address))
+}
+
+func limitsByKey(policy config.LockoutPolicy, usernameKey, addressKey string) []loginLimit {
+	var limits []loginLimit
+	if policy.MaxFailures > 0 {
+		limits = append(limits, loginLimit{usernameKey, policy.MaxFailures})
+	}
+	if policy.MaxFailuresPerIP > 0 {
+		limits = append(limits, loginLimit{addressKey, policy.MaxFailuresPerIP})
+	}
+	return limits
+}
+
+// lockoutDuration returns how long logins are locked after count failures:
+// not at all below the threshold, then doubling from policy.Lockout with
+// each further failure up to policy.MaxLockout
+func lockoutDuration(policy config.LockoutPolicy, count, maxFailures int) time.Duration {
+	if count < maxFailures {
+		return 0
+	}
+	duration := policy.Lockout
+	for i := maxFailures; i < count && duration < policy.MaxLockout; i++ {
+		duration *= 2
+	}
+	if duration > policy.MaxLockout {
+		duration = policy.MaxLockout
+	}
+	return duration
+}
+
+// loginAttempt is a password login counted as a failure against its limits
+// before the credentials are checked, so that concurrent attempts see each
+// other. It is settled with failed or uncount.
+type loginAttempt struct {
+	handler *AuthHandler
+	policy  config.LockoutPolicy
+	counted []countedLogin
+}
+
+// countedLogin is a limit an attempt was counted against, with the time of
+// the last failure before the attempt
+type countedLogin struct {
+	limit         loginLimit
+	lastFailureAt time.Time
+	count         int
+}
+
+// startLoginAttempt counts a password login for the username from the
+// address against the lockout limits. A locked login is answered with 429
+// and a Retry-After header, and nil is returned.
+func (h *AuthHandler) startLoginAttempt(rw *middleware.ResponseWriter, username, address, language string) *loginAttempt {
+	policy := rw.Config.App.LoginLockout()
+	return h.startAttempt(rw, policy, loginLimits(policy, username, address), "Too many failed logins, try again later", language)
+}
+
+// startAttempt counts an attempt against limits, checking and counting in
+// one storage update per limit. If a limit is locked, the attempt is
+// answered with 429, message and a Retry-After header, and nil is returned.
+func (h *AuthHandler) startAttempt(rw *middleware.ResponseWriter, policy config.LockoutPolicy, limits []loginLimit, message, language string) *loginAttempt {
+	attempt := &loginAttempt{handler: h, policy: policy}
+	since := time.Now().Add(-attempt.policy.ResetAfter)
+	for _, limit := range limits {
+		var wait time.Duration
+		var lastFailureAt time.Time
+		failures, err := h.DB.UpdateLoginFailures(limit.key, func(failures *storage.LoginFailures) bool {
+			now := time.Now()
+			if failures.LastFailureAt.Before(since) {
+				failures.Count = 0 // Failures are forgotten after a while
+			}
+			lockedUntil := failures.LastFailureAt.Add(lockoutDuration(attempt.policy, failures.Count, limit.maxFailures))
+			if wait = lockedUntil.Sub(now); wait > 0 {
+				return false
+			}
+			lastFailureAt = failures.LastFailureAt
+			failures.Count++
+			failures.LastFailureAt = now
+			return true
+		})
+		if err != nil {
+			attempt.uncount()
+			rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to check login attempts", language)
+			return nil
+		}
+		if wait > 0 {
+			attempt.uncount()
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			rw.WriteErrorWithLanguage(http.StatusTooManyRequests, "TooManyRequests", message, language)
+			return nil
+		}
+		attempt.counted = append(attempt.counted, countedLogin{limit, lastFailureAt, failures.Count})
+	}
+	return attempt
+}
+
+// failed keeps the attempt counted as a failed login
+func (a *loginAttempt) failed() {
+	for _, counted := range a.counted {
+		if counted.count >= counted.limit.maxFailures {
+			log.Printf("Security: logins for %s locked for %s after %d failures", counted.limit.key, lockoutDuration(a.policy, counted.count, counted.limit.maxFailures), counted.count)
+		}
+	}
+}
+
+// uncount takes back the attempt, which did not fail on the credentials
+func (a *loginAttempt) uncount() {
+	for _, counted := range a.counted {
+		_, err := a.handler.DB.UpdateLoginFailures(counted.limit.key, func(failures *storage.LoginFailures) bool {
+			if failures.Count == 0 {
+				return false
+			}
+			failures.Count--
+			// At the threshold only one attempt at a time passes the check,
+			// so the last failure before it is still the last failure
+			if failures.Count >= counted.limit.maxFailures {
+				failures.LastFailureAt = counted.lastFailureAt
+			}
+			return true
+		})
+		if err != nil {
+			log.Printf("Failed to update login failures: %v", err)
+		}
+	}
+}
+
+// clearLoginFailures forgets the failures of a username after it logged in.
+// Failures of the address are kept, as one address may try many usernames.
+func (h *AuthHandler) clearLoginFailures(username string) {
+	if err := h.DB.ClearLoginFailures(storage.UsernameFailureKey(username)); err != nil {
+		log.Printf("Failed to clear login failures: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/notify"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+	"github.com/moehoshio/NekoLcServer/internal/testutil"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	policy := config.LockoutPolicy{Lockout: 30 * time.Second, MaxLockout: 5 * time.Minute}
+
+	tests := map[int]time.Duration{
+		2:  0,
+		3:  30 * time.Second,
+		4:  time.Minute,
+		6:  4 * time.Minute,
+		7:  5 * time.Minute,
+		70: 5 * time.Minute,
+	}
+	for count, expected := range tests {
+		if duration := lockoutDuration(policy, count, 3); duration != expected {
+			t.Errorf("%d failures: expected %s, got %s", count, expected, duration)
+		}
+	}
+}
+
+func TestAuthHandler_Login_Lockout(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			cfg.App.Authentication.Lockout.MaxFailures = 3
+			cfg.App.Authentication.Lockout.MaxFailuresPerIP = -1
+			cfg.App.Authentication.Lockout.LockoutSec = 60
+			handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+			createTestUser(t, db, "alice", "password")
+			createTestUser(t, db, "bob", "password")
+
+			// A successful login forgets earlier failures
+			postLogin(handler, "alice", "wrong")
+			postLogin(handler, "alice", "wrong")
+			if w := postLogin(handler, "alice", "password"); w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			for i := 0; i < 3; i++ {
+				if w := postLogin(handler, "alice", "wrong"); w.Code != http.StatusUnauthorized {
+					t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+				}
+			}
+
+			// Locked, even with the right password
+			w := postLogin(handler, "alice", "password")
+			if w.Code != http.StatusTooManyRequests || errorType(w) != "TooManyRequests" {
+				t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+			}
+			if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 59 || retryAfter > 60 {
+				t.Errorf("Expected Retry-After of about 60 seconds, got %q", w.Header().Get("Retry-After"))
+			}
+
+			// Other usernames are not affected
+			if w := postLogin(handler, "bob", "password"); w.Code != http.StatusOK {
+				t.Errorf("Expected status %d for another user, got %d", http.StatusOK, w.Code)
+			}
+
+			// Unlocking the username allows logins again
+			if err := db.ClearLoginFailures(storage.UsernameFailureKey("alice")); err != nil {
+				t.Fatalf("Failed to unlock: %v", err)
+			}
+			if w := postLogin(handler, "alice", "password"); w.Code != http.StatusOK {
+				t.Errorf("Expected status %d after unlocking, got %d", http.StatusOK, w.Code)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_Login_LockoutPerIP(t *testing.T) {
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	cfg := createTestConfig(true)
+	cfg.App.Authentication.Lockout.MaxFailures = -1
+	cfg.App.Authentication.Lockout.MaxFailuresPerIP = 3
+	handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+	createTestUser(t, db, "alice", "password")
+
+	// Guessing different usernames from one address
+	for _, username := range []string{"bob", "carol", "dave"} {
+		if w := postLogin(handler, username, "password"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+	}
+	if w := postLogin(handler, "alice", "password"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d from a locked address, got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestAuthHandler_Login_LockoutConcurrent(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			cfg.App.Authentication.Lockout.MaxFailures = 3
+			cfg.App.Authentication.Lockout.MaxFailuresPerIP = -1
+			handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+			createTestUser(t, db, "alice", "password")
+
+			// Attempts in flight count as failures, so only as many
+			// guesses as the limit allows are checked
+			var wg sync.WaitGroup
+			var checked atomic.Int32
+			for i := 0; i < 12; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if w := postLogin(handler, "alice", "wrong"); w.Code == http.StatusUnauthorized {
+						checked.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			if checked.Load() != 3 {
+				t.Errorf("Expected 3 checked passwords, got %d", checked.Load())
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cfg := createTestConfig(true)
+	cfg.App.Server.TrustedProxies = []string{"10.0.0.1", "192.168.0.0/16"}
+	if err := cfg.App.Validate(); err != nil {
+		t.Fatalf("Failed to validate config: %v", err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"203.0.113.7:1234", nil, "203.0.113.7"},
+		{"203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"}, // not a proxy
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1, unknown, 192.168.1.1"}, "192.168.1.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/v0/api/auth/login", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := clientIP(cfg, r); ip != test.expected {
+			t.Errorf("%s with %q: expected %s, got %s", test.remoteAddr, test.forwarded, test.expected, ip)
+		}
+	}
+
+	cfg.App.Server.TrustedProxies = []string{"proxy.local"}
+	if err := cfg.App.Validate(); err == nil {
+		t.Error("Expected an invalid trusted proxy to be rejected")
+	}
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// OIDCAuthorize handles POST /v0/api/auth/oidcAuthorize, returning the URL
+// of the identity provider where the launcher starts an OpenID Connect login
+func (h *AuthHandler) OIDCAuthorize(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled || !h.OIDC.Enabled() {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "OpenID Connect login not implemented")
+		return
+	}
+
+	var req models.OIDCAuthorizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	info := req.OIDCAuthorize
+	if !h.OIDC.AllowedRedirectURI(info.RedirectURI) {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Redirect URI is not allowed", language)
+		return
+	}
+	// A SHA-256 code challenge is always 43 base64url characters
+	if len(info.CodeChallenge) != 43 {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "codeChallenge must be the base64url SHA-256 of the code verifier", language)
+		return
+	}
+
+	authorizationURL, err := h.OIDC.AuthorizationURL(r.Context(), info.RedirectURI, info.CodeChallenge, info.State, info.Nonce)
+	if err != nil {
+		log.Printf("OpenID Connect discovery failed: %v", err)
+		rw.WriteErrorWithLanguage(http.StatusServiceUnavailable, "ServiceUnavailable", "Identity provider is unavailable", language)
+		return
+	}
+
+	response := models.OIDCAuthorizeResponse{
+		AuthorizationURL: authorizationURL,
+		Meta:             models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+
+	rw.WriteJSON(http.StatusOK, response)
+}
+
+// checkOIDCRequest returns a message describing what is wrong with the
+// redirect URI or code verifier of an OpenID Connect login, or ""
+func checkOIDCRequest(provider *auth.OIDCProvider, redirectURI, codeVerifier string) string {
+	if !provider.AllowedRedirectURI(redirectURI) {
+		return "Redirect URI is not allowed"
+	}
+	// RFC 7636 section 4.1
+	if len(codeVerifier) < 43 || len(codeVerifier) > 128 {
+		return "codeVerifier must be 43 to 128 characters"
+	}
+	return ""
+}
+
+// authenticateOIDC exchanges an authorization code and returns the local
+// user linked to the identity, creating one on the first login
+func (h *AuthHandler) authenticateOIDC(ctx context.Context, info models.AuthInfo) (*storage.User, error) {
+	identity, err := h.OIDC.Exchange(ctx, info.Code, info.CodeVerifier, info.RedirectURI, info.Nonce)
+	if err != nil {
+		if errors.Is(err, auth.ErrOIDCUnavailable) {
+			return nil, err
+		}
+		log.Printf("OpenID Connect login rejected: %v", err)
+		return nil, errInvalidCredentials
+	}
+
+	linked, err := h.DB.GetExternalIdentity(identity.Issuer, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if linked == nil {
+		linked, err = h.linkExternalIdentity(identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	user, err := h.DB.GetUser(linked.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errInvalidCredentials
+	}
+	if user.Disabled {
+		return nil, errAccountDisabled
+	}
+	return user, nil
+}
+
+// linkExternalIdentity creates a local user for an identity that logs in for
+// the first time. The user has no password, so it can only log in through
+// the identity provider until a password is set with a reset.
+func (h *AuthHandler) linkExternalIdentity(identity *auth.OIDCIdentity) (*storage.ExternalIdentity, error) {
+	user := &storage.User{}
+	base := oidcUsername(identity.Username)
+	for attempt := 0; ; attempt++ {
+		// Usernames taken by local accounts get a random suffix
+		user.Username = base
+		if attempt > 0 {
+			suffix := make([]byte, 3)
+			rand.Read(suffix)
+			user.Username = base + "-" + hex.EncodeToString(suffix)
+		}
+		err := h.DB.CreateUser(user)
+		if err == nil {
+			break
+		}
+		if err != storage.ErrUserExists || attempt == 4 {
+			return nil, err
+		}
+	}
+
+	linked := &storage.ExternalIdentity{
+		Issuer:  identity.Issuer,
+		Subject: identity.Subject,
+		UserID:  user.ID,
+	}
+	if err := h.DB.CreateExternalIdentity(linked); err != nil {
+		// The account created above is linked to nothing
+		if deleteErr := h.DB.DeleteUser(user.ID); deleteErr != nil {
+			log.Printf("Failed to delete unlinked user %s: %v", user.Username, deleteErr)
+		}
+		if err != storage.ErrIdentityExists {
+			return nil, err
+		}
+		// A concurrent first login linked the identity first
+		return h.DB.GetExternalIdentity(identity.Issuer, identity.Subject)
+	}
+	log.Printf("Created user %s for OpenID Connect subject %s of %s", user.Username, identity.Subject, identity.Issuer)
+	return linked, nil
+}
+
+// oidcUsername derives a valid local username from the username claim,
+// leaving room for a suffix if it is taken
+func oidcUsername(claim string) string {
+	var username []rune
+	for _, c := range claim {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-' {
+			username = append(username, c)
+		}
+	}
+	if len(username) > maxUsernameLength-7 {
+		username = username[:maxUsernameLength-7]
+	}
+	if len(username) < minUsernameLength {
+		return "user"
+	}
+	return string(username)
+}
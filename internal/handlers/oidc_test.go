@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/notify"
+	"github.com/moehoshio/NekoLcServer/internal/oidctest"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+	"github.com/moehoshio/NekoLcServer/internal/testutil"
+)
+
+const testRedirectURI = "http://127.0.0.1:53682/callback"
+
+func createTestOIDCHandler(t *testing.T, db storage.Storage) (*AuthHandler, *oidctest.Issuer) {
+	issuer := oidctest.NewIssuer("nekolc-launcher")
+	t.Cleanup(issuer.Close)
+
+	cfg := createTestConfig(true)
+	oidc := &cfg.App.Authentication.OIDC
+	oidc.Enabled = true
+	oidc.Issuer = issuer.URL()
+	oidc.ClientID = issuer.ClientID
+	oidc.RedirectURIs = []string{testRedirectURI}
+	return NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier()), issuer
+}
+
+// postOIDCLogin logs in as the subject of the mock issuer
+func postOIDCLogin(t *testing.T, handler *AuthHandler, issuer *oidctest.Issuer, subject, username string) (*models.LoginResponse, int) {
+	t.Helper()
+	verifier := oidctest.NewCodeVerifier()
+	code := issuer.Authorize(subject, verifier, testRedirectURI, map[string]interface{}{"preferred_username": username})
+	req := models.LoginRequest{Auth: models.AuthInfo{Code: code, CodeVerifier: verifier, RedirectURI: testRedirectURI}}
+	w := postJSON(handler.Login, "/v0/api/auth/login", req, "")
+	var response models.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return &response, w.Code
+}
+
+func TestAuthHandler_Login_OIDC(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			handler, issuer := createTestOIDCHandler(t, db)
+			createTestUser(t, db, "alice", "password")
+
+			// The first login creates a local user; "alice" is taken locally
+			response, status := postOIDCLogin(t, handler, issuer, "forum-42", "alice")
+			if status != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+			}
+			claims, err := handler.JWTAuth.ValidateToken(response.AccessToken)
+			if err != nil {
+				t.Fatalf("Expected a valid token: %v", err)
+			}
+			user, _ := db.GetUser(claims.UserID)
+			if user == nil || !strings.HasPrefix(user.Username, "alice-") {
+				t.Fatalf("Expected a new user named alice-*, got %+v", user)
+			}
+
+			// Later logins map the subject to the same user, whatever its username
+			response, status = postOIDCLogin(t, handler, issuer, "forum-42", "renamed")
+			if status != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+			}
+			if claims, _ := handler.JWTAuth.ValidateToken(response.AccessToken); claims == nil || claims.UserID != user.ID {
+				t.Errorf("Expected the same user for the same subject")
+			}
+
+			// The linked user has no password to log in with
+			if w := postLogin(handler, user.Username, "password"); w.Code == http.StatusOK {
+				t.Error("Expected password login of the linked user to fail")
+			}
+
+			user.Disabled = true
+			db.UpdateUser(user)
+			if _, status := postOIDCLogin(t, handler, issuer, "forum-42", "alice"); status != http.StatusForbidden {
+				t.Errorf("Expected status %d for a disabled user, got %d", http.StatusForbidden, status)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_LinkExternalIdentity_Race(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			handler, _ := createTestOIDCHandler(t, db)
+			owner := createTestUser(t, db, "owner", "password")
+
+			// Another login linked the subject between the lookup and the link
+			existing := &storage.ExternalIdentity{Issuer: "https://issuer", Subject: "forum-42", UserID: owner.ID}
+			if err := db.CreateExternalIdentity(existing); err != nil {
+				t.Fatalf("Failed to link identity: %v", err)
+			}
+
+			linked, err := handler.linkExternalIdentity(&auth.OIDCIdentity{Issuer: "https://issuer", Subject: "forum-42", Username: "racer"})
+			if err != nil || linked == nil || linked.UserID != owner.ID {
+				t.Fatalf("Expected the identity linked by the other login, got %+v, %v", linked, err)
+			}
+			if user, _ := db.GetUserByUsername("racer"); user != nil {
+				t.Errorf("Expected the unlinked user to be deleted, got %+v", user)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_Login_OIDC_Invalid(t *testing.T) {
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	handler, issuer := createTestOIDCHandler(t, db)
+	verifier := oidctest.NewCodeVerifier()
+
+	tests := map[string]struct {
+		auth   models.AuthInfo
+		status int
+	}{
+		"unknown code":       {models.AuthInfo{Code: "unknown", CodeVerifier: verifier, RedirectURI: testRedirectURI}, http.StatusUnauthorized},
+		"wrong verifier":     {models.AuthInfo{Code: issuer.Authorize("forum-42", verifier, testRedirectURI, nil), CodeVerifier: oidctest.NewCodeVerifier(), RedirectURI: testRedirectURI}, http.StatusUnauthorized},
+		"short verifier":     {models.AuthInfo{Code: "code", CodeVerifier: "short", RedirectURI: testRedirectURI}, http.StatusBadRequest},
+		"other redirect URI": {models.AuthInfo{Code: "code", CodeVerifier: verifier, RedirectURI: "https://evil.example.com/callback"}, http.StatusBadRequest},
+	}
+	for name, test := range tests {
+		w := postJSON(handler.Login, "/v0/api/auth/login", models.LoginRequest{Auth: test.auth}, "")
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", name, test.status, w.Code)
+		}
+	}
+
+	issuer.Fail(1)
+	if _, status := postOIDCLogin(t, handler, issuer, "forum-42", "bob"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d when the provider fails, got %d", http.StatusServiceUnavailable, status)
+	}
+
+	handler.Config.App.Authentication.OIDC.Enabled = false
+	if _, status := postOIDCLogin(t, handler, issuer, "forum-42", "bob"); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d when OpenID Connect is disabled, got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestAuthHandler_OIDCAuthorize(t *testing.T) {
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	handler, issuer := createTestOIDCHandler(t, db)
+	challenge := oidctest.CodeChallenge(oidctest.NewCodeVerifier())
+
+	req := models.OIDCAuthorizeRequest{OIDCAuthorize: models.OIDCAuthorizeInfo{RedirectURI: testRedirectURI, CodeChallenge: challenge, State: "state-1"}}
+	w := postJSON(handler.OIDCAuthorize, "/v0/api/auth/oidcAuthorize", req, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response models.OIDCAuthorizeResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if !strings.HasPrefix(response.AuthorizationURL, issuer.URL()+"/authorize?") || !strings.Contains(response.AuthorizationURL, "code_challenge="+challenge) {
+		t.Errorf("Unexpected authorization URL %s", response.AuthorizationURL)
+	}
+
+	req.OIDCAuthorize.RedirectURI = "https://evil.example.com/callback"
+	if w := postJSON(handler.OIDCAuthorize, "/v0/api/auth/oidcAuthorize", req, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for another redirect URI, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	handler.Config.App.Authentication.OIDC.Enabled = false
+	if w := postJSON(handler.OIDCAuthorize, "/v0/api/auth/oidcAuthorize", req, ""); w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status %d when OpenID Connect is disabled, got %d", http.StatusNotImplemented, w.Code)
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/realtime"
+)
+
+const (
+	defaultPresenceWindowMinutes = 60
+	maxPresenceWindowMinutes     = 24 * 60
+)
+
+type PresenceHandler struct {
+	Config *config.Config
+	Hub    *realtime.Hub
+}
+
+func NewPresenceHandler(cfg *config.Config, hub *realtime.Hub) *PresenceHandler {
+	return &PresenceHandler{
+		Config: cfg,
+		Hub:    hub,
+	}
+}
+
+// Presence handles GET /v0/admin/presence
+func (h *PresenceHandler) Presence(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	minutes := defaultPresenceWindowMinutes
+	if value := r.URL.Query().Get("minutes"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPresenceWindowMinutes {
+			rw.WriteError(http.StatusBadRequest, "InvalidRequest", "minutes must be between 1 and 1440")
+			return
+		}
+		minutes = parsed
+	}
+
+	response := models.PresenceResponse{
+		Presence: h.Hub.Presence(time.Now(), time.Duration(minutes)*time.Minute),
+		Meta:     models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+
+	rw.WriteJSON(http.StatusOK, response)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/realtime"
+)
+
+func TestPresenceHandler_Presence(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	hub := realtime.NewHub()
+	handler := NewPresenceHandler(cfg, hub)
+
+	client := realtime.NewClient()
+	client.Update(models.ClientInfo{OS: "windows", Arch: "x64", CoreVersion: "1.0.0", ResourceVersion: "2.0.0"}, models.Preferences{Language: "en"})
+	hub.Register(client)
+
+	httpReq := httptest.NewRequest("GET", "/v0/admin/presence?minutes=10", nil)
+	w := httptest.NewRecorder()
+	handler.Presence(w, httpReq)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response models.PresenceResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Presence.Online != 1 || response.Presence.ByOS["windows"] != 1 {
+		t.Errorf("Unexpected presence %+v", response.Presence)
+	}
+	if len(response.Presence.Peaks) != 10 {
+		t.Errorf("Expected 10 intervals, got %d", len(response.Presence.Peaks))
+	}
+}
+
+func TestPresenceHandler_InvalidWindow(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	handler := NewPresenceHandler(cfg, realtime.NewHub())
+
+	httpReq := httptest.NewRequest("GET", "/v0/admin/presence?minutes=0", nil)
+	w := httptest.NewRecorder()
+	handler.Presence(w, httpReq)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
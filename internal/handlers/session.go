@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// maxUserAgentLength limits how much of the User-Agent header is stored
+const maxUserAgentLength = 256
+
+// recordSession creates or updates the session of a token family after
+// tokens were issued for it. OS and architecture are kept from the login if
+// a refresh does not send them. A session revoked in the meantime, e.g. by a
+// logout racing the refresh, is left alone; its tokens are revoked with it.
+func (h *AuthHandler) recordSession(cfg *config.Config, r *http.Request, userID, familyID string, expiresAt time.Time, info models.SessionInfo) error {
+	session, err := h.DB.GetSession(familyID)
+	if err != nil {
+		return err
+	}
+	if session != nil && session.Revoked {
+		return nil
+	}
+	now := time.Now().UTC()
+	if session == nil {
+		session = &storage.Session{
+			ID:        familyID,
+			UserID:    userID,
+			CreatedAt: now,
+		}
+	}
+	if info.OS != "" {
+		session.OS = info.OS
+	}
+	if info.Arch != "" {
+		session.Arch = info.Arch
+	}
+	session.UserAgent = r.UserAgent()
+	if len(session.UserAgent) > maxUserAgentLength {
+		session.UserAgent = session.UserAgent[:maxUserAgentLength]
+	}
+	session.IPAddress = clientIP(cfg, r)
+	session.LastUsedAt = now
+	session.ExpiresAt = expiresAt
+	return h.DB.StoreSession(session)
+}
+
+// clientIP returns the address the request came from. Requests from a
+// trusted proxy come from the last address in X-Forwarded-For that is not a
+// trusted proxy itself; earlier entries may be forged by the client.
+func clientIP(cfg *config.Config, r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !cfg.App.TrustsProxy(ip) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		ip := net.ParseIP(address)
+		if ip == nil {
+			break // Nothing before a malformed entry can be trusted
+		}
+		host = ip.String()
+		if !cfg.App.TrustsProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// sessionAuth is the user and session of the access token of a request
+type sessionAuth struct {
+	UserID    string
+	SessionID string // empty for tokens issued before sessions were recorded
+}
+
+// authenticateSession validates the Bearer access token of a request
+func (h *AuthHandler) authenticateSession(r *http.Request) (*sessionAuth, error) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, errInvalidCredentials
+	}
+	claims, storedToken, err := lookupAccessToken(h.DB, h.JWTAuth, strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	return &sessionAuth{UserID: claims.UserID, SessionID: storedToken.FamilyID}, nil
+}
+
+// Sessions handles POST /v0/api/auth/sessions, listing where the user is logged in
+func (h *AuthHandler) Sessions(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+
+	var req models.SessionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	current, err := h.authenticateSession(r)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
+		return
+	}
+
+	sessions, err := h.DB.ListUserSessions(current.UserID)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to list sessions", language)
+		return
+	}
+
+	response := models.SessionsResponse{
+		Sessions: make([]models.Session, 0, len(sessions)),
+		Meta:     models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, models.Session{
+			ID:         session.ID,
+			OS:         session.OS,
+			Arch:       session.Arch,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt.Unix(),
+			LastUsedAt: session.LastUsedAt.Unix(),
+			Current:    session.ID == current.SessionID,
+		})
+	}
+
+	rw.WriteJSON(http.StatusOK, response)
+}
+
+// RevokeSession handles POST /v0/api/auth/revokeSession, logging out one
+// session of the user
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+
+	var req models.RevokeSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	current, err := h.authenticateSession(r)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
+		return
+	}
+
+	session, err := h.DB.GetSession(req.RevokeSession.SessionID)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to load session", language)
+		return
+	}
+	// Sessions of other users are reported as missing
+	if session == nil || session.UserID != current.UserID {
+		rw.WriteErrorWithLanguage(http.StatusNotFound, "NotFound", "Session not found", language)
+		return
+	}
+
+	if err := h.DB.RevokeTokenFamily(session.ID); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to revoke session", language)
+		return
+	}
+
+	rw.WriteNoContent()
+}
+
+// RevokeAllSessions handles POST /v0/api/auth/revokeAllSessions, logging the
+// user out everywhere, including the session that sent the request
+func (h *AuthHandler) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+
+	var req models.SessionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	current, err := h.authenticateSession(r)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
+		return
+	}
+
+	if err := h.DB.RevokeAllUserTokens(current.UserID); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to revoke sessions", language)
+		return
+	}
+
+	rw.WriteNoContent()
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/notify"
+	"github.com/moehoshio/NekoLcServer/internal/testutil"
+)
+
+// loginFrom logs in with a password, reporting the given OS and architecture
+func loginFrom(t *testing.T, handler *AuthHandler, username, os, arch string) *models.LoginResponse {
+	t.Helper()
+	req := models.LoginRequest{
+		Auth:    models.AuthInfo{Username: username, Password: "password"},
+		Session: models.SessionInfo{OS: os, Arch: arch},
+	}
+	w := postJSON(handler.Login, "/v0/api/auth/login", req, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response models.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return &response
+}
+
+func listSessions(t *testing.T, handler *AuthHandler, accessToken string) []models.Session {
+	t.Helper()
+	w := postJSON(handler.Sessions, "/v0/api/auth/sessions", models.SessionsRequest{}, accessToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response models.SessionsResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response.Sessions
+}
+
+func TestAuthHandler_Sessions(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+			createTestUser(t, db, "alice", "password")
+			createTestUser(t, db, "bob", "password")
+
+			windows := loginFrom(t, handler, "alice", "windows", "x64")
+			linux := loginFrom(t, handler, "alice", "linux", "arm64")
+			bob := loginFrom(t, handler, "bob", "osx", "arm64")
+
+			// A refresh keeps the session and its device info
+			w := postRefresh(handler, linux.RefreshToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			var refreshed models.RefreshResponse
+			json.Unmarshal(w.Body.Bytes(), &refreshed)
+
+			sessions := listSessions(t, handler, refreshed.AccessToken)
+			if len(sessions) != 2 {
+				t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+			}
+			var current *models.Session
+			for i := range sessions {
+				if sessions[i].Current {
+					current = &sessions[i]
+				}
+			}
+			if current == nil || current.OS != "linux" || current.Arch != "arm64" || current.IPAddress == "" {
+				t.Fatalf("Expected the linux session to be current, got %+v", sessions)
+			}
+
+			// Sessions of other users cannot be revoked
+			for _, session := range listSessions(t, handler, bob.AccessToken) {
+				req := models.RevokeSessionRequest{RevokeSession: models.RevokeSessionInfo{SessionID: session.ID}}
+				if w := postJSON(handler.RevokeSession, "/v0/api/auth/revokeSession", req, refreshed.AccessToken); w.Code != http.StatusNotFound {
+					t.Errorf("Expected status %d for another user's session, got %d", http.StatusNotFound, w.Code)
+				}
+			}
+
+			// Revoking the windows session logs it out
+			var other string
+			for _, session := range sessions {
+				if !session.Current {
+					other = session.ID
+				}
+			}
+			req := models.RevokeSessionRequest{RevokeSession: models.RevokeSessionInfo{SessionID: other}}
+			if w := postJSON(handler.RevokeSession, "/v0/api/auth/revokeSession", req, refreshed.AccessToken); w.Code != http.StatusNoContent {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+			}
+			if w := postRefresh(handler, windows.RefreshToken); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d for the revoked session, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if sessions := listSessions(t, handler, refreshed.AccessToken); len(sessions) != 1 || !sessions[0].Current {
+				t.Errorf("Expected only the current session, got %+v", sessions)
+			}
+
+			// Logging out everywhere includes the current session
+			if w := postJSON(handler.RevokeAllSessions, "/v0/api/auth/revokeAllSessions", models.SessionsRequest{}, refreshed.AccessToken); w.Code != http.StatusNoContent {
+				t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+			}
+			if w := postRefresh(handler, refreshed.RefreshToken); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d after logging out everywhere, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if w := postJSON(handler.Sessions, "/v0/api/auth/sessions", models.SessionsRequest{}, refreshed.AccessToken); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d after logging out everywhere, got %d", http.StatusUnauthorized, w.Code)
+			}
+
+			// Other users are not affected
+			if sessions := listSessions(t, handler, bob.AccessToken); len(sessions) != 1 {
+				t.Errorf("Expected bob's session to remain, got %+v", sessions)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_Sessions_Unauthorized(t *testing.T) {
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	cfg := createTestConfig(true)
+	handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+
+	endpoints := map[string]http.HandlerFunc{
+		"sessions":          handler.Sessions,
+		"revokeSession":     handler.RevokeSession,
+		"revokeAllSessions": handler.RevokeAllSessions,
+	}
+	for name, handlerFunc := range endpoints {
+		w := postJSON(handlerFunc, "/v0/api/auth/"+name, models.SessionsRequest{}, "")
+		if w.Code != http.StatusUnauthorized || errorType(w) != "Unauthorized" {
+			t.Errorf("%s: expected status %d, got %d", name, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
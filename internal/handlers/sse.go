@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/realtime"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// SSEHandler serves the real-time notification channel as Server-Sent Events,
+// for networks that block WebSocket upgrades
+type SSEHandler struct {
+	Config   *config.Config
+	DB       storage.Storage
+	JWTAuth  *auth.JWTAuth
+	Notifier *realtime.Notifier
+}
+
+func NewSSEHandler(cfg *config.Config, db storage.Storage, jwtAuth *auth.JWTAuth, notifier *realtime.Notifier) *SSEHandler {
+	return &SSEHandler{
+		Config:   cfg,
+		DB:       db,
+		JWTAuth:  jwtAuth,
+		Notifier: notifier,
+	}
+}
+
+// Serve handles GET /v0/sse
+func (h *SSEHandler) Serve(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.Launcher.WebSocket.Enable {
+		rw.WriteError(http.StatusNotFound, "NotFound", "Real-time notifications are not enabled")
+		return
+	}
+
+	// Streams cannot carry a request body, so the client information is
+	// passed as query parameters
+	query := r.URL.Query()
+	info := models.ClientInfo{
+		OS:              query.Get("os"),
+		Arch:            query.Get("arch"),
+		CoreVersion:     query.Get("coreVersion"),
+		ResourceVersion: query.Get("resourceVersion"),
+	}
+	language := query.Get("language")
+	if language == "" {
+		language = "en"
+	}
+
+	if info.OS == "" || info.Arch == "" {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Missing required fields: os, arch", language)
+		return
+	}
+
+	// Last-Event-ID is set by EventSource implementations on reconnect
+	lastMessageID := r.Header.Get("Last-Event-ID")
+	if lastMessageID == "" {
+		lastMessageID = query.Get("lastMessageId")
+	}
+	if lastMessageID != "" {
+		if _, ok := realtime.ParseMessageID(lastMessageID); !ok {
+			rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Invalid lastMessageId", language)
+			return
+		}
+	}
+
+	var userID string
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" && cfg.App.Authentication.Enabled {
+		claims, err := validateAccessToken(h.DB, h.JWTAuth, strings.TrimPrefix(authHeader, "Bearer "))
+		if err != nil {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
+			return
+		}
+		userID = claims.UserID
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Streaming is not supported", language)
+		return
+	}
+
+	client := realtime.NewClient()
+	client.Update(info, models.Preferences{Language: language})
+	client.SetUserID(userID)
+	client.Transport = "sse"
+	h.Notifier.Hub.Register(client)
+	defer h.Notifier.Hub.Unregister(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Keep reverse proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if cfg.Launcher.RetryIntervalSec > 0 {
+		fmt.Fprintf(w, "retry: %d\n\n", cfg.Launcher.RetryIntervalSec*1000)
+	}
+	flusher.Flush()
+
+	if lastMessageID != "" {
+		h.Notifier.Replay(client, lastMessageID)
+	}
+
+	heartbeat := time.Duration(cfg.Launcher.WebSocket.HeartbeatIntervalSec) * time.Second
+	if heartbeat <= 0 {
+		heartbeat = 30 * time.Second
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-client.Messages():
+			if err := writeEvent(w, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			// Comments keep proxies from closing an idle stream
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-client.Done():
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes a server message as an event named after its action.
+// Stored notifications carry their messageId as the event ID.
+func writeEvent(w http.ResponseWriter, msg models.ServerMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if msg.MessageID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", msg.MessageID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Action, data)
+	return err
+}
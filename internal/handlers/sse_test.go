@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/realtime"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+func createTestSSEServer(t *testing.T, cfg *config.Config) (*httptest.Server, *SSEHandler, func()) {
+	db, cleanup := createTestDatabase()
+	jwtAuth := auth.NewJWTAuth("test-secret")
+	handler := NewSSEHandler(cfg, db, jwtAuth, realtime.NewNotifier(cfg, db, realtime.NewHub()))
+
+	server := httptest.NewServer(http.HandlerFunc(handler.Serve))
+	return server, handler, func() {
+		server.Close()
+		cleanup()
+	}
+}
+
+// readSSEEvent reads the next event from a stream, skipping comments and
+// retry fields
+func readSSEEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	var event sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if event.Data != "" {
+				return event
+			}
+		case strings.HasPrefix(line, "id: "):
+			event.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestSSEHandler_Disabled(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	server, _, cleanup := createTestSSEServer(t, cfg)
+	defer cleanup()
+
+	resp, err := http.Get(server.URL + "?os=windows&arch=x64")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestSSEHandler_MissingFields(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	server, _, cleanup := createTestSSEServer(t, cfg)
+	defer cleanup()
+
+	resp, err := http.Get(server.URL + "?os=windows")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestSSEHandler_Notify(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	server, handler, cleanup := createTestSSEServer(t, cfg)
+	defer cleanup()
+	hub := handler.Notifier.Hub
+
+	resp, err := http.Get(server.URL + "?os=windows&arch=x64&coreVersion=1.0.0&resourceVersion=1.0.0&language=zh-tw")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Expected Content-Type 'text/event-stream', got %s", contentType)
+	}
+
+	waitFor(t, func() bool { return hub.Count() == 1 })
+	clients := hub.Clients()
+	if clients[0].Language() != "zh-tw" || clients[0].Info().OS != "windows" {
+		t.Errorf("Expected client info from query parameters, got %+v", clients[0].Info())
+	}
+
+	handler.Notifier.Notify(&storage.Notification{Type: "maintenance", Status: "progress", Message: "Maintenance in progress"})
+
+	event := readSSEEvent(t, bufio.NewReader(resp.Body))
+	if event.Event != "notify" || event.ID != "msg-1" {
+		t.Errorf("Expected notify event msg-1, got %+v", event)
+	}
+	var msg models.ServerMessage
+	if err := json.Unmarshal([]byte(event.Data), &msg); err != nil {
+		t.Fatalf("Failed to decode event data: %v", err)
+	}
+	if msg.MessageID != "msg-1" || msg.NotifyChanged == nil || msg.NotifyChanged.Type != "maintenance" {
+		t.Errorf("Expected the WebSocket notify payload, got %+v", msg)
+	}
+
+	resp.Body.Close()
+	waitFor(t, func() bool { return hub.Count() == 0 })
+}
+
+func TestSSEHandler_LastEventID(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	server, handler, cleanup := createTestSSEServer(t, cfg)
+	defer cleanup()
+
+	handler.Notifier.Notify(&storage.Notification{Type: "maintenance", Status: "progress", Message: "Maintenance in progress"})
+	handler.Notifier.Notify(&storage.Notification{Type: "maintenance", Status: "completed", Message: "Maintenance completed"})
+
+	req, _ := http.NewRequest("GET", server.URL+"?os=windows&arch=x64", nil)
+	req.Header.Set("Last-Event-ID", "msg-1")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	event := readSSEEvent(t, bufio.NewReader(resp.Body))
+	if event.ID != "msg-2" {
+		t.Errorf("Expected missed notification msg-2, got %+v", event)
+	}
+}
+
+func TestSSEHandler_InvalidLastEventID(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	server, _, cleanup := createTestSSEServer(t, cfg)
+	defer cleanup()
+
+	req, _ := http.NewRequest("GET", server.URL+"?os=windows&arch=x64", nil)
+	req.Header.Set("Last-Event-ID", "latest")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -20,15 +20,16 @@ func NewTestingHandler(cfg *config.Config) *TestingHandler {
 
 // Ping handles GET /v0/testing/ping
 func (h *TestingHandler) Ping(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
 	response := map[string]interface{}{
 		"message": "pong",
 		"status":  "ok",
-		"meta":    models.NewMeta(h.Config.App.Server.APIVersion, h.Config.App.Server.MinAPIVersion, h.Config.App.Server.BuildVersion, h.Config.App.Server.ReleaseDate),
+		"meta":    models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
 	}
 	
 	rw.WriteJSON(http.StatusOK, response)
@@ -36,9 +37,10 @@ func (h *TestingHandler) Ping(w http.ResponseWriter, r *http.Request) {
 
 // Echo handles POST /v0/testing/echo (debug only)
 func (h *TestingHandler) Echo(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
 	rw := &middleware.ResponseWriter{
 		ResponseWriter: w,
-		Config:         h.Config,
+		Config:         cfg,
 	}
 	
 	// Read the request body
@@ -59,7 +61,7 @@ func (h *TestingHandler) Echo(w http.ResponseWriter, r *http.Request) {
 	// Create response with echo data and meta
 	response := map[string]interface{}{
 		"echo": jsonData,
-		"meta": models.NewMeta(h.Config.App.Server.APIVersion, h.Config.App.Server.MinAPIVersion, h.Config.App.Server.BuildVersion, h.Config.App.Server.ReleaseDate),
+		"meta": models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
 	}
 	
 	rw.WriteJSON(http.StatusOK, response)
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// startTwoFactorLogin answers a login of a user with two-factor
+// authentication, by password, OpenID Connect or a device of the user, with
+// a challenge, which Login accepts with a TOTP or recovery code to finish
+// the login. deviceID is the device that logged in, if any.
+func (h *AuthHandler) startTwoFactorLogin(rw *middleware.ResponseWriter, user *storage.User, deviceID, language string) {
+	challenge := &storage.AuthChallenge{
+		Value:     auth.NewDeviceChallenge(),
+		UserID:    user.ID,
+		DeviceID:  deviceID,
+		ExpiresAt: time.Now().Add(auth.TwoFactorChallengeTTL),
+	}
+	if err := h.DB.StoreChallenge(challenge); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to store challenge", language)
+		return
+	}
+
+	rw.WriteJSON(http.StatusOK, models.LoginResponse{
+		TwoFactor: &models.TwoFactorChallenge{
+			Challenge: challenge.Value,
+			ExpiresAt: challenge.ExpiresAt.Unix(),
+			Methods:   []string{"totp", "recovery"},
+		},
+		Meta: models.NewMeta(rw.Config.App.Server.APIVersion, rw.Config.App.Server.MinAPIVersion, rw.Config.App.Server.BuildVersion, rw.Config.App.Server.ReleaseDate),
+	})
+}
+
+// consumeTwoFactorChallenge returns the user whose login the challenge
+// continues, and the device that logged in, if any. Challenges are consumed
+// by the first attempt, so a wrong code means logging in again.
+func (h *AuthHandler) consumeTwoFactorChallenge(value string) (*storage.User, string, error) {
+	challenge, err := h.DB.ConsumeChallenge(value)
+	if err != nil {
+		return nil, "", err
+	}
+	if challenge == nil || challenge.UserID == "" || time.Now().After(challenge.ExpiresAt) {
+		return nil, "", errInvalidCredentials
+	}
+
+	user, err := h.DB.GetUser(challenge.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	if user == nil || !user.TOTP.Enabled {
+		return nil, "", errInvalidCredentials
+	}
+	if user.Disabled {
+		return nil, "", errAccountDisabled
+	}
+	if challenge.DeviceID != "" {
+		// The device may have been revoked since its signature was checked
+		device, err := h.DB.GetDevice(challenge.DeviceID)
+		if err != nil {
+			return nil, "", err
+		}
+		if device == nil || device.Revoked || device.UserID != user.ID {
+			return nil, "", errInvalidCredentials
+		}
+	}
+	return user, challenge.DeviceID, nil
+}
+
+// verifySecondFactor checks a TOTP code, which cannot be used twice, or uses
+// up a recovery code. Storage records the use atomically, so that concurrent
+// logins cannot both accept the same code.
+func (h *AuthHandler) verifySecondFactor(user *storage.User, code, recoveryCode string) error {
+	if code != "" {
+		step, ok := auth.VerifyTOTP(user.TOTP.Secret, code, time.Now(), user.TOTP.LastStep)
+		if !ok {
+			return errInvalidCredentials
+		}
+		used, err := h.DB.UseTOTPStep(user.ID, step)
+		if err != nil {
+			return err
+		}
+		if !used {
+			return errInvalidCredentials
+		}
+		user.TOTP.LastStep = step
+		return nil
+	}
+
+	codeHash := auth.HashRecoveryCode(recoveryCode)
+	index := slices.Index(user.TOTP.RecoveryCodes, codeHash)
+	if recoveryCode == "" || index < 0 {
+		return errInvalidCredentials
+	}
+	used, err := h.DB.UseRecoveryCode(user.ID, codeHash)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return errInvalidCredentials
+	}
+	user.TOTP.RecoveryCodes = slices.Delete(user.TOTP.RecoveryCodes, index, index+1)
+	return nil
+}
+
+// totpUser returns the password user of the access token of a request
+func (h *AuthHandler) totpUser(rw *middleware.ResponseWriter, r *http.Request, language string) *storage.User {
+	current, err := h.authenticateSession(r)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
+		return nil
+	}
+	user, err := h.DB.GetUser(current.UserID)
+	if err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to load user", language)
+		return nil
+	}
+	if user == nil {
+		// Identifier/signature logins and anonymous devices have no account
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Account has no password", language)
+		return nil
+	}
+	if user.Disabled {
+		rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Account is disabled", language)
+		return nil
+	}
+	return user
+}
+
+// TOTPSetup handles POST /v0/api/auth/totpSetup, starting the enrollment of
+// an authenticator app. Two-factor authentication is enabled once
+// TOTPEnable receives a code of the new secret.
+func (h *AuthHandler) TOTPSetup(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+
+	var req models.TOTPSetupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	user := h.totpUser(rw, r, language)
+	if user == nil {
+		return
+	}
+	if user.TOTP.Enabled {
+		rw.WriteErrorWithLanguage(http.StatusConflict, "Conflict", "Two-factor authentication is already enabled", language)
+		return
+	}
+
+	user.TOTP = storage.TOTP{Secret: auth.GenerateTOTPSecret()}
+	if err := h.DB.UpdateUser(user); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to start two-factor setup", language)
+		return
+	}
+
+	rw.WriteJSON(http.StatusOK, models.TOTPSetupResponse{
+		TOTP: models.TOTPSetupInfo{
+			Secret:          user.TOTP.Secret,
+			ProvisioningURI: auth.TOTPProvisioningURI(cfg.App.TOTPIssuer(), user.Username, user.TOTP.Secret),
+		},
+		Meta: models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	})
+}
+
+// TOTPEnable handles POST /v0/api/auth/totpEnable, confirming the secret of
+// TOTPSetup with a code and returning the recovery codes
+func (h *AuthHandler) TOTPEnable(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+
+	var req models.TOTPEnableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	user := h.totpUser(rw, r, language)
+	if user == nil {
+		return
+	}
+	if user.TOTP.Enabled {
+		rw.WriteErrorWithLanguage(http.StatusConflict, "Conflict", "Two-factor authentication is already enabled", language)
+		return
+	}
+	if user.TOTP.Secret == "" {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Two-factor setup has not been started", language)
+		return
+	}
+
+	step, ok := auth.VerifyTOTP(user.TOTP.Secret, req.TOTPEnable.Code, time.Now(), 0)
+	if !ok {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Invalid verification code", language)
+		return
+	}
+
+	codes, hashes := auth.GenerateRecoveryCodes()
+	user.TOTP.Enabled = true
+	user.TOTP.LastStep = step
+	user.TOTP.RecoveryCodes = hashes
+	if err := h.DB.UpdateUser(user); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to enable two-factor authentication", language)
+		return
+	}
+
+	rw.WriteJSON(http.StatusOK, models.TOTPEnableResponse{
+		RecoveryCodes: codes,
+		Meta:          models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	})
+}
+
+// TOTPDisable handles POST /v0/api/auth/totpDisable. It needs the password
+// and a TOTP or recovery code, so a stolen access token cannot remove the
+// second factor.
+func (h *AuthHandler) TOTPDisable(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	rw := &middleware.ResponseWriter{
+		ResponseWriter: w,
+		Config:         cfg,
+	}
+
+	if !cfg.App.Authentication.Enabled {
+		rw.WriteError(http.StatusNotImplemented, "NotImplemented", "Authentication system not implemented")
+		return
+	}
+
+	var req models.TOTPDisableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rw.WriteError(http.StatusBadRequest, "InvalidRequest", "Invalid JSON format")
+		return
+	}
+
+	language := cfg.Language(req.Preferences.Language)
+
+	user := h.totpUser(rw, r, language)
+	if user == nil {
+		return
+	}
+	if !user.TOTP.Enabled {
+		rw.WriteErrorWithLanguage(http.StatusBadRequest, "InvalidRequest", "Two-factor authentication is not enabled", language)
+		return
+	}
+
+	// Accounts without a password, such as those created by OpenID Connect
+	// logins, prove themselves with the second factor alone
+	if user.PasswordHash != "" {
+		ok, err := auth.VerifyPassword(req.TOTPDisable.Password, user.PasswordHash)
+		if err != nil || !ok {
+			rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid credentials", language)
+			return
+		}
+	}
+	if err := h.verifySecondFactor(user, req.TOTPDisable.Code, req.TOTPDisable.RecoveryCode); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid credentials", language)
+		return
+	}
+
+	user.TOTP = storage.TOTP{}
+	if err := h.DB.UpdateUser(user); err != nil {
+		rw.WriteErrorWithLanguage(http.StatusInternalServerError, "InternalError", "Failed to disable two-factor authentication", language)
+		return
+	}
+
+	rw.WriteNoContent()
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/notify"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+	"github.com/moehoshio/NekoLcServer/internal/testutil"
+)
+
+// secondFactorLogin completes a two-factor login with a TOTP or recovery code
+func secondFactorLogin(handler *AuthHandler, challenge, code, recoveryCode string) *models.LoginResponse {
+	req := models.LoginRequest{Auth: models.AuthInfo{Challenge: challenge, TOTPCode: code, RecoveryCode: recoveryCode}}
+	w := postJSON(handler.Login, "/v0/api/auth/login", req, "")
+	if w.Code != http.StatusOK {
+		return nil
+	}
+	var response models.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return &response
+}
+
+func TestAuthHandler_TwoFactor(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			cfg.App.Authentication.TwoFactor.RequiredRoles = []string{auth.RolePublisher}
+			user := createTestUser(t, db, "alice", "password")
+			user.Roles = []string{auth.RolePublisher, auth.RoleTester}
+			db.UpdateUser(user)
+			jwtAuth := auth.NewJWTAuth(cfg.App.Authentication.JWTSecret)
+			handler := NewAuthHandler(cfg, db, jwtAuth, notify.NewLogNotifier())
+
+			// Roles requiring a second factor are withheld until it is enabled
+			login := loginFrom(t, handler, "alice", "", "")
+			claims, _ := jwtAuth.ValidateToken(login.AccessToken)
+			if claims.HasRole(auth.RolePublisher) || !claims.HasRole(auth.RoleTester) {
+				t.Errorf("Expected only the tester role before enrolling, got %v", claims.Roles)
+			}
+
+			w := postJSON(handler.TOTPSetup, "/v0/api/auth/totpSetup", models.TOTPSetupRequest{}, login.AccessToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var setup models.TOTPSetupResponse
+			json.Unmarshal(w.Body.Bytes(), &setup)
+			secret := setup.TOTP.Secret
+
+			enable := models.TOTPEnableRequest{TOTPEnable: models.TOTPEnableInfo{Code: "000000"}}
+			if w := postJSON(handler.TOTPEnable, "/v0/api/auth/totpEnable", enable, login.AccessToken); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d for a wrong code, got %d", http.StatusBadRequest, w.Code)
+			}
+			enable.TOTPEnable.Code, _ = auth.TOTPCode(secret, time.Now())
+			w = postJSON(handler.TOTPEnable, "/v0/api/auth/totpEnable", enable, login.AccessToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var enabled models.TOTPEnableResponse
+			json.Unmarshal(w.Body.Bytes(), &enabled)
+			if len(enabled.RecoveryCodes) != auth.RecoveryCodeCount {
+				t.Fatalf("Expected %d recovery codes, got %d", auth.RecoveryCodeCount, len(enabled.RecoveryCodes))
+			}
+
+			// The password alone only returns a challenge
+			challenge := loginFrom(t, handler, "alice", "", "")
+			if challenge.AccessToken != "" || challenge.TwoFactor == nil || challenge.TwoFactor.Challenge == "" {
+				t.Fatalf("Expected a two-factor challenge, got %+v", challenge)
+			}
+			if secondFactorLogin(handler, challenge.TwoFactor.Challenge, "000000", "") != nil {
+				t.Error("Expected a wrong code to be rejected")
+			}
+
+			// A wrong code uses up the challenge
+			next, _ := auth.TOTPCode(secret, time.Now().Add(30*time.Second))
+			if secondFactorLogin(handler, challenge.TwoFactor.Challenge, next, "") != nil {
+				t.Error("Expected the challenge to be used up")
+			}
+			challenge = loginFrom(t, handler, "alice", "", "")
+			tokens := secondFactorLogin(handler, challenge.TwoFactor.Challenge, next, "")
+			if tokens == nil || tokens.AccessToken == "" {
+				t.Fatal("Expected tokens after the second factor")
+			}
+			claims, _ = jwtAuth.ValidateToken(tokens.AccessToken)
+			if !claims.HasRole(auth.RolePublisher) {
+				t.Errorf("Expected the publisher role after enrolling, got %v", claims.Roles)
+			}
+
+			// Codes cannot be replayed, recovery codes work once
+			challenge = loginFrom(t, handler, "alice", "", "")
+			if secondFactorLogin(handler, challenge.TwoFactor.Challenge, next, "") != nil {
+				t.Error("Expected a used code to be rejected")
+			}
+			for i, expected := range []bool{true, false} {
+				challenge = loginFrom(t, handler, "alice", "", "")
+				if ok := secondFactorLogin(handler, challenge.TwoFactor.Challenge, "", enabled.RecoveryCodes[0]) != nil; ok != expected {
+					t.Errorf("Recovery code use %d: expected success %v", i+1, expected)
+				}
+			}
+
+			// Disabling needs the password and a second factor
+			disable := models.TOTPDisableRequest{TOTPDisable: models.TOTPDisableInfo{Password: "wrong", RecoveryCode: enabled.RecoveryCodes[1]}}
+			if w := postJSON(handler.TOTPDisable, "/v0/api/auth/totpDisable", disable, tokens.AccessToken); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d with a wrong password, got %d", http.StatusUnauthorized, w.Code)
+			}
+			disable.TOTPDisable.Password = "password"
+			if w := postJSON(handler.TOTPDisable, "/v0/api/auth/totpDisable", disable, tokens.AccessToken); w.Code != http.StatusNoContent {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+			}
+			if login := loginFrom(t, handler, "alice", "", ""); login.AccessToken == "" {
+				t.Error("Expected the password alone to log in again")
+			}
+		})
+	}
+}
+
+func TestAuthHandler_TwoFactor_DeviceChallenge(t *testing.T) {
+	db, cleanup := createTestDatabase()
+	defer cleanup()
+	cfg := createTestConfig(true)
+	handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+
+	// Device challenges do not complete password logins
+	challenge := &storage.AuthChallenge{Value: auth.NewDeviceChallenge(), ExpiresAt: time.Now().Add(time.Minute)}
+	if err := db.StoreChallenge(challenge); err != nil {
+		t.Fatalf("Failed to store challenge: %v", err)
+	}
+	if secondFactorLogin(handler, challenge.Value, "", "00000-00000") != nil {
+		t.Error("Expected a device challenge to be rejected")
+	}
+}
+
+func TestAuthHandler_TwoFactor_OtherLogins(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			handler, issuer := createTestOIDCHandler(t, db)
+			login, status := postOIDCLogin(t, handler, issuer, "forum-7", "carol")
+			if status != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+			}
+
+			// An account without a password can enroll
+			w := postJSON(handler.TOTPSetup, "/v0/api/auth/totpSetup", models.TOTPSetupRequest{}, login.AccessToken)
+			var setup models.TOTPSetupResponse
+			json.Unmarshal(w.Body.Bytes(), &setup)
+			enable := models.TOTPEnableRequest{}
+			enable.TOTPEnable.Code, _ = auth.TOTPCode(setup.TOTP.Secret, time.Now())
+			w = postJSON(handler.TOTPEnable, "/v0/api/auth/totpEnable", enable, login.AccessToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var enabled models.TOTPEnableResponse
+			json.Unmarshal(w.Body.Bytes(), &enabled)
+			device := newTestDevice(t)
+			if w := device.register(t, handler, login.AccessToken); w.Code != http.StatusCreated {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+			}
+
+			// OpenID Connect logins need the second factor too
+			challenge, status := postOIDCLogin(t, handler, issuer, "forum-7", "carol")
+			if status != http.StatusOK || challenge.AccessToken != "" || challenge.TwoFactor == nil {
+				t.Fatalf("Expected a two-factor challenge, got %d %+v", status, challenge)
+			}
+			if tokens := secondFactorLogin(handler, challenge.TwoFactor.Challenge, "", enabled.RecoveryCodes[0]); tokens == nil || tokens.AccessToken == "" {
+				t.Fatal("Expected tokens after the second factor")
+			}
+
+			// So do logins by a device of the user, whose tokens stay in the
+			// family of the device
+			var response models.LoginResponse
+			json.Unmarshal(device.login(t, handler).Body.Bytes(), &response)
+			if response.AccessToken != "" || response.TwoFactor == nil {
+				t.Fatalf("Expected a two-factor challenge, got %+v", response)
+			}
+			tokens := secondFactorLogin(handler, response.TwoFactor.Challenge, "", enabled.RecoveryCodes[1])
+			if tokens == nil || tokens.AccessToken == "" {
+				t.Fatal("Expected tokens after the second factor")
+			}
+			if stored, _ := db.FindAuthToken(handler.JWTAuth.GetTokenHash(tokens.RefreshToken)); stored == nil || stored.FamilyID != device.id {
+				t.Errorf("Expected the tokens in the family of the device, got %+v", stored)
+			}
+
+			// A device revoked before the second step does not log in
+			json.Unmarshal(device.login(t, handler).Body.Bytes(), &response)
+			stored, _ := db.GetDevice(device.id)
+			stored.Revoked = true
+			db.UpdateDevice(stored)
+			if secondFactorLogin(handler, response.TwoFactor.Challenge, "", enabled.RecoveryCodes[2]) != nil {
+				t.Error("Expected the revoked device to be rejected")
+			}
+
+			// Without a password the second factor alone disables it
+			disable := models.TOTPDisableRequest{TOTPDisable: models.TOTPDisableInfo{RecoveryCode: enabled.RecoveryCodes[3]}}
+			if w := postJSON(handler.TOTPDisable, "/v0/api/auth/totpDisable", disable, tokens.AccessToken); w.Code != http.StatusNoContent {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+			}
+			if login, _ := postOIDCLogin(t, handler, issuer, "forum-7", "carol"); login.AccessToken == "" {
+				t.Error("Expected OpenID Connect alone to log in again")
+			}
+		})
+	}
+}
+
+func TestAuthHandler_TwoFactor_ConcurrentReplay(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := createTestConfig(true)
+			cfg.App.Authentication.Lockout.MaxFailures = -1
+			cfg.App.Authentication.Lockout.MaxFailuresPerIP = -1
+			handler := NewAuthHandler(cfg, db, auth.NewJWTAuth(cfg.App.Authentication.JWTSecret), notify.NewLogNotifier())
+			user := createTestUser(t, db, "alice", "password")
+			secret := auth.GenerateTOTPSecret()
+			codes, hashes := auth.GenerateRecoveryCodes()
+			user.TOTP = storage.TOTP{Secret: secret, Enabled: true, RecoveryCodes: hashes}
+			if err := db.UpdateUser(user); err != nil {
+				t.Fatalf("Failed to update user: %v", err)
+			}
+			code, _ := auth.TOTPCode(secret, time.Now())
+
+			// Logins racing with the same code are accepted only once
+			for _, factor := range []struct{ code, recoveryCode string }{{code, ""}, {"", codes[0]}} {
+				var challenges []string
+				for i := 0; i < 8; i++ {
+					challenges = append(challenges, loginFrom(t, handler, "alice", "", "").TwoFactor.Challenge)
+				}
+				var wg sync.WaitGroup
+				var accepted atomic.Int32
+				for _, challenge := range challenges {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if secondFactorLogin(handler, challenge, factor.code, factor.recoveryCode) != nil {
+							accepted.Add(1)
+						}
+					}()
+				}
+				wg.Wait()
+				if accepted.Load() != 1 {
+					t.Errorf("Expected the second factor %+v to be accepted once, got %d", factor, accepted.Load())
+				}
+			}
+
+			stored, err := db.GetUser(user.ID)
+			if err != nil || stored == nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			if stored.TOTP.LastStep == 0 || len(stored.TOTP.RecoveryCodes) != len(hashes)-1 {
+				t.Errorf("Expected the step and one recovery code to be used, got %+v", stored.TOTP)
+			}
+		})
+	}
+}
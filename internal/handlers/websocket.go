@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/middleware"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/realtime"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+const (
+	// Maximum size of a message sent by the client
+	maxClientMessageSize = 16 * 1024
+	// Time allowed to write a message to the client
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+type WebSocketHandler struct {
+	Config   *config.Config
+	DB       storage.Storage
+	JWTAuth  *auth.JWTAuth
+	Hub      *realtime.Hub
+	Notifier *realtime.Notifier
+	upgrader websocket.Upgrader
+}
+
+func NewWebSocketHandler(cfg *config.Config, db storage.Storage, jwtAuth *auth.JWTAuth, notifier *realtime.Notifier) *WebSocketHandler {
+	return &WebSocketHandler{
+		Config:   cfg,
+		DB:       db,
+		JWTAuth:  jwtAuth,
+		Hub:      notifier.Hub,
+		Notifier: notifier,
+		upgrader: websocket.Upgrader{
+			// Launchers are not browsers, so there is no origin to check
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// Serve handles GET /v0/ws
+func (h *WebSocketHandler) Serve(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config.Current()
+	if !cfg.Launcher.WebSocket.Enable {
+		rw := &middleware.ResponseWriter{
+			ResponseWriter: w,
+			Config:         cfg,
+		}
+		rw.WriteError(http.StatusNotFound, "NotFound", "WebSocket is not enabled")
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		return
+	}
+
+	client := realtime.NewClient()
+	client.Transport = "websocket"
+	h.Hub.Register(client)
+	go h.writePump(conn, client)
+
+	h.readPump(conn, client)
+	h.Hub.Unregister(client)
+}
+
+// readPump reads client messages until the connection fails, the client
+// misses its heartbeat, or a message requires the connection to be closed
+func (h *WebSocketHandler) readPump(conn *websocket.Conn, client *realtime.Client) {
+	heartbeat := time.Duration(h.Config.Current().Launcher.WebSocket.HeartbeatIntervalSec) * time.Second
+	if heartbeat <= 0 {
+		heartbeat = 30 * time.Second
+	}
+
+	conn.SetReadLimit(maxClientMessageSize)
+	for {
+		// Clients must send a message at least once per heartbeat interval,
+		// with one interval of grace for slow networks
+		conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		// Each message is answered from the configuration it arrived under
+		cfg := h.Config.Current()
+		var msg models.ClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			client.Send(h.errorMessage(cfg, client.Language(), "InvalidRequest", "Invalid JSON format"))
+			continue
+		}
+
+		if !h.handleMessage(cfg, client, &msg) {
+			return
+		}
+	}
+}
+
+// handleMessage processes a single client message. It returns false if the
+// connection should be closed.
+func (h *WebSocketHandler) handleMessage(cfg *config.Config, client *realtime.Client, msg *models.ClientMessage) bool {
+	client.Update(msg.ClientInfo, msg.Preferences)
+	language := client.Language()
+
+	if msg.AccessToken != "" && cfg.App.Authentication.Enabled {
+		claims, err := validateAccessToken(h.DB, h.JWTAuth, msg.AccessToken)
+		if err != nil {
+			client.Send(h.errorMessage(cfg, language, "Unauthorized", "Invalid or expired token"))
+			return false
+		}
+		client.SetUserID(claims.UserID)
+	}
+
+	if msg.LastMessageID != "" {
+		// Resend the notifications missed while the client was disconnected
+		if err := h.Notifier.Replay(client, msg.LastMessageID); err != nil {
+			client.Send(h.errorMessage(cfg, language, "InvalidRequest", "Invalid lastMessageId"))
+		}
+	}
+
+	switch msg.Action {
+	case "ping":
+		client.Send(models.ServerMessage{
+			Action: "pong",
+			Meta:   h.meta(cfg),
+		})
+	case "pong":
+		// Heartbeat only
+	default:
+		client.Send(h.errorMessage(cfg, language, "InvalidRequest", "Unknown action"))
+	}
+
+	return true
+}
+
+// writePump writes queued messages to the connection and closes the
+// connection once the client is closed
+func (h *WebSocketHandler) writePump(conn *websocket.Conn, client *realtime.Client) {
+	defer conn.Close()
+
+	for {
+		select {
+		case msg := <-client.Messages():
+			conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+			if err := conn.WriteJSON(msg); err != nil {
+				client.Close()
+				return
+			}
+		case <-client.Done():
+			// Flush messages queued before the client was closed
+			for {
+				select {
+				case msg := <-client.Messages():
+					conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+					if err := conn.WriteJSON(msg); err != nil {
+						return
+					}
+				default:
+					conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+					conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+					return
+				}
+			}
+		}
+	}
+}
+
+// errorMessage builds a localized error message in the standard error format.
+// Errors are reported with the "pong" action.
+func (h *WebSocketHandler) errorMessage(cfg *config.Config, language, errorType, fallbackMessage string) models.ServerMessage {
+	localizedMessage := cfg.GetLocalizedString(language, "errors", errorType)
+	if localizedMessage == errorType {
+		localizedMessage = fallbackMessage
+	}
+
+	errorResp := models.NewErrorResponse(h.meta(cfg), errorType, localizedMessage)
+	return models.ServerMessage{
+		Action: "pong",
+		Errors: errorResp.Errors,
+		Meta:   errorResp.Meta,
+	}
+}
+
+func (h *WebSocketHandler) meta(cfg *config.Config) models.Meta {
+	return models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate)
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/notify"
+	"github.com/moehoshio/NekoLcServer/internal/realtime"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+func createTestWebSocketServer(t *testing.T, cfg *config.Config) (*httptest.Server, *WebSocketHandler, func()) {
+	db, cleanup := createTestDatabase()
+	jwtAuth := auth.NewJWTAuth("test-secret")
+	handler := NewWebSocketHandler(cfg, db, jwtAuth, realtime.NewNotifier(cfg, db, realtime.NewHub()))
+
+	server := httptest.NewServer(http.HandlerFunc(handler.Serve))
+	return server, handler, func() {
+		server.Close()
+		cleanup()
+	}
+}
+
+func dialTestWebSocket(t *testing.T, server *httptest.Server) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	return conn
+}
+
+func readServerMessage(t *testing.T, conn *websocket.Conn) models.ServerMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg models.ServerMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read server message: %v", err)
+	}
+	return msg
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketHandler_Disabled(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	server, _, cleanup := createTestWebSocketServer(t, cfg)
+	defer cleanup()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("Expected dial to fail when WebSocket is disabled")
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %d", http.StatusNotFound)
+	}
+}
+
+func TestWebSocketHandler_PingPong(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	server, handler, cleanup := createTestWebSocketServer(t, cfg)
+	defer cleanup()
+	hub := handler.Hub
+
+	conn := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	ping := models.ClientMessage{
+		Action: "ping",
+		ClientInfo: models.ClientInfo{
+			OS:              "windows",
+			Arch:            "x64",
+			CoreVersion:     "1.0.0",
+			ResourceVersion: "2.0.0",
+		},
+		Preferences: models.Preferences{
+			Language: "zh-tw",
+		},
+	}
+	if err := conn.WriteJSON(ping); err != nil {
+		t.Fatalf("Failed to send ping: %v", err)
+	}
+
+	msg := readServerMessage(t, conn)
+	if msg.Action != "pong" {
+		t.Errorf("Expected action 'pong', got %s", msg.Action)
+	}
+	if len(msg.Errors) != 0 {
+		t.Errorf("Expected no errors, got %v", msg.Errors)
+	}
+	if msg.Meta.APIVersion != "1.0.0" {
+		t.Errorf("Expected meta apiVersion '1.0.0', got %s", msg.Meta.APIVersion)
+	}
+
+	clients := hub.Clients()
+	if len(clients) != 1 {
+		t.Fatalf("Expected 1 connected client, got %d", len(clients))
+	}
+	if clients[0].Info() != ping.ClientInfo {
+		t.Errorf("Expected client info %+v, got %+v", ping.ClientInfo, clients[0].Info())
+	}
+	if clients[0].Language() != "zh-tw" {
+		t.Errorf("Expected language 'zh-tw', got %s", clients[0].Language())
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return hub.Count() == 0 })
+}
+
+func TestWebSocketHandler_InvalidMessage(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	server, _, cleanup := createTestWebSocketServer(t, cfg)
+	defer cleanup()
+
+	conn := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("{invalid json"))
+
+	msg := readServerMessage(t, conn)
+	if len(msg.Errors) == 0 || msg.Errors[0].ErrorType != "InvalidRequest" {
+		t.Errorf("Expected InvalidRequest error, got %v", msg.Errors)
+	}
+}
+
+func TestWebSocketHandler_AccessToken(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	cfg.App.Authentication.Enabled = true
+	cfg.App.Authentication.TokenExpirationSec = 3600
+	cfg.App.Authentication.RefreshTokenExpirationDays = 30
+	server, handler, cleanup := createTestWebSocketServer(t, cfg)
+	defer cleanup()
+
+	// Obtain a stored access token through the login handler
+	user := createTestUser(t, handler.DB, "admin", "password")
+	loginReq := models.LoginRequest{
+		Auth: models.AuthInfo{
+			Username: "admin",
+			Password: "password",
+		},
+	}
+	body, _ := json.Marshal(loginReq)
+	httpReq := httptest.NewRequest("POST", "/v0/api/auth/login", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	NewAuthHandler(cfg, handler.DB, handler.JWTAuth, notify.NewLogNotifier()).Login(w, httpReq)
+
+	var loginResponse models.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &loginResponse)
+
+	conn := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	conn.WriteJSON(models.ClientMessage{Action: "ping", AccessToken: loginResponse.AccessToken})
+
+	msg := readServerMessage(t, conn)
+	if len(msg.Errors) != 0 {
+		t.Fatalf("Expected no errors, got %v", msg.Errors)
+	}
+	clients := handler.Hub.Clients()
+	if len(clients) != 1 || clients[0].UserID() != user.ID {
+		t.Errorf("Expected client authenticated as %s", user.ID)
+	}
+}
+
+func TestWebSocketHandler_InvalidAccessToken(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	cfg.App.Authentication.Enabled = true
+	server, _, cleanup := createTestWebSocketServer(t, cfg)
+	defer cleanup()
+
+	conn := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	conn.WriteJSON(models.ClientMessage{Action: "ping", AccessToken: "invalid-token"})
+
+	msg := readServerMessage(t, conn)
+	if len(msg.Errors) == 0 || msg.Errors[0].ErrorType != "Unauthorized" {
+		t.Fatalf("Expected Unauthorized error, got %v", msg.Errors)
+	}
+
+	// The server closes the connection after rejecting the token
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+}
+
+func TestWebSocketHandler_HeartbeatTimeout(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	cfg.Launcher.WebSocket.HeartbeatIntervalSec = 1
+	server, handler, cleanup := createTestWebSocketServer(t, cfg)
+	defer cleanup()
+	hub := handler.Hub
+
+	conn := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	waitFor(t, func() bool { return hub.Count() == 1 })
+
+	// Without any ping the server drops the client after the grace period
+	waitFor(t, func() bool { return hub.Count() == 0 })
+}
+
+func TestWebSocketHandler_ReplayMissedNotifications(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	server, handler, cleanup := createTestWebSocketServer(t, cfg)
+	defer cleanup()
+
+	// Sent while the client was disconnected
+	handler.Notifier.Notify(&storage.Notification{Type: "maintenance", Status: "progress", Message: "Maintenance in progress"})
+
+	conn := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	conn.WriteJSON(models.ClientMessage{
+		Action:        "ping",
+		LastMessageID: "msg-0",
+		ClientInfo:    models.ClientInfo{OS: "windows", Arch: "x64"},
+	})
+
+	msg := readServerMessage(t, conn)
+	if msg.Action != "notify" || msg.MessageID != "msg-1" {
+		t.Fatalf("Expected replayed notification msg-1, got %+v", msg)
+	}
+	if msg.NotifyChanged == nil || msg.NotifyChanged.Type != "maintenance" {
+		t.Errorf("Expected maintenance notification, got %+v", msg.NotifyChanged)
+	}
+
+	msg = readServerMessage(t, conn)
+	if msg.Action != "pong" {
+		t.Errorf("Expected action 'pong', got %s", msg.Action)
+	}
+}
+
+func TestWebSocketHandler_InvalidLastMessageID(t *testing.T) {
+	cfg := createTestLauncherConfig()
+	cfg.Launcher.WebSocket.Enable = true
+	server, _, cleanup := createTestWebSocketServer(t, cfg)
+	defer cleanup()
+
+	conn := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	conn.WriteJSON(models.ClientMessage{Action: "ping", LastMessageID: "latest"})
+
+	msg := readServerMessage(t, conn)
+	if len(msg.Errors) == 0 || msg.Errors[0].ErrorType != "InvalidRequest" {
+		t.Errorf("Expected InvalidRequest error, got %v", msg.Errors)
+	}
+}
@@ -0,0 +1,135 @@
+// Package janitor purges expired tokens, sessions, password resets, login
+// failures and notifications from storage, which otherwise keeps a row or
+// file for every token ever issued.
+package janitor
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// Result counts what one run purged
+type Result struct {
+	Tokens         int64
+	Sessions       int64
+	PasswordResets int64
+	LoginFailures  int64
+	Notifications  int64
+}
+
+// Purge deletes the records that storage no longer needs:
+//   - tokens, sessions and password resets that expired more than grace ago
+//   - login failures whose last failure was more than resetAfter + grace
+//     ago, so that the lockout forgot them more than grace ago
+//   - notifications older than retention, which are no longer replayed
+//
+// Revoked tokens are kept until they expire too, so that reuse of a rotated
+// refresh token is still detected.
+func Purge(db storage.Storage, grace, resetAfter, retention time.Duration) (Result, error) {
+	var result Result
+	before := time.Now().Add(-grace)
+
+	var err error
+	if result.Tokens, err = db.PurgeAuthTokens(before); err != nil {
+		return result, err
+	}
+	if result.Sessions, err = db.PurgeSessions(before); err != nil {
+		return result, err
+	}
+	if result.PasswordResets, err = db.PurgePasswordResets(before); err != nil {
+		return result, err
+	}
+	if result.LoginFailures, err = db.PurgeLoginFailures(before.Add(-resetAfter)); err != nil {
+		return result, err
+	}
+	result.Notifications, err = db.PurgeNotifications(time.Now().Add(-retention))
+	return result, err
+}
+
+// Total returns how many records were purged
+func (r Result) Total() int64 {
+	return r.Tokens + r.Sessions + r.PasswordResets + r.LoginFailures + r.Notifications
+}
+
+// String describes what was purged
+func (r Result) String() string {
+	return fmt.Sprintf("%d expired tokens, %d expired sessions, %d expired password resets, %d login failures and %d notifications",
+		r.Tokens, r.Sessions, r.PasswordResets, r.LoginFailures, r.Notifications)
+}
+
+// Janitor runs Purge on the schedule of the configuration. Schedule changes
+// apply from the next run after a configuration reload.
+type Janitor struct {
+	Config *config.Config
+	DB     storage.Storage
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Start runs the janitor in the background until Stop is called
+func Start(cfg *config.Config, db storage.Storage) *Janitor {
+	j := &Janitor{
+		Config: cfg,
+		DB:     db,
+		stop:   make(chan struct{}),
+	}
+	go j.loop()
+	return j
+}
+
+func (j *Janitor) Stop() {
+	j.stopOnce.Do(func() { close(j.stop) })
+}
+
+func (j *Janitor) loop() {
+	for {
+		interval, _ := j.Config.Current().App.CleanupSchedule()
+		wait := interval
+		if wait == 0 {
+			// Disabled; check again in case a reload enables it
+			wait = time.Hour
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-j.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		app := j.Config.Current().App
+		if interval, grace := app.CleanupSchedule(); interval > 0 {
+			j.run(grace, app.LoginLockout().ResetAfter, app.NotificationRetention())
+		}
+	}
+}
+
+func (j *Janitor) run(grace, resetAfter, retention time.Duration) {
+	// Instances sharing a database take turns instead of purging the same rows
+	if locker, ok := j.DB.(storage.Locker); ok {
+		release, acquired, err := locker.TryLock("cleanup")
+		if err != nil {
+			log.Printf("Failed to take cleanup lock: %v", err)
+			return
+		}
+		if !acquired {
+			return
+		}
+		defer release()
+	}
+
+	result, err := Purge(j.DB, grace, resetAfter, retention)
+	if err != nil {
+		log.Printf("Failed to purge expired records: %v", err)
+	}
+	if result.Total() > 0 {
+		log.Printf("Purged %s", result)
+	}
+}
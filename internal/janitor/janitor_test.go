@@ -0,0 +1,138 @@
+package janitor
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+	"github.com/moehoshio/NekoLcServer/internal/testutil"
+)
+
+func TestPurge(t *testing.T) {
+	for name, db := range testutil.Storages(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			tokens := map[string]struct {
+				expiresAt time.Time
+				revoked   bool
+				purged    bool
+			}{
+				"expiredlongago":   {now.Add(-48 * time.Hour), false, true},
+				"revokedlongago":   {now.Add(-48 * time.Hour), true, true},
+				"expiredrecently":  {now.Add(-time.Hour), false, false},
+				"revokedunexpired": {now.Add(time.Hour), true, false},
+				"valid":            {now.Add(time.Hour), false, false},
+			}
+			for hash, token := range tokens {
+				if err := db.StoreAuthToken(&storage.AuthToken{TokenHash: hash, TokenType: "access", UserID: "u1", FamilyID: hash, ExpiresAt: token.expiresAt}); err != nil {
+					t.Fatalf("Failed to store token: %v", err)
+				}
+				if token.revoked {
+					db.RevokeAuthToken(hash)
+				}
+				session := &storage.Session{ID: hash, UserID: "u1", CreatedAt: now, LastUsedAt: now, ExpiresAt: token.expiresAt}
+				if err := db.StoreSession(session); err != nil {
+					t.Fatalf("Failed to store session: %v", err)
+				}
+			}
+
+			for hash, expiresAt := range map[string]time.Time{"resetlongago": now.Add(-48 * time.Hour), "resetrecently": now.Add(-time.Hour)} {
+				if err := db.StorePasswordReset(&storage.PasswordReset{TokenHash: hash, UserID: "u1", ExpiresAt: expiresAt}); err != nil {
+					t.Fatalf("Failed to store password reset: %v", err)
+				}
+			}
+			// Failures are forgotten an hour after the last one
+			for key, lastFailureAt := range map[string]time.Time{"user:old": now.Add(-26 * time.Hour), "user:recent": now.Add(-24 * time.Hour)} {
+				_, err := db.UpdateLoginFailures(key, func(failures *storage.LoginFailures) bool {
+					failures.Count = 3
+					failures.LastFailureAt = lastFailureAt
+					return true
+				})
+				if err != nil {
+					t.Fatalf("Failed to store login failures: %v", err)
+				}
+			}
+
+			for _, createdAt := range []time.Time{now.Add(-73 * time.Hour), now.Add(-71 * time.Hour)} {
+				if err := db.StoreNotification(&storage.Notification{Type: "update", CreatedAt: createdAt}); err != nil {
+					t.Fatalf("Failed to store notification: %v", err)
+				}
+			}
+
+			result, err := Purge(db, 24*time.Hour, time.Hour, 72*time.Hour)
+			if err != nil {
+				t.Fatalf("Failed to purge: %v", err)
+			}
+			if result != (Result{Tokens: 2, Sessions: 2, PasswordResets: 1, LoginFailures: 1, Notifications: 1}) {
+				t.Errorf("Expected 2 tokens, 2 sessions, 1 password reset, 1 login failure and 1 notification purged, got %+v", result)
+			}
+			for hash, token := range tokens {
+				stored, _ := db.FindAuthToken(hash)
+				if (stored == nil) != token.purged {
+					t.Errorf("%s: expected purged=%v", hash, token.purged)
+				}
+				session, _ := db.GetSession(hash)
+				if (session == nil) != token.purged {
+					t.Errorf("%s: expected session purged=%v", hash, token.purged)
+				}
+			}
+
+			if failures, _ := db.GetLoginFailures("user:recent"); failures == nil {
+				t.Error("Expected failures that are not forgotten yet to be kept")
+			}
+			if reset, _ := db.ConsumePasswordReset("resetrecently"); reset == nil {
+				t.Error("Expected a recently expired password reset to be kept")
+			}
+			if notifications, _ := db.GetNotificationsSince(0); len(notifications) != 1 {
+				t.Errorf("Expected 1 notification within the retention to be kept, got %d", len(notifications))
+			}
+
+			if result, _ := Purge(db, 24*time.Hour, time.Hour, 72*time.Hour); result.Total() != 0 {
+				t.Errorf("Expected nothing left to purge, got %+v", result)
+			}
+		})
+	}
+}
+
+// lockedStorage is storage whose cleanup lock another instance may hold
+type lockedStorage struct {
+	storage.Storage
+	held     bool
+	released int
+}
+
+func (l *lockedStorage) TryLock(name string) (func(), bool, error) {
+	if l.held {
+		return nil, false, nil
+	}
+	return func() { l.released++ }, true, nil
+}
+
+func TestJanitor_Lock(t *testing.T) {
+	database, err := storage.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer database.Close()
+	expired := &storage.AuthToken{TokenHash: "expired", TokenType: "access", UserID: "u1", ExpiresAt: time.Now().Add(-48 * time.Hour)}
+	if err := database.StoreAuthToken(expired); err != nil {
+		t.Fatalf("Failed to store token: %v", err)
+	}
+
+	db := &lockedStorage{Storage: database, held: true}
+	j := &Janitor{DB: db}
+	j.run(24*time.Hour, time.Hour, 72*time.Hour)
+	if token, _ := database.FindAuthToken("expired"); token == nil {
+		t.Error("Expected no purge while another instance holds the lock")
+	}
+
+	db.held = false
+	j.run(24*time.Hour, time.Hour, 72*time.Hour)
+	if token, _ := database.FindAuthToken("expired"); token != nil {
+		t.Error("Expected the token to be purged once the lock is free")
+	}
+	if db.released != 1 {
+		t.Errorf("Expected the lock to be released once, got %d", db.released)
+	}
+}
@@ -1,9 +1,14 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"log"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/moehoshio/NekoLcServer/internal/auth"
 	"github.com/moehoshio/NekoLcServer/internal/config"
@@ -14,7 +19,7 @@ import (
 // ResponseWriter wraps http.ResponseWriter to provide utility methods
 type ResponseWriter struct {
 	http.ResponseWriter
-	Config *config.Config
+	Config *config.Config // the snapshot the request is served from
 }
 
 // WriteJSON writes a JSON response with the given status code
@@ -54,9 +59,10 @@ func CommonMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Wrap the response writer
+			current := cfg.Current()
 			rw := &ResponseWriter{
 				ResponseWriter: w,
-				Config:         cfg,
+				Config:         current,
 			}
 			
 			// Set common headers
@@ -74,26 +80,84 @@ func CommonMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
 	}
 }
 
-// AuthMiddleware checks for valid JWT authentication
-func AuthMiddleware(cfg *config.Config, db storage.Storage, jwtAuth *auth.JWTAuth, required bool) func(http.Handler) http.Handler {
+// contextKey is the type of the request context keys of this package
+type contextKey int
+
+const claimsKey contextKey = 0
+
+// WithClaims returns a context carrying the claims of an authenticated request
+func WithClaims(ctx context.Context, claims *auth.Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext returns the claims of the access token that
+// AuthMiddleware accepted for the request, if any
+func ClaimsFromContext(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*auth.Claims)
+	return claims, ok && claims != nil
+}
+
+// APIKeyHeader is the request header that carries API keys
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyTouchInterval limits how often the last use of an API key is written
+const apiKeyTouchInterval = time.Minute
+
+// AuthMiddleware checks the access token of a request according to the
+// policy configured for the route in authentication.routePolicies:
+//   - none: the Authorization header is ignored
+//   - optional (default): a valid token is accepted, anything else is anonymous
+//   - required: a valid token is required
+//   - role:<name>: a valid token granting the role is required
+// An API key in the X-API-Key header is accepted in place of an access
+// token, granting the roles of its scopes. Claims of accepted tokens and
+// keys are available through ClaimsFromContext.
+func AuthMiddleware(cfg *config.Config, db storage.Storage, jwtAuth *auth.JWTAuth, route string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current := cfg.Current()
 			rw := &ResponseWriter{
 				ResponseWriter: w,
-				Config:         cfg,
+				Config:         current,
 			}
 			
 			// If authentication is not enabled, proceed
-			if !cfg.App.Authentication.Enabled {
+			if !current.App.Authentication.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			
+			policy := current.App.RoutePolicy(route)
+			if policy.Level == "none" {
 				next.ServeHTTP(w, r)
 				return
 			}
+			required := policy.Level == "required"
+			language := RequestLanguage(r)
+			
+			if key := r.Header.Get(APIKeyHeader); key != "" {
+				claims, err := authenticateAPIKey(db, key)
+				if err != nil || claims == nil {
+					if required {
+						rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired API key", language)
+						return
+					}
+					next.ServeHTTP(w, r)
+					return
+				}
+				if policy.Role != "" && !claims.Grants(policy.Role) {
+					rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Insufficient role", language)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+				return
+			}
 			
 			// Check for Authorization header
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
 				if required {
-					rw.WriteError(http.StatusUnauthorized, "Unauthorized", "Authorization header required")
+					rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Authorization header required", language)
 					return
 				}
 				next.ServeHTTP(w, r)
@@ -103,7 +167,7 @@ func AuthMiddleware(cfg *config.Config, db storage.Storage, jwtAuth *auth.JWTAut
 			// Check Bearer token format
 			if !strings.HasPrefix(authHeader, "Bearer ") {
 				if required {
-					rw.WriteError(http.StatusUnauthorized, "Unauthorized", "Invalid authorization format")
+					rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid authorization format", language)
 					return
 				}
 				next.ServeHTTP(w, r)
@@ -113,11 +177,11 @@ func AuthMiddleware(cfg *config.Config, db storage.Storage, jwtAuth *auth.JWTAut
 			// Extract token
 			token := strings.TrimPrefix(authHeader, "Bearer ")
 			
-			// Validate JWT token
-			_, err := jwtAuth.ValidateToken(token)
-			if err != nil {
+			// Validate JWT token; refresh tokens do not authenticate requests
+			claims, err := jwtAuth.ValidateToken(token)
+			if err != nil || claims.TokenType != "access" {
 				if required {
-					rw.WriteError(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token")
+					rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Invalid or expired token", language)
 					return
 				}
 				next.ServeHTTP(w, r)
@@ -129,31 +193,118 @@ func AuthMiddleware(cfg *config.Config, db storage.Storage, jwtAuth *auth.JWTAut
 			storedToken, err := db.GetAuthToken(tokenHash)
 			if err != nil || storedToken == nil || storedToken.IsRevoked {
 				if required {
-					rw.WriteError(http.StatusUnauthorized, "Unauthorized", "Token has been revoked")
+					rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Token has been revoked", language)
 					return
 				}
 				next.ServeHTTP(w, r)
 				return
 			}
 			
-			// Add user info to request context if needed
-			// context.WithValue(r.Context(), "userID", claims.UserID)
+			if policy.Role != "" && !claims.Grants(policy.Role) {
+				rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Insufficient role", language)
+				return
+			}
+			
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		})
+	}
+}
+
+// authenticateAPIKey returns the claims of a valid API key, or nil if the
+// key is unknown, revoked or expired, or its owner is missing or disabled.
+// A key created by a user only carries the scopes its owner still grants;
+// keys created from the command line have no owner and keep their scopes.
+func authenticateAPIKey(db storage.Storage, key string) (*auth.Claims, error) {
+	apiKey, err := db.GetAPIKeyByHash(auth.HashAPIKey(key))
+	if err != nil || apiKey == nil {
+		return nil, err
+	}
+	now := time.Now()
+	if apiKey.Revoked || apiKey.Expired(now) {
+		return nil, nil
+	}
+	roles := apiKey.Scopes
+	if apiKey.UserID != "" {
+		owner, err := db.GetUser(apiKey.UserID)
+		if err != nil || owner == nil || owner.Disabled {
+			return nil, err
+		}
+		roles = auth.GrantedRoles(apiKey.Scopes, owner.Roles)
+	}
+	
+	if now.Sub(apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		if err := db.TouchAPIKey(apiKey.ID, now); err != nil {
+			log.Printf("Failed to record use of API key %s: %v", apiKey.ID, err)
+		}
+	}
+	
+	return &auth.Claims{
+		UserID:    apiKey.UserID,
+		TokenType: auth.APIKeyTokenType,
+		Roles:     roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID: apiKey.ID,
+		},
+	}, nil
+}
+
+// RequireRole rejects requests whose access token does not grant the role.
+// It runs after an AuthMiddleware that put the claims in the request context;
+// requests without claims are unauthenticated. Since roles cannot be checked
+// without authentication, the route is unavailable when it is disabled.
+func RequireRole(cfg *config.Config, role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current := cfg.Current()
+			rw := &ResponseWriter{
+				ResponseWriter: w,
+				Config:         current,
+			}
+			language := RequestLanguage(r)
+			
+			if !current.App.Authentication.Enabled {
+				rw.WriteErrorWithLanguage(http.StatusNotImplemented, "NotImplemented", "Authentication is not enabled", language)
+				return
+			}
+			
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok {
+				rw.WriteErrorWithLanguage(http.StatusUnauthorized, "Unauthorized", "Authorization header required", language)
+				return
+			}
+			if !claims.Grants(role) {
+				rw.WriteErrorWithLanguage(http.StatusForbidden, "Forbidden", "Insufficient role", language)
+				return
+			}
 			
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+// RequestLanguage returns the language of the first tag of the
+// Accept-Language header, for errors written before a request body is read
+func RequestLanguage(r *http.Request) string {
+	tag, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	tag, _, _ = strings.Cut(tag, ";")
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || tag == "*" {
+		return "en"
+	}
+	return tag
+}
+
 // DebugOnlyMiddleware restricts access to debug-only endpoints
 func DebugOnlyMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current := cfg.Current()
 			rw := &ResponseWriter{
 				ResponseWriter: w,
-				Config:         cfg,
+				Config:         current,
 			}
 			
-			if !cfg.App.Debug.Enabled {
+			if !current.App.Debug.Enabled {
 				rw.WriteError(http.StatusNotFound, "NotFound", "Endpoint not available in production")
 				return
 			}
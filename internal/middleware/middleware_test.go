@@ -0,0 +1,319 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/auth"
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+const testRoute = "/v0/api/feedbackLog"
+
+// issueToken stores and returns a token pair for the user
+func issueToken(t *testing.T, db storage.Storage, jwtAuth *auth.JWTAuth, userID string, roles ...string) *auth.TokenPair {
+	t.Helper()
+	tokens, err := jwtAuth.GenerateUserTokens(userID, roles)
+	if err != nil {
+		t.Fatalf("Failed to generate tokens: %v", err)
+	}
+	for token, tokenType := range map[string]string{tokens.AccessToken: "access", tokens.RefreshToken: "refresh"} {
+		stored := &storage.AuthToken{TokenHash: jwtAuth.GetTokenHash(token), TokenType: tokenType, UserID: userID, ExpiresAt: tokens.RefreshTokenExpiresAt}
+		if err := db.StoreAuthToken(stored); err != nil {
+			t.Fatalf("Failed to store token: %v", err)
+		}
+	}
+	return tokens
+}
+
+func TestAuthMiddleware_Policies(t *testing.T) {
+	db, err := storage.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := &config.Config{App: &config.AppConfig{}}
+	cfg.App.Authentication.Enabled = true
+	jwtAuth := auth.NewJWTAuth("test-secret")
+	tokens := issueToken(t, db, jwtAuth, "user-1")
+	revoked := issueToken(t, db, jwtAuth, "user-2")
+	publisher := issueToken(t, db, jwtAuth, "user-3", auth.RolePublisher)
+	admin := issueToken(t, db, jwtAuth, "user-4", auth.RoleAdmin)
+	db.RevokeAuthToken(jwtAuth.GetTokenHash(revoked.AccessToken))
+
+	var seenUser string
+	handler := AuthMiddleware(cfg, db, jwtAuth, testRoute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenUser = ""
+		if claims, ok := ClaimsFromContext(r.Context()); ok {
+			seenUser = claims.UserID
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		policy string
+		token  string
+		status int
+		user   string
+	}{
+		{"", "", http.StatusNoContent, ""},
+		{"", tokens.AccessToken, http.StatusNoContent, "user-1"},
+		{"optional", "invalid", http.StatusNoContent, ""},
+		{"optional", revoked.AccessToken, http.StatusNoContent, ""},
+		{"none", tokens.AccessToken, http.StatusNoContent, ""},
+		{"required", "", http.StatusUnauthorized, ""},
+		{"required", tokens.RefreshToken, http.StatusUnauthorized, ""},
+		{"required", revoked.AccessToken, http.StatusUnauthorized, ""},
+		{"required", tokens.AccessToken, http.StatusNoContent, "user-1"},
+		{"role:publisher", "", http.StatusUnauthorized, ""},
+		{"role:publisher", tokens.AccessToken, http.StatusForbidden, ""},
+		{"role:publisher", publisher.AccessToken, http.StatusNoContent, "user-3"},
+		{"role:publisher", admin.AccessToken, http.StatusNoContent, "user-4"},
+		{"role:tester", publisher.AccessToken, http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		cfg.App.Authentication.RoutePolicies = map[string]string{}
+		if test.policy != "" {
+			cfg.App.Authentication.RoutePolicies[testRoute] = test.policy
+		}
+		if err := cfg.App.Validate(); err != nil {
+			t.Fatalf("policy %q: failed to validate: %v", test.policy, err)
+		}
+		seenUser = ""
+		req := httptest.NewRequest("POST", testRoute, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status || seenUser != test.user {
+			t.Errorf("policy %q: expected status %d and user %q, got %d and %q", test.policy, test.status, test.user, w.Code, seenUser)
+		}
+	}
+
+	// Invalid policies are rejected when the configuration is loaded
+	for _, policy := range []string{"role:", "sometimes"} {
+		cfg.App.Authentication.RoutePolicies = map[string]string{testRoute: policy}
+		if err := cfg.App.Validate(); err == nil {
+			t.Errorf("policy %q: expected the configuration to be rejected", policy)
+		}
+	}
+
+	// Without authentication every route is open
+	cfg.App.Authentication.Enabled = false
+	cfg.App.Authentication.RoutePolicies = map[string]string{testRoute: "required"}
+	if err := cfg.App.Validate(); err != nil {
+		t.Fatalf("Failed to validate: %v", err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", testRoute, nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d with authentication disabled, got %d", http.StatusNoContent, w.Code)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	cfg := &config.Config{App: &config.AppConfig{}}
+	cfg.App.Authentication.Enabled = true
+	cfg.Languages = config.LanguageConfig{
+		"en":    {Errors: map[string]string{"Forbidden": "Access denied."}},
+		"zh-tw": {Errors: map[string]string{"Forbidden": "拒絕存取。"}},
+	}
+	handler := RequireRole(cfg, auth.RoleTester)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(claims *auth.Claims, language string) *httptest.ResponseRecorder {
+		ctx := context.Background()
+		if claims != nil {
+			ctx = WithClaims(ctx, claims)
+		}
+		req := httptest.NewRequest("POST", testRoute, nil).WithContext(ctx)
+		if language != "" {
+			req.Header.Set("Accept-Language", language)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(nil, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without claims, got %d", http.StatusUnauthorized, w.Code)
+	}
+	for _, roles := range [][]string{{auth.RoleTester}, {auth.RoleAdmin}} {
+		if w := serve(&auth.Claims{UserID: "user-1", Roles: roles}, ""); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d with roles %v, got %d", http.StatusNoContent, roles, w.Code)
+		}
+	}
+
+	// Rejections are localized
+	for language, message := range map[string]string{"": "Access denied.", "zh-TW,zh;q=0.9": "拒絕存取。", "fr": "Access denied."} {
+		w := serve(&auth.Claims{UserID: "user-1", Roles: []string{auth.RolePublisher}}, language)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+			continue
+		}
+		var response models.ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if len(response.Errors) != 1 || response.Errors[0].ErrorMessage != message {
+			t.Errorf("Accept-Language %q: expected message %q, got %+v", language, message, response.Errors)
+		}
+	}
+
+	cfg.App.Authentication.Enabled = false
+	if w := serve(&auth.Claims{UserID: "user-1", Roles: []string{auth.RoleTester}}, ""); w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status %d with authentication disabled, got %d", http.StatusNotImplemented, w.Code)
+	}
+}
+
+func TestAuthMiddleware_APIKey(t *testing.T) {
+	db, err := storage.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := &config.Config{App: &config.AppConfig{}}
+	cfg.App.Authentication.Enabled = true
+	jwtAuth := auth.NewJWTAuth("test-secret")
+
+	keys := map[string]*storage.APIKey{
+		"valid":   {Name: "ci", Scopes: []string{auth.RolePublisher}},
+		"expired": {Name: "old", Scopes: []string{auth.RolePublisher}, ExpiresAt: time.Now().Add(-time.Hour)},
+		"revoked": {Name: "leaked", Scopes: []string{auth.RolePublisher}},
+	}
+	secrets := make(map[string]string)
+	for name, apiKey := range keys {
+		secrets[name] = auth.GenerateAPIKey()
+		apiKey.KeyHash = auth.HashAPIKey(secrets[name])
+		if err := db.CreateAPIKey(apiKey); err != nil {
+			t.Fatalf("Failed to create API key: %v", err)
+		}
+	}
+	db.RevokeAPIKey(keys["revoked"].ID)
+
+	var seen *auth.Claims
+	handler := AuthMiddleware(cfg, db, jwtAuth, testRoute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = ClaimsFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		policy string
+		key    string
+		status int
+		scoped bool
+	}{
+		{"optional", secrets["valid"], http.StatusNoContent, true},
+		{"optional", "nlk_unknown", http.StatusNoContent, false},
+		{"required", "nlk_unknown", http.StatusUnauthorized, false},
+		{"required", secrets["expired"], http.StatusUnauthorized, false},
+		{"required", secrets["revoked"], http.StatusUnauthorized, false},
+		{"role:publisher", secrets["valid"], http.StatusNoContent, true},
+		{"role:tester", secrets["valid"], http.StatusForbidden, false},
+	}
+	for _, test := range tests {
+		cfg.App.Authentication.RoutePolicies = map[string]string{testRoute: test.policy}
+		if err := cfg.App.Validate(); err != nil {
+			t.Fatalf("policy %q: failed to validate: %v", test.policy, err)
+		}
+		seen = nil
+		req := httptest.NewRequest("POST", testRoute, nil)
+		req.Header.Set(APIKeyHeader, test.key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status || (seen != nil) != test.scoped {
+			t.Errorf("policy %q: expected status %d and claims %v, got %d and %+v", test.policy, test.status, test.scoped, w.Code, seen)
+			continue
+		}
+		if seen != nil && (seen.TokenType != auth.APIKeyTokenType || seen.ID != keys["valid"].ID) {
+			t.Errorf("Expected the claims of the API key, got %+v", seen)
+		}
+	}
+
+	stored, err := db.GetAPIKey(keys["valid"].ID)
+	if err != nil || stored == nil {
+		t.Fatalf("Failed to get API key: %v", err)
+	}
+	if time.Since(stored.LastUsedAt) > time.Minute {
+		t.Errorf("Expected the last use to be recorded, got %v", stored.LastUsedAt)
+	}
+	if stored, _ := db.GetAPIKey(keys["expired"].ID); !stored.LastUsedAt.IsZero() {
+		t.Errorf("Expected the expired key not to be marked used, got %v", stored.LastUsedAt)
+	}
+}
+
+func TestAuthMiddleware_APIKeyOwner(t *testing.T) {
+	db, err := storage.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := &config.Config{App: &config.AppConfig{}}
+	cfg.App.Authentication.Enabled = true
+	cfg.App.Authentication.RoutePolicies = map[string]string{testRoute: "required"}
+	if err := cfg.App.Validate(); err != nil {
+		t.Fatalf("Failed to validate: %v", err)
+	}
+
+	owner := &storage.User{Username: "alice", Roles: []string{auth.RoleAdmin}}
+	if err := db.CreateUser(owner); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	secret := auth.GenerateAPIKey()
+	apiKey := &storage.APIKey{UserID: owner.ID, Name: "ci", KeyHash: auth.HashAPIKey(secret), Scopes: []string{auth.RoleAdmin, auth.RolePublisher}}
+	if err := db.CreateAPIKey(apiKey); err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+
+	var seen *auth.Claims
+	handler := AuthMiddleware(cfg, db, auth.NewJWTAuth("test-secret"), testRoute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = ClaimsFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func() int {
+		seen = nil
+		req := httptest.NewRequest("POST", testRoute, nil)
+		req.Header.Set(APIKeyHeader, secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := serve(); code != http.StatusNoContent || !slices.Equal(seen.Roles, apiKey.Scopes) {
+		t.Fatalf("Expected the key to carry its scopes, got %d and %+v", code, seen)
+	}
+
+	// Scopes the owner no longer holds are dropped
+	owner.Roles = []string{auth.RolePublisher}
+	if err := db.UpdateUser(owner); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	if code := serve(); code != http.StatusNoContent || !slices.Equal(seen.Roles, []string{auth.RolePublisher}) {
+		t.Errorf("Expected only the publisher scope, got %d and %+v", code, seen)
+	}
+
+	owner.Disabled = true
+	if err := db.UpdateUser(owner); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	if code := serve(); code != http.StatusUnauthorized {
+		t.Errorf("Expected the key of a disabled owner to be rejected, got %d", code)
+	}
+
+	if err := db.DeleteUser(owner.ID); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	if code := serve(); code != http.StatusUnauthorized {
+		t.Errorf("Expected the key of a deleted owner to be rejected, got %d", code)
+	}
+}
@@ -0,0 +1,49 @@
+package models
+
+// API key models
+
+type APIKeysRequest struct {
+	Preferences Preferences `json:"preferences,omitempty"`
+}
+
+type APIKeysResponse struct {
+	APIKeys []APIKey `json:"apiKeys"`
+	Meta    Meta     `json:"meta"`
+}
+
+type APIKey struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedBy  string   `json:"createdBy,omitempty"` // user ID, empty if created from the command line
+	Revoked    bool     `json:"revoked"`
+	CreatedAt  int64    `json:"createdAt"`            // Unix seconds
+	ExpiresAt  int64    `json:"expiresAt,omitempty"`  // Unix seconds, omitted if the key does not expire
+	LastUsedAt int64    `json:"lastUsedAt,omitempty"` // Unix seconds, omitted if the key was never used
+}
+
+type CreateAPIKeyRequest struct {
+	CreateAPIKey CreateAPIKeyInfo `json:"createApiKey"`
+	Preferences  Preferences      `json:"preferences,omitempty"`
+}
+
+type CreateAPIKeyInfo struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays,omitempty"` // 0 for a key that does not expire
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey APIKey `json:"apiKey"`
+	Key    string `json:"key"` // shown only once
+	Meta   Meta   `json:"meta"`
+}
+
+type RevokeAPIKeyRequest struct {
+	RevokeAPIKey RevokeAPIKeyInfo `json:"revokeApiKey"`
+	Preferences  Preferences      `json:"preferences,omitempty"`
+}
+
+type RevokeAPIKeyInfo struct {
+	ID string `json:"id"`
+}
@@ -4,9 +4,16 @@ package models
 
 type LoginRequest struct {
 	Auth        AuthInfo    `json:"auth"`
+	Session     SessionInfo `json:"session,omitempty"`
 	Preferences Preferences `json:"preferences,omitempty"`
 }
 
+// SessionInfo describes the launcher a login comes from, shown in the list of sessions
+type SessionInfo struct {
+	OS   string `json:"os,omitempty"`
+	Arch string `json:"arch,omitempty"`
+}
+
 type AuthInfo struct {
 	// Username/password authentication
 	Username string `json:"username,omitempty"`
@@ -15,13 +22,37 @@ type AuthInfo struct {
 	// Identifier/signature authentication
 	Identifier string `json:"identifier,omitempty"`
 	Timestamp  int64  `json:"timestamp,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`
 	Signature  string `json:"signature,omitempty"`
+	
+	// Device challenge/response authentication, the signature is over the challenge
+	DeviceID  string `json:"deviceId,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
+	
+	// Second factor, sent with the challenge of a TwoFactorChallenge
+	TOTPCode     string `json:"totpCode,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+	
+	// OpenID Connect authorization code with PKCE, see OIDCAuthorizeRequest.
+	// Nonce, if sent to the provider, must be sent here as well.
+	Code         string `json:"code,omitempty"`
+	CodeVerifier string `json:"codeVerifier,omitempty"`
+	RedirectURI  string `json:"redirectUri,omitempty"`
 }
 
+// LoginResponse carries either the tokens or, when the password of a user
+// with two-factor authentication was accepted, the challenge to complete
 type LoginResponse struct {
-	AccessToken  string `json:"accessToken"`
-	RefreshToken string `json:"refreshToken"`
-	Meta         Meta   `json:"meta"`
+	AccessToken  string              `json:"accessToken,omitempty"`
+	RefreshToken string              `json:"refreshToken,omitempty"`
+	TwoFactor    *TwoFactorChallenge `json:"twoFactor,omitempty"`
+	Meta         Meta                `json:"meta"`
+}
+
+type TwoFactorChallenge struct {
+	Challenge string   `json:"challenge"`
+	ExpiresAt int64    `json:"expiresAt"` // Unix seconds
+	Methods   []string `json:"methods"`   // "totp" and "recovery"
 }
 
 type RefreshRequest struct {
@@ -29,12 +60,27 @@ type RefreshRequest struct {
 }
 
 type RefreshResponse struct {
-	AccessToken string `json:"accessToken"`
-	Meta        Meta   `json:"meta"`
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"` // replaces the refresh token that was sent
+	Meta         Meta   `json:"meta"`
 }
 
 type ValidateRequest struct {
 	AccessToken string `json:"accessToken"`
+	Introspect  bool   `json:"introspect,omitempty"` // describe the token instead of answering 204 or 401
+}
+
+// IntrospectionResponse describes a token in the style of RFC 7662. Only
+// Active is set for tokens that are invalid, expired or revoked.
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	Sub       string   `json:"sub,omitempty"`       // user ID
+	Exp       int64    `json:"exp,omitempty"`       // Unix seconds
+	Iat       int64    `json:"iat,omitempty"`       // Unix seconds
+	TokenType string   `json:"tokenType,omitempty"` // "access" or "refresh"
+	Roles     []string `json:"roles,omitempty"`
+	SessionID string   `json:"sessionId,omitempty"` // see SessionsResponse
+	Meta      Meta     `json:"meta"`
 }
 
 type LogoutRequest struct {
@@ -44,4 +90,169 @@ type LogoutRequest struct {
 type LogoutInfo struct {
 	AccessToken  string `json:"accessToken"`
 	RefreshToken string `json:"refreshToken"`
-}
\ No newline at end of file
+}
+type RegisterRequest struct {
+	Register    RegisterInfo `json:"register"`
+	Session     SessionInfo  `json:"session,omitempty"`
+	Preferences Preferences  `json:"preferences,omitempty"`
+}
+
+type RegisterInfo struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordRequest struct {
+	ChangePassword ChangePasswordInfo `json:"changePassword"`
+	Preferences    Preferences        `json:"preferences,omitempty"`
+}
+
+type ChangePasswordInfo struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+type PasswordResetRequest struct {
+	PasswordReset PasswordResetInfo `json:"passwordReset"`
+	Preferences   Preferences       `json:"preferences,omitempty"`
+}
+
+type PasswordResetInfo struct {
+	// Requesting a reset token
+	Username string `json:"username,omitempty"`
+	
+	// Resetting the password with the token
+	Token       string `json:"token,omitempty"`
+	NewPassword string `json:"newPassword,omitempty"`
+}
+
+type ChallengeRequest struct {
+	Preferences Preferences `json:"preferences,omitempty"`
+}
+
+type ChallengeResponse struct {
+	Challenge ChallengeInfo `json:"challenge"`
+	Meta      Meta          `json:"meta"`
+}
+
+type ChallengeInfo struct {
+	Value     string `json:"value"`     // sign the bytes of this string
+	ExpiresAt int64  `json:"expiresAt"` // Unix seconds
+}
+
+type RegisterDeviceRequest struct {
+	Device      RegisterDeviceInfo `json:"device"`
+	Preferences Preferences        `json:"preferences,omitempty"`
+}
+
+type RegisterDeviceInfo struct {
+	PublicKey string `json:"publicKey"` // base64 Ed25519 public key
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"` // proves possession of the key
+	Name      string `json:"name,omitempty"`
+}
+
+type RegisterDeviceResponse struct {
+	Device DeviceInfo `json:"device"`
+	Meta   Meta       `json:"meta"`
+}
+
+type DeviceInfo struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Anonymous bool   `json:"anonymous"` // not bound to a user
+}
+
+type RevokeDeviceRequest struct {
+	RevokeDevice RevokeDeviceInfo `json:"revokeDevice"`
+	Preferences  Preferences      `json:"preferences,omitempty"`
+}
+
+type RevokeDeviceInfo struct {
+	DeviceID string `json:"deviceId"`
+}
+
+type OIDCAuthorizeRequest struct {
+	OIDCAuthorize OIDCAuthorizeInfo `json:"oidcAuthorize"`
+	Preferences   Preferences       `json:"preferences,omitempty"`
+}
+
+type OIDCAuthorizeInfo struct {
+	RedirectURI   string `json:"redirectUri"`
+	CodeChallenge string `json:"codeChallenge"` // base64url SHA-256 of the code verifier
+	State         string `json:"state,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+}
+
+type OIDCAuthorizeResponse struct {
+	AuthorizationURL string `json:"authorizationUrl"`
+	Meta             Meta   `json:"meta"`
+}
+
+type SessionsRequest struct {
+	Preferences Preferences `json:"preferences,omitempty"`
+}
+
+type SessionsResponse struct {
+	Sessions []Session `json:"sessions"`
+	Meta     Meta      `json:"meta"`
+}
+
+type Session struct {
+	ID         string `json:"id"`
+	OS         string `json:"os,omitempty"`
+	Arch       string `json:"arch,omitempty"`
+	UserAgent  string `json:"userAgent,omitempty"`
+	IPAddress  string `json:"ipAddress,omitempty"`
+	CreatedAt  int64  `json:"createdAt"`  // Unix seconds
+	LastUsedAt int64  `json:"lastUsedAt"` // Unix seconds, last login or refresh
+	Current    bool   `json:"current"`    // the session of the access token used for the request
+}
+
+type RevokeSessionRequest struct {
+	RevokeSession RevokeSessionInfo `json:"revokeSession"`
+	Preferences   Preferences       `json:"preferences,omitempty"`
+}
+
+type RevokeSessionInfo struct {
+	SessionID string `json:"sessionId"`
+}
+
+type TOTPSetupRequest struct {
+	Preferences Preferences `json:"preferences,omitempty"`
+}
+
+type TOTPSetupResponse struct {
+	TOTP TOTPSetupInfo `json:"totp"`
+	Meta Meta          `json:"meta"`
+}
+
+type TOTPSetupInfo struct {
+	Secret          string `json:"secret"`          // base32, for manual entry
+	ProvisioningURI string `json:"provisioningUri"` // otpauth:// URI to show as a QR code
+}
+
+type TOTPEnableRequest struct {
+	TOTPEnable  TOTPEnableInfo `json:"totpEnable"`
+	Preferences Preferences    `json:"preferences,omitempty"`
+}
+
+type TOTPEnableInfo struct {
+	Code string `json:"code"`
+}
+
+type TOTPEnableResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"` // shown only once
+	Meta          Meta     `json:"meta"`
+}
+
+type TOTPDisableRequest struct {
+	TOTPDisable TOTPDisableInfo `json:"totpDisable"`
+	Preferences Preferences     `json:"preferences,omitempty"`
+}
+
+type TOTPDisableInfo struct {
+	Password     string `json:"password"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+}
@@ -55,7 +55,7 @@ func NewMeta(apiVersion, minAPIVersion, buildVersion, releaseDate string) Meta {
 func NewErrorResponse(meta Meta, errorType, errorMessage string) ErrorResponse {
 	var errorClass string
 	switch errorType {
-	case "InvalidRequest", "NotFound", "Unauthorized":
+	case "InvalidRequest", "NotFound", "Unauthorized", "Forbidden", "Conflict":
 		errorClass = "ForClientError"
 	default:
 		errorClass = "ForServerError"
@@ -0,0 +1,20 @@
+package models
+
+// JSON Web Key Set models (RFC 7517). The key set is served as is, without
+// meta, so that standard JWT libraries can consume it.
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"` // "RSA", "EC" or "OKP"
+	Kid string `json:"kid"`
+	Use string `json:"use"`           // always "sig"
+	Alg string `json:"alg"`           // "RS256", "ES256" or "EdDSA"
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // "P-256" or "Ed25519"
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"` // EC only
+}
@@ -30,7 +30,9 @@ type LauncherConfig struct {
 
 type WebSocket struct {
 	Enable                bool   `json:"enable"`
+	Transport            string `json:"transport,omitempty"` // "websocket" or "sse"
 	SocketHost           string `json:"socketHost,omitempty"`
+	SseUrl               string `json:"sseUrl,omitempty"`
 	HeartbeatIntervalSec int    `json:"heartbeatIntervalSec,omitempty"`
 }
 
@@ -114,6 +116,29 @@ type DownloadMeta struct {
 	IsAbsoluteUrl       bool   `json:"isAbsoluteUrl"`
 }
 
+// Bootstrap models
+
+type BootstrapRequest struct {
+	Bootstrap   BootstrapInfo `json:"bootstrap"`
+	Preferences Preferences   `json:"preferences,omitempty"`
+}
+
+type BootstrapInfo struct {
+	OS              string `json:"os"`
+	Arch            string `json:"arch"`
+	CoreVersion     string `json:"coreVersion,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// BootstrapResponse carries the launcherConfig, maintenance and checkUpdates
+// results. Sections without content are omitted.
+type BootstrapResponse struct {
+	LauncherConfig         LauncherConfig          `json:"launcherConfig"`
+	MaintenanceInformation *MaintenanceInformation `json:"maintenanceInformation,omitempty"`
+	UpdateInformation      *UpdateInformation      `json:"updateInformation,omitempty"`
+	Meta                   Meta                    `json:"meta"`
+}
+
 // Feedback models
 
 type FeedbackLogRequest struct {
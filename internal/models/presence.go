@@ -0,0 +1,25 @@
+package models
+
+// Presence models
+
+type PresenceResponse struct {
+	Presence Presence `json:"presence"`
+	Meta     Meta     `json:"meta"`
+}
+
+type Presence struct {
+	Online            int            `json:"online"`
+	ByTransport       map[string]int `json:"byTransport"`
+	ByOS              map[string]int `json:"byOs"`
+	ByArch            map[string]int `json:"byArch"`
+	ByCoreVersion     map[string]int `json:"byCoreVersion"`
+	ByResourceVersion map[string]int `json:"byResourceVersion"`
+	ByLanguage        map[string]int `json:"byLanguage"`
+	Peaks             []PresencePeak `json:"peaks"`
+}
+
+// PresencePeak is the highest number of concurrent clients in one interval
+type PresencePeak struct {
+	Timestamp int64 `json:"timestamp"` // start of the interval
+	Peak      int   `json:"peak"`
+}
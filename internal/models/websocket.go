@@ -0,0 +1,37 @@
+package models
+
+// WebSocket models
+
+// ServerMessage is a message sent from the server over the WebSocket channel
+type ServerMessage struct {
+	Action        string         `json:"action"` // "ping", "pong", "notify" or "resync"
+	MessageID     string         `json:"messageId,omitempty"`
+	NotifyChanged *NotifyChanged `json:"notifyChanged,omitempty"`
+	Errors        []ErrorInfo    `json:"errors,omitempty"`
+	Meta          Meta           `json:"meta"`
+}
+
+type NotifyChanged struct {
+	Type            string `json:"type"` // "update" or "maintenance"
+	OS              string `json:"os"`
+	Arch            string `json:"arch"`
+	CoreVersion     string `json:"coreVersion"`
+	ResourceVersion string `json:"resourceVersion"`
+	Message         string `json:"message"`
+}
+
+// ClientMessage is a message sent from the client over the WebSocket channel
+type ClientMessage struct {
+	Action        string      `json:"action"` // "ping" or "pong"
+	AccessToken   string      `json:"accessToken,omitempty"`
+	LastMessageID string      `json:"lastMessageId,omitempty"`
+	ClientInfo    ClientInfo  `json:"clientInfo"`
+	Preferences   Preferences `json:"preferences,omitempty"`
+}
+
+type ClientInfo struct {
+	OS              string `json:"os"`
+	Arch            string `json:"arch"`
+	CoreVersion     string `json:"coreVersion"`
+	ResourceVersion string `json:"resourceVersion"`
+}
@@ -0,0 +1,68 @@
+// Package mysqltest provides an in-process MySQL compatible server for tests
+// of MySQL storage.
+package mysqltest
+
+import (
+	"crypto/tls"
+	"net"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	"github.com/dolthub/go-mysql-server/sql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// Database is the name of the database the server starts with
+const Database = "nekolc"
+
+// Server keeps its data in memory and accepts the root user without a
+// password
+type Server struct {
+	Addr string
+
+	server *server.Server
+}
+
+// NewServer starts a server with an empty database. Clients may use TLS if
+// tlsConfig is set. Close it when done.
+func NewServer(tlsConfig *tls.Config) (*Server, error) {
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	database := memory.NewDatabase(Database)
+	database.EnablePrimaryKeyIndexes()
+	provider := memory.NewDBProvider(database)
+	engine := sqle.NewDefault(provider)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	config := server.Config{
+		Protocol:  "tcp",
+		Listener:  listener,
+		TLSConfig: tlsConfig,
+	}
+	s, err := server.NewServer(config, engine, sql.NewContext, memory.NewSessionBuilder(provider), nil)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go s.Start()
+	return &Server{Addr: listener.Addr().String(), server: s}, nil
+}
+
+// Config returns the driver settings for the database of the server
+func (s *Server) Config() *mysql.Config {
+	config := mysql.NewConfig()
+	config.Net = "tcp"
+	config.Addr = s.Addr
+	config.User = "root"
+	config.DBName = Database
+	return config
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// Notifier delivers account messages, such as password reset tokens, to users.
+// Implementations for email or other channels can be added next to the file
+// notifier.
+type Notifier interface {
+	SendPasswordReset(user *storage.User, token string, expiresAt time.Time) error
+}
+
+// NewNotifier creates a notifier based on configuration. It returns nil if no
+// notifier is configured, which disables password reset.
+func NewNotifier(cfg *config.Config) (Notifier, error) {
+	reset := cfg.App.Authentication.PasswordReset
+	switch reset.Notifier {
+	case "":
+		return nil, nil
+	case "log":
+		return NewLogNotifier(), nil
+	case "file":
+		if reset.FilePath == "" {
+			return nil, fmt.Errorf("passwordReset.filePath is required for the file notifier")
+		}
+		return NewFileNotifier(reset.FilePath), nil
+	default:
+		return nil, fmt.Errorf("unsupported notifier: %s", reset.Notifier)
+	}
+}
+
+// LogNotifier writes account messages to the server log. It is meant for
+// development: reset tokens in the log let anyone who reads it take over
+// accounts, so the configuration only allows it in debug mode.
+type LogNotifier struct{}
+
+func NewLogNotifier() *LogNotifier {
+	return &LogNotifier{}
+}
+
+func (n *LogNotifier) SendPasswordReset(user *storage.User, token string, expiresAt time.Time) error {
+	log.Printf("Password reset token for user %s: %s (expires %s)", user.Username, token, expiresAt.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// FileNotifier appends account messages to a file, one line per message
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{
+		Path: path,
+	}
+}
+
+func (n *FileNotifier) SendPasswordReset(user *storage.User, token string, expiresAt time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(n.Path), 0755); err != nil {
+		return fmt.Errorf("failed to create notifier directory: %w", err)
+	}
+	// Reset tokens are secrets, so the file is not world-readable
+	file, err := os.OpenFile(n.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open notifier file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s password_reset username=%s token=%s expires=%s\n",
+		time.Now().UTC().Format(time.RFC3339), user.Username, token, expiresAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to write notifier file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+func TestFileNotifier_SendPasswordReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resets", "password_resets.log")
+	notifier := NewFileNotifier(path)
+	user := &storage.User{ID: "user-1", Username: "alice"}
+
+	if err := notifier.SendPasswordReset(user, "token-1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to send password reset: %v", err)
+	}
+	if err := notifier.SendPasswordReset(user, "token-2", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to send password reset: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read notifier file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	if !strings.Contains(lines[1], "username=alice") || !strings.Contains(lines[1], "token=token-2") {
+		t.Errorf("Unexpected line %q", lines[1])
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	cfg := &config.Config{App: &config.AppConfig{}}
+	if notifier := mustNotifier(t, cfg); notifier != nil {
+		t.Errorf("Expected no notifier by default, got %T", notifier)
+	}
+
+	cfg.App.Authentication.PasswordReset.Notifier = "log"
+	if _, ok := mustNotifier(t, cfg).(*LogNotifier); !ok {
+		t.Error("Expected log notifier")
+	}
+
+	cfg.App.Authentication.PasswordReset.Notifier = "file"
+	if _, err := NewNotifier(cfg); err == nil {
+		t.Error("Expected error for file notifier without a path")
+	}
+	cfg.App.Authentication.PasswordReset.FilePath = filepath.Join(t.TempDir(), "resets.log")
+	if _, ok := mustNotifier(t, cfg).(*FileNotifier); !ok {
+		t.Error("Expected file notifier")
+	}
+
+	cfg.App.Authentication.PasswordReset.Notifier = "carrier-pigeon"
+	if _, err := NewNotifier(cfg); err == nil {
+		t.Error("Expected error for unsupported notifier")
+	}
+}
+
+func mustNotifier(t *testing.T, cfg *config.Config) Notifier {
+	notifier, err := NewNotifier(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	return notifier
+}
@@ -0,0 +1,227 @@
+// Package oidctest provides a local OpenID Connect provider for tests of
+// the authorization code flow with PKCE.
+package oidctest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Issuer is a mock OpenID Connect provider. Codes are issued directly with
+// Authorize instead of through a browser login.
+type Issuer struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string // if set, the token endpoint requires it
+
+	mu         sync.Mutex
+	keyID      string
+	privateKey ed25519.PrivateKey
+	codes      map[string]*authorization
+	audience   string // overrides ClientID as the ID token audience
+	failures   int    // number of upcoming requests answered with 500
+}
+
+type authorization struct {
+	claims        jwt.MapClaims
+	codeChallenge string
+	redirectURI   string
+}
+
+// NewIssuer starts a mock provider. Close it when done.
+func NewIssuer(clientID string) *Issuer {
+	issuer := &Issuer{
+		ClientID: clientID,
+		codes:    make(map[string]*authorization),
+	}
+	issuer.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+// URL returns the issuer identifier
+func (i *Issuer) URL() string {
+	return i.Server.URL
+}
+
+func (i *Issuer) Close() {
+	i.Server.Close()
+}
+
+// RotateKey replaces the signing key; the old key is no longer published
+func (i *Issuer) RotateKey() {
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.privateKey = privateKey
+	i.keyID = randomString(8)
+}
+
+// SetAudience makes ID tokens carry another audience than the client ID
+func (i *Issuer) SetAudience(audience string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.audience = audience
+}
+
+// Fail answers the next n requests with 500 Internal Server Error
+func (i *Issuer) Fail(n int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.failures = n
+}
+
+// Authorize returns a code as if the user logged in with the given subject.
+// claims are added to the ID token, e.g. preferred_username or nonce.
+func (i *Issuer) Authorize(subject, codeVerifier, redirectURI string, claims map[string]interface{}) string {
+	idClaims := jwt.MapClaims{"sub": subject}
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+	code := randomString(16)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.codes[code] = &authorization{
+		claims:        idClaims,
+		codeChallenge: CodeChallenge(codeVerifier),
+		redirectURI:   redirectURI,
+	}
+	return code
+}
+
+// CodeChallenge returns the S256 code challenge of a verifier
+func CodeChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// NewCodeVerifier returns a random PKCE code verifier
+func NewCodeVerifier() string {
+	return randomString(32)
+}
+
+func (i *Issuer) failing() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.failures > 0 {
+		i.failures--
+		return true
+	}
+	return false
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	if i.failing() {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 i.URL(),
+		"authorization_endpoint": i.URL() + "/authorize",
+		"token_endpoint":         i.URL() + "/token",
+		"jwks_uri":               i.URL() + "/jwks",
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	i.mu.Lock()
+	key := map[string]string{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"use": "sig",
+		"alg": "EdDSA",
+		"kid": i.keyID,
+		"x":   base64.RawURLEncoding.EncodeToString(i.privateKey.Public().(ed25519.PublicKey)),
+	}
+	i.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []interface{}{key}})
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if i.failing() {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if i.ClientSecret != "" {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != i.ClientID || clientSecret != i.ClientSecret {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Codes are single use
+	code := r.PostForm.Get("code")
+	auth := i.codes[code]
+	delete(i.codes, code)
+	if auth == nil ||
+		r.PostForm.Get("client_id") != i.ClientID ||
+		r.PostForm.Get("redirect_uri") != auth.redirectURI ||
+		CodeChallenge(r.PostForm.Get("code_verifier")) != auth.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": i.URL(),
+		"aud": i.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	if i.audience != "" {
+		claims["aud"] = i.audience
+	}
+	for name, value := range auth.claims {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = i.keyID
+	idToken, err := token.SignedString(i.privateKey)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(16),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString(n int) string {
+	data := make([]byte, n)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
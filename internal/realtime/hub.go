@@ -0,0 +1,230 @@
+package realtime
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/models"
+)
+
+// sendBufferSize is the number of messages queued per client before new
+// messages are dropped for that client
+const sendBufferSize = 32
+
+// Hub tracks the clients connected to the real-time notification channel
+type Hub struct {
+	mu       sync.RWMutex
+	clients  map[*Client]struct{}
+	presence []presenceBucket
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[*Client]struct{}),
+	}
+}
+
+// Register adds a client to the hub
+func (h *Hub) Register(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous := len(h.clients)
+	h.clients[c] = struct{}{}
+	h.recordPresence(time.Now(), previous, len(h.clients))
+}
+
+// Unregister removes a client from the hub and closes it
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	previous := len(h.clients)
+	delete(h.clients, c)
+	h.recordPresence(time.Now(), previous, len(h.clients))
+	h.mu.Unlock()
+	c.Close()
+}
+
+// Clients returns a snapshot of the connected clients
+func (h *Hub) Clients() []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// Count returns the number of connected clients
+func (h *Hub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// Client is a single connection to the hub. The transport reads queued
+// messages from Messages and writes them to the connection.
+type Client struct {
+	ID          string
+	ConnectedAt time.Time
+	Transport   string // "websocket" or "sse", set before registering
+
+	mu       sync.RWMutex
+	info     models.ClientInfo
+	language string
+	userID   string
+
+	sendMu    sync.Mutex // makes checking and filling the queue atomic
+	send      chan models.ServerMessage
+	done      chan struct{}
+	closeOnce sync.Once
+
+	deliveredMu sync.Mutex
+	delivered   map[int64]struct{} // notification IDs sent to this client
+}
+
+func NewClient() *Client {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Client{
+		ID:          hex.EncodeToString(id),
+		ConnectedAt: time.Now(),
+		language:    "en",
+		send:        make(chan models.ServerMessage, sendBufferSize),
+		done:        make(chan struct{}),
+		delivered:   make(map[int64]struct{}),
+	}
+}
+
+// Info returns the client information last reported by the client
+func (c *Client) Info() models.ClientInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.info
+}
+
+// Language returns the preferred language of the client
+func (c *Client) Language() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.language
+}
+
+// UserID returns the authenticated user, or an empty string for anonymous clients
+func (c *Client) UserID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.userID
+}
+
+// Update records the client information and preferences reported by the
+// client. Messages without them keep the previously reported values.
+func (c *Client) Update(info models.ClientInfo, preferences models.Preferences) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info != (models.ClientInfo{}) {
+		c.info = info
+	}
+	if preferences.Language != "" {
+		c.language = preferences.Language
+	}
+}
+
+// SetUserID records the user the client authenticated as
+func (c *Client) SetUserID(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.userID = userID
+}
+
+// Send queues a message for the client. It never blocks; false is returned
+// if the client is closed or its queue is full.
+func (c *Client) Send(msg models.ServerMessage) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.queue(msg)
+}
+
+// queue queues a message without blocking. sendMu must be held.
+func (c *Client) queue(msg models.ServerMessage) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendNotification queues a stored notification unless the client has
+// already received it, so live and replayed notifications are not duplicated
+func (c *Client) SendNotification(id int64, msg models.ServerMessage) bool {
+	c.deliveredMu.Lock()
+	defer c.deliveredMu.Unlock()
+	if _, ok := c.delivered[id]; ok {
+		return false
+	}
+	if !c.Send(msg) {
+		return false
+	}
+	c.delivered[id] = struct{}{}
+	return true
+}
+
+// pendingNotification is a stored notification built for one client
+type pendingNotification struct {
+	id  int64
+	msg models.ServerMessage
+}
+
+// sendNotifications queues the stored notifications that the client has not
+// received yet, in order. Either all of them are queued or, if they do not
+// fit in the queue, none are and false is returned.
+func (c *Client) sendNotifications(notifications []pendingNotification) bool {
+	c.deliveredMu.Lock()
+	defer c.deliveredMu.Unlock()
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	pending := make([]pendingNotification, 0, len(notifications))
+	for _, notification := range notifications {
+		if _, ok := c.delivered[notification.id]; !ok {
+			pending = append(pending, notification)
+		}
+	}
+	// Only the writer takes messages off the queue, so the free space
+	// cannot shrink while sendMu is held
+	if len(pending) > cap(c.send)-len(c.send) {
+		return false
+	}
+	for _, notification := range pending {
+		if !c.queue(notification.msg) {
+			return false
+		}
+		c.delivered[notification.id] = struct{}{}
+	}
+	return true
+}
+
+// Messages returns the queue of messages waiting to be written
+func (c *Client) Messages() <-chan models.ServerMessage {
+	return c.send
+}
+
+// Done is closed once the client has been closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close marks the client as closed
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
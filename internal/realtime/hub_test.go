@@ -0,0 +1,146 @@
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/models"
+)
+
+func TestHub_RegisterUnregister(t *testing.T) {
+	hub := NewHub()
+	client := NewClient()
+
+	hub.Register(client)
+	if hub.Count() != 1 {
+		t.Fatalf("Expected 1 client, got %d", hub.Count())
+	}
+
+	hub.Unregister(client)
+	if hub.Count() != 0 {
+		t.Fatalf("Expected 0 clients, got %d", hub.Count())
+	}
+
+	select {
+	case <-client.Done():
+	default:
+		t.Error("Expected unregistered client to be closed")
+	}
+}
+
+func TestClient_Send(t *testing.T) {
+	client := NewClient()
+
+	if !client.Send(models.ServerMessage{Action: "pong"}) {
+		t.Fatal("Expected message to be queued")
+	}
+	msg := <-client.Messages()
+	if msg.Action != "pong" {
+		t.Errorf("Expected action 'pong', got %s", msg.Action)
+	}
+
+	// A full queue drops messages instead of blocking
+	for i := 0; i < sendBufferSize; i++ {
+		client.Send(models.ServerMessage{Action: "notify"})
+	}
+	if client.Send(models.ServerMessage{Action: "notify"}) {
+		t.Error("Expected message to be dropped when the queue is full")
+	}
+
+	client.Close()
+	if client.Send(models.ServerMessage{Action: "notify"}) {
+		t.Error("Expected message to be dropped after close")
+	}
+}
+
+func TestClient_Update(t *testing.T) {
+	client := NewClient()
+	if client.Language() != "en" {
+		t.Errorf("Expected default language 'en', got %s", client.Language())
+	}
+
+	info := models.ClientInfo{OS: "linux", Arch: "x64", CoreVersion: "1.0.0", ResourceVersion: "2.0.0"}
+	client.Update(info, models.Preferences{Language: "zh-tw"})
+	if client.Info() != info {
+		t.Errorf("Expected client info %+v, got %+v", info, client.Info())
+	}
+	if client.Language() != "zh-tw" {
+		t.Errorf("Expected language 'zh-tw', got %s", client.Language())
+	}
+
+	// An empty language keeps the previous preference
+	client.Update(info, models.Preferences{})
+	if client.Language() != "zh-tw" {
+		t.Errorf("Expected language 'zh-tw', got %s", client.Language())
+	}
+
+	// Messages without client information keep the reported one
+	client.Update(models.ClientInfo{}, models.Preferences{})
+	if client.Info() != info {
+		t.Errorf("Expected client info %+v to be kept, got %+v", info, client.Info())
+	}
+}
+
+func TestHub_Presence(t *testing.T) {
+	hub := NewHub()
+	connectTestClient(hub, models.ClientInfo{OS: "windows", Arch: "x64", CoreVersion: "1.0.0", ResourceVersion: "1.0.0"}, "zh-tw")
+	connectTestClient(hub, models.ClientInfo{OS: "windows", Arch: "arm64", CoreVersion: "1.0.0", ResourceVersion: "1.0.0"}, "en")
+	sse := NewClient()
+	sse.Transport = "sse"
+	hub.Register(sse)
+
+	presence := hub.Presence(time.Now(), time.Minute)
+	if presence.Online != 3 {
+		t.Errorf("Expected 3 online, got %d", presence.Online)
+	}
+	if presence.ByOS["windows"] != 2 || presence.ByOS["unknown"] != 1 {
+		t.Errorf("Unexpected OS breakdown %v", presence.ByOS)
+	}
+	if presence.ByArch["x64"] != 1 || presence.ByArch["arm64"] != 1 {
+		t.Errorf("Unexpected arch breakdown %v", presence.ByArch)
+	}
+	if presence.ByCoreVersion["1.0.0"] != 2 || presence.ByLanguage["en"] != 2 || presence.ByLanguage["zh-tw"] != 1 {
+		t.Errorf("Unexpected version or language breakdown %v %v", presence.ByCoreVersion, presence.ByLanguage)
+	}
+	if presence.ByTransport["sse"] != 1 {
+		t.Errorf("Unexpected transport breakdown %v", presence.ByTransport)
+	}
+	if len(presence.Peaks) != 1 || presence.Peaks[0].Peak != 3 {
+		t.Errorf("Expected current peak of 3, got %+v", presence.Peaks)
+	}
+}
+
+func TestHub_PresencePeaks(t *testing.T) {
+	hub := NewHub()
+	start := time.Now().Truncate(presenceInterval)
+
+	hub.mu.Lock()
+	hub.recordPresence(start, 0, 1)
+	hub.recordPresence(start.Add(10*time.Second), 1, 2)
+	hub.recordPresence(start.Add(20*time.Second), 2, 1)
+	hub.recordPresence(start.Add(3*time.Minute), 1, 0)
+	hub.mu.Unlock()
+
+	presence := hub.Presence(start.Add(4*time.Minute), 5*time.Minute)
+	expected := []int{2, 1, 1, 1, 0}
+	if len(presence.Peaks) != len(expected) {
+		t.Fatalf("Expected %d intervals, got %+v", len(expected), presence.Peaks)
+	}
+	for i, peak := range presence.Peaks {
+		if peak.Peak != expected[i] {
+			t.Errorf("Interval %d: expected peak %d, got %d", i, expected[i], peak.Peak)
+		}
+		if peak.Timestamp != start.Add(time.Duration(i)*presenceInterval).Unix() {
+			t.Errorf("Interval %d: unexpected timestamp %d", i, peak.Timestamp)
+		}
+	}
+
+	// Intervals older than the history are dropped
+	hub.mu.Lock()
+	hub.recordPresence(start.Add(presenceHistory+time.Hour), 0, 1)
+	remaining := len(hub.presence)
+	hub.mu.Unlock()
+	if remaining != 1 {
+		t.Errorf("Expected old intervals to be dropped, %d remaining", remaining)
+	}
+}
@@ -0,0 +1,323 @@
+package realtime
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// Notifier pushes notifications to the clients connected to a hub and keeps
+// them in storage so reconnecting clients can catch up
+type Notifier struct {
+	Config *config.Config
+	DB     storage.Storage
+	Hub    *Hub
+}
+
+func NewNotifier(cfg *config.Config, db storage.Storage, hub *Hub) *Notifier {
+	return &Notifier{
+		Config: cfg,
+		DB:     db,
+		Hub:    hub,
+	}
+}
+
+// FormatMessageID returns the messageId of a stored notification
+func FormatMessageID(id int64) string {
+	return fmt.Sprintf("msg-%d", id)
+}
+
+// ParseMessageID returns the notification ID of a messageId
+func ParseMessageID(messageID string) (int64, bool) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(messageID, "msg-"), 10, 64)
+	if err != nil || id < 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// ConfigReloaded compares the previous configuration with the current one and
+// notifies affected clients. Register it with config.Config.OnReload.
+func (n *Notifier) ConfigReloaded(previous *config.Config) {
+	for _, notification := range DiffConfig(previous, n.Config.Current()) {
+		n.Notify(notification)
+	}
+}
+
+// Notify stores a notification and sends it to every connected client it affects
+func (n *Notifier) Notify(notification *storage.Notification) {
+	if err := n.DB.StoreNotification(notification); err != nil {
+		// Still deliver to connected clients, only the history is lost
+		log.Printf("Failed to store notification: %v", err)
+	}
+
+	for _, client := range n.Hub.Clients() {
+		n.deliver(client, notification)
+	}
+}
+
+// Replay sends every stored notification after lastMessageID that affects
+// the client. If they do not all fit in the client's queue, a single
+// "resync" message is sent instead, telling the client to fetch the current
+// state rather than silently losing some of them.
+func (n *Notifier) Replay(client *Client, lastMessageID string) error {
+	id, ok := ParseMessageID(lastMessageID)
+	if !ok {
+		return fmt.Errorf("invalid message id: %s", lastMessageID)
+	}
+
+	notifications, err := n.DB.GetNotificationsSince(id)
+	if err != nil {
+		return err
+	}
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	info := client.Info()
+	language := client.Language()
+	cutoff := time.Now().Add(-n.Config.Current().App.NotificationRetention())
+	var pending []pendingNotification
+	for _, notification := range notifications {
+		if notification.CreatedAt.Before(cutoff) || !n.Affects(notification, info) {
+			continue
+		}
+		msg := n.Message(notification, info, language)
+		msg.MessageID = FormatMessageID(notification.ID)
+		pending = append(pending, pendingNotification{id: notification.ID, msg: msg})
+	}
+	if client.sendNotifications(pending) {
+		return nil
+	}
+
+	// The resync carries the newest messageId, so that the client does not
+	// replay the same notifications after its next reconnect
+	cfg := n.Config.Current()
+	resync := models.ServerMessage{
+		Action:    "resync",
+		MessageID: FormatMessageID(notifications[len(notifications)-1].ID),
+		Meta:      models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+	if !client.Send(resync) {
+		// Not even the resync fits; the client reconnects and replays again
+		client.Close()
+	}
+	return nil
+}
+
+func (n *Notifier) deliver(client *Client, notification *storage.Notification) {
+	info := client.Info()
+	if !n.Affects(notification, info) {
+		return
+	}
+
+	msg := n.Message(notification, info, client.Language())
+	if notification.ID == 0 {
+		client.Send(msg)
+		return
+	}
+	msg.MessageID = FormatMessageID(notification.ID)
+	client.SendNotification(notification.ID, msg)
+}
+
+// Affects reports whether a notification is relevant to a client, based on
+// the current configuration
+func (n *Notifier) Affects(notification *storage.Notification, info models.ClientInfo) bool {
+	if notification.OS != "" && notification.OS != info.OS {
+		return false
+	}
+	if notification.Arch != "" && notification.Arch != info.Arch {
+		return false
+	}
+
+	cfg := n.Config.Current()
+	switch notification.Type {
+	case "maintenance":
+		if notification.OS == "" && notification.Arch == "" {
+			// Global maintenance does not reach platforms with an active override
+			platform, exists := cfg.Maintenance.PlatformSpecific[info.OS+"-"+info.Arch]
+			return !exists || !platform.MaintenanceActive
+		}
+		return true
+	case "update":
+		if info.OS == "" || info.Arch == "" {
+			return false
+		}
+		if info.CoreVersion == notification.CoreVersion && info.ResourceVersion == notification.ResourceVersion {
+			return false
+		}
+		return cfg.Updates.FindUpdate(info.OS, info.Arch, info.CoreVersion, info.ResourceVersion) != nil
+	}
+	return false
+}
+
+// Message builds the notify message for a client, localized to its language
+func (n *Notifier) Message(notification *storage.Notification, info models.ClientInfo, language string) models.ServerMessage {
+	cfg := n.Config.Current()
+	var message string
+	switch notification.Type {
+	case "update":
+		message = cfg.GetLocalizedString(language, "updates", "available")
+	case "maintenance":
+		message = cfg.GetLocalizedString(language, "maintenance", notification.Status)
+		if message == notification.Status && notification.Message != "" {
+			// Fallback to config message if no localization found
+			message = notification.Message
+		}
+	}
+
+	changed := &models.NotifyChanged{
+		Type:            notification.Type,
+		OS:              firstNonEmpty(notification.OS, info.OS),
+		Arch:            firstNonEmpty(notification.Arch, info.Arch),
+		CoreVersion:     firstNonEmpty(notification.CoreVersion, info.CoreVersion),
+		ResourceVersion: firstNonEmpty(notification.ResourceVersion, info.ResourceVersion),
+		Message:         message,
+	}
+
+	return models.ServerMessage{
+		Action:        "notify",
+		NotifyChanged: changed,
+		Meta:          models.NewMeta(cfg.App.Server.APIVersion, cfg.App.Server.MinAPIVersion, cfg.App.Server.BuildVersion, cfg.App.Server.ReleaseDate),
+	}
+}
+
+// DiffConfig returns the notifications caused by the differences between the
+// update and maintenance settings of two configurations
+func DiffConfig(previous, current *config.Config) []*storage.Notification {
+	var notifications []*storage.Notification
+	notifications = append(notifications, diffMaintenance(previous.Maintenance, current.Maintenance)...)
+	notifications = append(notifications, diffUpdates(previous.Updates, current.Updates)...)
+	return notifications
+}
+
+func diffMaintenance(previous, current *config.MaintenanceConfigData) []*storage.Notification {
+	var notifications []*storage.Notification
+
+	if previous.MaintenanceActive != current.MaintenanceActive ||
+		(current.MaintenanceActive && previous.MaintenanceInfo != current.MaintenanceInfo) {
+		notifications = append(notifications, maintenanceNotification("", "", current.MaintenanceActive, current.MaintenanceInfo))
+	}
+
+	for _, platformKey := range platformKeys(previous.PlatformSpecific, current.PlatformSpecific) {
+		previousPlatform := previous.PlatformSpecific[platformKey]
+		currentPlatform := current.PlatformSpecific[platformKey]
+		if !previousPlatform.MaintenanceActive && !currentPlatform.MaintenanceActive {
+			// Changes of the global settings are covered above
+			continue
+		}
+
+		os, arch, _ := strings.Cut(platformKey, "-")
+		previousActive, previousInfo := previous.ForPlatform(os, arch)
+		currentActive, currentInfo := current.ForPlatform(os, arch)
+		if previousActive == currentActive && (!currentActive || previousInfo == currentInfo) {
+			continue
+		}
+		notifications = append(notifications, maintenanceNotification(os, arch, currentActive, currentInfo))
+	}
+
+	return notifications
+}
+
+func maintenanceNotification(os, arch string, active bool, info config.MaintenanceInfoConfig) *storage.Notification {
+	if !active {
+		return &storage.Notification{
+			Type:    "maintenance",
+			OS:      os,
+			Arch:    arch,
+			Status:  "completed",
+			Message: "Maintenance completed",
+		}
+	}
+	return &storage.Notification{
+		Type:    "maintenance",
+		OS:      os,
+		Arch:    arch,
+		Status:  info.Status,
+		Message: info.Message,
+	}
+}
+
+func diffUpdates(previous, current *config.UpdateConfigData) []*storage.Notification {
+	var notifications []*storage.Notification
+	versionChanged := previous.LatestCoreVersion != current.LatestCoreVersion ||
+		previous.LatestResourceVersion != current.LatestResourceVersion
+
+	for _, platformKey := range updatePlatformKeys(current) {
+		os, arch, _ := strings.Cut(platformKey, "-")
+		if !versionChanged &&
+			previous.FullPackages[platformKey] == current.FullPackages[platformKey] &&
+			reflect.DeepEqual(platformFiles(previous, os, arch), platformFiles(current, os, arch)) {
+			continue
+		}
+		notifications = append(notifications, &storage.Notification{
+			Type:            "update",
+			OS:              os,
+			Arch:            arch,
+			CoreVersion:     current.LatestCoreVersion,
+			ResourceVersion: current.LatestResourceVersion,
+		})
+	}
+
+	return notifications
+}
+
+// updatePlatformKeys returns the "os-arch" keys that have a full package or
+// incremental update in the configuration
+func updatePlatformKeys(updates *config.UpdateConfigData) []string {
+	keys := make(map[string]struct{})
+	for key := range updates.FullPackages {
+		keys[key] = struct{}{}
+	}
+	for _, file := range updates.Files {
+		keys[file.OS+"-"+file.Arch] = struct{}{}
+	}
+	return sortedKeys(keys)
+}
+
+func platformFiles(updates *config.UpdateConfigData, os, arch string) []config.UpdateFileInfo {
+	var files []config.UpdateFileInfo
+	for _, file := range updates.Files {
+		if file.OS == os && file.Arch == arch {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func platformKeys(previous, current map[string]config.PlatformMaintenanceConfig) []string {
+	keys := make(map[string]struct{})
+	for key := range previous {
+		keys[key] = struct{}{}
+	}
+	for key := range current {
+		keys[key] = struct{}{}
+	}
+	return sortedKeys(keys)
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,297 @@
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/models"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+func createTestConfig() *config.Config {
+	cfg := &config.Config{
+		App: &config.AppConfig{},
+		Maintenance: &config.MaintenanceConfigData{
+			MaintenanceInfo: config.MaintenanceInfoConfig{
+				Status:  "scheduled",
+				Message: "Scheduled maintenance",
+			},
+			PlatformSpecific: map[string]config.PlatformMaintenanceConfig{},
+		},
+		Updates: &config.UpdateConfigData{
+			LatestCoreVersion:     "1.1.1",
+			LatestResourceVersion: "1.1.0",
+			FullPackages: map[string]config.UpdatePackageInfo{
+				"windows-x64": {CoreVersion: "1.1.1", ResourceVersion: "1.1.0", DownloadUrl: "https://example.com/windows-x64.zip"},
+				"linux-x64":   {CoreVersion: "1.1.1", ResourceVersion: "1.1.0", DownloadUrl: "https://example.com/linux-x64.tar.gz"},
+			},
+		},
+		Languages: config.LanguageConfig{
+			"en": config.LanguageStrings{
+				Maintenance: map[string]string{"progress": "Maintenance in progress"},
+				Updates:     map[string]string{"available": "New version available"},
+			},
+			"zh-tw": config.LanguageStrings{
+				Maintenance: map[string]string{"progress": "維護進行中"},
+				Updates:     map[string]string{"available": "有新版本可用"},
+			},
+		},
+	}
+	cfg.App.Server.APIVersion = "1.0.0"
+	return cfg
+}
+
+// copyConfig returns a copy of cfg whose maintenance and update settings can
+// be modified independently
+func copyConfig(cfg *config.Config) *config.Config {
+	maintenance := *cfg.Maintenance
+	maintenance.PlatformSpecific = make(map[string]config.PlatformMaintenanceConfig)
+	for key, value := range cfg.Maintenance.PlatformSpecific {
+		maintenance.PlatformSpecific[key] = value
+	}
+	updates := *cfg.Updates
+	updates.FullPackages = make(map[string]config.UpdatePackageInfo)
+	for key, value := range cfg.Updates.FullPackages {
+		updates.FullPackages[key] = value
+	}
+	return &config.Config{
+		App:         cfg.App,
+		Launcher:    cfg.Launcher,
+		Maintenance: &maintenance,
+		Updates:     &updates,
+		Languages:   cfg.Languages,
+	}
+}
+
+func createTestNotifier(t *testing.T, cfg *config.Config) *Notifier {
+	db, err := storage.NewDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewNotifier(cfg, db, NewHub())
+}
+
+func connectTestClient(hub *Hub, info models.ClientInfo, language string) *Client {
+	client := NewClient()
+	client.Update(info, models.Preferences{Language: language})
+	hub.Register(client)
+	return client
+}
+
+func receive(client *Client) *models.ServerMessage {
+	select {
+	case msg := <-client.Messages():
+		return &msg
+	default:
+		return nil
+	}
+}
+
+func TestDiffConfig_NoChanges(t *testing.T) {
+	cfg := createTestConfig()
+	if notifications := DiffConfig(cfg, copyConfig(cfg)); len(notifications) != 0 {
+		t.Errorf("Expected no notifications, got %+v", notifications)
+	}
+}
+
+func TestDiffConfig_UpdateReleased(t *testing.T) {
+	previous := createTestConfig()
+	current := copyConfig(previous)
+	current.Updates.LatestCoreVersion = "1.2.0"
+
+	notifications := DiffConfig(previous, current)
+	if len(notifications) != 2 {
+		t.Fatalf("Expected one notification per platform, got %+v", notifications)
+	}
+	for _, notification := range notifications {
+		if notification.Type != "update" || notification.CoreVersion != "1.2.0" {
+			t.Errorf("Unexpected notification %+v", notification)
+		}
+	}
+}
+
+func TestDiffConfig_PlatformMaintenance(t *testing.T) {
+	previous := createTestConfig()
+	current := copyConfig(previous)
+	current.Maintenance.PlatformSpecific["linux-x64"] = config.PlatformMaintenanceConfig{
+		MaintenanceActive: true,
+		MaintenanceInfo:   config.MaintenanceInfoConfig{Status: "progress", Message: "Linux maintenance"},
+	}
+
+	notifications := DiffConfig(previous, current)
+	if len(notifications) != 1 {
+		t.Fatalf("Expected 1 notification, got %+v", notifications)
+	}
+	notification := notifications[0]
+	if notification.Type != "maintenance" || notification.OS != "linux" || notification.Arch != "x64" || notification.Status != "progress" {
+		t.Errorf("Unexpected notification %+v", notification)
+	}
+
+	// Ending the maintenance is also a change
+	notifications = DiffConfig(current, previous)
+	if len(notifications) != 1 || notifications[0].Status != "completed" {
+		t.Errorf("Expected a completed maintenance notification, got %+v", notifications)
+	}
+}
+
+func TestNotifier_ConfigReloaded(t *testing.T) {
+	cfg := createTestConfig()
+	notifier := createTestNotifier(t, cfg)
+	hub := notifier.Hub
+	cfg.OnReload(notifier.ConfigReloaded)
+
+	outdated := connectTestClient(hub, models.ClientInfo{OS: "windows", Arch: "x64", CoreVersion: "1.1.1", ResourceVersion: "1.1.0"}, "zh-tw")
+	unsupported := connectTestClient(hub, models.ClientInfo{OS: "macos", Arch: "arm64", CoreVersion: "1.1.1", ResourceVersion: "1.1.0"}, "en")
+	current := connectTestClient(hub, models.ClientInfo{OS: "linux", Arch: "x64", CoreVersion: "1.2.0", ResourceVersion: "1.1.0"}, "en")
+
+	next := copyConfig(cfg)
+	next.Updates.LatestCoreVersion = "1.2.0"
+	cfg.Swap(next)
+
+	msg := receive(outdated)
+	if msg == nil {
+		t.Fatal("Expected outdated client to be notified")
+	}
+	if msg.Action != "notify" || msg.NotifyChanged.Type != "update" {
+		t.Errorf("Expected update notification, got %+v", msg)
+	}
+	if msg.NotifyChanged.Message != "有新版本可用" {
+		t.Errorf("Expected localized message, got %s", msg.NotifyChanged.Message)
+	}
+	if msg.NotifyChanged.CoreVersion != "1.2.0" {
+		t.Errorf("Expected core version '1.2.0', got %s", msg.NotifyChanged.CoreVersion)
+	}
+
+	if receive(unsupported) != nil {
+		t.Error("Expected client without update for its platform not to be notified")
+	}
+	if receive(current) != nil {
+		t.Error("Expected up to date client not to be notified")
+	}
+}
+
+func TestNotifier_GlobalMaintenanceSkipsOverriddenPlatforms(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Maintenance.PlatformSpecific["linux-x64"] = config.PlatformMaintenanceConfig{
+		MaintenanceActive: true,
+		MaintenanceInfo:   config.MaintenanceInfoConfig{Status: "progress"},
+	}
+	notifier := createTestNotifier(t, cfg)
+	hub := notifier.Hub
+
+	windows := connectTestClient(hub, models.ClientInfo{OS: "windows", Arch: "x64"}, "en")
+	linux := connectTestClient(hub, models.ClientInfo{OS: "linux", Arch: "x64"}, "en")
+
+	notifier.Notify(&storage.Notification{Type: "maintenance", Status: "progress"})
+
+	msg := receive(windows)
+	if msg == nil || msg.NotifyChanged.Message != "Maintenance in progress" {
+		t.Errorf("Expected localized maintenance notification, got %+v", msg)
+	}
+	if receive(linux) != nil {
+		t.Error("Expected platform with its own maintenance not to be notified")
+	}
+}
+
+func TestParseMessageID(t *testing.T) {
+	if id, ok := ParseMessageID(FormatMessageID(42)); !ok || id != 42 {
+		t.Errorf("Expected id 42, got %d", id)
+	}
+	for _, messageID := range []string{"", "msg-", "msg-abc", "msg--1"} {
+		if _, ok := ParseMessageID(messageID); ok {
+			t.Errorf("Expected %q to be invalid", messageID)
+		}
+	}
+}
+
+func TestNotifier_Replay(t *testing.T) {
+	cfg := createTestConfig()
+	notifier := createTestNotifier(t, cfg)
+	hub := notifier.Hub
+
+	// Received the first notification before disconnecting
+	notifier.Notify(&storage.Notification{Type: "maintenance", Status: "progress"})
+	notifier.Notify(&storage.Notification{Type: "maintenance", OS: "linux", Arch: "x64", Status: "progress"})
+	notifier.Notify(&storage.Notification{Type: "maintenance", Status: "completed", Message: "Maintenance completed"})
+
+	client := connectTestClient(hub, models.ClientInfo{OS: "windows", Arch: "x64"}, "en")
+	if err := notifier.Replay(client, FormatMessageID(1)); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+
+	msg := receive(client)
+	if msg == nil || msg.MessageID != "msg-3" {
+		t.Fatalf("Expected missed notification msg-3, got %+v", msg)
+	}
+	if msg.NotifyChanged.Message != "Maintenance completed" {
+		t.Errorf("Expected completed maintenance, got %s", msg.NotifyChanged.Message)
+	}
+	if msg := receive(client); msg != nil {
+		t.Errorf("Expected notifications for other platforms to be skipped, got %+v", msg)
+	}
+
+	// Replaying again does not resend notifications the client already received
+	notifier.Replay(client, FormatMessageID(0))
+	msg = receive(client)
+	if msg == nil || msg.MessageID != "msg-1" {
+		t.Fatalf("Expected msg-1, got %+v", msg)
+	}
+	if msg := receive(client); msg != nil {
+		t.Errorf("Expected no duplicate notifications, got %+v", msg)
+	}
+
+	if err := notifier.Replay(client, "invalid"); err == nil {
+		t.Error("Expected invalid message id to fail")
+	}
+}
+
+func TestNotifier_ReplaySkipsExpired(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.App.Notifications.RetentionHours = 1
+	notifier := createTestNotifier(t, cfg)
+
+	notifier.DB.StoreNotification(&storage.Notification{
+		Type:      "maintenance",
+		Status:    "progress",
+		CreatedAt: time.Now().Add(-2 * time.Hour),
+	})
+
+	client := connectTestClient(notifier.Hub, models.ClientInfo{OS: "windows", Arch: "x64"}, "en")
+	notifier.Replay(client, FormatMessageID(0))
+	if msg := receive(client); msg != nil {
+		t.Errorf("Expected expired notification not to be replayed, got %+v", msg)
+	}
+}
+
+func TestNotifier_ReplayResync(t *testing.T) {
+	cfg := createTestConfig()
+	notifier := createTestNotifier(t, cfg)
+
+	for i := 0; i < sendBufferSize+1; i++ {
+		notifier.DB.StoreNotification(&storage.Notification{Type: "maintenance", Status: "progress"})
+	}
+
+	// A backlog that does not fit in the queue is not partially delivered
+	client := connectTestClient(notifier.Hub, models.ClientInfo{OS: "windows", Arch: "x64"}, "en")
+	if err := notifier.Replay(client, FormatMessageID(0)); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	msg := receive(client)
+	if msg == nil || msg.Action != "resync" || msg.MessageID != FormatMessageID(sendBufferSize+1) {
+		t.Fatalf("Expected a resync with the newest messageId, got %+v", msg)
+	}
+	if msg := receive(client); msg != nil {
+		t.Errorf("Expected only the resync, got %+v", msg)
+	}
+
+	// A backlog that fits is delivered in full
+	notifier.Replay(client, FormatMessageID(1))
+	for i := 2; i <= sendBufferSize+1; i++ {
+		msg := receive(client)
+		if msg == nil || msg.MessageID != FormatMessageID(int64(i)) {
+			t.Fatalf("Expected msg-%d, got %+v", i, msg)
+		}
+	}
+}
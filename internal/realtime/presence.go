@@ -0,0 +1,106 @@
+package realtime
+
+import (
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/models"
+)
+
+const (
+	// presenceInterval is the resolution of the peak concurrency series
+	presenceInterval = time.Minute
+	// presenceHistory is how long peak concurrency is kept
+	presenceHistory = 24 * time.Hour
+)
+
+// presenceBucket records the connection counts of one presenceInterval
+type presenceBucket struct {
+	start time.Time
+	peak  int
+	last  int // count at the end of the interval, carried into empty intervals
+}
+
+// recordPresence updates the peak concurrency after the number of clients
+// changed from previous to current. Must be called with h.mu held.
+func (h *Hub) recordPresence(now time.Time, previous, current int) {
+	start := now.Truncate(presenceInterval)
+	if n := len(h.presence); n == 0 || !h.presence[n-1].start.Equal(start) {
+		// The count before the change was held since the interval started
+		h.presence = append(h.presence, presenceBucket{start: start, peak: previous})
+	}
+
+	bucket := &h.presence[len(h.presence)-1]
+	if current > bucket.peak {
+		bucket.peak = current
+	}
+	bucket.last = current
+
+	cutoff := start.Add(-presenceHistory)
+	trim := 0
+	for trim < len(h.presence)-1 && !h.presence[trim].start.After(cutoff) {
+		trim++
+	}
+	h.presence = h.presence[trim:]
+}
+
+// Presence returns the connected clients broken down by their reported
+// information, and the peak concurrency per interval over the given window
+func (h *Hub) Presence(now time.Time, window time.Duration) models.Presence {
+	presence := models.Presence{
+		ByTransport:       make(map[string]int),
+		ByOS:              make(map[string]int),
+		ByArch:            make(map[string]int),
+		ByCoreVersion:     make(map[string]int),
+		ByResourceVersion: make(map[string]int),
+		ByLanguage:        make(map[string]int),
+		Peaks:             []models.PresencePeak{},
+	}
+
+	for _, client := range h.Clients() {
+		info := client.Info()
+		presence.Online++
+		presence.ByTransport[orUnknown(client.Transport)]++
+		presence.ByOS[orUnknown(info.OS)]++
+		presence.ByArch[orUnknown(info.Arch)]++
+		presence.ByCoreVersion[orUnknown(info.CoreVersion)]++
+		presence.ByResourceVersion[orUnknown(info.ResourceVersion)]++
+		presence.ByLanguage[orUnknown(client.Language())]++
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if window > presenceHistory {
+		window = presenceHistory
+	}
+	end := now.Truncate(presenceInterval)
+	start := end.Add(-window + presenceInterval)
+
+	// Intervals without connection changes hold the count of the last change
+	// before them
+	carry, i := 0, 0
+	for ; i < len(h.presence) && h.presence[i].start.Before(start); i++ {
+		carry = h.presence[i].last
+	}
+	for t := start; !t.After(end); t = t.Add(presenceInterval) {
+		peak := carry
+		if i < len(h.presence) && h.presence[i].start.Equal(t) {
+			peak = h.presence[i].peak
+			carry = h.presence[i].last
+			i++
+		}
+		presence.Peaks = append(presence.Peaks, models.PresencePeak{
+			Timestamp: t.Unix(),
+			Peak:      peak,
+		})
+	}
+
+	return presence
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
@@ -1,8 +1,12 @@
 package storage
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -13,11 +17,73 @@ type Storage interface {
 	StoreFeedbackLog(log *FeedbackLog) error
 	StoreAuthToken(token *AuthToken) error
 	GetAuthToken(tokenHash string) (*AuthToken, error)
+	FindAuthToken(tokenHash string) (*AuthToken, error)
+	RotateAuthToken(tokenHash string, issued []*AuthToken) (bool, error)
 	RevokeAuthToken(tokenHash string) error
+	RevokeTokenFamily(familyID string) error
 	RevokeAllUserTokens(userID string) error
+	StoreNotification(notification *Notification) error
+	GetNotificationsSince(id int64) ([]*Notification, error)
+	PurgeNotifications(before time.Time) (int64, error)
+	CreateUser(user *User) error
+	GetUser(id string) (*User, error)
+	GetUserByUsername(username string) (*User, error)
+	UpdateUser(user *User) error
+	DeleteUser(id string) error
+	UseTOTPStep(userID string, step int64) (bool, error)
+	UseRecoveryCode(userID, codeHash string) (bool, error)
+	StorePasswordReset(reset *PasswordReset) error
+	ConsumePasswordReset(tokenHash string) (*PasswordReset, error)
+	PurgePasswordResets(expiredBefore time.Time) (int64, error)
+	CreateClient(client *Client) error
+	GetClient(id string) (*Client, error)
+	UpdateClient(client *Client) error
+	UseClientNonce(clientID, nonce string, expiresAt time.Time) (bool, error)
+	CreateDevice(device *Device) error
+	GetDevice(id string) (*Device, error)
+	UpdateDevice(device *Device) error
+	StoreChallenge(challenge *AuthChallenge) error
+	ConsumeChallenge(value string) (*AuthChallenge, error)
+	CreateExternalIdentity(identity *ExternalIdentity) error
+	GetExternalIdentity(issuer, subject string) (*ExternalIdentity, error)
+	StoreSession(session *Session) error
+	GetSession(id string) (*Session, error)
+	ListUserSessions(userID string) ([]*Session, error)
+	PurgeAuthTokens(expiredBefore time.Time) (int64, error)
+	PurgeSessions(expiredBefore time.Time) (int64, error)
+	UpdateLoginFailures(key string, update func(failures *LoginFailures) bool) (*LoginFailures, error)
+	GetLoginFailures(key string) (*LoginFailures, error)
+	ClearLoginFailures(key string) error
+	PurgeLoginFailures(before time.Time) (int64, error)
+	CreateAPIKey(key *APIKey) error
+	GetAPIKey(id string) (*APIKey, error)
+	GetAPIKeyByHash(keyHash string) (*APIKey, error)
+	ListAPIKeys() ([]*APIKey, error)
+	RevokeAPIKey(id string) error
+	TouchAPIKey(id string, usedAt time.Time) error
 	Close() error
 }
 
+// Locker is implemented by storage shared between server instances, so that
+// background jobs run on only one of them at a time
+type Locker interface {
+	// TryLock takes the named lock without waiting. It returns false if another
+	// instance holds it, otherwise a function that releases it.
+	TryLock(name string) (release func(), acquired bool, err error)
+}
+
+// ErrUserExists is returned by CreateUser if the username is already taken
+var ErrUserExists = errors.New("user already exists")
+
+// ErrClientExists is returned by CreateClient if the identifier is already taken
+var ErrClientExists = errors.New("client already exists")
+
+// ErrDeviceExists is returned by CreateDevice if the public key is already registered
+var ErrDeviceExists = errors.New("device already exists")
+
+// ErrIdentityExists is returned by CreateExternalIdentity if the identity is already linked
+var ErrIdentityExists = errors.New("external identity already exists")
+
 type Database struct {
 	db *sql.DB
 }
@@ -30,6 +96,7 @@ type FeedbackLog struct {
 	ResourceVersion string    `json:"resourceVersion"`
 	Timestamp       int64     `json:"timestamp"`
 	Content         string    `json:"content"`
+	UserID          string    `json:"userId,omitempty"` // empty for feedback sent without a login
 	CreatedAt       time.Time `json:"createdAt"`
 }
 
@@ -38,13 +105,174 @@ type AuthToken struct {
 	TokenHash    string    `json:"tokenHash"`
 	TokenType    string    `json:"tokenType"` // "access" or "refresh"
 	UserID       string    `json:"userId"`
+	FamilyID     string    `json:"familyId"` // shared by tokens descending from one login
 	ExpiresAt    time.Time `json:"expiresAt"`
 	CreatedAt    time.Time `json:"createdAt"`
 	IsRevoked    bool      `json:"isRevoked"`
+	IsRotated    bool      `json:"isRotated"` // refresh token that was exchanged for a new one
+}
+
+// Notification is a real-time notification kept for message history compensation
+type Notification struct {
+	ID              int64     `json:"id"`
+	Type            string    `json:"type"` // "update" or "maintenance"
+	OS              string    `json:"os"`   // empty matches every OS
+	Arch            string    `json:"arch"` // empty matches every architecture
+	CoreVersion     string    `json:"coreVersion"`
+	ResourceVersion string    `json:"resourceVersion"`
+	Status          string    `json:"status"`
+	Message         string    `json:"message"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// User is an account that can log in with a username and password
+type User struct {
+	ID           string    `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"` // argon2id, see auth.HashPassword
+	Disabled     bool      `json:"disabled"`
+	Roles        []string  `json:"roles,omitempty"` // e.g. admin, tester, publisher
+	TOTP         TOTP      `json:"totp"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// TOTP is the two-factor authentication state of a user. The secret is set
+// when the user starts enrolling and Enabled once a code confirmed it.
+type TOTP struct {
+	Secret        string   `json:"secret,omitempty"` // base32, kept readable to verify codes
+	Enabled       bool     `json:"enabled"`
+	LastStep      int64    `json:"lastStep"`                // time step of the last accepted code
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"` // hashes of unused codes, see auth.HashRecoveryCode
+}
+
+// PasswordReset is a single-use token that allows a user to set a new password
+type PasswordReset struct {
+	TokenHash string    `json:"tokenHash"`
+	UserID    string    `json:"userId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Client is a registered identifier that logs in with HMAC signatures made
+// with its own secret
+type Client struct {
+	ID        string    `json:"id"`
+	Secret    string    `json:"secret"` // HMAC-SHA256 key, kept readable to verify signatures
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Device is a launcher installation that logs in by signing a challenge
+// with its Ed25519 key
+type Device struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"userId"`    // bound user, empty for an anonymous device
+	PublicKey  string    `json:"publicKey"` // base64url Ed25519 public key
+	Name       string    `json:"name"`
+	Revoked    bool      `json:"revoked"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// AuthChallenge is a single-use value that devices sign to prove they hold
+// their key, or that completes a password login with a second factor
+type AuthChallenge struct {
+	Value     string    `json:"value"`
+	UserID    string    `json:"userId,omitempty"`   // user whose first factor was accepted, empty for device challenges
+	DeviceID  string    `json:"deviceId,omitempty"` // device whose login a second factor challenge continues
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ExternalIdentity links an account of an external identity provider,
+// identified by its issuer and subject, to a local user
+type ExternalIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    string    `json:"userId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Session is one login of a user: the tokens of a token family and the
+// client they were issued to. Revoking the token family revokes the session.
+type Session struct {
+	ID         string    `json:"id"` // token family ID
+	UserID     string    `json:"userId"`
+	OS         string    `json:"os"`
+	Arch       string    `json:"arch"`
+	UserAgent  string    `json:"userAgent"`
+	IPAddress  string    `json:"ipAddress"`
+	Revoked    bool      `json:"revoked"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"` // last login or refresh
+	ExpiresAt  time.Time `json:"expiresAt"`  // expiry of the current refresh token
+}
+
+// LoginFailures counts the failed logins for a username or source address
+// since the failures were last cleared
+type LoginFailures struct {
+	Key           string    `json:"key"` // "user:<username>" or "ip:<address>"
+	Count         int       `json:"count"`
+	LastFailureAt time.Time `json:"lastFailureAt"`
+}
+
+// APIKey is a long-lived credential for automation such as release
+// pipelines, sent in the X-API-Key header. Its scopes are the roles it grants.
+type APIKey struct {
+	ID         string    `json:"id"`
+	KeyHash    string    `json:"keyHash"` // see auth.HashAPIKey
+	Name       string    `json:"name"`
+	UserID     string    `json:"userId"` // admin that created it, empty if created from the command line
+	Scopes     []string  `json:"scopes,omitempty"`
+	Revoked    bool      `json:"revoked"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`  // zero if the key does not expire
+	LastUsedAt time.Time `json:"lastUsedAt"` // zero if the key was never used
+}
+
+// Expired reports whether the key has expired at the given time
+func (k *APIKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// UsernameFailureKey returns the LoginFailures key of a username
+func UsernameFailureKey(username string) string {
+	return "user:" + username
+}
+
+// AddressFailureKey returns the LoginFailures key of a source address
+func AddressFailureKey(address string) string {
+	return "ip:" + address
+}
+
+// UsernameResetKey returns the LoginFailures key that counts the password
+// reset requests for a username
+func UsernameResetKey(username string) string {
+	return "reset-user:" + username
+}
+
+// AddressResetKey returns the LoginFailures key that counts the password
+// reset requests from a source address
+func AddressResetKey(address string) string {
+	return "reset-ip:" + address
+}
+
+// newRandomID returns a random ID for users and devices
+func newRandomID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
 }
 
 func NewDatabase(dbPath string) (*Database, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	// Writers wait for each other instead of failing with SQLITE_BUSY
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite", dbPath+separator+"_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -68,6 +296,7 @@ func (d *Database) createTables() error {
 		resource_version TEXT NOT NULL,
 		timestamp INTEGER NOT NULL,
 		content TEXT NOT NULL,
+		user_id TEXT NOT NULL DEFAULT '',
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);`
 
@@ -78,9 +307,139 @@ func (d *Database) createTables() error {
 		token_hash TEXT UNIQUE NOT NULL,
 		token_type TEXT NOT NULL,
 		user_id TEXT NOT NULL,
+		family_id TEXT NOT NULL DEFAULT '',
 		expires_at DATETIME NOT NULL,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		is_revoked BOOLEAN DEFAULT FALSE
+		is_revoked BOOLEAN DEFAULT FALSE,
+		is_rotated BOOLEAN NOT NULL DEFAULT FALSE
+	);`
+
+	// Create notifications table
+	notificationsTableSQL := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		os TEXT NOT NULL DEFAULT '',
+		arch TEXT NOT NULL DEFAULT '',
+		core_version TEXT NOT NULL DEFAULT '',
+		resource_version TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);`
+
+	// Create users table
+	usersTableSQL := `
+	CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		username TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		disabled BOOLEAN NOT NULL DEFAULT FALSE,
+		roles TEXT NOT NULL DEFAULT '',
+		totp_secret TEXT NOT NULL DEFAULT '',
+		totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		totp_last_step INTEGER NOT NULL DEFAULT 0,
+		recovery_codes TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`
+
+	// Create password_resets table
+	passwordResetsTableSQL := `
+	CREATE TABLE IF NOT EXISTS password_resets (
+		token_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL
+	);`
+
+	// Create devices table
+	devicesTableSQL := `
+	CREATE TABLE IF NOT EXISTS devices (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL DEFAULT '',
+		public_key TEXT UNIQUE NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		revoked BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME NOT NULL
+	);`
+
+	// Create auth_challenges table
+	authChallengesTableSQL := `
+	CREATE TABLE IF NOT EXISTS auth_challenges (
+		value TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL DEFAULT '',
+		device_id TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL
+	);`
+
+	// Create external_identities table
+	externalIdentitiesTableSQL := `
+	CREATE TABLE IF NOT EXISTS external_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (issuer, subject)
+	);`
+
+	// Create sessions table
+	sessionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		os TEXT NOT NULL DEFAULT '',
+		arch TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip_address TEXT NOT NULL DEFAULT '',
+		revoked BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);`
+
+	// Create login_failures table
+	loginFailuresTableSQL := `
+	CREATE TABLE IF NOT EXISTS login_failures (
+		key TEXT PRIMARY KEY,
+		count INTEGER NOT NULL,
+		last_failure_at DATETIME NOT NULL
+	);`
+
+	// Create api_keys table
+	apiKeysTableSQL := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		key_hash TEXT UNIQUE NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		user_id TEXT NOT NULL DEFAULT '',
+		scopes TEXT NOT NULL DEFAULT '',
+		revoked BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME,
+		last_used_at DATETIME
+	);`
+
+	// Create clients table
+	clientsTableSQL := `
+	CREATE TABLE IF NOT EXISTS clients (
+		id TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		disabled BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`
+
+	// Create client_nonces table
+	clientNoncesTableSQL := `
+	CREATE TABLE IF NOT EXISTS client_nonces (
+		client_id TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (client_id, nonce)
 	);`
 
 	if _, err := d.db.Exec(feedbackTableSQL); err != nil {
@@ -91,15 +450,107 @@ func (d *Database) createTables() error {
 		return fmt.Errorf("failed to create auth_tokens table: %w", err)
 	}
 
+	if _, err := d.db.Exec(notificationsTableSQL); err != nil {
+		return fmt.Errorf("failed to create notifications table: %w", err)
+	}
+
+	if _, err := d.db.Exec(usersTableSQL); err != nil {
+		return fmt.Errorf("failed to create users table: %w", err)
+	}
+
+	if _, err := d.db.Exec(passwordResetsTableSQL); err != nil {
+		return fmt.Errorf("failed to create password_resets table: %w", err)
+	}
+
+	if _, err := d.db.Exec(clientsTableSQL); err != nil {
+		return fmt.Errorf("failed to create clients table: %w", err)
+	}
+
+	if _, err := d.db.Exec(clientNoncesTableSQL); err != nil {
+		return fmt.Errorf("failed to create client_nonces table: %w", err)
+	}
+
+	if _, err := d.db.Exec(devicesTableSQL); err != nil {
+		return fmt.Errorf("failed to create devices table: %w", err)
+	}
+
+	if _, err := d.db.Exec(authChallengesTableSQL); err != nil {
+		return fmt.Errorf("failed to create auth_challenges table: %w", err)
+	}
+
+	if _, err := d.db.Exec(externalIdentitiesTableSQL); err != nil {
+		return fmt.Errorf("failed to create external_identities table: %w", err)
+	}
+
+	if _, err := d.db.Exec(sessionsTableSQL); err != nil {
+		return fmt.Errorf("failed to create sessions table: %w", err)
+	}
+
+	if _, err := d.db.Exec(loginFailuresTableSQL); err != nil {
+		return fmt.Errorf("failed to create login_failures table: %w", err)
+	}
+
+	if _, err := d.db.Exec(apiKeysTableSQL); err != nil {
+		return fmt.Errorf("failed to create api_keys table: %w", err)
+	}
+
+	// Columns added after the first release
+	if err := d.addColumn("auth_tokens", "family_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumn("auth_tokens", "is_rotated", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return err
+	}
+	if err := d.addColumn("feedback_logs", "user_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumn("users", "roles", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumn("users", "totp_secret", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumn("users", "totp_enabled", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return err
+	}
+	if err := d.addColumn("users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := d.addColumn("users", "recovery_codes", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumn("auth_challenges", "user_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumn("auth_challenges", "device_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// addColumn adds a column to a table created by an older version
+func (d *Database) addColumn(table, column, definition string) error {
+	var count int
+	query := `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`
+	if err := d.db.QueryRow(query, table, column).Scan(&count); err != nil {
+		return fmt.Errorf("failed to inspect %s table: %w", table, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+	}
 	return nil
 }
 
 func (d *Database) StoreFeedbackLog(log *FeedbackLog) error {
 	query := `
-		INSERT INTO feedback_logs (os, arch, core_version, resource_version, timestamp, content)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO feedback_logs (os, arch, core_version, resource_version, timestamp, content, user_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := d.db.Exec(query, log.OS, log.Arch, log.CoreVersion, log.ResourceVersion, log.Timestamp, log.Content)
+	_, err := d.db.Exec(query, log.OS, log.Arch, log.CoreVersion, log.ResourceVersion, log.Timestamp, log.Content, log.UserID)
 	if err != nil {
 		return fmt.Errorf("failed to store feedback log: %w", err)
 	}
@@ -107,11 +558,18 @@ func (d *Database) StoreFeedbackLog(log *FeedbackLog) error {
 }
 
 func (d *Database) StoreAuthToken(token *AuthToken) error {
+	return storeAuthToken(d.db.Exec, token)
+}
+
+// storeAuthToken inserts a token with exec, which belongs to the database or
+// to a transaction
+func storeAuthToken(exec func(query string, args ...interface{}) (sql.Result, error), token *AuthToken) error {
 	query := `
-		INSERT INTO auth_tokens (token_hash, token_type, user_id, expires_at)
-		VALUES (?, ?, ?, ?)
+		INSERT INTO auth_tokens (token_hash, token_type, user_id, family_id, expires_at)
+		VALUES (?, ?, ?, ?, ?)
 	`
-	_, err := d.db.Exec(query, token.TokenHash, token.TokenType, token.UserID, token.ExpiresAt)
+	// Stored as UTC so that expires_at compares correctly in PurgeAuthTokens
+	_, err := exec(query, token.TokenHash, token.TokenType, token.UserID, token.FamilyID, token.ExpiresAt.UTC())
 	if err != nil {
 		return fmt.Errorf("failed to store auth token: %w", err)
 	}
@@ -119,15 +577,24 @@ func (d *Database) StoreAuthToken(token *AuthToken) error {
 }
 
 func (d *Database) GetAuthToken(tokenHash string) (*AuthToken, error) {
+	token, err := d.FindAuthToken(tokenHash)
+	if err != nil || token == nil || token.IsRevoked {
+		return nil, err
+	}
+	return token, nil
+}
+
+// FindAuthToken returns a token whether or not it has been revoked
+func (d *Database) FindAuthToken(tokenHash string) (*AuthToken, error) {
 	query := `
-		SELECT id, token_hash, token_type, user_id, expires_at, created_at, is_revoked
+		SELECT id, token_hash, token_type, user_id, family_id, expires_at, created_at, is_revoked, is_rotated
 		FROM auth_tokens
-		WHERE token_hash = ? AND is_revoked = FALSE
+		WHERE token_hash = ?
 	`
 	row := d.db.QueryRow(query, tokenHash)
 	
 	var token AuthToken
-	err := row.Scan(&token.ID, &token.TokenHash, &token.TokenType, &token.UserID, &token.ExpiresAt, &token.CreatedAt, &token.IsRevoked)
+	err := row.Scan(&token.ID, &token.TokenHash, &token.TokenType, &token.UserID, &token.FamilyID, &token.ExpiresAt, &token.CreatedAt, &token.IsRevoked, &token.IsRotated)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // Token not found
@@ -138,6 +605,40 @@ func (d *Database) GetAuthToken(tokenHash string) (*AuthToken, error) {
 	return &token, nil
 }
 
+// RotateAuthToken marks a refresh token as exchanged and stores the tokens
+// issued for it in the same transaction, so that revoking the family cannot
+// miss them. It returns false and stores nothing if the token was already
+// revoked, e.g. by a concurrent refresh.
+func (d *Database) RotateAuthToken(tokenHash string, issued []*AuthToken) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE auth_tokens SET is_revoked = TRUE, is_rotated = TRUE WHERE token_hash = ? AND is_revoked = FALSE`
+	result, err := tx.Exec(query, tokenHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %w", err)
+	}
+	if rows != 1 {
+		return false, nil
+	}
+	for _, token := range issued {
+		if err := storeAuthToken(tx.Exec, token); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %w", err)
+	}
+	return true, nil
+}
+
 func (d *Database) RevokeAuthToken(tokenHash string) error {
 	query := `UPDATE auth_tokens SET is_revoked = TRUE WHERE token_hash = ?`
 	_, err := d.db.Exec(query, tokenHash)
@@ -147,15 +648,672 @@ func (d *Database) RevokeAuthToken(tokenHash string) error {
 	return nil
 }
 
+// RevokeTokenFamily revokes every token issued from the same login. Tokens
+// stored without a family are not affected.
+func (d *Database) RevokeTokenFamily(familyID string) error {
+	if familyID == "" {
+		return nil
+	}
+	query := `UPDATE auth_tokens SET is_revoked = TRUE WHERE family_id = ?`
+	_, err := d.db.Exec(query, familyID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+	if _, err := d.db.Exec(`UPDATE sessions SET revoked = TRUE WHERE id = ?`, familyID); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	return nil
+}
+
 func (d *Database) RevokeAllUserTokens(userID string) error {
 	query := `UPDATE auth_tokens SET is_revoked = TRUE WHERE user_id = ?`
 	_, err := d.db.Exec(query, userID)
 	if err != nil {
 		return fmt.Errorf("failed to revoke user tokens: %w", err)
 	}
+	if _, err := d.db.Exec(`UPDATE sessions SET revoked = TRUE WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to revoke user sessions: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) StoreNotification(notification *Notification) error {
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = time.Now()
+	}
+	// Stored as UTC so that created_at compares correctly in PurgeNotifications
+	notification.CreatedAt = notification.CreatedAt.UTC()
+	query := `
+		INSERT INTO notifications (type, os, arch, core_version, resource_version, status, message, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := d.db.Exec(query, notification.Type, notification.OS, notification.Arch, notification.CoreVersion,
+		notification.ResourceVersion, notification.Status, notification.Message, notification.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store notification: %w", err)
+	}
+	notification.ID, err = result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get notification id: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) GetNotificationsSince(id int64) ([]*Notification, error) {
+	query := `
+		SELECT id, type, os, arch, core_version, resource_version, status, message, created_at
+		FROM notifications
+		WHERE id > ?
+		ORDER BY id
+	`
+	rows, err := d.db.Query(query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notifications: %w", err)
+	}
+	defer rows.Close()
+
+	var notifications []*Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.OS, &n.Arch, &n.CoreVersion, &n.ResourceVersion, &n.Status, &n.Message, &n.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		notifications = append(notifications, &n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get notifications: %w", err)
+	}
+	return notifications, nil
+}
+
+func (d *Database) PurgeNotifications(before time.Time) (int64, error) {
+	result, err := d.db.Exec(`DELETE FROM notifications WHERE created_at < ?`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge notifications: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// PurgeAuthTokens deletes tokens that expired before the given time, whether
+// or not they were revoked, and returns how many were deleted
+func (d *Database) PurgeAuthTokens(expiredBefore time.Time) (int64, error) {
+	result, err := d.db.Exec(`DELETE FROM auth_tokens WHERE expires_at < ?`, expiredBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge auth tokens: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (d *Database) CreateUser(user *User) error {
+	if user.ID == "" {
+		user.ID = newRandomID()
+	}
+	now := time.Now().UTC()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+
+	query := `
+		INSERT INTO users (id, username, password_hash, disabled, roles, totp_secret, totp_enabled, totp_last_step, recovery_codes, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := d.db.Exec(query, user.ID, user.Username, user.PasswordHash, user.Disabled, strings.Join(user.Roles, ","),
+		user.TOTP.Secret, user.TOTP.Enabled, user.TOTP.LastStep, strings.Join(user.TOTP.RecoveryCodes, ","), user.CreatedAt, user.UpdatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrUserExists
+		}
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	return nil
+}
+
+const userColumns = `id, username, password_hash, disabled, roles, totp_secret, totp_enabled, totp_last_step, recovery_codes, created_at, updated_at`
+
+func (d *Database) GetUser(id string) (*User, error) {
+	return d.getUser(`SELECT `+userColumns+` FROM users WHERE id = ?`, id)
+}
+
+func (d *Database) GetUserByUsername(username string) (*User, error) {
+	return d.getUser(`SELECT `+userColumns+` FROM users WHERE username = ?`, username)
+}
+
+func (d *Database) getUser(query string, arg string) (*User, error) {
+	var user User
+	var roles, recoveryCodes string
+	err := d.db.QueryRow(query, arg).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Disabled, &roles,
+		&user.TOTP.Secret, &user.TOTP.Enabled, &user.TOTP.LastStep, &recoveryCodes, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // User not found
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
+	if recoveryCodes != "" {
+		user.TOTP.RecoveryCodes = strings.Split(recoveryCodes, ",")
+	}
+	return &user, nil
+}
+
+func (d *Database) UpdateUser(user *User) error {
+	user.UpdatedAt = time.Now().UTC()
+	query := `
+		UPDATE users SET username = ?, password_hash = ?, disabled = ?, roles = ?,
+			totp_secret = ?, totp_enabled = ?, totp_last_step = ?, recovery_codes = ?, updated_at = ?
+		WHERE id = ?
+	`
+	_, err := d.db.Exec(query, user.Username, user.PasswordHash, user.Disabled, strings.Join(user.Roles, ","),
+		user.TOTP.Secret, user.TOTP.Enabled, user.TOTP.LastStep, strings.Join(user.TOTP.RecoveryCodes, ","), user.UpdatedAt, user.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrUserExists
+		}
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// DeleteUser removes a user account. It is meant for accounts that were just
+// created; the tokens and sessions of the user are not touched.
+func (d *Database) DeleteUser(id string) error {
+	if _, err := d.db.Exec(`DELETE FROM users WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
 	return nil
 }
 
+// UseTOTPStep records the time step of an accepted TOTP code. It returns false
+// if a code of the same or a later step was accepted already.
+func (d *Database) UseTOTPStep(userID string, step int64) (bool, error) {
+	query := `UPDATE users SET totp_last_step = ?, updated_at = ? WHERE id = ? AND totp_last_step < ?`
+	result, err := d.db.Exec(query, step, time.Now().UTC(), userID, step)
+	if err != nil {
+		return false, fmt.Errorf("failed to record TOTP step: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record TOTP step: %w", err)
+	}
+	return rows == 1, nil
+}
+
+// UseRecoveryCode removes a recovery code of a user. It returns false if the
+// user has no such code, e.g. because it was used already.
+func (d *Database) UseRecoveryCode(userID, codeHash string) (bool, error) {
+	for {
+		var codes string
+		err := d.db.QueryRow(`SELECT recovery_codes FROM users WHERE id = ?`, userID).Scan(&codes)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get recovery codes: %w", err)
+		}
+		remaining, ok := removeRecoveryCode(codes, codeHash)
+		if !ok {
+			return false, nil
+		}
+
+		// Only replace the codes that were read, so that concurrent logins
+		// cannot both remove the same code
+		query := `UPDATE users SET recovery_codes = ?, updated_at = ? WHERE id = ? AND recovery_codes = ?`
+		result, err := d.db.Exec(query, remaining, time.Now().UTC(), userID, codes)
+		if err != nil {
+			return false, fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return false, fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		if rows == 1 {
+			return true, nil
+		}
+		// The codes changed since they were read; look again
+	}
+}
+
+// removeRecoveryCode removes a hash from a comma separated list of recovery
+// code hashes
+func removeRecoveryCode(codes, codeHash string) (string, bool) {
+	list := strings.Split(codes, ",")
+	for i, code := range list {
+		if code != "" && code == codeHash {
+			return strings.Join(append(list[:i], list[i+1:]...), ","), true
+		}
+	}
+	return codes, false
+}
+
+func (d *Database) StorePasswordReset(reset *PasswordReset) error {
+	reset.CreatedAt = time.Now().UTC()
+	query := `
+		INSERT INTO password_resets (token_hash, user_id, expires_at, created_at)
+		VALUES (?, ?, ?, ?)
+	`
+	_, err := d.db.Exec(query, reset.TokenHash, reset.UserID, reset.ExpiresAt.UTC(), reset.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store password reset: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) ConsumePasswordReset(tokenHash string) (*PasswordReset, error) {
+	// Reading and deleting in one statement lets only one caller use the token
+	var reset PasswordReset
+	query := `DELETE FROM password_resets WHERE token_hash = ? RETURNING token_hash, user_id, expires_at, created_at`
+	if err := d.db.QueryRow(query, tokenHash).Scan(&reset.TokenHash, &reset.UserID, &reset.ExpiresAt, &reset.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Token not found or already used
+		}
+		return nil, fmt.Errorf("failed to consume password reset: %w", err)
+	}
+	return &reset, nil
+}
+
+// PurgePasswordResets deletes unused password reset tokens that expired
+// before the given time and returns how many were deleted
+func (d *Database) PurgePasswordResets(expiredBefore time.Time) (int64, error) {
+	result, err := d.db.Exec(`DELETE FROM password_resets WHERE expires_at < ?`, expiredBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge password resets: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (d *Database) CreateClient(client *Client) error {
+	now := time.Now().UTC()
+	client.CreatedAt = now
+	client.UpdatedAt = now
+
+	query := `
+		INSERT INTO clients (id, secret, disabled, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := d.db.Exec(query, client.ID, client.Secret, client.Disabled, client.CreatedAt, client.UpdatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrClientExists
+		}
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) GetClient(id string) (*Client, error) {
+	var client Client
+	row := d.db.QueryRow(`SELECT id, secret, disabled, created_at, updated_at FROM clients WHERE id = ?`, id)
+	if err := row.Scan(&client.ID, &client.Secret, &client.Disabled, &client.CreatedAt, &client.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Client not found
+		}
+		return nil, fmt.Errorf("failed to get client: %w", err)
+	}
+	return &client, nil
+}
+
+func (d *Database) UpdateClient(client *Client) error {
+	client.UpdatedAt = time.Now().UTC()
+	query := `UPDATE clients SET secret = ?, disabled = ?, updated_at = ? WHERE id = ?`
+	if _, err := d.db.Exec(query, client.Secret, client.Disabled, client.UpdatedAt, client.ID); err != nil {
+		return fmt.Errorf("failed to update client: %w", err)
+	}
+	return nil
+}
+
+// UseClientNonce records a nonce until it expires. It returns false if the
+// client already used the nonce.
+func (d *Database) UseClientNonce(clientID, nonce string, expiresAt time.Time) (bool, error) {
+	if _, err := d.db.Exec(`DELETE FROM client_nonces WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return false, fmt.Errorf("failed to purge client nonces: %w", err)
+	}
+
+	query := `
+		INSERT OR IGNORE INTO client_nonces (client_id, nonce, expires_at)
+		VALUES (?, ?, ?)
+	`
+	result, err := d.db.Exec(query, clientID, nonce, expiresAt.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to store client nonce: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to store client nonce: %w", err)
+	}
+	return rows == 1, nil
+}
+
+func (d *Database) CreateDevice(device *Device) error {
+	if device.ID == "" {
+		device.ID = newRandomID()
+	}
+	now := time.Now().UTC()
+	device.CreatedAt = now
+	device.LastUsedAt = now
+
+	query := `
+		INSERT INTO devices (id, user_id, public_key, name, revoked, created_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := d.db.Exec(query, device.ID, device.UserID, device.PublicKey, device.Name, device.Revoked, device.CreatedAt, device.LastUsedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrDeviceExists
+		}
+		return fmt.Errorf("failed to create device: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) GetDevice(id string) (*Device, error) {
+	var device Device
+	row := d.db.QueryRow(`SELECT id, user_id, public_key, name, revoked, created_at, last_used_at FROM devices WHERE id = ?`, id)
+	if err := row.Scan(&device.ID, &device.UserID, &device.PublicKey, &device.Name, &device.Revoked, &device.CreatedAt, &device.LastUsedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Device not found
+		}
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+	return &device, nil
+}
+
+func (d *Database) UpdateDevice(device *Device) error {
+	query := `UPDATE devices SET name = ?, revoked = ?, last_used_at = ? WHERE id = ?`
+	if _, err := d.db.Exec(query, device.Name, device.Revoked, device.LastUsedAt.UTC(), device.ID); err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) StoreChallenge(challenge *AuthChallenge) error {
+	// Unused challenges are forgotten once they expire
+	if _, err := d.db.Exec(`DELETE FROM auth_challenges WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to purge challenges: %w", err)
+	}
+
+	challenge.CreatedAt = time.Now().UTC()
+	query := `INSERT INTO auth_challenges (value, user_id, device_id, expires_at, created_at) VALUES (?, ?, ?, ?, ?)`
+	if _, err := d.db.Exec(query, challenge.Value, challenge.UserID, challenge.DeviceID, challenge.ExpiresAt.UTC(), challenge.CreatedAt); err != nil {
+		return fmt.Errorf("failed to store challenge: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) ConsumeChallenge(value string) (*AuthChallenge, error) {
+	var challenge AuthChallenge
+	query := `DELETE FROM auth_challenges WHERE value = ? RETURNING value, user_id, device_id, expires_at, created_at`
+	if err := d.db.QueryRow(query, value).Scan(&challenge.Value, &challenge.UserID, &challenge.DeviceID, &challenge.ExpiresAt, &challenge.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Challenge not found or already used
+		}
+		return nil, fmt.Errorf("failed to consume challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+func (d *Database) CreateExternalIdentity(identity *ExternalIdentity) error {
+	identity.CreatedAt = time.Now().UTC()
+	query := `INSERT INTO external_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)`
+	if _, err := d.db.Exec(query, identity.Issuer, identity.Subject, identity.UserID, identity.CreatedAt); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrIdentityExists
+		}
+		return fmt.Errorf("failed to create external identity: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) GetExternalIdentity(issuer, subject string) (*ExternalIdentity, error) {
+	var identity ExternalIdentity
+	row := d.db.QueryRow(`SELECT issuer, subject, user_id, created_at FROM external_identities WHERE issuer = ? AND subject = ?`, issuer, subject)
+	if err := row.Scan(&identity.Issuer, &identity.Subject, &identity.UserID, &identity.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Identity not linked
+		}
+		return nil, fmt.Errorf("failed to get external identity: %w", err)
+	}
+	return &identity, nil
+}
+
+// StoreSession creates or updates a session. A revoked session stays revoked.
+func (d *Database) StoreSession(session *Session) error {
+	query := `
+		INSERT INTO sessions (id, user_id, os, arch, user_agent, ip_address, revoked, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			os = excluded.os, arch = excluded.arch, user_agent = excluded.user_agent, ip_address = excluded.ip_address,
+			revoked = sessions.revoked OR excluded.revoked, last_used_at = excluded.last_used_at, expires_at = excluded.expires_at
+	`
+	_, err := d.db.Exec(query, session.ID, session.UserID, session.OS, session.Arch, session.UserAgent, session.IPAddress,
+		session.Revoked, session.CreatedAt.UTC(), session.LastUsedAt.UTC(), session.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+	return nil
+}
+
+const sessionColumns = `id, user_id, os, arch, user_agent, ip_address, revoked, created_at, last_used_at, expires_at`
+
+func (d *Database) GetSession(id string) (*Session, error) {
+	row := d.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id)
+	session, err := scanSession(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Session not found
+		}
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	return session, nil
+}
+
+// ListUserSessions returns the sessions of a user that are neither revoked
+// nor expired, most recently used first
+func (d *Database) ListUserSessions(userID string) ([]*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions
+		WHERE user_id = ? AND revoked = FALSE AND expires_at > ?
+		ORDER BY last_used_at DESC`
+	rows, err := d.db.Query(query, userID, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// PurgeSessions deletes sessions whose refresh token expired before the
+// given time and returns how many were deleted
+func (d *Database) PurgeSessions(expiredBefore time.Time) (int64, error) {
+	result, err := d.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, expiredBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func scanSession(row interface{ Scan(...interface{}) error }) (*Session, error) {
+	var session Session
+	err := row.Scan(&session.ID, &session.UserID, &session.OS, &session.Arch, &session.UserAgent, &session.IPAddress,
+		&session.Revoked, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// UpdateLoginFailures reads the failures of key, zero if none are stored,
+// and stores them again if update returns true. Updates of one key run one
+// after another, so that checking and counting an attempt is a single step.
+func (d *Database) UpdateLoginFailures(key string, update func(failures *LoginFailures) bool) (*LoginFailures, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// A write takes the database write lock, which a read would not, even if
+	// it changes no rows
+	if _, err := tx.Exec(`UPDATE login_failures SET count = count WHERE key = ?`, key); err != nil {
+		return nil, fmt.Errorf("failed to lock login failures: %w", err)
+	}
+	var failures LoginFailures
+	row := tx.QueryRow(`SELECT key, count, last_failure_at FROM login_failures WHERE key = ?`, key)
+	switch err := row.Scan(&failures.Key, &failures.Count, &failures.LastFailureAt); {
+	case err == sql.ErrNoRows:
+		failures = LoginFailures{Key: key, LastFailureAt: time.Now().UTC()}
+	case err != nil:
+		return nil, fmt.Errorf("failed to update login failures: %w", err)
+	}
+	if !update(&failures) {
+		return &failures, nil
+	}
+	query := `
+		INSERT INTO login_failures (key, count, last_failure_at) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET count = excluded.count, last_failure_at = excluded.last_failure_at
+	`
+	if _, err := tx.Exec(query, key, failures.Count, failures.LastFailureAt.UTC()); err != nil {
+		return nil, fmt.Errorf("failed to update login failures: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update login failures: %w", err)
+	}
+	return &failures, nil
+}
+
+func (d *Database) GetLoginFailures(key string) (*LoginFailures, error) {
+	var failures LoginFailures
+	row := d.db.QueryRow(`SELECT key, count, last_failure_at FROM login_failures WHERE key = ?`, key)
+	if err := row.Scan(&failures.Key, &failures.Count, &failures.LastFailureAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No failures recorded
+		}
+		return nil, fmt.Errorf("failed to get login failures: %w", err)
+	}
+	return &failures, nil
+}
+
+func (d *Database) ClearLoginFailures(key string) error {
+	if _, err := d.db.Exec(`DELETE FROM login_failures WHERE key = ?`, key); err != nil {
+		return fmt.Errorf("failed to clear login failures: %w", err)
+	}
+	return nil
+}
+
+// PurgeLoginFailures deletes the failures of keys whose last failure was
+// before the given time and returns how many were deleted
+func (d *Database) PurgeLoginFailures(before time.Time) (int64, error) {
+	result, err := d.db.Exec(`DELETE FROM login_failures WHERE last_failure_at < ?`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge login failures: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (d *Database) CreateAPIKey(key *APIKey) error {
+	if key.ID == "" {
+		key.ID = newRandomID()
+	}
+	key.CreatedAt = time.Now().UTC()
+
+	query := `
+		INSERT INTO api_keys (id, key_hash, name, user_id, scopes, revoked, created_at, expires_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := d.db.Exec(query, key.ID, key.KeyHash, key.Name, key.UserID, strings.Join(key.Scopes, ","), key.Revoked,
+		key.CreatedAt, nullTime(key.ExpiresAt), nullTime(key.LastUsedAt))
+	if err != nil {
+		return fmt.Errorf("failed to create API key: %w", err)
+	}
+	return nil
+}
+
+const apiKeyColumns = `id, key_hash, name, user_id, scopes, revoked, created_at, expires_at, last_used_at`
+
+func (d *Database) GetAPIKey(id string) (*APIKey, error) {
+	return d.getAPIKey(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id)
+}
+
+// GetAPIKeyByHash returns a key whether or not it has been revoked or has expired
+func (d *Database) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	return d.getAPIKey(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash)
+}
+
+func (d *Database) getAPIKey(query, arg string) (*APIKey, error) {
+	key, err := scanAPIKey(d.db.QueryRow(query, arg))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // API key not found
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns every API key, including revoked and expired ones,
+// newest first
+func (d *Database) ListAPIKeys() ([]*APIKey, error) {
+	rows, err := d.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (d *Database) RevokeAPIKey(id string) error {
+	if _, err := d.db.Exec(`UPDATE api_keys SET revoked = TRUE WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	return nil
+}
+
+// TouchAPIKey records when a key was last used
+func (d *Database) TouchAPIKey(id string, usedAt time.Time) error {
+	if _, err := d.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, usedAt.UTC(), id); err != nil {
+		return fmt.Errorf("failed to update API key: %w", err)
+	}
+	return nil
+}
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.KeyHash, &key.Name, &key.UserID, &scopes, &key.Revoked, &key.CreatedAt, &expiresAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	key.ExpiresAt = expiresAt.Time
+	key.LastUsedAt = lastUsedAt.Time
+	return &key, nil
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
 func (d *Database) Close() error {
 	return d.db.Close()
 }
\ No newline at end of file
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func createTestDatabase(t *testing.T) *Database {
+	d, err := NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestDatabase_Tokens(t *testing.T) {
+	testTokens(t, createTestDatabase(t))
+}
+
+func TestDatabase_SingleUse(t *testing.T) {
+	testSingleUse(t, createTestDatabase(t))
+}
+
+func TestDatabase_LoginFailures(t *testing.T) {
+	testLoginFailures(t, createTestDatabase(t))
+}
+
+func TestFileStorage_LoginFailures(t *testing.T) {
+	f, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create file storage: %v", err)
+	}
+	testLoginFailures(t, f)
+}
+
+func TestFileStorage_SecondFactor(t *testing.T) {
+	f, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create file storage: %v", err)
+	}
+	user := &User{Username: "alice", PasswordHash: "hash", Disabled: true}
+	user.TOTP = TOTP{Secret: "SECRET", Enabled: true, LastStep: 42, RecoveryCodes: []string{"a", "b"}}
+	if err := f.CreateUser(user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	testSecondFactor(t, f, user.ID)
+}
+
+func TestFileStorage_APIKeyByHash(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to create file storage: %v", err)
+	}
+	key := &APIKey{KeyHash: "hash", Name: "ci"}
+	if err := f.CreateAPIKey(key); err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if found, err := f.GetAPIKeyByHash("hash"); err != nil || found == nil || found.ID != key.ID {
+		t.Fatalf("Expected the key by its hash, got %+v, %v", found, err)
+	}
+	if found, err := f.GetAPIKeyByHash("other"); err != nil || found != nil {
+		t.Errorf("Expected no key for an unknown hash, got %+v, %v", found, err)
+	}
+
+	// Keys written before they were indexed are indexed when storage opens
+	legacy := &APIKey{ID: "legacy", KeyHash: "legacyhash", Name: "old"}
+	if err := f.writeAPIKey(legacy); err != nil {
+		t.Fatalf("Failed to write API key: %v", err)
+	}
+	if found, _ := f.GetAPIKeyByHash("legacyhash"); found != nil {
+		t.Fatal("Expected the unindexed key not to be found")
+	}
+	if f, err = NewFileStorage(dir); err != nil {
+		t.Fatalf("Failed to reopen file storage: %v", err)
+	}
+	if found, err := f.GetAPIKeyByHash("legacyhash"); err != nil || found == nil || found.ID != "legacy" {
+		t.Errorf("Expected the legacy key to be indexed, got %+v, %v", found, err)
+	}
+}
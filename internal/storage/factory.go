@@ -1,9 +1,17 @@
 package storage
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 
 	"github.com/moehoshio/NekoLcServer/internal/config"
 )
@@ -20,13 +28,51 @@ func NewStorage(cfg *config.Config) (Storage, error) {
 		}
 		return NewFileStorage(basePath)
 	case "mysql":
-		// TODO: Implement MySQL storage
-		return nil, fmt.Errorf("MySQL storage not yet implemented")
+		dsn, err := mysqlConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewMySQL(dsn, cfg.App.DatabasePool())
+	case "postgres":
+		conn, err := postgresConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewPostgres(conn, cfg.App.DatabasePool())
 	default:
 		return nil, fmt.Errorf("unsupported storage type: %s", cfg.App.Database.Type)
 	}
 }
 
+// Describe returns the storage type and where the data is kept, for logs.
+// Connection strings are reduced to host and database, as they may hold a
+// password.
+func Describe(cfg *config.Config) string {
+	database := cfg.App.Database
+	switch database.Type {
+	case "sqlite":
+		return "sqlite at " + database.Path
+	case "file":
+		if database.Path == "" {
+			return "file at " + cfg.App.Storage.BasePath
+		}
+		return "file at " + database.Path
+	case "mysql":
+		dsn, err := mysqlConfig(cfg)
+		if err != nil {
+			return "mysql with invalid settings"
+		}
+		return fmt.Sprintf("mysql at %s/%s", dsn.Addr, dsn.DBName)
+	case "postgres":
+		conn, err := postgresConfig(cfg)
+		if err != nil {
+			return "postgres with invalid settings"
+		}
+		return fmt.Sprintf("postgres at %s/%s", net.JoinHostPort(conn.Host, strconv.Itoa(int(conn.Port))), conn.Database)
+	}
+	return database.Type
+}
+
 // EnsureDataDirectory creates the data directory if it doesn't exist
 func EnsureDataDirectory(cfg *config.Config) error {
 	var dirPath string
@@ -50,4 +96,163 @@ func EnsureDataDirectory(cfg *config.Config) error {
 	}
 	
 	return nil
-}
\ No newline at end of file
+}
+
+// mysqlConfig returns the connection settings of MySQL storage. The path is
+// used as the DSN if set, otherwise host, port, name, user and password.
+func mysqlConfig(cfg *config.Config) (*mysql.Config, error) {
+	database := cfg.App.Database
+	var dsn *mysql.Config
+	if database.Path != "" {
+		var err error
+		if dsn, err = mysql.ParseDSN(database.Path); err != nil {
+			return nil, fmt.Errorf("invalid MySQL DSN: %w", err)
+		}
+	} else {
+		host := database.Host
+		if host == "" {
+			host = "localhost"
+		}
+		port := database.Port
+		if port == 0 {
+			port = 3306
+		}
+		dsn = mysql.NewConfig()
+		dsn.Net = "tcp"
+		dsn.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+		dsn.DBName = database.Name
+		dsn.User = database.User
+		dsn.Passwd = database.Password
+	}
+
+	// A TLS mode in the DSN is kept unless the configuration sets one
+	mode := database.TLS.Mode
+	if mode == "" {
+		return dsn, nil
+	}
+	if mode == "disabled" {
+		dsn.TLS = nil
+		dsn.TLSConfig = "false"
+		return dsn, nil
+	}
+	tlsConfig, err := databaseTLSConfig(cfg, dsn.Addr)
+	if err != nil {
+		return nil, err
+	}
+	dsn.TLS = tlsConfig
+	dsn.AllowFallbackToPlaintext = mode == "preferred"
+	return dsn, nil
+}
+
+// postgresConfig returns the connection settings of PostgreSQL storage. The
+// path is used as the DSN if set, either as a URL or as key=value pairs,
+// otherwise host, port, name, user and password.
+func postgresConfig(cfg *config.Config) (*pgx.ConnConfig, error) {
+	database := cfg.App.Database
+	if database.Path != "" {
+		conn, err := pgx.ParseConfig(database.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PostgreSQL DSN: %w", err)
+		}
+		// An sslmode in the DSN is kept unless the configuration sets a TLS mode
+		if database.TLS.Mode == "" {
+			return conn, nil
+		}
+		return conn, postgresTLS(cfg, conn)
+	}
+
+	// Settings are only taken from the environment if nothing is configured
+	conn, err := pgx.ParseConfig("sslmode=disable")
+	if err != nil {
+		return nil, err
+	}
+	conn.Host = database.Host
+	if conn.Host == "" {
+		conn.Host = "localhost"
+	}
+	conn.Port = uint16(database.Port)
+	if conn.Port == 0 {
+		conn.Port = 5432
+	}
+	conn.Fallbacks = nil
+	conn.Database = database.Name
+	conn.User = database.User
+	conn.Password = database.Password
+	if database.TLS.Mode == "" {
+		return conn, nil
+	}
+	return conn, postgresTLS(cfg, conn)
+}
+
+// postgresTLS applies the configured TLS mode to every host of a connection.
+// With the preferred mode each host is tried again without TLS if the TLS
+// handshake fails.
+func postgresTLS(cfg *config.Config, conn *pgx.ConnConfig) error {
+	mode := cfg.App.Database.TLS.Mode
+	hosts := []*pgconn.FallbackConfig{{Host: conn.Host, Port: conn.Port}}
+	for _, fallback := range conn.Fallbacks {
+		last := hosts[len(hosts)-1]
+		if fallback.Host != last.Host || fallback.Port != last.Port {
+			hosts = append(hosts, &pgconn.FallbackConfig{Host: fallback.Host, Port: fallback.Port})
+		}
+	}
+
+	var configs []*pgconn.FallbackConfig
+	for _, host := range hosts {
+		if mode == "disabled" {
+			configs = append(configs, host)
+			continue
+		}
+		tlsConfig, err := databaseTLSConfig(cfg, host.Host)
+		if err != nil {
+			return err
+		}
+		configs = append(configs, &pgconn.FallbackConfig{Host: host.Host, Port: host.Port, TLSConfig: tlsConfig})
+		if mode == "preferred" {
+			configs = append(configs, host)
+		}
+	}
+	conn.Host, conn.Port, conn.TLSConfig = configs[0].Host, configs[0].Port, configs[0].TLSConfig
+	conn.Fallbacks = configs[1:]
+	return nil
+}
+
+// databaseTLSConfig returns the TLS settings for a connection to a database
+// server at addr
+func databaseTLSConfig(cfg *config.Config, addr string) (*tls.Config, error) {
+	settings := cfg.App.Database.TLS
+	tlsConfig := &tls.Config{ServerName: settings.ServerName}
+	switch settings.Mode {
+	case "preferred", "skip-verify":
+		tlsConfig.InsecureSkipVerify = true
+	case "verify":
+		if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			tlsConfig.ServerName = host
+		}
+		if settings.CAFile != "" {
+			pem, err := os.ReadFile(settings.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read database CA file: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in database CA file %s", settings.CAFile)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported database TLS mode: %s", settings.Mode)
+	}
+
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load database client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
@@ -1,16 +1,23 @@
 package storage
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // FileStorage implements storage using local files
 type FileStorage struct {
 	basePath string
+	mu       sync.Mutex // guards ID counters, username uniqueness and token updates
 }
 
 // NewFileStorage creates a new file-based storage
@@ -20,9 +27,13 @@ func NewFileStorage(basePath string) (*FileStorage, error) {
 		return nil, fmt.Errorf("failed to create storage directory: %w", err)
 	}
 	
-	return &FileStorage{
+	f := &FileStorage{
 		basePath: basePath,
-	}, nil
+	}
+	if err := f.indexAPIKeys(); err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
 func (f *FileStorage) StoreFeedbackLog(log *FeedbackLog) error {
@@ -49,6 +60,12 @@ func (f *FileStorage) StoreFeedbackLog(log *FeedbackLog) error {
 }
 
 func (f *FileStorage) StoreAuthToken(token *AuthToken) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAuthToken(token)
+}
+
+func (f *FileStorage) writeAuthToken(token *AuthToken) error {
 	tokenDir := filepath.Join(f.basePath, "tokens")
 	if err := os.MkdirAll(tokenDir, 0755); err != nil {
 		return fmt.Errorf("failed to create token directory: %w", err)
@@ -71,6 +88,24 @@ func (f *FileStorage) StoreAuthToken(token *AuthToken) error {
 }
 
 func (f *FileStorage) GetAuthToken(tokenHash string) (*AuthToken, error) {
+	token, err := f.FindAuthToken(tokenHash)
+	if err != nil || token == nil {
+		return nil, err
+	}
+	
+	// Check if token is revoked or expired
+	if token.IsRevoked || time.Now().After(token.ExpiresAt) {
+		return nil, nil
+	}
+	
+	return token, nil
+}
+
+// FindAuthToken returns a token whether or not it has been revoked or has expired
+func (f *FileStorage) FindAuthToken(tokenHash string) (*AuthToken, error) {
+	if !isFileKey(tokenHash) {
+		return nil, nil
+	}
 	filename := fmt.Sprintf("token_%s.json", tokenHash)
 	filePath := filepath.Join(f.basePath, "tokens", filename)
 	
@@ -87,15 +122,42 @@ func (f *FileStorage) GetAuthToken(tokenHash string) (*AuthToken, error) {
 		return nil, fmt.Errorf("failed to unmarshal auth token: %w", err)
 	}
 	
-	// Check if token is revoked or expired
-	if token.IsRevoked || time.Now().After(token.ExpiresAt) {
-		return nil, nil
+	return &token, nil
+}
+
+// RotateAuthToken marks a refresh token as exchanged and stores the tokens
+// issued for it while holding the lock, so that revoking the family cannot
+// miss them. It returns false and stores nothing if the token was already
+// revoked, e.g. by a concurrent refresh.
+func (f *FileStorage) RotateAuthToken(tokenHash string, issued []*AuthToken) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	token, err := f.FindAuthToken(tokenHash)
+	if err != nil {
+		return false, err
+	}
+	if token == nil || token.IsRevoked {
+		return false, nil
 	}
 	
-	return &token, nil
+	token.IsRevoked = true
+	token.IsRotated = true
+	if err := f.writeAuthToken(token); err != nil {
+		return false, err
+	}
+	for _, token := range issued {
+		if err := f.writeAuthToken(token); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
 func (f *FileStorage) RevokeAuthToken(tokenHash string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
 	token, err := f.GetAuthToken(tokenHash)
 	if err != nil {
 		return err
@@ -105,10 +167,86 @@ func (f *FileStorage) RevokeAuthToken(tokenHash string) error {
 	}
 	
 	token.IsRevoked = true
-	return f.StoreAuthToken(token)
+	return f.writeAuthToken(token)
+}
+
+// RevokeTokenFamily revokes every token issued from the same login. Tokens
+// stored without a family are not affected.
+func (f *FileStorage) RevokeTokenFamily(familyID string) error {
+	if familyID == "" {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	if err := f.revokeTokens(func(token *AuthToken) bool {
+		return token.FamilyID == familyID
+	}); err != nil {
+		return err
+	}
+	return f.revokeSessions(func(session *Session) bool {
+		return session.ID == familyID
+	})
 }
 
 func (f *FileStorage) RevokeAllUserTokens(userID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	if err := f.revokeTokens(func(token *AuthToken) bool {
+		return token.UserID == userID
+	}); err != nil {
+		return err
+	}
+	return f.revokeSessions(func(session *Session) bool {
+		return session.UserID == userID
+	})
+}
+
+// PurgeAuthTokens deletes tokens that expired before the given time, whether
+// or not they were revoked, and returns how many were deleted
+func (f *FileStorage) PurgeAuthTokens(expiredBefore time.Time) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	tokenDir := filepath.Join(f.basePath, "tokens")
+	files, err := os.ReadDir(tokenDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil // No tokens directory
+		}
+		return 0, fmt.Errorf("failed to read tokens directory: %w", err)
+	}
+	
+	var purged int64
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "token_") {
+			continue
+		}
+		
+		filePath := filepath.Join(tokenDir, file.Name())
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			continue
+		}
+		
+		var token AuthToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			continue
+		}
+		if !token.ExpiresAt.Before(expiredBefore) {
+			continue
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return purged, fmt.Errorf("failed to remove auth token: %w", err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// revokeTokens revokes every stored token that matches. The caller holds f.mu.
+func (f *FileStorage) revokeTokens(match func(token *AuthToken) bool) error {
 	tokenDir := filepath.Join(f.basePath, "tokens")
 	files, err := os.ReadDir(tokenDir)
 	if err != nil {
@@ -134,7 +272,7 @@ func (f *FileStorage) RevokeAllUserTokens(userID string) error {
 			continue
 		}
 		
-		if token.UserID == userID && !token.IsRevoked {
+		if match(&token) && !token.IsRevoked {
 			token.IsRevoked = true
 			tokenData, err := json.Marshal(&token)
 			if err != nil {
@@ -147,6 +285,1108 @@ func (f *FileStorage) RevokeAllUserTokens(userID string) error {
 	return nil
 }
 
+func (f *FileStorage) StoreNotification(notification *Notification) error {
+	notificationDir := filepath.Join(f.basePath, "notifications")
+	if err := os.MkdirAll(notificationDir, 0755); err != nil {
+		return fmt.Errorf("failed to create notification directory: %w", err)
+	}
+	
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	// IDs must be monotonic, so the last one is kept in a counter file
+	counterPath := filepath.Join(notificationDir, "last_id")
+	var lastID int64
+	if data, err := os.ReadFile(counterPath); err == nil {
+		lastID, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	notification.ID = lastID + 1
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = time.Now().UTC()
+	}
+	
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	
+	filePath := filepath.Join(notificationDir, fmt.Sprintf("notification_%d.json", notification.ID))
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write notification: %w", err)
+	}
+	if err := os.WriteFile(counterPath, []byte(strconv.FormatInt(notification.ID, 10)), 0644); err != nil {
+		return fmt.Errorf("failed to write notification counter: %w", err)
+	}
+	
+	return nil
+}
+
+func (f *FileStorage) GetNotificationsSince(id int64) ([]*Notification, error) {
+	notifications, err := f.readNotifications()
+	if err != nil {
+		return nil, err
+	}
+	
+	var result []*Notification
+	for _, notification := range notifications {
+		if notification.ID > id {
+			result = append(result, notification)
+		}
+	}
+	return result, nil
+}
+
+func (f *FileStorage) PurgeNotifications(before time.Time) (int64, error) {
+	notifications, err := f.readNotifications()
+	if err != nil {
+		return 0, err
+	}
+	
+	var purged int64
+	for _, notification := range notifications {
+		if !notification.CreatedAt.Before(before) {
+			continue
+		}
+		filePath := filepath.Join(f.basePath, "notifications", fmt.Sprintf("notification_%d.json", notification.ID))
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return purged, fmt.Errorf("failed to remove notification: %w", err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// readNotifications returns all stored notifications ordered by ID
+func (f *FileStorage) readNotifications() ([]*Notification, error) {
+	notificationDir := filepath.Join(f.basePath, "notifications")
+	files, err := os.ReadDir(notificationDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // No notifications directory
+		}
+		return nil, fmt.Errorf("failed to read notifications directory: %w", err)
+	}
+	
+	var notifications []*Notification
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "notification_") {
+			continue
+		}
+		
+		data, err := os.ReadFile(filepath.Join(notificationDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		
+		var notification Notification
+		if err := json.Unmarshal(data, &notification); err != nil {
+			continue
+		}
+		notifications = append(notifications, &notification)
+	}
+	
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].ID < notifications[j].ID
+	})
+	return notifications, nil
+}
+
+func (f *FileStorage) CreateUser(user *User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	if user.ID == "" {
+		user.ID = newRandomID()
+	}
+	
+	existing, err := f.findUser(func(u *User) bool { return u.Username == user.Username || u.ID == user.ID })
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ErrUserExists
+	}
+	
+	now := time.Now().UTC()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	return f.writeUser(user)
+}
+
+func (f *FileStorage) GetUser(id string) (*User, error) {
+	if !isFileKey(id) {
+		return nil, nil // Not an ID this storage could have created
+	}
+	
+	data, err := os.ReadFile(filepath.Join(f.basePath, "users", fmt.Sprintf("user_%s.json", id)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // User not found
+		}
+		return nil, fmt.Errorf("failed to read user: %w", err)
+	}
+	
+	var user User
+	if err := json.Unmarshal(data, &user); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal user: %w", err)
+	}
+	return &user, nil
+}
+
+func (f *FileStorage) GetUserByUsername(username string) (*User, error) {
+	return f.findUser(func(u *User) bool { return u.Username == username })
+}
+
+func (f *FileStorage) UpdateUser(user *User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	existing, err := f.findUser(func(u *User) bool { return u.Username == user.Username && u.ID != user.ID })
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ErrUserExists
+	}
+	
+	user.UpdatedAt = time.Now().UTC()
+	return f.writeUser(user)
+}
+
+// DeleteUser removes a user account. It is meant for accounts that were just
+// created; the tokens and sessions of the user are not touched.
+func (f *FileStorage) DeleteUser(id string) error {
+	if !isFileKey(id) {
+		return nil // Not an ID this storage could have created
+	}
+	
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	if err := os.Remove(filepath.Join(f.basePath, "users", fmt.Sprintf("user_%s.json", id))); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code. It returns false
+// if a code of the same or a later step was accepted already.
+func (f *FileStorage) UseTOTPStep(userID string, step int64) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, err := f.GetUser(userID)
+	if err != nil || user == nil || user.TOTP.LastStep >= step {
+		return false, err
+	}
+	user.TOTP.LastStep = step
+	user.UpdatedAt = time.Now().UTC()
+	if err := f.writeUser(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UseRecoveryCode removes a recovery code of a user. It returns false if the
+// user has no such code, e.g. because it was used already.
+func (f *FileStorage) UseRecoveryCode(userID, codeHash string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, err := f.GetUser(userID)
+	if err != nil || user == nil {
+		return false, err
+	}
+	index := slices.Index(user.TOTP.RecoveryCodes, codeHash)
+	if index < 0 {
+		return false, nil
+	}
+	user.TOTP.RecoveryCodes = slices.Delete(user.TOTP.RecoveryCodes, index, index+1)
+	user.UpdatedAt = time.Now().UTC()
+	if err := f.writeUser(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (f *FileStorage) writeUser(user *User) error {
+	if !isFileKey(user.ID) {
+		return fmt.Errorf("invalid user id: %s", user.ID)
+	}
+	
+	userDir := filepath.Join(f.basePath, "users")
+	if err := os.MkdirAll(userDir, 0755); err != nil {
+		return fmt.Errorf("failed to create user directory: %w", err)
+	}
+	
+	data, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user: %w", err)
+	}
+	
+	// Password hashes are stored here, so the file is not world-readable
+	filePath := filepath.Join(userDir, fmt.Sprintf("user_%s.json", user.ID))
+	if err := os.WriteFile(filePath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write user: %w", err)
+	}
+	return nil
+}
+
+// findUser returns the first stored user matching the predicate
+func (f *FileStorage) findUser(match func(*User) bool) (*User, error) {
+	userDir := filepath.Join(f.basePath, "users")
+	files, err := os.ReadDir(userDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // No users directory
+		}
+		return nil, fmt.Errorf("failed to read users directory: %w", err)
+	}
+	
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "user_") {
+			continue
+		}
+		
+		data, err := os.ReadFile(filepath.Join(userDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			continue
+		}
+		if match(&user) {
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *FileStorage) StorePasswordReset(reset *PasswordReset) error {
+	if !isFileKey(reset.TokenHash) {
+		return fmt.Errorf("invalid token hash")
+	}
+	
+	resetDir := filepath.Join(f.basePath, "password_resets")
+	if err := os.MkdirAll(resetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create password reset directory: %w", err)
+	}
+	
+	reset.CreatedAt = time.Now().UTC()
+	data, err := json.Marshal(reset)
+	if err != nil {
+		return fmt.Errorf("failed to marshal password reset: %w", err)
+	}
+	
+	filePath := filepath.Join(resetDir, fmt.Sprintf("reset_%s.json", reset.TokenHash))
+	if err := os.WriteFile(filePath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write password reset: %w", err)
+	}
+	return nil
+}
+
+func (f *FileStorage) ConsumePasswordReset(tokenHash string) (*PasswordReset, error) {
+	if !isFileKey(tokenHash) {
+		return nil, nil // Not a hash this storage could have stored
+	}
+	
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	filePath := filepath.Join(f.basePath, "password_resets", fmt.Sprintf("reset_%s.json", tokenHash))
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // Token not found or already used
+		}
+		return nil, fmt.Errorf("failed to read password reset: %w", err)
+	}
+	if err := os.Remove(filePath); err != nil {
+		return nil, fmt.Errorf("failed to consume password reset: %w", err)
+	}
+	
+	var reset PasswordReset
+	if err := json.Unmarshal(data, &reset); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal password reset: %w", err)
+	}
+	return &reset, nil
+}
+
+// PurgePasswordResets deletes unused password reset tokens that expired
+// before the given time and returns how many were deleted
+func (f *FileStorage) PurgePasswordResets(expiredBefore time.Time) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return purgeFiles(filepath.Join(f.basePath, "password_resets"), "reset_", func(data []byte) bool {
+		var reset PasswordReset
+		return json.Unmarshal(data, &reset) == nil && reset.ExpiresAt.Before(expiredBefore)
+	})
+}
+
+func (f *FileStorage) CreateClient(client *Client) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	existing, err := f.GetClient(client.ID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ErrClientExists
+	}
+	
+	now := time.Now().UTC()
+	client.CreatedAt = now
+	client.UpdatedAt = now
+	return f.writeClient(client)
+}
+
+func (f *FileStorage) GetClient(id string) (*Client, error) {
+	if !isFileKey(id) {
+		return nil, nil // Not an ID this storage could have stored
+	}
+	
+	data, err := os.ReadFile(filepath.Join(f.basePath, "clients", fmt.Sprintf("client_%s.json", id)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // Client not found
+		}
+		return nil, fmt.Errorf("failed to read client: %w", err)
+	}
+	
+	var client Client
+	if err := json.Unmarshal(data, &client); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal client: %w", err)
+	}
+	return &client, nil
+}
+
+func (f *FileStorage) UpdateClient(client *Client) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	client.UpdatedAt = time.Now().UTC()
+	return f.writeClient(client)
+}
+
+func (f *FileStorage) writeClient(client *Client) error {
+	if !isFileKey(client.ID) {
+		return fmt.Errorf("invalid client id: %s", client.ID)
+	}
+	
+	clientDir := filepath.Join(f.basePath, "clients")
+	if err := os.MkdirAll(clientDir, 0755); err != nil {
+		return fmt.Errorf("failed to create client directory: %w", err)
+	}
+	
+	data, err := json.Marshal(client)
+	if err != nil {
+		return fmt.Errorf("failed to marshal client: %w", err)
+	}
+	
+	// Client secrets are stored here, so the file is not world-readable
+	filePath := filepath.Join(clientDir, fmt.Sprintf("client_%s.json", client.ID))
+	if err := os.WriteFile(filePath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write client: %w", err)
+	}
+	return nil
+}
+
+// UseClientNonce records a nonce until it expires. It returns false if the
+// client already used the nonce.
+func (f *FileStorage) UseClientNonce(clientID, nonce string, expiresAt time.Time) (bool, error) {
+	nonceDir := filepath.Join(f.basePath, "client_nonces")
+	if err := os.MkdirAll(nonceDir, 0755); err != nil {
+		return false, fmt.Errorf("failed to create nonce directory: %w", err)
+	}
+	
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	// Forget expired nonces; the file holds the expiry as Unix seconds
+	now := time.Now()
+	files, err := os.ReadDir(nonceDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to read nonce directory: %w", err)
+	}
+	for _, file := range files {
+		filePath := filepath.Join(nonceDir, file.Name())
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			continue
+		}
+		if expiry, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && now.Unix() > expiry {
+			os.Remove(filePath)
+		}
+	}
+	
+	// Client IDs and nonces are hashed into a file name
+	hash := sha256.Sum256([]byte(clientID + "\n" + nonce))
+	filePath := filepath.Join(nonceDir, fmt.Sprintf("nonce_%x", hash))
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to store client nonce: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(strconv.FormatInt(expiresAt.Unix(), 10)); err != nil {
+		return false, fmt.Errorf("failed to store client nonce: %w", err)
+	}
+	return true, nil
+}
+
+func (f *FileStorage) CreateDevice(device *Device) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	if device.ID == "" {
+		device.ID = newRandomID()
+	}
+	
+	existing, err := f.findDevice(func(d *Device) bool { return d.PublicKey == device.PublicKey || d.ID == device.ID })
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ErrDeviceExists
+	}
+	
+	now := time.Now().UTC()
+	device.CreatedAt = now
+	device.LastUsedAt = now
+	return f.writeDevice(device)
+}
+
+func (f *FileStorage) GetDevice(id string) (*Device, error) {
+	if !isFileKey(id) {
+		return nil, nil // Not an ID this storage could have created
+	}
+	
+	data, err := os.ReadFile(filepath.Join(f.basePath, "devices", fmt.Sprintf("device_%s.json", id)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // Device not found
+		}
+		return nil, fmt.Errorf("failed to read device: %w", err)
+	}
+	
+	var device Device
+	if err := json.Unmarshal(data, &device); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal device: %w", err)
+	}
+	return &device, nil
+}
+
+func (f *FileStorage) UpdateDevice(device *Device) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	return f.writeDevice(device)
+}
+
+func (f *FileStorage) writeDevice(device *Device) error {
+	if !isFileKey(device.ID) {
+		return fmt.Errorf("invalid device id: %s", device.ID)
+	}
+	
+	deviceDir := filepath.Join(f.basePath, "devices")
+	if err := os.MkdirAll(deviceDir, 0755); err != nil {
+		return fmt.Errorf("failed to create device directory: %w", err)
+	}
+	
+	data, err := json.Marshal(device)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device: %w", err)
+	}
+	
+	filePath := filepath.Join(deviceDir, fmt.Sprintf("device_%s.json", device.ID))
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write device: %w", err)
+	}
+	return nil
+}
+
+// findDevice returns the first stored device matching the predicate
+func (f *FileStorage) findDevice(match func(*Device) bool) (*Device, error) {
+	deviceDir := filepath.Join(f.basePath, "devices")
+	files, err := os.ReadDir(deviceDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // No devices directory
+		}
+		return nil, fmt.Errorf("failed to read devices directory: %w", err)
+	}
+	
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "device_") {
+			continue
+		}
+		
+		data, err := os.ReadFile(filepath.Join(deviceDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		
+		var device Device
+		if err := json.Unmarshal(data, &device); err != nil {
+			continue
+		}
+		if match(&device) {
+			return &device, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *FileStorage) StoreChallenge(challenge *AuthChallenge) error {
+	if !isFileKey(challenge.Value) {
+		return fmt.Errorf("invalid challenge")
+	}
+	
+	challengeDir := filepath.Join(f.basePath, "challenges")
+	if err := os.MkdirAll(challengeDir, 0755); err != nil {
+		return fmt.Errorf("failed to create challenge directory: %w", err)
+	}
+	
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	// Unused challenges are forgotten once they expire
+	now := time.Now()
+	files, err := os.ReadDir(challengeDir)
+	if err != nil {
+		return fmt.Errorf("failed to read challenge directory: %w", err)
+	}
+	for _, file := range files {
+		filePath := filepath.Join(challengeDir, file.Name())
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			continue
+		}
+		var stored AuthChallenge
+		if err := json.Unmarshal(data, &stored); err == nil && now.After(stored.ExpiresAt) {
+			os.Remove(filePath)
+		}
+	}
+	
+	challenge.CreatedAt = now.UTC()
+	data, err := json.Marshal(challenge)
+	if err != nil {
+		return fmt.Errorf("failed to marshal challenge: %w", err)
+	}
+	
+	filePath := filepath.Join(challengeDir, fmt.Sprintf("challenge_%s.json", challenge.Value))
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write challenge: %w", err)
+	}
+	return nil
+}
+
+func (f *FileStorage) ConsumeChallenge(value string) (*AuthChallenge, error) {
+	if !isFileKey(value) {
+		return nil, nil // Not a challenge this storage could have stored
+	}
+	
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	filePath := filepath.Join(f.basePath, "challenges", fmt.Sprintf("challenge_%s.json", value))
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // Challenge not found or already used
+		}
+		return nil, fmt.Errorf("failed to read challenge: %w", err)
+	}
+	if err := os.Remove(filePath); err != nil {
+		return nil, fmt.Errorf("failed to consume challenge: %w", err)
+	}
+	
+	var challenge AuthChallenge
+	if err := json.Unmarshal(data, &challenge); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+func (f *FileStorage) CreateExternalIdentity(identity *ExternalIdentity) error {
+	identityDir := filepath.Join(f.basePath, "identities")
+	if err := os.MkdirAll(identityDir, 0755); err != nil {
+		return fmt.Errorf("failed to create identity directory: %w", err)
+	}
+	
+	identity.CreatedAt = time.Now().UTC()
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal external identity: %w", err)
+	}
+	
+	file, err := os.OpenFile(identityPath(identityDir, identity.Issuer, identity.Subject), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return ErrIdentityExists
+		}
+		return fmt.Errorf("failed to create external identity: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write external identity: %w", err)
+	}
+	return nil
+}
+
+func (f *FileStorage) GetExternalIdentity(issuer, subject string) (*ExternalIdentity, error) {
+	data, err := os.ReadFile(identityPath(filepath.Join(f.basePath, "identities"), issuer, subject))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // Identity not linked
+		}
+		return nil, fmt.Errorf("failed to read external identity: %w", err)
+	}
+	
+	var identity ExternalIdentity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal external identity: %w", err)
+	}
+	return &identity, nil
+}
+
+// identityPath returns the file of an external identity. Issuers are URLs and
+// subjects are arbitrary strings, so they are hashed into the file name.
+func identityPath(identityDir, issuer, subject string) string {
+	hash := sha256.Sum256([]byte(issuer + "\n" + subject))
+	return filepath.Join(identityDir, fmt.Sprintf("identity_%x.json", hash))
+}
+
+// StoreSession creates or updates a session. A revoked session stays revoked.
+func (f *FileStorage) StoreSession(session *Session) error {
+	if !isFileKey(session.ID) {
+		return fmt.Errorf("invalid session id: %s", session.ID)
+	}
+	
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	existing, err := f.GetSession(session.ID)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Revoked {
+		session.Revoked = true
+	}
+	
+	sessionDir := filepath.Join(f.basePath, "sessions")
+	if err := os.MkdirAll(sessionDir, 0755); err != nil {
+		return fmt.Errorf("failed to create session directory: %w", err)
+	}
+	
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+	
+	filePath := filepath.Join(sessionDir, fmt.Sprintf("session_%s.json", session.ID))
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	return nil
+}
+
+func (f *FileStorage) GetSession(id string) (*Session, error) {
+	if !isFileKey(id) {
+		return nil, nil // Not an ID this storage could have stored
+	}
+	
+	data, err := os.ReadFile(filepath.Join(f.basePath, "sessions", fmt.Sprintf("session_%s.json", id)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // Session not found
+		}
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+	
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+	}
+	return &session, nil
+}
+
+// ListUserSessions returns the sessions of a user that are neither revoked
+// nor expired, most recently used first
+func (f *FileStorage) ListUserSessions(userID string) ([]*Session, error) {
+	now := time.Now()
+	var sessions []*Session
+	err := f.forEachSession(func(session *Session, filePath string) {
+		if session.UserID == userID && !session.Revoked && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+// PurgeSessions deletes sessions whose refresh token expired before the
+// given time and returns how many were deleted
+func (f *FileStorage) PurgeSessions(expiredBefore time.Time) (int64, error) {
+	var purged int64
+	var removeErr error
+	err := f.forEachSession(func(session *Session, filePath string) {
+		if removeErr != nil || !session.ExpiresAt.Before(expiredBefore) {
+			return
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			removeErr = fmt.Errorf("failed to remove session: %w", err)
+			return
+		}
+		purged++
+	})
+	if err != nil {
+		return purged, err
+	}
+	return purged, removeErr
+}
+
+// revokeSessions marks every stored session that matches as revoked. The
+// caller holds f.mu.
+func (f *FileStorage) revokeSessions(match func(session *Session) bool) error {
+	return f.forEachSession(func(session *Session, filePath string) {
+		if match(session) && !session.Revoked {
+			session.Revoked = true
+			if data, err := json.Marshal(session); err == nil {
+				os.WriteFile(filePath, data, 0644)
+			}
+		}
+	})
+}
+
+func (f *FileStorage) forEachSession(fn func(session *Session, filePath string)) error {
+	sessionDir := filepath.Join(f.basePath, "sessions")
+	files, err := os.ReadDir(sessionDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // No sessions directory
+		}
+		return fmt.Errorf("failed to read sessions directory: %w", err)
+	}
+	
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "session_") {
+			continue
+		}
+		
+		filePath := filepath.Join(sessionDir, file.Name())
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			continue
+		}
+		
+		var session Session
+		if err := json.Unmarshal(data, &session); err != nil {
+			continue
+		}
+		fn(&session, filePath)
+	}
+	return nil
+}
+
+// isFileKey reports whether a value is safe to use in a file name
+func isFileKey(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateLoginFailures reads the failures of key, zero if none are stored,
+// and stores them again if update returns true. Updates of one key run one
+// after another, so that checking and counting an attempt is a single step.
+func (f *FileStorage) UpdateLoginFailures(key string, update func(failures *LoginFailures) bool) (*LoginFailures, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	failureDir := filepath.Join(f.basePath, "login_failures")
+	if err := os.MkdirAll(failureDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create login failure directory: %w", err)
+	}
+	
+	failures, err := f.readLoginFailures(key)
+	if err != nil {
+		return nil, err
+	}
+	if failures == nil {
+		failures = &LoginFailures{Key: key, LastFailureAt: time.Now().UTC()}
+	}
+	if !update(failures) {
+		return failures, nil
+	}
+	failures.LastFailureAt = failures.LastFailureAt.UTC()
+	
+	data, err := json.Marshal(failures)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal login failures: %w", err)
+	}
+	if err := os.WriteFile(loginFailuresPath(failureDir, key), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write login failures: %w", err)
+	}
+	return failures, nil
+}
+
+func (f *FileStorage) GetLoginFailures(key string) (*LoginFailures, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readLoginFailures(key)
+}
+
+func (f *FileStorage) ClearLoginFailures(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	err := os.Remove(loginFailuresPath(filepath.Join(f.basePath, "login_failures"), key))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear login failures: %w", err)
+	}
+	return nil
+}
+
+// PurgeLoginFailures deletes the failures of keys whose last failure was
+// before the given time and returns how many were deleted
+func (f *FileStorage) PurgeLoginFailures(before time.Time) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return purgeFiles(filepath.Join(f.basePath, "login_failures"), "failures_", func(data []byte) bool {
+		var failures LoginFailures
+		return json.Unmarshal(data, &failures) == nil && failures.LastFailureAt.Before(before)
+	})
+}
+
+// purgeFiles removes the files in dir with the prefix whose content is
+// expired and returns how many were removed
+func purgeFiles(dir, prefix string, expired func(data []byte) bool) (int64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil // Nothing stored yet
+		}
+		return 0, fmt.Errorf("failed to read %s directory: %w", filepath.Base(dir), err)
+	}
+
+	var purged int64
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), prefix) {
+			continue
+		}
+		filePath := filepath.Join(dir, file.Name())
+		data, err := os.ReadFile(filePath)
+		if err != nil || !expired(data) {
+			continue
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return purged, fmt.Errorf("failed to remove %s: %w", file.Name(), err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (f *FileStorage) readLoginFailures(key string) (*LoginFailures, error) {
+	data, err := os.ReadFile(loginFailuresPath(filepath.Join(f.basePath, "login_failures"), key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // No failures recorded
+		}
+		return nil, fmt.Errorf("failed to read login failures: %w", err)
+	}
+	
+	var failures LoginFailures
+	if err := json.Unmarshal(data, &failures); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal login failures: %w", err)
+	}
+	return &failures, nil
+}
+
+// loginFailuresPath returns the file of the failures of a key. Keys contain
+// usernames and addresses, so they are hashed into the file name.
+func loginFailuresPath(failureDir, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(failureDir, fmt.Sprintf("failures_%x.json", hash))
+}
+
+func (f *FileStorage) CreateAPIKey(key *APIKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	if key.ID == "" {
+		key.ID = newRandomID()
+	}
+	key.CreatedAt = time.Now().UTC()
+	if err := f.writeAPIKey(key); err != nil {
+		return err
+	}
+	return writeAPIKeyHash(f.basePath, key)
+}
+
+func (f *FileStorage) GetAPIKey(id string) (*APIKey, error) {
+	if !isFileKey(id) {
+		return nil, nil // Not an ID this storage could have created
+	}
+	
+	data, err := os.ReadFile(filepath.Join(f.basePath, "api_keys", fmt.Sprintf("apikey_%s.json", id)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // API key not found
+		}
+		return nil, fmt.Errorf("failed to read API key: %w", err)
+	}
+	
+	var key APIKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal API key: %w", err)
+	}
+	return &key, nil
+}
+
+// GetAPIKeyByHash returns a key whether or not it has been revoked or has expired
+func (f *FileStorage) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	id, err := os.ReadFile(apiKeyHashPath(f.basePath, keyHash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // API key not found
+		}
+		return nil, fmt.Errorf("failed to read API key index: %w", err)
+	}
+	key, err := f.GetAPIKey(string(id))
+	if err != nil || key == nil || key.KeyHash != keyHash {
+		return nil, err
+	}
+	return key, nil
+}
+
+// apiKeyHashPath returns the index file that holds the ID of the key with a
+// hash, so that a key is found without reading every key
+func apiKeyHashPath(basePath, keyHash string) string {
+	hash := sha256.Sum256([]byte(keyHash))
+	return filepath.Join(basePath, "api_key_hashes", fmt.Sprintf("hash_%x", hash))
+}
+
+func writeAPIKeyHash(basePath string, key *APIKey) error {
+	hashDir := filepath.Join(basePath, "api_key_hashes")
+	if err := os.MkdirAll(hashDir, 0755); err != nil {
+		return fmt.Errorf("failed to create API key index directory: %w", err)
+	}
+	if err := os.WriteFile(apiKeyHashPath(basePath, key.KeyHash), []byte(key.ID), 0644); err != nil {
+		return fmt.Errorf("failed to write API key index: %w", err)
+	}
+	return nil
+}
+
+// indexAPIKeys indexes the keys created before keys were indexed by hash
+func (f *FileStorage) indexAPIKeys() error {
+	keys, err := f.ListAPIKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := os.Stat(apiKeyHashPath(f.basePath, key.KeyHash)); !os.IsNotExist(err) {
+			continue
+		}
+		if err := writeAPIKeyHash(f.basePath, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListAPIKeys returns every API key, including revoked and expired ones,
+// newest first
+func (f *FileStorage) ListAPIKeys() ([]*APIKey, error) {
+	keyDir := filepath.Join(f.basePath, "api_keys")
+	files, err := os.ReadDir(keyDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read API key directory: %w", err)
+	}
+	
+	var keys []*APIKey
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "apikey_") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(keyDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		var key APIKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			continue
+		}
+		keys = append(keys, &key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (f *FileStorage) RevokeAPIKey(id string) error {
+	return f.updateAPIKey(id, func(key *APIKey) { key.Revoked = true })
+}
+
+// TouchAPIKey records when a key was last used
+func (f *FileStorage) TouchAPIKey(id string, usedAt time.Time) error {
+	return f.updateAPIKey(id, func(key *APIKey) { key.LastUsedAt = usedAt.UTC() })
+}
+
+// updateAPIKey changes a stored key, if it exists
+func (f *FileStorage) updateAPIKey(id string, update func(key *APIKey)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	key, err := f.GetAPIKey(id)
+	if err != nil || key == nil {
+		return err
+	}
+	update(key)
+	return f.writeAPIKey(key)
+}
+
+func (f *FileStorage) writeAPIKey(key *APIKey) error {
+	if !isFileKey(key.ID) {
+		return fmt.Errorf("invalid API key id: %s", key.ID)
+	}
+	
+	keyDir := filepath.Join(f.basePath, "api_keys")
+	if err := os.MkdirAll(keyDir, 0755); err != nil {
+		return fmt.Errorf("failed to create API key directory: %w", err)
+	}
+	
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal API key: %w", err)
+	}
+	
+	filePath := filepath.Join(keyDir, fmt.Sprintf("apikey_%s.json", key.ID))
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write API key: %w", err)
+	}
+	return nil
+}
+
 func (f *FileStorage) Close() error {
 	// No cleanup needed for file storage
 	return nil
@@ -0,0 +1,958 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+)
+
+// MySQL stores data in a MySQL or MariaDB database, which several server
+// instances can share
+type MySQL struct {
+	db *sql.DB
+}
+
+// erDupEntry is the MySQL error number of unique key violations
+const erDupEntry = 1062
+
+// NewMySQL connects to a MySQL server and creates the tables that do not
+// exist yet. Times are always read and written as UTC.
+func NewMySQL(dsn *mysql.Config, pool config.DatabasePool) (*MySQL, error) {
+	dsn = dsn.Clone()
+	dsn.ParseTime = true
+	dsn.Loc = time.UTC
+	connector, err := mysql.NewConnector(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MySQL configuration: %w", err)
+	}
+
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
+
+	storage := &MySQL{db: db}
+	if err := storage.createTables(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create tables: %w", err)
+	}
+	return storage, nil
+}
+
+func (m *MySQL) createTables() error {
+	// Binary collation compares like SQLite, e.g. usernames are case sensitive
+	const options = ` ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin`
+
+	tables := []struct {
+		name string
+		sql  string
+	}{
+		{"feedback_logs", `
+		CREATE TABLE IF NOT EXISTS feedback_logs (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			os VARCHAR(255) NOT NULL,
+			arch VARCHAR(255) NOT NULL,
+			core_version VARCHAR(255) NOT NULL,
+			resource_version VARCHAR(255) NOT NULL,
+			timestamp BIGINT NOT NULL,
+			content MEDIUMTEXT NOT NULL,
+			user_id VARCHAR(255) NOT NULL DEFAULT '',
+			created_at DATETIME(6) NOT NULL
+		)`},
+		{"auth_tokens", `
+		CREATE TABLE IF NOT EXISTS auth_tokens (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			token_hash VARCHAR(255) NOT NULL UNIQUE,
+			token_type VARCHAR(32) NOT NULL,
+			user_id VARCHAR(255) NOT NULL,
+			family_id VARCHAR(255) NOT NULL DEFAULT '',
+			expires_at DATETIME(6) NOT NULL,
+			created_at DATETIME(6) NOT NULL,
+			is_revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			is_rotated BOOLEAN NOT NULL DEFAULT FALSE,
+			INDEX idx_auth_tokens_family_id (family_id),
+			INDEX idx_auth_tokens_user_id (user_id)
+		)`},
+		{"notifications", `
+		CREATE TABLE IF NOT EXISTS notifications (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			type VARCHAR(32) NOT NULL,
+			os VARCHAR(255) NOT NULL DEFAULT '',
+			arch VARCHAR(255) NOT NULL DEFAULT '',
+			core_version VARCHAR(255) NOT NULL DEFAULT '',
+			resource_version VARCHAR(255) NOT NULL DEFAULT '',
+			status VARCHAR(255) NOT NULL DEFAULT '',
+			message TEXT NOT NULL,
+			created_at DATETIME(6) NOT NULL
+		)`},
+		{"users", `
+		CREATE TABLE IF NOT EXISTS users (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			username VARCHAR(255) NOT NULL UNIQUE,
+			password_hash VARCHAR(255) NOT NULL,
+			disabled BOOLEAN NOT NULL DEFAULT FALSE,
+			roles VARCHAR(1024) NOT NULL DEFAULT '',
+			totp_secret VARCHAR(255) NOT NULL DEFAULT '',
+			totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			totp_last_step BIGINT NOT NULL DEFAULT 0,
+			recovery_codes TEXT NOT NULL,
+			created_at DATETIME(6) NOT NULL,
+			updated_at DATETIME(6) NOT NULL
+		)`},
+		{"password_resets", `
+		CREATE TABLE IF NOT EXISTS password_resets (
+			token_hash VARCHAR(255) NOT NULL PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL,
+			expires_at DATETIME(6) NOT NULL,
+			created_at DATETIME(6) NOT NULL
+		)`},
+		{"clients", `
+		CREATE TABLE IF NOT EXISTS clients (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			secret VARCHAR(255) NOT NULL,
+			disabled BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at DATETIME(6) NOT NULL,
+			updated_at DATETIME(6) NOT NULL
+		)`},
+		{"client_nonces", `
+		CREATE TABLE IF NOT EXISTS client_nonces (
+			client_id VARCHAR(255) NOT NULL,
+			nonce VARCHAR(255) NOT NULL,
+			expires_at DATETIME(6) NOT NULL,
+			PRIMARY KEY (client_id, nonce)
+		)`},
+		{"devices", `
+		CREATE TABLE IF NOT EXISTS devices (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL DEFAULT '',
+			public_key VARCHAR(255) NOT NULL UNIQUE,
+			name VARCHAR(255) NOT NULL DEFAULT '',
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at DATETIME(6) NOT NULL,
+			last_used_at DATETIME(6) NOT NULL
+		)`},
+		{"auth_challenges", `
+		CREATE TABLE IF NOT EXISTS auth_challenges (
+			value VARCHAR(255) NOT NULL PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL DEFAULT '',
+			device_id VARCHAR(255) NOT NULL DEFAULT '',
+			expires_at DATETIME(6) NOT NULL,
+			created_at DATETIME(6) NOT NULL
+		)`},
+		{"external_identities", `
+		CREATE TABLE IF NOT EXISTS external_identities (
+			issuer VARCHAR(255) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			user_id VARCHAR(255) NOT NULL,
+			created_at DATETIME(6) NOT NULL,
+			PRIMARY KEY (issuer, subject)
+		)`},
+		{"sessions", `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL,
+			os VARCHAR(255) NOT NULL DEFAULT '',
+			arch VARCHAR(255) NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL,
+			ip_address VARCHAR(255) NOT NULL DEFAULT '',
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at DATETIME(6) NOT NULL,
+			last_used_at DATETIME(6) NOT NULL,
+			expires_at DATETIME(6) NOT NULL,
+			INDEX idx_sessions_user_id (user_id)
+		)`},
+		{"login_failures", "\n\t\tCREATE TABLE IF NOT EXISTS login_failures (\n\t\t\t`key` VARCHAR(255) NOT NULL PRIMARY KEY," + `
+			count INT NOT NULL,
+			last_failure_at DATETIME(6) NOT NULL
+		)`},
+		{"api_keys", `
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			key_hash VARCHAR(255) NOT NULL UNIQUE,
+			name VARCHAR(255) NOT NULL DEFAULT '',
+			user_id VARCHAR(255) NOT NULL DEFAULT '',
+			scopes VARCHAR(1024) NOT NULL DEFAULT '',
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at DATETIME(6) NOT NULL,
+			expires_at DATETIME(6) NULL,
+			last_used_at DATETIME(6) NULL
+		)`},
+	}
+
+	for _, table := range tables {
+		if _, err := m.db.Exec(table.sql + options); err != nil {
+			return fmt.Errorf("failed to create %s table: %w", table.name, err)
+		}
+	}
+	return m.addColumn("auth_challenges", "device_id", "VARCHAR(255) NOT NULL DEFAULT ''")
+}
+
+// addColumn adds a column to a table created by an older version
+func (m *MySQL) addColumn(table, column, definition string) error {
+	var count int
+	query := `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?`
+	if err := m.db.QueryRow(query, table, column).Scan(&count); err != nil {
+		return fmt.Errorf("failed to inspect %s table: %w", table, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := m.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+	}
+	return nil
+}
+
+// isDuplicateEntry reports whether an error is a unique key violation
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == erDupEntry
+}
+
+func (m *MySQL) StoreFeedbackLog(log *FeedbackLog) error {
+	query := `
+		INSERT INTO feedback_logs (os, arch, core_version, resource_version, timestamp, content, user_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := m.db.Exec(query, log.OS, log.Arch, log.CoreVersion, log.ResourceVersion, log.Timestamp, log.Content, log.UserID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to store feedback log: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) StoreAuthToken(token *AuthToken) error {
+	return m.storeAuthToken(m.db.Exec, token)
+}
+
+func (m *MySQL) storeAuthToken(exec func(query string, args ...interface{}) (sql.Result, error), token *AuthToken) error {
+	query := `
+		INSERT INTO auth_tokens (token_hash, token_type, user_id, family_id, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err := exec(query, token.TokenHash, token.TokenType, token.UserID, token.FamilyID, token.ExpiresAt.UTC(), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to store auth token: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) GetAuthToken(tokenHash string) (*AuthToken, error) {
+	token, err := m.FindAuthToken(tokenHash)
+	if err != nil || token == nil || token.IsRevoked {
+		return nil, err
+	}
+	return token, nil
+}
+
+// FindAuthToken returns a token whether or not it has been revoked
+func (m *MySQL) FindAuthToken(tokenHash string) (*AuthToken, error) {
+	query := `
+		SELECT id, token_hash, token_type, user_id, family_id, expires_at, created_at, is_revoked, is_rotated
+		FROM auth_tokens
+		WHERE token_hash = ?
+	`
+	var token AuthToken
+	err := m.db.QueryRow(query, tokenHash).Scan(&token.ID, &token.TokenHash, &token.TokenType, &token.UserID, &token.FamilyID,
+		&token.ExpiresAt, &token.CreatedAt, &token.IsRevoked, &token.IsRotated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Token not found
+		}
+		return nil, fmt.Errorf("failed to get auth token: %w", err)
+	}
+	return &token, nil
+}
+
+// RotateAuthToken marks a refresh token as exchanged and stores the tokens
+// issued for it in the same transaction. Revoking the family locks its rows,
+// so it either waits for the new tokens or makes the rotation fail. It returns
+// false and stores nothing if the token was already revoked, e.g. by a
+// concurrent refresh on another instance.
+func (m *MySQL) RotateAuthToken(tokenHash string, issued []*AuthToken) (bool, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE auth_tokens SET is_revoked = TRUE, is_rotated = TRUE WHERE token_hash = ? AND is_revoked = FALSE`
+	result, err := tx.Exec(query, tokenHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %w", err)
+	}
+	if rows != 1 {
+		return false, nil
+	}
+	for _, token := range issued {
+		if err := m.storeAuthToken(tx.Exec, token); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %w", err)
+	}
+	return true, nil
+}
+
+func (m *MySQL) RevokeAuthToken(tokenHash string) error {
+	if _, err := m.db.Exec(`UPDATE auth_tokens SET is_revoked = TRUE WHERE token_hash = ?`, tokenHash); err != nil {
+		return fmt.Errorf("failed to revoke auth token: %w", err)
+	}
+	return nil
+}
+
+// RevokeTokenFamily revokes every token issued from the same login. Tokens
+// stored without a family are not affected.
+func (m *MySQL) RevokeTokenFamily(familyID string) error {
+	if familyID == "" {
+		return nil
+	}
+	if _, err := m.db.Exec(`UPDATE auth_tokens SET is_revoked = TRUE WHERE family_id = ?`, familyID); err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+	if _, err := m.db.Exec(`UPDATE sessions SET revoked = TRUE WHERE id = ?`, familyID); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) RevokeAllUserTokens(userID string) error {
+	if _, err := m.db.Exec(`UPDATE auth_tokens SET is_revoked = TRUE WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %w", err)
+	}
+	if _, err := m.db.Exec(`UPDATE sessions SET revoked = TRUE WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to revoke user sessions: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) StoreNotification(notification *Notification) error {
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = time.Now()
+	}
+	notification.CreatedAt = notification.CreatedAt.UTC()
+	query := `
+		INSERT INTO notifications (type, os, arch, core_version, resource_version, status, message, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := m.db.Exec(query, notification.Type, notification.OS, notification.Arch, notification.CoreVersion,
+		notification.ResourceVersion, notification.Status, notification.Message, notification.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store notification: %w", err)
+	}
+	notification.ID, err = result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get notification id: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) GetNotificationsSince(id int64) ([]*Notification, error) {
+	query := `
+		SELECT id, type, os, arch, core_version, resource_version, status, message, created_at
+		FROM notifications
+		WHERE id > ?
+		ORDER BY id
+	`
+	rows, err := m.db.Query(query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notifications: %w", err)
+	}
+	defer rows.Close()
+
+	var notifications []*Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.OS, &n.Arch, &n.CoreVersion, &n.ResourceVersion, &n.Status, &n.Message, &n.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		notifications = append(notifications, &n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get notifications: %w", err)
+	}
+	return notifications, nil
+}
+
+func (m *MySQL) PurgeNotifications(before time.Time) (int64, error) {
+	result, err := m.db.Exec(`DELETE FROM notifications WHERE created_at < ?`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge notifications: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// PurgeAuthTokens deletes tokens that expired before the given time, whether
+// or not they were revoked, and returns how many were deleted
+func (m *MySQL) PurgeAuthTokens(expiredBefore time.Time) (int64, error) {
+	result, err := m.db.Exec(`DELETE FROM auth_tokens WHERE expires_at < ?`, expiredBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge auth tokens: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (m *MySQL) CreateUser(user *User) error {
+	if user.ID == "" {
+		user.ID = newRandomID()
+	}
+	now := time.Now().UTC()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+
+	query := `
+		INSERT INTO users (` + userColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := m.db.Exec(query, user.ID, user.Username, user.PasswordHash, user.Disabled, strings.Join(user.Roles, ","),
+		user.TOTP.Secret, user.TOTP.Enabled, user.TOTP.LastStep, strings.Join(user.TOTP.RecoveryCodes, ","), user.CreatedAt, user.UpdatedAt)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return ErrUserExists
+		}
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) GetUser(id string) (*User, error) {
+	return m.getUser(`SELECT `+userColumns+` FROM users WHERE id = ?`, id)
+}
+
+func (m *MySQL) GetUserByUsername(username string) (*User, error) {
+	return m.getUser(`SELECT `+userColumns+` FROM users WHERE username = ?`, username)
+}
+
+func (m *MySQL) getUser(query string, arg string) (*User, error) {
+	var user User
+	var roles, recoveryCodes string
+	err := m.db.QueryRow(query, arg).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Disabled, &roles,
+		&user.TOTP.Secret, &user.TOTP.Enabled, &user.TOTP.LastStep, &recoveryCodes, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // User not found
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
+	if recoveryCodes != "" {
+		user.TOTP.RecoveryCodes = strings.Split(recoveryCodes, ",")
+	}
+	return &user, nil
+}
+
+func (m *MySQL) UpdateUser(user *User) error {
+	user.UpdatedAt = time.Now().UTC()
+	query := `
+		UPDATE users SET username = ?, password_hash = ?, disabled = ?, roles = ?,
+			totp_secret = ?, totp_enabled = ?, totp_last_step = ?, recovery_codes = ?, updated_at = ?
+		WHERE id = ?
+	`
+	_, err := m.db.Exec(query, user.Username, user.PasswordHash, user.Disabled, strings.Join(user.Roles, ","),
+		user.TOTP.Secret, user.TOTP.Enabled, user.TOTP.LastStep, strings.Join(user.TOTP.RecoveryCodes, ","), user.UpdatedAt, user.ID)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return ErrUserExists
+		}
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// DeleteUser removes a user account. It is meant for accounts that were just
+// created; the tokens and sessions of the user are not touched.
+func (m *MySQL) DeleteUser(id string) error {
+	if _, err := m.db.Exec(`DELETE FROM users WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code. It returns false
+// if a code of the same or a later step was accepted already.
+func (m *MySQL) UseTOTPStep(userID string, step int64) (bool, error) {
+	query := `UPDATE users SET totp_last_step = ?, updated_at = ? WHERE id = ? AND totp_last_step < ?`
+	result, err := m.db.Exec(query, step, time.Now().UTC(), userID, step)
+	if err != nil {
+		return false, fmt.Errorf("failed to record TOTP step: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record TOTP step: %w", err)
+	}
+	return rows == 1, nil
+}
+
+// UseRecoveryCode removes a recovery code of a user. It returns false if the
+// user has no such code, e.g. because it was used already.
+func (m *MySQL) UseRecoveryCode(userID, codeHash string) (bool, error) {
+	for {
+		var codes string
+		err := m.db.QueryRow(`SELECT recovery_codes FROM users WHERE id = ?`, userID).Scan(&codes)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get recovery codes: %w", err)
+		}
+		remaining, ok := removeRecoveryCode(codes, codeHash)
+		if !ok {
+			return false, nil
+		}
+
+		// Only replace the codes that were read, so that concurrent logins
+		// cannot both remove the same code
+		query := `UPDATE users SET recovery_codes = ?, updated_at = ? WHERE id = ? AND recovery_codes = ?`
+		result, err := m.db.Exec(query, remaining, time.Now().UTC(), userID, codes)
+		if err != nil {
+			return false, fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return false, fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		if rows == 1 {
+			return true, nil
+		}
+		// The codes changed since they were read; look again
+	}
+}
+
+func (m *MySQL) StorePasswordReset(reset *PasswordReset) error {
+	reset.CreatedAt = time.Now().UTC()
+	query := `INSERT INTO password_resets (token_hash, user_id, expires_at, created_at) VALUES (?, ?, ?, ?)`
+	if _, err := m.db.Exec(query, reset.TokenHash, reset.UserID, reset.ExpiresAt.UTC(), reset.CreatedAt); err != nil {
+		return fmt.Errorf("failed to store password reset: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) ConsumePasswordReset(tokenHash string) (*PasswordReset, error) {
+	var reset PasswordReset
+	row := m.db.QueryRow(`SELECT token_hash, user_id, expires_at, created_at FROM password_resets WHERE token_hash = ?`, tokenHash)
+	if err := row.Scan(&reset.TokenHash, &reset.UserID, &reset.ExpiresAt, &reset.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Token not found or already used
+		}
+		return nil, fmt.Errorf("failed to get password reset: %w", err)
+	}
+
+	// Only the instance that deletes the token may use it
+	consumed, err := m.deleteOne(`DELETE FROM password_resets WHERE token_hash = ?`, tokenHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume password reset: %w", err)
+	}
+	if !consumed {
+		return nil, nil
+	}
+	return &reset, nil
+}
+
+// PurgePasswordResets deletes unused password reset tokens that expired
+// before the given time and returns how many were deleted
+func (m *MySQL) PurgePasswordResets(expiredBefore time.Time) (int64, error) {
+	result, err := m.db.Exec(`DELETE FROM password_resets WHERE expires_at < ?`, expiredBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge password resets: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// deleteOne runs a delete statement and reports whether it deleted a row
+func (m *MySQL) deleteOne(query string, args ...interface{}) (bool, error) {
+	result, err := m.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+func (m *MySQL) CreateClient(client *Client) error {
+	now := time.Now().UTC()
+	client.CreatedAt = now
+	client.UpdatedAt = now
+
+	query := `INSERT INTO clients (id, secret, disabled, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`
+	if _, err := m.db.Exec(query, client.ID, client.Secret, client.Disabled, client.CreatedAt, client.UpdatedAt); err != nil {
+		if isDuplicateEntry(err) {
+			return ErrClientExists
+		}
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) GetClient(id string) (*Client, error) {
+	var client Client
+	row := m.db.QueryRow(`SELECT id, secret, disabled, created_at, updated_at FROM clients WHERE id = ?`, id)
+	if err := row.Scan(&client.ID, &client.Secret, &client.Disabled, &client.CreatedAt, &client.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Client not found
+		}
+		return nil, fmt.Errorf("failed to get client: %w", err)
+	}
+	return &client, nil
+}
+
+func (m *MySQL) UpdateClient(client *Client) error {
+	client.UpdatedAt = time.Now().UTC()
+	query := `UPDATE clients SET secret = ?, disabled = ?, updated_at = ? WHERE id = ?`
+	if _, err := m.db.Exec(query, client.Secret, client.Disabled, client.UpdatedAt, client.ID); err != nil {
+		return fmt.Errorf("failed to update client: %w", err)
+	}
+	return nil
+}
+
+// UseClientNonce records a nonce until it expires. It returns false if the
+// client already used the nonce.
+func (m *MySQL) UseClientNonce(clientID, nonce string, expiresAt time.Time) (bool, error) {
+	if _, err := m.db.Exec(`DELETE FROM client_nonces WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return false, fmt.Errorf("failed to purge client nonces: %w", err)
+	}
+
+	query := `INSERT IGNORE INTO client_nonces (client_id, nonce, expires_at) VALUES (?, ?, ?)`
+	result, err := m.db.Exec(query, clientID, nonce, expiresAt.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to store client nonce: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to store client nonce: %w", err)
+	}
+	return rows == 1, nil
+}
+
+func (m *MySQL) CreateDevice(device *Device) error {
+	if device.ID == "" {
+		device.ID = newRandomID()
+	}
+	now := time.Now().UTC()
+	device.CreatedAt = now
+	device.LastUsedAt = now
+
+	query := `
+		INSERT INTO devices (id, user_id, public_key, name, revoked, created_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := m.db.Exec(query, device.ID, device.UserID, device.PublicKey, device.Name, device.Revoked, device.CreatedAt, device.LastUsedAt)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return ErrDeviceExists
+		}
+		return fmt.Errorf("failed to create device: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) GetDevice(id string) (*Device, error) {
+	var device Device
+	row := m.db.QueryRow(`SELECT id, user_id, public_key, name, revoked, created_at, last_used_at FROM devices WHERE id = ?`, id)
+	if err := row.Scan(&device.ID, &device.UserID, &device.PublicKey, &device.Name, &device.Revoked, &device.CreatedAt, &device.LastUsedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Device not found
+		}
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+	return &device, nil
+}
+
+func (m *MySQL) UpdateDevice(device *Device) error {
+	query := `UPDATE devices SET name = ?, revoked = ?, last_used_at = ? WHERE id = ?`
+	if _, err := m.db.Exec(query, device.Name, device.Revoked, device.LastUsedAt.UTC(), device.ID); err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) StoreChallenge(challenge *AuthChallenge) error {
+	// Unused challenges are forgotten once they expire
+	if _, err := m.db.Exec(`DELETE FROM auth_challenges WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to purge challenges: %w", err)
+	}
+
+	challenge.CreatedAt = time.Now().UTC()
+	query := `INSERT INTO auth_challenges (value, user_id, device_id, expires_at, created_at) VALUES (?, ?, ?, ?, ?)`
+	if _, err := m.db.Exec(query, challenge.Value, challenge.UserID, challenge.DeviceID, challenge.ExpiresAt.UTC(), challenge.CreatedAt); err != nil {
+		return fmt.Errorf("failed to store challenge: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) ConsumeChallenge(value string) (*AuthChallenge, error) {
+	var challenge AuthChallenge
+	row := m.db.QueryRow(`SELECT value, user_id, device_id, expires_at, created_at FROM auth_challenges WHERE value = ?`, value)
+	if err := row.Scan(&challenge.Value, &challenge.UserID, &challenge.DeviceID, &challenge.ExpiresAt, &challenge.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Challenge not found or already used
+		}
+		return nil, fmt.Errorf("failed to get challenge: %w", err)
+	}
+
+	consumed, err := m.deleteOne(`DELETE FROM auth_challenges WHERE value = ?`, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume challenge: %w", err)
+	}
+	if !consumed {
+		return nil, nil
+	}
+	return &challenge, nil
+}
+
+func (m *MySQL) CreateExternalIdentity(identity *ExternalIdentity) error {
+	identity.CreatedAt = time.Now().UTC()
+	query := `INSERT INTO external_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)`
+	if _, err := m.db.Exec(query, identity.Issuer, identity.Subject, identity.UserID, identity.CreatedAt); err != nil {
+		if isDuplicateEntry(err) {
+			return ErrIdentityExists
+		}
+		return fmt.Errorf("failed to create external identity: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) GetExternalIdentity(issuer, subject string) (*ExternalIdentity, error) {
+	var identity ExternalIdentity
+	row := m.db.QueryRow(`SELECT issuer, subject, user_id, created_at FROM external_identities WHERE issuer = ? AND subject = ?`, issuer, subject)
+	if err := row.Scan(&identity.Issuer, &identity.Subject, &identity.UserID, &identity.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Identity not linked
+		}
+		return nil, fmt.Errorf("failed to get external identity: %w", err)
+	}
+	return &identity, nil
+}
+
+// StoreSession creates or updates a session. A revoked session stays revoked.
+func (m *MySQL) StoreSession(session *Session) error {
+	query := `
+		INSERT INTO sessions (` + sessionColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			os = VALUES(os), arch = VALUES(arch), user_agent = VALUES(user_agent), ip_address = VALUES(ip_address),
+			revoked = revoked OR VALUES(revoked), last_used_at = VALUES(last_used_at), expires_at = VALUES(expires_at)
+	`
+	_, err := m.db.Exec(query, session.ID, session.UserID, session.OS, session.Arch, session.UserAgent, session.IPAddress,
+		session.Revoked, session.CreatedAt.UTC(), session.LastUsedAt.UTC(), session.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) GetSession(id string) (*Session, error) {
+	session, err := scanSession(m.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Session not found
+		}
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	return session, nil
+}
+
+// ListUserSessions returns the sessions of a user that are neither revoked
+// nor expired, most recently used first
+func (m *MySQL) ListUserSessions(userID string) ([]*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions
+		WHERE user_id = ? AND revoked = FALSE AND expires_at > ?
+		ORDER BY last_used_at DESC`
+	rows, err := m.db.Query(query, userID, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// PurgeSessions deletes sessions whose refresh token expired before the
+// given time and returns how many were deleted
+func (m *MySQL) PurgeSessions(expiredBefore time.Time) (int64, error) {
+	result, err := m.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, expiredBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// UpdateLoginFailures reads the failures of key, zero if none are stored,
+// and stores them again if update returns true. Updates of one key run one
+// after another, so that checking and counting an attempt is a single step.
+func (m *MySQL) UpdateLoginFailures(key string, update func(failures *LoginFailures) bool) (*LoginFailures, error) {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update login failures: %w", err)
+	}
+	defer conn.Close()
+
+	// A named lock rather than SELECT ... FOR UPDATE, which not every MySQL
+	// compatible server honours. Names are limited to 64 characters.
+	hash := sha256.Sum256([]byte(key))
+	name := "nekolc:login_failures:" + hex.EncodeToString(hash[:16])
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 10)", name).Scan(&locked); err != nil {
+		return nil, fmt.Errorf("failed to lock login failures: %w", err)
+	}
+	if locked.Int64 != 1 {
+		return nil, fmt.Errorf("failed to lock login failures: timed out")
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name)
+
+	var failures LoginFailures
+	row := conn.QueryRowContext(ctx, "SELECT `key`, count, last_failure_at FROM login_failures WHERE `key` = ?", key)
+	switch err := row.Scan(&failures.Key, &failures.Count, &failures.LastFailureAt); {
+	case err == sql.ErrNoRows:
+		failures = LoginFailures{Key: key, LastFailureAt: time.Now().UTC()}
+	case err != nil:
+		return nil, fmt.Errorf("failed to update login failures: %w", err)
+	}
+	if !update(&failures) {
+		return &failures, nil
+	}
+	query := "INSERT INTO login_failures (`key`, count, last_failure_at) VALUES (?, ?, ?)" + `
+		ON DUPLICATE KEY UPDATE count = VALUES(count), last_failure_at = VALUES(last_failure_at)
+	`
+	if _, err := conn.ExecContext(ctx, query, key, failures.Count, failures.LastFailureAt.UTC()); err != nil {
+		return nil, fmt.Errorf("failed to update login failures: %w", err)
+	}
+	return &failures, nil
+}
+
+func (m *MySQL) GetLoginFailures(key string) (*LoginFailures, error) {
+	var failures LoginFailures
+	row := m.db.QueryRow("SELECT `key`, count, last_failure_at FROM login_failures WHERE `key` = ?", key)
+	if err := row.Scan(&failures.Key, &failures.Count, &failures.LastFailureAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No failures recorded
+		}
+		return nil, fmt.Errorf("failed to get login failures: %w", err)
+	}
+	return &failures, nil
+}
+
+func (m *MySQL) ClearLoginFailures(key string) error {
+	if _, err := m.db.Exec("DELETE FROM login_failures WHERE `key` = ?", key); err != nil {
+		return fmt.Errorf("failed to clear login failures: %w", err)
+	}
+	return nil
+}
+
+// PurgeLoginFailures deletes the failures of keys whose last failure was
+// before the given time and returns how many were deleted
+func (m *MySQL) PurgeLoginFailures(before time.Time) (int64, error) {
+	result, err := m.db.Exec(`DELETE FROM login_failures WHERE last_failure_at < ?`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge login failures: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (m *MySQL) CreateAPIKey(key *APIKey) error {
+	if key.ID == "" {
+		key.ID = newRandomID()
+	}
+	key.CreatedAt = time.Now().UTC()
+
+	query := `
+		INSERT INTO api_keys (` + apiKeyColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := m.db.Exec(query, key.ID, key.KeyHash, key.Name, key.UserID, strings.Join(key.Scopes, ","), key.Revoked,
+		key.CreatedAt, nullTime(key.ExpiresAt), nullTime(key.LastUsedAt))
+	if err != nil {
+		return fmt.Errorf("failed to create API key: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) GetAPIKey(id string) (*APIKey, error) {
+	return m.getAPIKey(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id)
+}
+
+// GetAPIKeyByHash returns a key whether or not it has been revoked or has expired
+func (m *MySQL) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	return m.getAPIKey(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash)
+}
+
+func (m *MySQL) getAPIKey(query, arg string) (*APIKey, error) {
+	key, err := scanAPIKey(m.db.QueryRow(query, arg))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // API key not found
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns every API key, including revoked and expired ones,
+// newest first
+func (m *MySQL) ListAPIKeys() ([]*APIKey, error) {
+	rows, err := m.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (m *MySQL) RevokeAPIKey(id string) error {
+	if _, err := m.db.Exec(`UPDATE api_keys SET revoked = TRUE WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	return nil
+}
+
+// TouchAPIKey records when a key was last used
+func (m *MySQL) TouchAPIKey(id string, usedAt time.Time) error {
+	if _, err := m.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, usedAt.UTC(), id); err != nil {
+		return fmt.Errorf("failed to update API key: %w", err)
+	}
+	return nil
+}
+
+func (m *MySQL) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,469 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/mysqltest"
+)
+
+func createTestMySQL(t *testing.T) *MySQL {
+	server, err := mysqltest.NewServer(nil)
+	if err != nil {
+		t.Fatalf("Failed to start MySQL server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	m, err := NewMySQL(server.Config(), config.DatabasePool{MaxOpenConns: 4, MaxIdleConns: 2})
+	if err != nil {
+		t.Fatalf("Failed to connect to MySQL: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestMySQL_Users(t *testing.T) {
+	testUsers(t, createTestMySQL(t))
+}
+
+// testUsers runs against every SQL storage
+func testUsers(t *testing.T, m Storage) {
+	user := &User{Username: "Alice", PasswordHash: "hash", Roles: []string{"admin", "tester"}}
+	user.TOTP = TOTP{Secret: "SECRET", Enabled: true, LastStep: 42, RecoveryCodes: []string{"a", "b"}}
+	if err := m.CreateUser(user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := m.CreateUser(&User{Username: "Alice", PasswordHash: "hash"}); err != ErrUserExists {
+		t.Errorf("Expected ErrUserExists, got %v", err)
+	}
+
+	// Usernames are case sensitive as with SQLite
+	if found, err := m.GetUserByUsername("alice"); err != nil || found != nil {
+		t.Errorf("Expected no user named alice, got %v, %v", found, err)
+	}
+	found, err := m.GetUserByUsername("Alice")
+	if err != nil || found == nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if found.ID != user.ID || len(found.Roles) != 2 || found.TOTP.LastStep != 42 || len(found.TOTP.RecoveryCodes) != 2 {
+		t.Errorf("Unexpected user: %+v", found)
+	}
+	if found.CreatedAt.Sub(user.CreatedAt).Abs() > time.Millisecond || found.CreatedAt.Location() != time.UTC {
+		t.Errorf("Expected created at %v in UTC, got %v", user.CreatedAt, found.CreatedAt)
+	}
+
+	found.Disabled = true
+	found.Roles = nil
+	if err := m.UpdateUser(found); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	found, _ = m.GetUser(user.ID)
+	if !found.Disabled || found.Roles != nil {
+		t.Errorf("Expected a disabled user without roles, got %+v", found)
+	}
+	if missing, err := m.GetUser("missing"); err != nil || missing != nil {
+		t.Errorf("Expected no user, got %v, %v", missing, err)
+	}
+	testSecondFactor(t, m, user.ID)
+}
+
+// testSecondFactor checks that TOTP steps and recovery codes are used once
+func testSecondFactor(t *testing.T, m Storage, userID string) {
+	for _, test := range []struct {
+		step int64
+		used bool
+	}{{42, false}, {41, false}, {43, true}, {43, false}} {
+		if used, err := m.UseTOTPStep(userID, test.step); err != nil || used != test.used {
+			t.Errorf("Step %d: expected %v, got %v, %v", test.step, test.used, used, err)
+		}
+	}
+	for _, test := range []struct {
+		code string
+		used bool
+	}{{"b", true}, {"b", false}, {"c", false}, {"a", true}, {"a", false}} {
+		if used, err := m.UseRecoveryCode(userID, test.code); err != nil || used != test.used {
+			t.Errorf("Recovery code %q: expected %v, got %v, %v", test.code, test.used, used, err)
+		}
+	}
+	if used, err := m.UseRecoveryCode("missing", "a"); err != nil || used {
+		t.Errorf("Expected no recovery code of a missing user, got %v, %v", used, err)
+	}
+
+	user, err := m.GetUser(userID)
+	if err != nil || user == nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if user.TOTP.LastStep != 43 || len(user.TOTP.RecoveryCodes) != 0 || !user.Disabled {
+		t.Errorf("Expected only the second factor to change, got %+v", user)
+	}
+}
+
+func TestMySQL_Tokens(t *testing.T) {
+	testTokens(t, createTestMySQL(t))
+}
+
+// testTokens runs against every SQL storage
+func testTokens(t *testing.T, m Storage) {
+	expiresAt := time.Now().Add(time.Hour)
+	for _, hash := range []string{"refresh1", "access1"} {
+		if err := m.StoreAuthToken(&AuthToken{TokenHash: hash, TokenType: "refresh", UserID: "u1", FamilyID: "f1", ExpiresAt: expiresAt}); err != nil {
+			t.Fatalf("Failed to store token: %v", err)
+		}
+	}
+	if err := m.StoreSession(&Session{ID: "f1", UserID: "u1", OS: "linux", CreatedAt: time.Now(), LastUsedAt: time.Now(), ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+
+	// Only one concurrent refresh may exchange a refresh token, and the
+	// tokens of a losing refresh are not stored
+	issued := []*AuthToken{{TokenHash: "refresh2", TokenType: "refresh", UserID: "u1", FamilyID: "f1", ExpiresAt: expiresAt}}
+	if rotated, err := m.RotateAuthToken("refresh1", issued); err != nil || !rotated {
+		t.Fatalf("Expected the token to rotate, got %v, %v", rotated, err)
+	}
+	if token, _ := m.GetAuthToken("refresh2"); token == nil {
+		t.Error("Expected the issued token to be stored with the rotation")
+	}
+	lost := []*AuthToken{{TokenHash: "refresh3", TokenType: "refresh", UserID: "u1", FamilyID: "f1", ExpiresAt: expiresAt}}
+	if rotated, _ := m.RotateAuthToken("refresh1", lost); rotated {
+		t.Error("Expected the second rotation to fail")
+	}
+	if token, _ := m.FindAuthToken("refresh3"); token != nil {
+		t.Error("Expected the tokens of a failed rotation not to be stored")
+	}
+	token, err := m.FindAuthToken("refresh1")
+	if err != nil || token == nil || !token.IsRotated || !token.IsRevoked {
+		t.Fatalf("Expected a rotated token, got %+v, %v", token, err)
+	}
+	if token, _ := m.GetAuthToken("refresh1"); token != nil {
+		t.Error("Expected GetAuthToken to skip the revoked token")
+	}
+
+	// Sessions are updated in place
+	if err := m.StoreSession(&Session{ID: "f1", UserID: "u1", OS: "windows", CreatedAt: time.Now(), LastUsedAt: time.Now(), ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Failed to update session: %v", err)
+	}
+	sessions, err := m.ListUserSessions("u1")
+	if err != nil || len(sessions) != 1 || sessions[0].OS != "windows" {
+		t.Fatalf("Expected one updated session, got %v, %v", sessions, err)
+	}
+	if err := m.RevokeTokenFamily("f1"); err != nil {
+		t.Fatalf("Failed to revoke token family: %v", err)
+	}
+	for _, hash := range []string{"access1", "refresh2"} {
+		if token, _ := m.GetAuthToken(hash); token != nil {
+			t.Errorf("Expected token %s of the family to be revoked", hash)
+		}
+	}
+	if sessions, _ := m.ListUserSessions("u1"); len(sessions) != 0 {
+		t.Errorf("Expected the session to be revoked, got %v", sessions)
+	}
+	// Updating a revoked session does not restore it
+	if err := m.StoreSession(&Session{ID: "f1", UserID: "u1", OS: "linux", CreatedAt: time.Now(), LastUsedAt: time.Now(), ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Failed to update session: %v", err)
+	}
+	if session, _ := m.GetSession("f1"); session == nil || !session.Revoked {
+		t.Errorf("Expected the session to stay revoked, got %+v", session)
+	}
+
+	if purged, err := m.PurgeAuthTokens(expiresAt.Add(time.Minute)); err != nil || purged != 3 {
+		t.Errorf("Expected 3 purged tokens, got %d, %v", purged, err)
+	}
+	if purged, err := m.PurgeSessions(expiresAt.Add(time.Minute)); err != nil || purged != 1 {
+		t.Errorf("Expected 1 purged session, got %d, %v", purged, err)
+	}
+}
+
+func TestMySQL_SingleUse(t *testing.T) {
+	testSingleUse(t, createTestMySQL(t))
+}
+
+// testSingleUse runs against every SQL storage
+func testSingleUse(t *testing.T, m Storage) {
+	expiresAt := time.Now().Add(time.Minute)
+	if used, err := m.UseClientNonce("c1", "n1", expiresAt); err != nil || !used {
+		t.Fatalf("Expected the nonce to be accepted, got %v, %v", used, err)
+	}
+	if used, _ := m.UseClientNonce("c1", "n1", expiresAt); used {
+		t.Error("Expected the nonce to be rejected the second time")
+	}
+	if used, _ := m.UseClientNonce("c2", "n1", expiresAt); !used {
+		t.Error("Expected another client to use the same nonce")
+	}
+
+	if err := m.StoreChallenge(&AuthChallenge{Value: "challenge", UserID: "u1", DeviceID: "d1", ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Failed to store challenge: %v", err)
+	}
+	if challenge, err := m.ConsumeChallenge("challenge"); err != nil || challenge == nil || challenge.UserID != "u1" || challenge.DeviceID != "d1" {
+		t.Fatalf("Expected the challenge, got %+v, %v", challenge, err)
+	}
+	if challenge, _ := m.ConsumeChallenge("challenge"); challenge != nil {
+		t.Error("Expected the challenge to be consumed")
+	}
+	if err := m.StoreChallenge(&AuthChallenge{Value: "raced", UserID: "u1", ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Failed to store challenge: %v", err)
+	}
+	if consumed := consumeConcurrently(func() bool {
+		challenge, _ := m.ConsumeChallenge("raced")
+		return challenge != nil
+	}); consumed != 1 {
+		t.Errorf("Expected the challenge to be consumed once, got %d", consumed)
+	}
+
+	if err := m.StorePasswordReset(&PasswordReset{TokenHash: "reset", UserID: "u1", ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Failed to store password reset: %v", err)
+	}
+	if reset, err := m.ConsumePasswordReset("reset"); err != nil || reset == nil {
+		t.Fatalf("Expected the password reset, got %+v, %v", reset, err)
+	}
+	if reset, _ := m.ConsumePasswordReset("reset"); reset != nil {
+		t.Error("Expected the password reset to be consumed")
+	}
+
+	// Of concurrent attempts to use a token only one succeeds
+	if err := m.StorePasswordReset(&PasswordReset{TokenHash: "raced", UserID: "u1", ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Failed to store password reset: %v", err)
+	}
+	if consumed := consumeConcurrently(func() bool {
+		reset, _ := m.ConsumePasswordReset("raced")
+		return reset != nil
+	}); consumed != 1 {
+		t.Errorf("Expected the password reset to be consumed once, got %d", consumed)
+	}
+
+	if err := m.CreateDevice(&Device{PublicKey: "key"}); err != nil {
+		t.Fatalf("Failed to create device: %v", err)
+	}
+	if err := m.CreateDevice(&Device{PublicKey: "key"}); err != ErrDeviceExists {
+		t.Errorf("Expected ErrDeviceExists, got %v", err)
+	}
+	if err := m.CreateClient(&Client{ID: "c1", Secret: "secret"}); err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := m.CreateClient(&Client{ID: "c1", Secret: "secret"}); err != ErrClientExists {
+		t.Errorf("Expected ErrClientExists, got %v", err)
+	}
+	identity := &ExternalIdentity{Issuer: "https://issuer", Subject: "s1", UserID: "u1"}
+	if err := m.CreateExternalIdentity(identity); err != nil {
+		t.Fatalf("Failed to create external identity: %v", err)
+	}
+	if err := m.CreateExternalIdentity(identity); err != ErrIdentityExists {
+		t.Errorf("Expected ErrIdentityExists, got %v", err)
+	}
+}
+
+// consumeConcurrently runs consume from several goroutines at once and
+// returns how many of them succeeded
+func consumeConcurrently(consume func() bool) int {
+	var wg sync.WaitGroup
+	var consumed atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if consume() {
+				consumed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	return int(consumed.Load())
+}
+
+func TestMySQL_LoginFailures(t *testing.T) {
+	testLoginFailures(t, createTestMySQL(t))
+}
+
+// testLoginFailures runs against every SQL storage
+func testLoginFailures(t *testing.T, m Storage) {
+	key := UsernameFailureKey("alice")
+	failures, err := m.UpdateLoginFailures(key, func(failures *LoginFailures) bool { return false })
+	if err != nil || failures.Count != 0 {
+		t.Fatalf("Expected no failures, got %+v, %v", failures, err)
+	}
+
+	// Concurrent updates of one key see each other
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.UpdateLoginFailures(key, func(failures *LoginFailures) bool {
+				failures.Count++
+				failures.LastFailureAt = time.Now()
+				return true
+			})
+			if err != nil {
+				t.Errorf("Failed to update login failures: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if failures, err := m.GetLoginFailures(key); err != nil || failures == nil || failures.Count != 8 {
+		t.Errorf("Expected 8 failures, got %+v, %v", failures, err)
+	}
+
+	// Declined updates are not stored
+	failures, err = m.UpdateLoginFailures(key, func(failures *LoginFailures) bool {
+		failures.Count = 0
+		return false
+	})
+	if err != nil || failures.Count != 0 {
+		t.Errorf("Expected the declined count, got %+v, %v", failures, err)
+	}
+	if failures, err := m.GetLoginFailures(key); err != nil || failures == nil || failures.Count != 8 {
+		t.Errorf("Expected 8 failures to be kept, got %+v, %v", failures, err)
+	}
+
+	if err := m.ClearLoginFailures(key); err != nil {
+		t.Fatalf("Failed to clear login failures: %v", err)
+	}
+	if failures, err := m.GetLoginFailures(key); err != nil || failures != nil {
+		t.Errorf("Expected no failures, got %+v, %v", failures, err)
+	}
+}
+
+func TestMySQL_APIKeysAndNotifications(t *testing.T) {
+	testAPIKeysAndNotifications(t, createTestMySQL(t))
+}
+
+// testAPIKeysAndNotifications runs against every SQL storage
+func testAPIKeysAndNotifications(t *testing.T, m Storage) {
+	key := &APIKey{KeyHash: "hash", Name: "ci", Scopes: []string{"publisher"}}
+	if err := m.CreateAPIKey(key); err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	found, err := m.GetAPIKeyByHash("hash")
+	if err != nil || found == nil || !found.ExpiresAt.IsZero() || !found.LastUsedAt.IsZero() || found.Scopes[0] != "publisher" {
+		t.Fatalf("Unexpected API key: %+v, %v", found, err)
+	}
+	usedAt := time.Now()
+	if err := m.TouchAPIKey(key.ID, usedAt); err != nil {
+		t.Fatalf("Failed to touch API key: %v", err)
+	}
+	if err := m.RevokeAPIKey(key.ID); err != nil {
+		t.Fatalf("Failed to revoke API key: %v", err)
+	}
+	keys, err := m.ListAPIKeys()
+	if err != nil || len(keys) != 1 || !keys[0].Revoked || keys[0].LastUsedAt.Sub(usedAt).Abs() > time.Millisecond {
+		t.Errorf("Unexpected API keys: %v, %v", keys, err)
+	}
+
+	var ids []int64
+	for _, status := range []string{"first", "second"} {
+		notification := &Notification{Type: "maintenance", Status: status, Message: "message"}
+		if err := m.StoreNotification(notification); err != nil {
+			t.Fatalf("Failed to store notification: %v", err)
+		}
+		ids = append(ids, notification.ID)
+	}
+	notifications, err := m.GetNotificationsSince(ids[0])
+	if err != nil || len(notifications) != 1 || notifications[0].ID != ids[1] || notifications[0].Status != "second" {
+		t.Errorf("Expected the second notification, got %v, %v", notifications, err)
+	}
+}
+
+func TestMySQLConfig(t *testing.T) {
+	cfg := &config.Config{App: &config.AppConfig{}}
+	cfg.App.Database.Host = "db.example.com"
+	cfg.App.Database.Name = "nekolc"
+	cfg.App.Database.User = "nekolc"
+	cfg.App.Database.Password = "secret"
+	dsn, err := mysqlConfig(cfg)
+	if err != nil {
+		t.Fatalf("Failed to build MySQL configuration: %v", err)
+	}
+	if dsn.Addr != "db.example.com:3306" || dsn.DBName != "nekolc" || dsn.User != "nekolc" || dsn.Passwd != "secret" || dsn.TLS != nil {
+		t.Errorf("Unexpected configuration: %+v", dsn)
+	}
+
+	// The path is a DSN and takes precedence
+	cfg.App.Database.Path = "user:pass@tcp(10.0.0.1:3307)/other"
+	cfg.App.Database.TLS.Mode = "preferred"
+	dsn, err = mysqlConfig(cfg)
+	if err != nil {
+		t.Fatalf("Failed to build MySQL configuration: %v", err)
+	}
+	if dsn.Addr != "10.0.0.1:3307" || dsn.DBName != "other" || dsn.TLS == nil || !dsn.AllowFallbackToPlaintext {
+		t.Errorf("Unexpected configuration: %+v", dsn)
+	}
+
+	cfg.App.Database.TLS.Mode = "required"
+	if _, err := mysqlConfig(cfg); err == nil {
+		t.Error("Expected an unknown TLS mode to be rejected")
+	}
+}
+
+func TestMySQL_TLS(t *testing.T) {
+	certificate, caFile := createTestCertificate(t)
+	server, err := mysqltest.NewServer(&tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatalf("Failed to start MySQL server: %v", err)
+	}
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Addr)
+	cfg := &config.Config{App: &config.AppConfig{}}
+	cfg.App.Database.Type = "mysql"
+	cfg.App.Database.Host = host
+	cfg.App.Database.Port, _ = strconv.Atoi(port)
+	cfg.App.Database.Name = mysqltest.Database
+	cfg.App.Database.User = "root"
+	cfg.App.Database.TLS.Mode = "verify"
+	cfg.App.Database.TLS.CAFile = caFile
+
+	db, err := NewStorage(cfg)
+	if err != nil {
+		t.Fatalf("Failed to connect with TLS: %v", err)
+	}
+	db.Close()
+
+	// The certificate is only valid for 127.0.0.1
+	cfg.App.Database.TLS.ServerName = "db.example.com"
+	if db, err := NewStorage(cfg); err == nil {
+		db.Close()
+		t.Error("Expected the server name to be verified")
+	}
+}
+
+// createTestCertificate returns a self-signed certificate for 127.0.0.1 and
+// the path of its PEM file
+func createTestCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nekolc test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
@@ -0,0 +1,988 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+)
+
+// Postgres stores data in a PostgreSQL database, which several server
+// instances can share
+type Postgres struct {
+	db *sql.DB
+}
+
+// uniqueViolation is the PostgreSQL error code of unique constraint violations
+const uniqueViolation = "23505"
+
+// NewPostgres connects to a PostgreSQL server and creates the tables that do
+// not exist yet
+func NewPostgres(conn *pgx.ConnConfig, pool config.DatabasePool) (*Postgres, error) {
+	db := stdlib.OpenDB(*conn, stdlib.OptionAfterConnect(scanTimesInUTC))
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+
+	storage := &Postgres{db: db}
+	if err := storage.createTables(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create tables: %w", err)
+	}
+	return storage, nil
+}
+
+// scanTimesInUTC returns stored times in UTC as SQLite storage does, rather
+// than in the local time zone
+func scanTimesInUTC(ctx context.Context, conn *pgx.Conn) error {
+	conn.TypeMap().RegisterType(&pgtype.Type{
+		Name:  "timestamptz",
+		OID:   pgtype.TimestamptzOID,
+		Codec: &pgtype.TimestamptzCodec{ScanLocation: time.UTC},
+	})
+	return nil
+}
+
+func (p *Postgres) createTables() error {
+	tables := []struct {
+		name string
+		sql  string
+	}{
+		{"feedback_logs", `
+		CREATE TABLE IF NOT EXISTS feedback_logs (
+			id BIGSERIAL PRIMARY KEY,
+			os TEXT NOT NULL,
+			arch TEXT NOT NULL,
+			core_version TEXT NOT NULL,
+			resource_version TEXT NOT NULL,
+			timestamp BIGINT NOT NULL,
+			content TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`},
+		{"auth_tokens", `
+		CREATE TABLE IF NOT EXISTS auth_tokens (
+			id BIGSERIAL PRIMARY KEY,
+			token_hash TEXT UNIQUE NOT NULL,
+			token_type TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			family_id TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			is_revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			is_rotated BOOLEAN NOT NULL DEFAULT FALSE
+		)`},
+		{"notifications", `
+		CREATE TABLE IF NOT EXISTS notifications (
+			id BIGSERIAL PRIMARY KEY,
+			type TEXT NOT NULL,
+			os TEXT NOT NULL DEFAULT '',
+			arch TEXT NOT NULL DEFAULT '',
+			core_version TEXT NOT NULL DEFAULT '',
+			resource_version TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT '',
+			message TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL
+		)`},
+		{"users", `
+		CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			username TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL,
+			disabled BOOLEAN NOT NULL DEFAULT FALSE,
+			roles TEXT NOT NULL DEFAULT '',
+			totp_secret TEXT NOT NULL DEFAULT '',
+			totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			totp_last_step BIGINT NOT NULL DEFAULT 0,
+			recovery_codes TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		)`},
+		{"password_resets", `
+		CREATE TABLE IF NOT EXISTS password_resets (
+			token_hash TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		)`},
+		{"clients", `
+		CREATE TABLE IF NOT EXISTS clients (
+			id TEXT PRIMARY KEY,
+			secret TEXT NOT NULL,
+			disabled BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		)`},
+		{"client_nonces", `
+		CREATE TABLE IF NOT EXISTS client_nonces (
+			client_id TEXT NOT NULL,
+			nonce TEXT NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (client_id, nonce)
+		)`},
+		{"devices", `
+		CREATE TABLE IF NOT EXISTS devices (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL DEFAULT '',
+			public_key TEXT UNIQUE NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMPTZ NOT NULL,
+			last_used_at TIMESTAMPTZ NOT NULL
+		)`},
+		{"auth_challenges", `
+		CREATE TABLE IF NOT EXISTS auth_challenges (
+			value TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL DEFAULT '',
+			device_id TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		)`},
+		{"external_identities", `
+		CREATE TABLE IF NOT EXISTS external_identities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (issuer, subject)
+		)`},
+		{"sessions", `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			os TEXT NOT NULL DEFAULT '',
+			arch TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip_address TEXT NOT NULL DEFAULT '',
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMPTZ NOT NULL,
+			last_used_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		)`},
+		{"login_failures", `
+		CREATE TABLE IF NOT EXISTS login_failures (
+			key TEXT PRIMARY KEY,
+			count INTEGER NOT NULL,
+			last_failure_at TIMESTAMPTZ NOT NULL
+		)`},
+		{"api_keys", `
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id TEXT PRIMARY KEY,
+			key_hash TEXT UNIQUE NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			user_id TEXT NOT NULL DEFAULT '',
+			scopes TEXT NOT NULL DEFAULT '',
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ,
+			last_used_at TIMESTAMPTZ
+		)`},
+		{"auth_tokens", `CREATE INDEX IF NOT EXISTS idx_auth_tokens_family_id ON auth_tokens(family_id)`},
+		{"auth_tokens", `CREATE INDEX IF NOT EXISTS idx_auth_tokens_user_id ON auth_tokens(user_id)`},
+		{"sessions", `CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`},
+		// Columns added after the table was first released
+		{"auth_challenges", `ALTER TABLE auth_challenges ADD COLUMN IF NOT EXISTS device_id TEXT NOT NULL DEFAULT ''`},
+	}
+
+	for _, table := range tables {
+		if _, err := p.db.Exec(table.sql); err != nil {
+			return fmt.Errorf("failed to create %s table: %w", table.name, err)
+		}
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether an error is a unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
+// TryLock takes a session level advisory lock, which PostgreSQL releases by
+// itself if the instance holding it loses its connection
+func (p *Postgres) TryLock(name string) (func(), bool, error) {
+	ctx := context.Background()
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to take lock %s: %w", name, err)
+	}
+
+	// The lock belongs to the connection, so it is kept until the release
+	var acquired bool
+	key := "nekolc:" + name
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, key).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("failed to take lock %s: %w", name, err)
+	}
+	if !acquired {
+		conn.Close()
+		return nil, false, nil
+	}
+	release := func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock(hashtext($1))`, key); err != nil {
+			log.Printf("Failed to release lock %s: %v", name, err)
+			// Drop the connection rather than pooling it with the lock held
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+	return release, true, nil
+}
+
+func (p *Postgres) StoreFeedbackLog(log *FeedbackLog) error {
+	query := `
+		INSERT INTO feedback_logs (os, arch, core_version, resource_version, timestamp, content, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := p.db.Exec(query, log.OS, log.Arch, log.CoreVersion, log.ResourceVersion, log.Timestamp, log.Content, log.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to store feedback log: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) StoreAuthToken(token *AuthToken) error {
+	return p.storeAuthToken(p.db.Exec, token)
+}
+
+func (p *Postgres) storeAuthToken(exec func(query string, args ...interface{}) (sql.Result, error), token *AuthToken) error {
+	query := `
+		INSERT INTO auth_tokens (token_hash, token_type, user_id, family_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err := exec(query, token.TokenHash, token.TokenType, token.UserID, token.FamilyID, token.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to store auth token: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) GetAuthToken(tokenHash string) (*AuthToken, error) {
+	token, err := p.FindAuthToken(tokenHash)
+	if err != nil || token == nil || token.IsRevoked {
+		return nil, err
+	}
+	return token, nil
+}
+
+// FindAuthToken returns a token whether or not it has been revoked
+func (p *Postgres) FindAuthToken(tokenHash string) (*AuthToken, error) {
+	query := `
+		SELECT id, token_hash, token_type, user_id, family_id, expires_at, created_at, is_revoked, is_rotated
+		FROM auth_tokens
+		WHERE token_hash = $1
+	`
+	var token AuthToken
+	err := p.db.QueryRow(query, tokenHash).Scan(&token.ID, &token.TokenHash, &token.TokenType, &token.UserID, &token.FamilyID,
+		&token.ExpiresAt, &token.CreatedAt, &token.IsRevoked, &token.IsRotated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Token not found
+		}
+		return nil, fmt.Errorf("failed to get auth token: %w", err)
+	}
+	return &token, nil
+}
+
+// RotateAuthToken marks a refresh token as exchanged and stores the tokens
+// issued for it in the same transaction. It returns false and stores nothing
+// if the token was already revoked, e.g. by a concurrent refresh on another
+// instance.
+func (p *Postgres) RotateAuthToken(tokenHash string, issued []*AuthToken) (bool, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// An UPDATE that waited for this transaction does not see the rows it
+	// inserted, so revocations of the family or user wait for the lock first
+	if len(issued) > 0 {
+		if err := lockTokens(tx, "family", issued[0].FamilyID); err != nil {
+			return false, err
+		}
+		if err := lockTokens(tx, "user", issued[0].UserID); err != nil {
+			return false, err
+		}
+	}
+
+	query := `UPDATE auth_tokens SET is_revoked = TRUE, is_rotated = TRUE WHERE token_hash = $1 AND is_revoked = FALSE`
+	result, err := tx.Exec(query, tokenHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %w", err)
+	}
+	if rows != 1 {
+		return false, nil
+	}
+	for _, token := range issued {
+		if err := p.storeAuthToken(tx.Exec, token); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %w", err)
+	}
+	return true, nil
+}
+
+// lockTokens takes the transaction level advisory lock of the tokens of a
+// family or user
+func lockTokens(tx *sql.Tx, scope, id string) error {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, "nekolc:tokens:"+scope+":"+id); err != nil {
+		return fmt.Errorf("failed to lock tokens: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) RevokeAuthToken(tokenHash string) error {
+	if _, err := p.db.Exec(`UPDATE auth_tokens SET is_revoked = TRUE WHERE token_hash = $1`, tokenHash); err != nil {
+		return fmt.Errorf("failed to revoke auth token: %w", err)
+	}
+	return nil
+}
+
+// RevokeTokenFamily revokes every token issued from the same login. Tokens
+// stored without a family are not affected.
+func (p *Postgres) RevokeTokenFamily(familyID string) error {
+	if familyID == "" {
+		return nil
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockTokens(tx, "family", familyID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE auth_tokens SET is_revoked = TRUE WHERE family_id = $1`, familyID); err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET revoked = TRUE WHERE id = $1`, familyID); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) RevokeAllUserTokens(userID string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockTokens(tx, "user", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE auth_tokens SET is_revoked = TRUE WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET revoked = TRUE WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to revoke user sessions: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) StoreNotification(notification *Notification) error {
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = time.Now()
+	}
+	notification.CreatedAt = notification.CreatedAt.UTC()
+	query := `
+		INSERT INTO notifications (type, os, arch, core_version, resource_version, status, message, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`
+	err := p.db.QueryRow(query, notification.Type, notification.OS, notification.Arch, notification.CoreVersion,
+		notification.ResourceVersion, notification.Status, notification.Message, notification.CreatedAt).Scan(&notification.ID)
+	if err != nil {
+		return fmt.Errorf("failed to store notification: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) GetNotificationsSince(id int64) ([]*Notification, error) {
+	query := `
+		SELECT id, type, os, arch, core_version, resource_version, status, message, created_at
+		FROM notifications
+		WHERE id > $1
+		ORDER BY id
+	`
+	rows, err := p.db.Query(query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notifications: %w", err)
+	}
+	defer rows.Close()
+
+	var notifications []*Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.OS, &n.Arch, &n.CoreVersion, &n.ResourceVersion, &n.Status, &n.Message, &n.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		notifications = append(notifications, &n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get notifications: %w", err)
+	}
+	return notifications, nil
+}
+
+func (p *Postgres) PurgeNotifications(before time.Time) (int64, error) {
+	result, err := p.db.Exec(`DELETE FROM notifications WHERE created_at < $1`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge notifications: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// PurgeAuthTokens deletes tokens that expired before the given time, whether
+// or not they were revoked, and returns how many were deleted
+func (p *Postgres) PurgeAuthTokens(expiredBefore time.Time) (int64, error) {
+	result, err := p.db.Exec(`DELETE FROM auth_tokens WHERE expires_at < $1`, expiredBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge auth tokens: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (p *Postgres) CreateUser(user *User) error {
+	if user.ID == "" {
+		user.ID = newRandomID()
+	}
+	now := time.Now().UTC()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+
+	query := `
+		INSERT INTO users (` + userColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`
+	_, err := p.db.Exec(query, user.ID, user.Username, user.PasswordHash, user.Disabled, strings.Join(user.Roles, ","),
+		user.TOTP.Secret, user.TOTP.Enabled, user.TOTP.LastStep, strings.Join(user.TOTP.RecoveryCodes, ","), user.CreatedAt, user.UpdatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) GetUser(id string) (*User, error) {
+	return p.getUser(`SELECT `+userColumns+` FROM users WHERE id = $1`, id)
+}
+
+func (p *Postgres) GetUserByUsername(username string) (*User, error) {
+	return p.getUser(`SELECT `+userColumns+` FROM users WHERE username = $1`, username)
+}
+
+func (p *Postgres) getUser(query string, arg string) (*User, error) {
+	var user User
+	var roles, recoveryCodes string
+	err := p.db.QueryRow(query, arg).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Disabled, &roles,
+		&user.TOTP.Secret, &user.TOTP.Enabled, &user.TOTP.LastStep, &recoveryCodes, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // User not found
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
+	if recoveryCodes != "" {
+		user.TOTP.RecoveryCodes = strings.Split(recoveryCodes, ",")
+	}
+	return &user, nil
+}
+
+func (p *Postgres) UpdateUser(user *User) error {
+	user.UpdatedAt = time.Now().UTC()
+	query := `
+		UPDATE users SET username = $1, password_hash = $2, disabled = $3, roles = $4,
+			totp_secret = $5, totp_enabled = $6, totp_last_step = $7, recovery_codes = $8, updated_at = $9
+		WHERE id = $10
+	`
+	_, err := p.db.Exec(query, user.Username, user.PasswordHash, user.Disabled, strings.Join(user.Roles, ","),
+		user.TOTP.Secret, user.TOTP.Enabled, user.TOTP.LastStep, strings.Join(user.TOTP.RecoveryCodes, ","), user.UpdatedAt, user.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// DeleteUser removes a user account. It is meant for accounts that were just
+// created; the tokens and sessions of the user are not touched.
+func (p *Postgres) DeleteUser(id string) error {
+	if _, err := p.db.Exec(`DELETE FROM users WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code. It returns false
+// if a code of the same or a later step was accepted already.
+func (p *Postgres) UseTOTPStep(userID string, step int64) (bool, error) {
+	query := `UPDATE users SET totp_last_step = $1, updated_at = $2 WHERE id = $3 AND totp_last_step < $4`
+	result, err := p.db.Exec(query, step, time.Now().UTC(), userID, step)
+	if err != nil {
+		return false, fmt.Errorf("failed to record TOTP step: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record TOTP step: %w", err)
+	}
+	return rows == 1, nil
+}
+
+// UseRecoveryCode removes a recovery code of a user. It returns false if the
+// user has no such code, e.g. because it was used already.
+func (p *Postgres) UseRecoveryCode(userID, codeHash string) (bool, error) {
+	for {
+		var codes string
+		err := p.db.QueryRow(`SELECT recovery_codes FROM users WHERE id = $1`, userID).Scan(&codes)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get recovery codes: %w", err)
+		}
+		remaining, ok := removeRecoveryCode(codes, codeHash)
+		if !ok {
+			return false, nil
+		}
+
+		// Only replace the codes that were read, so that concurrent logins
+		// cannot both remove the same code
+		query := `UPDATE users SET recovery_codes = $1, updated_at = $2 WHERE id = $3 AND recovery_codes = $4`
+		result, err := p.db.Exec(query, remaining, time.Now().UTC(), userID, codes)
+		if err != nil {
+			return false, fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return false, fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		if rows == 1 {
+			return true, nil
+		}
+		// The codes changed since they were read; look again
+	}
+}
+
+func (p *Postgres) StorePasswordReset(reset *PasswordReset) error {
+	reset.CreatedAt = time.Now().UTC()
+	query := `INSERT INTO password_resets (token_hash, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4)`
+	if _, err := p.db.Exec(query, reset.TokenHash, reset.UserID, reset.ExpiresAt.UTC(), reset.CreatedAt); err != nil {
+		return fmt.Errorf("failed to store password reset: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) ConsumePasswordReset(tokenHash string) (*PasswordReset, error) {
+	var reset PasswordReset
+	query := `DELETE FROM password_resets WHERE token_hash = $1 RETURNING token_hash, user_id, expires_at, created_at`
+	if err := p.db.QueryRow(query, tokenHash).Scan(&reset.TokenHash, &reset.UserID, &reset.ExpiresAt, &reset.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Token not found or already used
+		}
+		return nil, fmt.Errorf("failed to consume password reset: %w", err)
+	}
+	return &reset, nil
+}
+
+// PurgePasswordResets deletes unused password reset tokens that expired
+// before the given time and returns how many were deleted
+func (p *Postgres) PurgePasswordResets(expiredBefore time.Time) (int64, error) {
+	result, err := p.db.Exec(`DELETE FROM password_resets WHERE expires_at < $1`, expiredBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge password resets: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (p *Postgres) CreateClient(client *Client) error {
+	now := time.Now().UTC()
+	client.CreatedAt = now
+	client.UpdatedAt = now
+
+	query := `INSERT INTO clients (id, secret, disabled, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)`
+	if _, err := p.db.Exec(query, client.ID, client.Secret, client.Disabled, client.CreatedAt, client.UpdatedAt); err != nil {
+		if isUniqueViolation(err) {
+			return ErrClientExists
+		}
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) GetClient(id string) (*Client, error) {
+	var client Client
+	row := p.db.QueryRow(`SELECT id, secret, disabled, created_at, updated_at FROM clients WHERE id = $1`, id)
+	if err := row.Scan(&client.ID, &client.Secret, &client.Disabled, &client.CreatedAt, &client.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Client not found
+		}
+		return nil, fmt.Errorf("failed to get client: %w", err)
+	}
+	return &client, nil
+}
+
+func (p *Postgres) UpdateClient(client *Client) error {
+	client.UpdatedAt = time.Now().UTC()
+	query := `UPDATE clients SET secret = $1, disabled = $2, updated_at = $3 WHERE id = $4`
+	if _, err := p.db.Exec(query, client.Secret, client.Disabled, client.UpdatedAt, client.ID); err != nil {
+		return fmt.Errorf("failed to update client: %w", err)
+	}
+	return nil
+}
+
+// UseClientNonce records a nonce until it expires. It returns false if the
+// client already used the nonce.
+func (p *Postgres) UseClientNonce(clientID, nonce string, expiresAt time.Time) (bool, error) {
+	if _, err := p.db.Exec(`DELETE FROM client_nonces WHERE expires_at < $1`, time.Now().UTC()); err != nil {
+		return false, fmt.Errorf("failed to purge client nonces: %w", err)
+	}
+
+	query := `
+		INSERT INTO client_nonces (client_id, nonce, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`
+	result, err := p.db.Exec(query, clientID, nonce, expiresAt.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to store client nonce: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to store client nonce: %w", err)
+	}
+	return rows == 1, nil
+}
+
+func (p *Postgres) CreateDevice(device *Device) error {
+	if device.ID == "" {
+		device.ID = newRandomID()
+	}
+	now := time.Now().UTC()
+	device.CreatedAt = now
+	device.LastUsedAt = now
+
+	query := `
+		INSERT INTO devices (id, user_id, public_key, name, revoked, created_at, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := p.db.Exec(query, device.ID, device.UserID, device.PublicKey, device.Name, device.Revoked, device.CreatedAt, device.LastUsedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrDeviceExists
+		}
+		return fmt.Errorf("failed to create device: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) GetDevice(id string) (*Device, error) {
+	var device Device
+	row := p.db.QueryRow(`SELECT id, user_id, public_key, name, revoked, created_at, last_used_at FROM devices WHERE id = $1`, id)
+	if err := row.Scan(&device.ID, &device.UserID, &device.PublicKey, &device.Name, &device.Revoked, &device.CreatedAt, &device.LastUsedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Device not found
+		}
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+	return &device, nil
+}
+
+func (p *Postgres) UpdateDevice(device *Device) error {
+	query := `UPDATE devices SET name = $1, revoked = $2, last_used_at = $3 WHERE id = $4`
+	if _, err := p.db.Exec(query, device.Name, device.Revoked, device.LastUsedAt.UTC(), device.ID); err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) StoreChallenge(challenge *AuthChallenge) error {
+	// Unused challenges are forgotten once they expire
+	if _, err := p.db.Exec(`DELETE FROM auth_challenges WHERE expires_at < $1`, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to purge challenges: %w", err)
+	}
+
+	challenge.CreatedAt = time.Now().UTC()
+	query := `INSERT INTO auth_challenges (value, user_id, device_id, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)`
+	if _, err := p.db.Exec(query, challenge.Value, challenge.UserID, challenge.DeviceID, challenge.ExpiresAt.UTC(), challenge.CreatedAt); err != nil {
+		return fmt.Errorf("failed to store challenge: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) ConsumeChallenge(value string) (*AuthChallenge, error) {
+	var challenge AuthChallenge
+	query := `DELETE FROM auth_challenges WHERE value = $1 RETURNING value, user_id, device_id, expires_at, created_at`
+	if err := p.db.QueryRow(query, value).Scan(&challenge.Value, &challenge.UserID, &challenge.DeviceID, &challenge.ExpiresAt, &challenge.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Challenge not found or already used
+		}
+		return nil, fmt.Errorf("failed to consume challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+func (p *Postgres) CreateExternalIdentity(identity *ExternalIdentity) error {
+	identity.CreatedAt = time.Now().UTC()
+	query := `INSERT INTO external_identities (issuer, subject, user_id, created_at) VALUES ($1, $2, $3, $4)`
+	if _, err := p.db.Exec(query, identity.Issuer, identity.Subject, identity.UserID, identity.CreatedAt); err != nil {
+		if isUniqueViolation(err) {
+			return ErrIdentityExists
+		}
+		return fmt.Errorf("failed to create external identity: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) GetExternalIdentity(issuer, subject string) (*ExternalIdentity, error) {
+	var identity ExternalIdentity
+	row := p.db.QueryRow(`SELECT issuer, subject, user_id, created_at FROM external_identities WHERE issuer = $1 AND subject = $2`, issuer, subject)
+	if err := row.Scan(&identity.Issuer, &identity.Subject, &identity.UserID, &identity.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Identity not linked
+		}
+		return nil, fmt.Errorf("failed to get external identity: %w", err)
+	}
+	return &identity, nil
+}
+
+// StoreSession creates or updates a session. A revoked session stays revoked.
+func (p *Postgres) StoreSession(session *Session) error {
+	query := `
+		INSERT INTO sessions (` + sessionColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET
+			os = excluded.os, arch = excluded.arch, user_agent = excluded.user_agent, ip_address = excluded.ip_address,
+			revoked = sessions.revoked OR excluded.revoked, last_used_at = excluded.last_used_at, expires_at = excluded.expires_at
+	`
+	_, err := p.db.Exec(query, session.ID, session.UserID, session.OS, session.Arch, session.UserAgent, session.IPAddress,
+		session.Revoked, session.CreatedAt.UTC(), session.LastUsedAt.UTC(), session.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) GetSession(id string) (*Session, error) {
+	session, err := scanSession(p.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = $1`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Session not found
+		}
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	return session, nil
+}
+
+// ListUserSessions returns the sessions of a user that are neither revoked
+// nor expired, most recently used first
+func (p *Postgres) ListUserSessions(userID string) ([]*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions
+		WHERE user_id = $1 AND revoked = FALSE AND expires_at > $2
+		ORDER BY last_used_at DESC`
+	rows, err := p.db.Query(query, userID, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// PurgeSessions deletes sessions whose refresh token expired before the
+// given time and returns how many were deleted
+func (p *Postgres) PurgeSessions(expiredBefore time.Time) (int64, error) {
+	result, err := p.db.Exec(`DELETE FROM sessions WHERE expires_at < $1`, expiredBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// UpdateLoginFailures reads the failures of key, zero if none are stored,
+// and stores them again if update returns true. Updates of one key run one
+// after another, so that checking and counting an attempt is a single step.
+func (p *Postgres) UpdateLoginFailures(key string, update func(failures *LoginFailures) bool) (*LoginFailures, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, "nekolc:login_failures:"+key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock login failures: %w", err)
+	}
+	var failures LoginFailures
+	row := tx.QueryRow(`SELECT key, count, last_failure_at FROM login_failures WHERE key = $1`, key)
+	switch err := row.Scan(&failures.Key, &failures.Count, &failures.LastFailureAt); {
+	case err == sql.ErrNoRows:
+		failures = LoginFailures{Key: key, LastFailureAt: time.Now().UTC()}
+	case err != nil:
+		return nil, fmt.Errorf("failed to update login failures: %w", err)
+	}
+	if !update(&failures) {
+		return &failures, nil
+	}
+	query := `
+		INSERT INTO login_failures (key, count, last_failure_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET count = excluded.count, last_failure_at = excluded.last_failure_at
+	`
+	if _, err := tx.Exec(query, key, failures.Count, failures.LastFailureAt.UTC()); err != nil {
+		return nil, fmt.Errorf("failed to update login failures: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update login failures: %w", err)
+	}
+	return &failures, nil
+}
+
+func (p *Postgres) GetLoginFailures(key string) (*LoginFailures, error) {
+	var failures LoginFailures
+	row := p.db.QueryRow(`SELECT key, count, last_failure_at FROM login_failures WHERE key = $1`, key)
+	if err := row.Scan(&failures.Key, &failures.Count, &failures.LastFailureAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No failures recorded
+		}
+		return nil, fmt.Errorf("failed to get login failures: %w", err)
+	}
+	return &failures, nil
+}
+
+func (p *Postgres) ClearLoginFailures(key string) error {
+	if _, err := p.db.Exec(`DELETE FROM login_failures WHERE key = $1`, key); err != nil {
+		return fmt.Errorf("failed to clear login failures: %w", err)
+	}
+	return nil
+}
+
+// PurgeLoginFailures deletes the failures of keys whose last failure was
+// before the given time and returns how many were deleted
+func (p *Postgres) PurgeLoginFailures(before time.Time) (int64, error) {
+	result, err := p.db.Exec(`DELETE FROM login_failures WHERE last_failure_at < $1`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge login failures: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (p *Postgres) CreateAPIKey(key *APIKey) error {
+	if key.ID == "" {
+		key.ID = newRandomID()
+	}
+	key.CreatedAt = time.Now().UTC()
+
+	query := `
+		INSERT INTO api_keys (` + apiKeyColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	_, err := p.db.Exec(query, key.ID, key.KeyHash, key.Name, key.UserID, strings.Join(key.Scopes, ","), key.Revoked,
+		key.CreatedAt, nullTime(key.ExpiresAt), nullTime(key.LastUsedAt))
+	if err != nil {
+		return fmt.Errorf("failed to create API key: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) GetAPIKey(id string) (*APIKey, error) {
+	return p.getAPIKey(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = $1`, id)
+}
+
+// GetAPIKeyByHash returns a key whether or not it has been revoked or has expired
+func (p *Postgres) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	return p.getAPIKey(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = $1`, keyHash)
+}
+
+func (p *Postgres) getAPIKey(query, arg string) (*APIKey, error) {
+	key, err := scanAPIKey(p.db.QueryRow(query, arg))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // API key not found
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns every API key, including revoked and expired ones,
+// newest first
+func (p *Postgres) ListAPIKeys() ([]*APIKey, error) {
+	rows, err := p.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (p *Postgres) RevokeAPIKey(id string) error {
+	if _, err := p.db.Exec(`UPDATE api_keys SET revoked = TRUE WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	return nil
+}
+
+// TouchAPIKey records when a key was last used
+func (p *Postgres) TouchAPIKey(id string, usedAt time.Time) error {
+	if _, err := p.db.Exec(`UPDATE api_keys SET last_used_at = $1 WHERE id = $2`, usedAt.UTC(), id); err != nil {
+		return fmt.Errorf("failed to update API key: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) Close() error {
+	return p.db.Close()
+}
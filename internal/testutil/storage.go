@@ -0,0 +1,107 @@
+// Package testutil provides fixtures shared by the tests of several
+// packages.
+package testutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/mysqltest"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
+)
+
+// PostgresDSNEnv names the environment variable with the PostgreSQL server
+// that tests run against. PostgreSQL is left out when it is not set.
+const PostgresDSNEnv = "NEKOLC_TEST_POSTGRES_DSN"
+
+// Storages returns empty storage of every backend that tests run against,
+// by name. The storage is closed when the test ends.
+func Storages(t testing.TB) map[string]storage.Storage {
+	t.Helper()
+	storages := map[string]storage.Storage{
+		"sqlite": SQLite(t),
+		"file":   File(t),
+		"mysql":  MySQL(t),
+	}
+	if os.Getenv(PostgresDSNEnv) != "" {
+		storages["postgres"] = Postgres(t)
+	}
+	return storages
+}
+
+// SQLite returns SQLite storage in a temporary file
+func SQLite(t testing.TB) storage.Storage {
+	t.Helper()
+	db, err := storage.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// File returns file storage in a temporary directory
+func File(t testing.TB) storage.Storage {
+	t.Helper()
+	f, err := storage.NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create file storage: %v", err)
+	}
+	return f
+}
+
+// MySQL returns MySQL storage backed by an in-process server
+func MySQL(t testing.TB) storage.Storage {
+	t.Helper()
+	server, err := mysqltest.NewServer(nil)
+	if err != nil {
+		t.Fatalf("Failed to start MySQL server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	db, err := storage.NewMySQL(server.Config(), config.DatabasePool{MaxOpenConns: 4, MaxIdleConns: 2})
+	if err != nil {
+		t.Fatalf("Failed to connect to MySQL: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Postgres returns PostgreSQL storage on the server in PostgresDSNEnv, with
+// the tables in a schema of their own that is dropped when the test ends.
+// The test is skipped when PostgresDSNEnv is not set.
+func Postgres(t testing.TB) storage.Storage {
+	t.Helper()
+	dsn := os.Getenv(PostgresDSNEnv)
+	if dsn == "" {
+		t.Skip(PostgresDSNEnv + " is not set")
+	}
+	conn, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("Invalid PostgreSQL DSN: %v", err)
+	}
+
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	schema := "test_" + hex.EncodeToString(suffix)
+	admin := stdlib.OpenDB(*conn)
+	t.Cleanup(func() { admin.Close() })
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	conn.RuntimeParams["search_path"] = schema
+	db, err := storage.NewPostgres(conn, config.DatabasePool{MaxOpenConns: 4, MaxIdleConns: 2})
+	if err != nil {
+		t.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -1,13 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/moehoshio/NekoLcServer/internal/api"
+	"github.com/moehoshio/NekoLcServer/internal/auth"
 	"github.com/moehoshio/NekoLcServer/internal/config"
+	"github.com/moehoshio/NekoLcServer/internal/janitor"
+	"github.com/moehoshio/NekoLcServer/internal/storage"
 )
 
 func parseFlags() *config.CLIFlags {
@@ -18,9 +33,27 @@ func parseFlags() *config.CLIFlags {
 	flags.Debug = flag.Bool("debug", false, "Enable debug mode (overrides config)")
 	flags.EnableAuth = flag.Bool("enable_auth", false, "Enable authentication (overrides config)")
 	flags.JWTSecret = flag.String("jwt_secret", "", "JWT secret key (overrides config)")
-	flags.DatabaseType = flag.String("database_type", "", "Database type: sqlite, mysql, file (overrides config)")
+	flags.DatabaseType = flag.String("database_type", "", "Database type: sqlite, mysql, postgres, file (overrides config)")
 	flags.DatabasePath = flag.String("database_path", "", "Database connection path (overrides config)")
-	flags.Reload = flag.Bool("reload", false, "Hot-reload configuration and exit")
+	flags.Reload = flag.Bool("reload", false, "Check the configuration, tell the running server to reload it and exit")
+	flags.PidFile = flag.String("pid_file", "", "File with the process ID of the running server (overrides config)")
+	flags.Cleanup = flag.Bool("cleanup", false, "Purge expired tokens, sessions, password resets, login failures and notifications and exit")
+	flags.CreateUser = flag.String("create_user", "", "Create a user account and exit")
+	flags.UserRoles = flag.String("user_roles", "", "Comma separated roles for --create_user or --set_roles")
+	flags.SetRoles = flag.String("set_roles", "", "Replace the roles of a user with --user_roles and exit")
+	flags.DisableUser = flag.String("disable_user", "", "Disable a user account and exit")
+	flags.EnableUser = flag.String("enable_user", "", "Re-enable a disabled user account and exit")
+	flags.UnlockUser = flag.String("unlock_user", "", "Clear the failed logins of a locked out username and exit")
+	flags.DisableTOTP = flag.String("disable_totp", "", "Turn off two-factor authentication of a user who lost their authenticator and exit")
+	flags.CreateClient = flag.String("create_client", "", "Register a client identifier, print its secret and exit")
+	flags.DisableClient = flag.String("disable_client", "", "Disable a client identifier and exit")
+	flags.EnableClient = flag.String("enable_client", "", "Re-enable a disabled client identifier and exit")
+	flags.RevokeDevice = flag.String("revoke_device", "", "Revoke a device key and its tokens and exit")
+	flags.CreateAPIKey = flag.String("create_api_key", "", "Create an API key with this name, print it and exit")
+	flags.APIKeyScopes = flag.String("api_key_scopes", "", "Comma separated scopes (roles) for --create_api_key")
+	flags.APIKeyDays = flag.Int("api_key_days", 0, "Days until a key from --create_api_key expires (default: never)")
+	flags.RevokeAPIKey = flag.String("revoke_api_key", "", "Revoke an API key and exit")
+	flags.ListAPIKeys = flag.Bool("list_api_keys", false, "List API keys and exit")
 	flags.Help = flag.Bool("help", false, "Show help message")
 	
 	flag.Parse()
@@ -39,15 +72,36 @@ func showHelp() {
 	fmt.Println("  --debug=BOOL          Enable debug mode (default: false)")
 	fmt.Println("  --enable_auth=BOOL    Enable authentication (default: false)")
 	fmt.Println("  --jwt_secret=SECRET   JWT secret key")
-	fmt.Println("  --database_type=TYPE  Database type: sqlite, mysql, file (default: sqlite)")
+	fmt.Println("  --database_type=TYPE  Database type: sqlite, mysql, postgres, file (default: sqlite)")
 	fmt.Println("  --database_path=PATH  Database connection path")
-	fmt.Println("  --reload              Hot-reload configuration and exit")
+	fmt.Println("  --reload              Check the configuration, tell the running server to reload it and exit")
+	fmt.Println("  --pid_file=PATH       File with the process ID of the running server, for --reload")
+	fmt.Println("  --cleanup             Purge expired tokens, sessions, password resets, login failures and notifications and exit")
+	fmt.Println("  --create_user=NAME    Create a user account with the password in NEKOLC_USER_PASSWORD or on stdin and exit")
+	fmt.Println("  --user_roles=LIST     Comma separated roles for --create_user or --set_roles")
+	fmt.Println("  --set_roles=NAME      Replace the roles of a user with --user_roles and exit")
+	fmt.Println("  --disable_user=NAME   Disable a user account and exit")
+	fmt.Println("  --enable_user=NAME    Re-enable a disabled user account and exit")
+	fmt.Println("  --unlock_user=NAME    Clear the failed logins of a locked out username and exit")
+	fmt.Println("  --disable_totp=NAME   Turn off two-factor authentication of a user who lost their authenticator and exit")
+	fmt.Println("  --create_client=ID    Register a client identifier, print its secret and exit")
+	fmt.Println("  --disable_client=ID   Disable a client identifier and exit")
+	fmt.Println("  --enable_client=ID    Re-enable a disabled client identifier and exit")
+	fmt.Println("  --revoke_device=ID    Revoke a device key and its tokens and exit")
+	fmt.Println("  --create_api_key=NAME Create an API key with this name, print it and exit")
+	fmt.Println("  --api_key_scopes=LIST Comma separated scopes (roles) for --create_api_key")
+	fmt.Println("  --api_key_days=N      Days until a key from --create_api_key expires (default: never)")
+	fmt.Println("  --revoke_api_key=ID   Revoke an API key and exit")
+	fmt.Println("  --list_api_keys       List API keys and exit")
 	fmt.Println("  --help                Show this help message")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  ./nekolc-server --config_path=/path/to/configs --debug=true")
 	fmt.Println("  ./nekolc-server --port=9000 --enable_auth=true")
 	fmt.Println("  ./nekolc-server --reload")
+	fmt.Println("  NEKOLC_USER_PASSWORD=secret ./nekolc-server --create_user=alice")
+	fmt.Println("  ./nekolc-server --set_roles=alice --user_roles=tester,publisher")
+	fmt.Println("  ./nekolc-server --create_api_key=ci --api_key_scopes=publisher --api_key_days=90")
 	fmt.Println()
 }
 
@@ -59,22 +113,65 @@ func main() {
 		return
 	}
 	
+	cfg, err := config.LoadWithFlags(flags)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	
 	if *flags.Reload {
-		fmt.Println("Hot-reloading configuration...")
-		// TODO: Implement hot-reload functionality
-		// For now, just validate and reload config
-		cfg := config.LoadWithFlags(flags)
-		fmt.Printf("Configuration reloaded successfully from: %s\n", cfg.ConfigPath)
+		if err := reloadServer(cfg); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Configuration from %s is valid, reload requested\n", cfg.ConfigPath)
 		return
 	}
 	
-	cfg := config.LoadWithFlags(flags)
+	if *flags.Cleanup {
+		if err := cleanup(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	
+	if *flags.CreateUser != "" || *flags.SetRoles != "" || *flags.DisableUser != "" || *flags.EnableUser != "" || *flags.UnlockUser != "" || *flags.DisableTOTP != "" {
+		if err := manageUsers(cfg, flags); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	
+	if *flags.CreateClient != "" || *flags.DisableClient != "" || *flags.EnableClient != "" || *flags.RevokeDevice != "" {
+		if err := manageClients(cfg, flags); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	
+	if *flags.CreateAPIKey != "" || *flags.RevokeAPIKey != "" || *flags.ListAPIKeys {
+		if err := manageAPIKeys(cfg, flags); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	
 	router := api.SetupRoutes(cfg)
 	
+	// Hot-reload configuration files on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := cfg.Reload(); err != nil {
+				log.Printf("Configuration not reloaded, keeping generation %d: %v", cfg.Generation(), err)
+				continue
+			}
+			log.Printf("Configuration reloaded from: %s (generation %d)", cfg.ConfigPath, cfg.Generation())
+		}
+	}()
+	
 	log.Printf("Starting NekoLc Server on port %s", cfg.App.Server.Port)
 	log.Printf("Configuration loaded from: %s", cfg.ConfigPath)
-	log.Printf("Database: %s at %s", cfg.App.Database.Type, cfg.App.Database.Path)
+	log.Printf("Database: %s", storage.Describe(cfg))
 	if cfg.App.Authentication.Enabled {
 		log.Printf("Authentication: enabled")
 	}
@@ -82,7 +179,368 @@ func main() {
 		log.Printf("Debug mode: enabled")
 	}
 	
-	if err := http.ListenAndServe(":"+cfg.App.Server.Port, router); err != nil {
+	if pidFile := cfg.App.Server.PidFile; pidFile != "" {
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			log.Fatalf("Failed to write pid file: %v", err)
+		}
+		defer os.Remove(pidFile)
+	}
+	
+	server := &http.Server{Addr: ":" + cfg.App.Server.Port, Handler: router}
+	
+	// Finish open requests and stop background work on SIGINT or SIGTERM
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-shutdown
+		log.Printf("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down gracefully: %v", err)
+		}
+		close(stopped)
+	}()
+	
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		os.Remove(cfg.App.Server.PidFile)
 		log.Fatal("Server failed to start:", err)
 	}
-}
\ No newline at end of file
+	<-stopped
+	if closer, ok := router.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close storage: %v", err)
+		}
+	}
+}
+
+// reloadServer sends SIGHUP to the server whose process ID is in the pid
+// file, after the configuration it will load has been checked
+func reloadServer(cfg *config.Config) error {
+	pidFile := cfg.App.Server.PidFile
+	if pidFile == "" {
+		return fmt.Errorf("--reload needs the pid file of the running server, set server.pidFile or --pid_file")
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("failed to read pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid pid file %s: %w", pidFile, err)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find server process %d: %w", pid, err)
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("failed to signal server process %d: %w", pid, err)
+	}
+	return nil
+}
+
+// cleanup purges expired tokens, sessions, password resets, login failures
+// and notifications once, like the janitor does
+// while the server runs
+func cleanup(cfg *config.Config) error {
+	if err := storage.EnsureDataDirectory(cfg); err != nil {
+		return err
+	}
+	db, err := storage.NewStorage(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	defer db.Close()
+	
+	_, grace := cfg.App.CleanupSchedule()
+	result, err := janitor.Purge(db, grace, cfg.App.LoginLockout().ResetAfter, cfg.App.NotificationRetention())
+	if err != nil {
+		return fmt.Errorf("failed to purge expired records: %w", err)
+	}
+	fmt.Printf("Purged %s\n", result)
+	return nil
+}
+
+// readUserPassword returns the password for --create_user from
+// NEKOLC_USER_PASSWORD, or else the first line of stdin. It is never taken
+// from a flag, which would show it in the process list and shell history.
+func readUserPassword() (string, error) {
+	if password := os.Getenv("NEKOLC_USER_PASSWORD"); password != "" {
+		return password, nil
+	}
+	
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("NEKOLC_USER_PASSWORD or a password on stdin is required to create a user")
+	}
+	return password, nil
+}
+
+// manageUsers runs the user account command line options
+func manageUsers(cfg *config.Config, flags *config.CLIFlags) error {
+	if err := storage.EnsureDataDirectory(cfg); err != nil {
+		return err
+	}
+	db, err := storage.NewStorage(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	defer db.Close()
+	
+	roles, err := auth.ParseRoles(*flags.UserRoles)
+	if err != nil {
+		return err
+	}
+	
+	if username := *flags.CreateUser; username != "" {
+		password, err := readUserPassword()
+		if err != nil {
+			return err
+		}
+		
+		hash, err := auth.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		user := &storage.User{Username: username, PasswordHash: hash, Roles: roles}
+		if err := db.CreateUser(user); err != nil {
+			return fmt.Errorf("failed to create user %s: %w", username, err)
+		}
+		fmt.Printf("Created user %s (id %s)\n", user.Username, user.ID)
+	}
+	
+	if username := *flags.SetRoles; username != "" {
+		user, err := db.GetUserByUsername(username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %s not found", username)
+		}
+		revoke := false
+		for _, role := range user.Roles {
+			if !slices.Contains(roles, role) {
+				revoke = true
+			}
+		}
+		user.Roles = roles
+		if err := db.UpdateUser(user); err != nil {
+			return fmt.Errorf("failed to update user %s: %w", username, err)
+		}
+		if revoke {
+			// Issued access tokens keep the removed roles until they expire
+			if err := db.RevokeAllUserTokens(user.ID); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Set roles of user %s to [%s]\n", username, strings.Join(roles, ","))
+	}
+	
+	for username, disabled := range map[string]bool{*flags.DisableUser: true, *flags.EnableUser: false} {
+		if username == "" {
+			continue
+		}
+		user, err := db.GetUserByUsername(username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %s not found", username)
+		}
+		user.Disabled = disabled
+		if err := db.UpdateUser(user); err != nil {
+			return fmt.Errorf("failed to update user %s: %w", username, err)
+		}
+		if disabled {
+			// Sign the user out everywhere
+			if err := db.RevokeAllUserTokens(user.ID); err != nil {
+				return err
+			}
+			fmt.Printf("Disabled user %s\n", username)
+		} else {
+			fmt.Printf("Enabled user %s\n", username)
+		}
+	}
+	
+	if username := *flags.UnlockUser; username != "" {
+		if err := db.ClearLoginFailures(storage.UsernameFailureKey(username)); err != nil {
+			return fmt.Errorf("failed to unlock user %s: %w", username, err)
+		}
+		fmt.Printf("Unlocked user %s\n", username)
+	}
+	
+	if username := *flags.DisableTOTP; username != "" {
+		user, err := db.GetUserByUsername(username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %s not found", username)
+		}
+		user.TOTP = storage.TOTP{}
+		if err := db.UpdateUser(user); err != nil {
+			return fmt.Errorf("failed to update user %s: %w", username, err)
+		}
+		fmt.Printf("Disabled two-factor authentication of user %s\n", username)
+	}
+	
+	return nil
+}
+
+// manageClients runs the client identifier and device command line options
+func manageClients(cfg *config.Config, flags *config.CLIFlags) error {
+	if err := storage.EnsureDataDirectory(cfg); err != nil {
+		return err
+	}
+	db, err := storage.NewStorage(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	defer db.Close()
+	
+	if id := *flags.CreateClient; id != "" {
+		if !validClientID(id) {
+			return fmt.Errorf("client identifiers must be 3 to 64 characters of [A-Za-z0-9_-]")
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		client := &storage.Client{ID: id, Secret: hex.EncodeToString(secret)}
+		if err := db.CreateClient(client); err != nil {
+			return fmt.Errorf("failed to create client %s: %w", id, err)
+		}
+		// The secret is only shown once; it signs the client's logins
+		fmt.Printf("Created client %s\nSecret: %s\n", client.ID, client.Secret)
+	}
+	
+	for id, disabled := range map[string]bool{*flags.DisableClient: true, *flags.EnableClient: false} {
+		if id == "" {
+			continue
+		}
+		client, err := db.GetClient(id)
+		if err != nil {
+			return err
+		}
+		if client == nil {
+			return fmt.Errorf("client %s not found", id)
+		}
+		client.Disabled = disabled
+		if err := db.UpdateClient(client); err != nil {
+			return fmt.Errorf("failed to update client %s: %w", id, err)
+		}
+		if disabled {
+			if err := db.RevokeAllUserTokens(client.ID); err != nil {
+				return err
+			}
+			fmt.Printf("Disabled client %s\n", id)
+		} else {
+			fmt.Printf("Enabled client %s\n", id)
+		}
+	}
+	
+	if id := *flags.RevokeDevice; id != "" {
+		device, err := db.GetDevice(id)
+		if err != nil {
+			return err
+		}
+		if device == nil {
+			return fmt.Errorf("device %s not found", id)
+		}
+		device.Revoked = true
+		if err := db.UpdateDevice(device); err != nil {
+			return fmt.Errorf("failed to revoke device %s: %w", id, err)
+		}
+		if err := db.RevokeTokenFamily(device.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked device %s\n", id)
+	}
+	
+	return nil
+}
+
+// manageAPIKeys runs the API key command line options
+func manageAPIKeys(cfg *config.Config, flags *config.CLIFlags) error {
+	if err := storage.EnsureDataDirectory(cfg); err != nil {
+		return err
+	}
+	db, err := storage.NewStorage(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	defer db.Close()
+	
+	if name := *flags.CreateAPIKey; name != "" {
+		scopes, err := auth.ParseRoles(*flags.APIKeyScopes)
+		if err != nil {
+			return err
+		}
+		if *flags.APIKeyDays < 0 {
+			return fmt.Errorf("--api_key_days must not be negative")
+		}
+		key := auth.GenerateAPIKey()
+		apiKey := &storage.APIKey{KeyHash: auth.HashAPIKey(key), Name: name, Scopes: scopes}
+		if *flags.APIKeyDays > 0 {
+			apiKey.ExpiresAt = time.Now().UTC().AddDate(0, 0, *flags.APIKeyDays)
+		}
+		if err := db.CreateAPIKey(apiKey); err != nil {
+			return fmt.Errorf("failed to create API key %s: %w", name, err)
+		}
+		// Only the hash is stored, so the key cannot be shown again
+		fmt.Printf("Created API key %s (id %s)\nKey: %s\n", apiKey.Name, apiKey.ID, key)
+	}
+	
+	if id := *flags.RevokeAPIKey; id != "" {
+		apiKey, err := db.GetAPIKey(id)
+		if err != nil {
+			return err
+		}
+		if apiKey == nil {
+			return fmt.Errorf("API key %s not found", id)
+		}
+		if err := db.RevokeAPIKey(apiKey.ID); err != nil {
+			return fmt.Errorf("failed to revoke API key %s: %w", id, err)
+		}
+		fmt.Printf("Revoked API key %s\n", id)
+	}
+	
+	if *flags.ListAPIKeys {
+		keys, err := db.ListAPIKeys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			status := "active"
+			switch {
+			case key.Revoked:
+				status = "revoked"
+			case key.Expired(time.Now()):
+				status = "expired"
+			}
+			lastUsed := "never"
+			if !key.LastUsedAt.IsZero() {
+				lastUsed = key.LastUsedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s  %-20s  [%s]  %s  last used %s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), status, lastUsed)
+		}
+	}
+	
+	return nil
+}
+
+// validClientID reports whether a client identifier can be registered
+func validClientID(id string) bool {
+	if len(id) < 3 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}